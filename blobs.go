@@ -102,6 +102,9 @@ type BlobDeleter interface {
 
 // BlobEnumerator enables iterating over blobs from storage
 type BlobEnumerator interface {
+	// Enumerate calls ingester for each blob, in no particular order. The
+	// ingester may be called concurrently and must be safe for concurrent
+	// use.
 	Enumerate(ctx context.Context, ingester func(dgst digest.Digest) error) error
 }
 
@@ -240,6 +243,22 @@ type BlobWriter interface {
 	Cancel(ctx context.Context) error
 }
 
+// ChunkedBlobWriter is a BlobWriter accepting chunks of the blob out of
+// order. The chunks may be written concurrently, by writers resumed from the
+// same upload, and are assembled after the data written in order on Commit,
+// which fails if they leave a gap or overlap.
+type ChunkedBlobWriter interface {
+	BlobWriter
+
+	// WriteChunk writes the chunk of the blob starting at offset, which must
+	// not be less than Size, replacing any chunk written at the same offset.
+	// It returns the number of bytes written.
+	WriteChunk(ctx context.Context, offset int64, r io.Reader) (int64, error)
+
+	// Chunked returns true if chunks have been written out of order.
+	Chunked(ctx context.Context) (bool, error)
+}
+
 // BlobService combines the operations to access, read and write blobs. This
 // can be used to describe remote blob services.
 type BlobService interface {
@@ -140,6 +140,14 @@ type Configuration struct {
 			} `yaml:"prometheus,omitempty"`
 		} `yaml:"debug,omitempty"`
 
+		// Admin configures the server of the administrative API.
+		Admin struct {
+			// Addr specifies the bind address for the administrative API,
+			// which performs no authorization. The API is disabled when
+			// empty.
+			Addr string `yaml:"addr,omitempty"`
+		} `yaml:"admin,omitempty"`
+
 		// HTTP2 configuration options
 		HTTP2 struct {
 			// Specifies whether the registry should disallow clients attempting
@@ -186,6 +194,9 @@ type Configuration struct {
 
 	Proxy Proxy `yaml:"proxy,omitempty"`
 
+	// Replication configures copying pushed content to other registries.
+	Replication Replication `yaml:"replication,omitempty"`
+
 	// Compatibility is used for configurations of working with older or deprecated features.
 	Compatibility struct {
 		// Schema1 configures how schema1 manifests will be handled
@@ -409,6 +420,14 @@ func (storage Storage) Type() string {
 			// allow configuration of delete
 		case "redirect":
 			// allow configuration of redirect
+		case "slowlog":
+			// allow configuration of slow storage action logging
+		case "routes":
+			// allow configuration of per-repository storage backends
+		case "metadata":
+			// allow configuration of the metadata database
+		case "automount":
+			// allow configuration of automatic cross-repository mounts
 		default:
 			storageType = append(storageType, k)
 		}
@@ -427,6 +446,126 @@ func (storage Storage) Parameters() Parameters {
 	return storage[storage.Type()]
 }
 
+// RepositoryPrefix returns a repository name prefix of the configuration
+// without the trailing "*" or "/" marking it as a prefix, so that
+// "docker.io", "docker.io/" and "docker.io/*" are the same prefix. A prefix
+// matches the repositories named after it and the repositories under it,
+// on path component boundaries.
+func RepositoryPrefix(prefix string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(prefix, "*"), "/")
+}
+
+// Routes returns the storage of the repositories placed on their own storage
+// backend, by repository name prefix. Each route is configured like the
+// storage section, with a single driver and its parameters, or the name of a
+// driver without parameters.
+func (storage Storage) Routes() (map[string]Storage, error) {
+	routes := make(map[string]Storage)
+	for p, v := range storage["routes"] {
+		prefix := RepositoryPrefix(p)
+		if prefix == "" {
+			return nil, fmt.Errorf("storage route prefix must not be empty")
+		}
+		if _, ok := routes[prefix]; ok {
+			return nil, fmt.Errorf("duplicate storage route prefix %q", p)
+		}
+
+		if driver, ok := v.(string); ok {
+			routes[prefix] = Storage{driver: Parameters{}}
+			continue
+		}
+
+		drivers, ok := v.(map[interface{}]interface{})
+		if !ok || len(drivers) != 1 {
+			return nil, fmt.Errorf("storage route %q must configure a single storage driver", prefix)
+		}
+		for driver, p := range drivers {
+			parameters := make(Parameters)
+			if p != nil {
+				params, ok := p.(map[interface{}]interface{})
+				if !ok {
+					return nil, fmt.Errorf("parameters of storage route %q must be a map", prefix)
+				}
+				for k, v := range params {
+					parameters[fmt.Sprint(k)] = v
+				}
+			}
+			routes[prefix] = Storage{fmt.Sprint(driver): parameters}
+		}
+	}
+	return routes, nil
+}
+
+// MetadataDatabase returns the path of the database indexing the metadata
+// of the repositories, or an empty string if they are not indexed.
+func (storage Storage) MetadataDatabase() (string, error) {
+	metadata, ok := storage["metadata"]
+	if !ok {
+		return "", nil
+	}
+	database, ok := metadata["database"].(string)
+	if !ok || database == "" {
+		return "", fmt.Errorf("storage metadata must configure the path of the database")
+	}
+	return database, nil
+}
+
+// Slowlog returns the thresholds above which storage actions are logged: the
+// threshold of all actions, and the thresholds of the actions configured
+// separately, such as reader or stat.
+func (storage Storage) Slowlog() (time.Duration, map[string]time.Duration, error) {
+	var threshold time.Duration
+	actions := make(map[string]time.Duration)
+	for key, v := range storage["slowlog"] {
+		d, err := time.ParseDuration(fmt.Sprint(v))
+		if err != nil {
+			return 0, nil, fmt.Errorf("unable to parse storage slowlog %s: %v", key, err)
+		}
+
+		if key == "threshold" {
+			threshold = d
+		} else {
+			actions[key] = d
+		}
+	}
+	return threshold, actions, nil
+}
+
+// The policies of automatic cross-repository mounts.
+const (
+	// AutomountRepository mounts a blob from a repository linking it which
+	// the client may pull from.
+	AutomountRepository = "repository"
+
+	// AutomountAny mounts a blob from any repository linking it.
+	AutomountAny = "any"
+)
+
+// Automount returns the policy of automatic cross-repository mounts, or an
+// empty string if they are disabled.
+func (storage Storage) Automount() (string, error) {
+	automount, ok := storage["automount"]
+	if !ok {
+		return "", nil
+	}
+	switch automount["enabled"] {
+	case nil, true:
+	case false:
+		return "", nil
+	default:
+		return "", fmt.Errorf("storage automount enabled must be a boolean")
+	}
+
+	switch policy := automount["policy"]; policy {
+	case nil:
+		return AutomountRepository, nil
+	case AutomountRepository, AutomountAny:
+		return policy.(string), nil
+	default:
+		return "", fmt.Errorf("unknown storage automount policy %v", policy)
+	}
+}
+
 // setParameter changes the parameter at the provided key to the new value
 func (storage Storage) setParameter(key string, value interface{}) {
 	storage[storage.Type()][key] = value
@@ -450,6 +589,14 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of delete
 				case "redirect":
 					// allow configuration of redirect
+				case "slowlog":
+					// allow configuration of slow storage action logging
+				case "routes":
+					// allow configuration of per-repository storage backends
+				case "metadata":
+					// allow configuration of the metadata database
+				case "automount":
+					// allow configuration of automatic cross-repository mounts
 				default:
 					types = append(types, k)
 				}
@@ -562,6 +709,33 @@ type Endpoint struct {
 	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
 	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
 	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	TLS               EndpointTLS   `yaml:"tls,omitempty"`     // client tls settings for the endpoint
+}
+
+// EndpointTLS configures the TLS client used to deliver notifications to an
+// endpoint. Endpoints requiring mutual TLS must specify both Certificate and
+// Key.
+type EndpointTLS struct {
+	// CAs specifies the CA certs used to verify the endpoint's certificate.
+	// A file may contain multiple CA certificates encoded as PEM. When empty,
+	// the system roots are used.
+	CAs []string `yaml:"cas,omitempty"`
+
+	// Certificate specifies the path to an x509 client certificate file
+	// presented to the endpoint.
+	Certificate string `yaml:"certificate,omitempty"`
+
+	// Key specifies the path to the x509 key file, which should contain the
+	// private portion for the file specified in Certificate.
+	Key string `yaml:"key,omitempty"`
+
+	// ServerName overrides the hostname used to verify the endpoint's
+	// certificate.
+	ServerName string `yaml:"servername,omitempty"`
+
+	// InsecureSkipVerify disables verification of the endpoint's
+	// certificate. This should only be used for testing.
+	InsecureSkipVerify bool `yaml:"insecureskipverify,omitempty"`
 }
 
 //Ignore configures mediaTypes and actions of the event, that it won't be propagated
@@ -619,6 +793,152 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// Remotes maps repository name prefixes to remote registries, allowing
+	// a single registry to cache content from several upstreams. When
+	// RemoteURL is also set, it serves repositories matching no prefix.
+	Remotes []ProxyRemote `yaml:"remotes,omitempty"`
+
+	// Mode selects how repositories are served when the registry is
+	// configured as a pull through cache. It is one of "cache" (the
+	// default), "hybrid" or "fallback".
+	Mode string `yaml:"mode,omitempty"`
+
+	// TTL is how long content fetched from a remote is cached before it is
+	// removed. Defaults to 7 days.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// MaxSize is the total size in bytes of the cached content above which
+	// the least recently used content is removed before its TTL expires.
+	// Zero means the cache is bounded by TTL only.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// Stale configures serving cached content when a remote is unreachable.
+	Stale ProxyStale `yaml:"stale,omitempty"`
+
+	// MaxConcurrentRequests bounds the number of concurrent requests made
+	// to each remote. Zero means unbounded.
+	MaxConcurrentRequests int `yaml:"maxconcurrentrequests,omitempty"`
+
+	// TagFreshness is how long a tag resolved from a remote is reused
+	// without asking the remote again. Zero asks the remote every time.
+	TagFreshness time.Duration `yaml:"tagfreshness,omitempty"`
+
+	// Warm configures references fetched from the remotes ahead of client
+	// requests.
+	Warm ProxyWarm `yaml:"warm,omitempty"`
+}
+
+// ProxyWarm configures a watch list of references which a pull through
+// cache keeps stored locally.
+type ProxyWarm struct {
+	// References are the tagged or digested references to fetch, such as
+	// "docker.io/library/ubuntu:latest".
+	References []string `yaml:"references,omitempty"`
+
+	// Interval is how often the references are fetched again, so that
+	// tags follow their remote. Zero disables the watch list.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// ProxyStale configures how a pull through cache resolves tags when the
+// remote fails or does not respond in time.
+type ProxyStale struct {
+	// Enabled resolves tags to the last cached digest when the remote is
+	// unreachable, marking the response with a Warning header.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Timeout is how long to wait for the remote before serving the cached
+	// tag. Zero waits until the remote request fails.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+const (
+	// ProxyModeCache serves every repository from a remote. Pushes are
+	// unsupported.
+	ProxyModeCache = "cache"
+
+	// ProxyModeHybrid serves repositories matching a remote from that
+	// remote, read-only. All other repositories are local and pushable.
+	ProxyModeHybrid = "hybrid"
+
+	// ProxyModeFallback serves every repository locally and pushes are
+	// supported. Repositories matching a remote fetch content from that
+	// remote only when it is missing locally.
+	ProxyModeFallback = "fallback"
+)
+
+// Enabled returns true if the registry is configured as a pull through cache
+// for at least one remote.
+func (proxy Proxy) Enabled() bool {
+	return proxy.RemoteURL != "" || len(proxy.Remotes) > 0
+}
+
+// CacheOnly returns true if the registry is configured as a pull through
+// cache that does not serve any local repositories.
+func (proxy Proxy) CacheOnly() bool {
+	return proxy.Enabled() && (proxy.Mode == "" || proxy.Mode == ProxyModeCache)
+}
+
+// Validate returns an error if the proxy configuration cannot work. The
+// top-level RemoteURL serves every repository matching no prefix, so it
+// leaves no local repository in the hybrid and fallback modes.
+func (proxy Proxy) Validate() error {
+	switch proxy.Mode {
+	case ProxyModeHybrid, ProxyModeFallback:
+		if proxy.RemoteURL != "" {
+			return fmt.Errorf("proxy remoteurl serves every repository and cannot be used in %s mode, configure remotes with prefixes instead", proxy.Mode)
+		}
+	}
+	return nil
+}
+
+// ProxyRemote configures a remote registry serving the repositories under a
+// name prefix.
+type ProxyRemote struct {
+	// Prefix is the repository name prefix routed to this remote, such as
+	// "docker.io". The prefix is removed from the repository name when
+	// requesting content from the remote.
+	Prefix string `yaml:"prefix"`
+
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username of the remote user
+	Username string `yaml:"username"`
+
+	// Password of the remote user
+	Password string `yaml:"password"`
+}
+
+// Replication configures the registries to which pushes and deletes are
+// replicated.
+type Replication struct {
+	// Targets are the registries receiving replicated content.
+	Targets []ReplicationTarget `yaml:"targets,omitempty"`
+}
+
+// ReplicationTarget describes a registry receiving replicated content.
+type ReplicationTarget struct {
+	Name     string      `yaml:"name"`               // identifies the target in logs and status
+	URL      string      `yaml:"url"`                // base url of the target registry
+	Username string      `yaml:"username,omitempty"` // username used to authenticate to the target
+	Password string      `yaml:"password,omitempty"` // password used to authenticate to the target
+	TLS      EndpointTLS `yaml:"tls,omitempty"`      // client TLS configuration
+	Disabled bool        `yaml:"disabled,omitempty"` // disables replication to the target
+
+	// Repositories are patterns, as accepted by path.Match, of the
+	// repositories replicated to the target. If empty, every repository is
+	// replicated.
+	Repositories []string `yaml:"repositories,omitempty"`
+
+	// Exclude are patterns of repositories which are not replicated, even
+	// if they match Repositories.
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	Timeout     time.Duration `yaml:"timeout,omitempty"`     // bounds a single replication attempt
+	Backoff     time.Duration `yaml:"backoff,omitempty"`     // wait between attempts
+	MaxAttempts int           `yaml:"maxattempts,omitempty"` // attempts before a replication is dropped
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
@@ -646,6 +966,12 @@ func Parse(rd io.Reader) (*Configuration, error) {
 					if v0_1.Storage.Type() == "" {
 						return nil, errors.New("No storage configuration provided")
 					}
+					if err := v0_1.Proxy.Validate(); err != nil {
+						return nil, err
+					}
+					if _, _, err := v0_1.Storage.Slowlog(); err != nil {
+						return nil, err
+					}
 					return (*Configuration)(v0_1), nil
 				}
 				return nil, fmt.Errorf("Expected *v0_1Configuration, received %#v", c)
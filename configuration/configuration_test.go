@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/yaml.v2"
@@ -67,6 +68,12 @@ var configStruct = Configuration{
 					MediaTypes: []string{"application/octet-stream"},
 					Actions:    []string{"pull"},
 				},
+				TLS: EndpointTLS{
+					CAs:         []string{"/path/to/ca.pem"},
+					Certificate: "/path/to/client.pem",
+					Key:         "/path/to/client.key",
+					ServerName:  "example.com",
+				},
 			},
 		},
 	},
@@ -95,6 +102,9 @@ var configStruct = Configuration{
 				Path    string `yaml:"path,omitempty"`
 			} `yaml:"prometheus,omitempty"`
 		} `yaml:"debug,omitempty"`
+		Admin struct {
+			Addr string `yaml:"addr,omitempty"`
+		} `yaml:"admin,omitempty"`
 		HTTP2 struct {
 			Disabled bool `yaml:"disabled,omitempty"`
 		} `yaml:"http2,omitempty"`
@@ -157,6 +167,12 @@ notifications:
            - application/octet-stream
         actions:
            - pull
+      tls:
+        cas:
+          - /path/to/ca.pem
+        certificate: /path/to/client.pem
+        key: /path/to/client.key
+        servername: example.com
 reporting:
   bugsnag:
     apikey: BugsnagApiKey
@@ -190,6 +206,12 @@ notifications:
            - application/octet-stream
         actions:
            - pull
+      tls:
+        cas:
+          - /path/to/ca.pem
+        certificate: /path/to/client.pem
+        key: /path/to/client.key
+        servername: example.com
 http:
   headers:
     X-Content-Type-Options: [nosniff]
@@ -357,6 +379,176 @@ func (suite *ConfigSuite) TestParseInvalidLoglevel(c *C) {
 
 }
 
+// TestParseProxyRemotes validates that multiple proxy remotes are parsed
+func (suite *ConfigSuite) TestParseProxyRemotes(c *C) {
+	yml := `version: 0.1
+storage: inmemory
+proxy:
+  remotes:
+    - prefix: docker.io
+      remoteurl: https://registry-1.docker.io
+      username: user
+      password: pass
+    - prefix: quay.io
+      remoteurl: https://quay.io
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Proxy.Enabled(), Equals, true)
+	c.Assert(config.Proxy.CacheOnly(), Equals, true)
+	c.Assert(config.Proxy.Remotes, DeepEquals, []ProxyRemote{
+		{Prefix: "docker.io", RemoteURL: "https://registry-1.docker.io", Username: "user", Password: "pass"},
+		{Prefix: "quay.io", RemoteURL: "https://quay.io"},
+	})
+}
+
+// TestParseStorageRoutes validates that per-repository storage backends are
+// parsed
+func (suite *ConfigSuite) TestParseStorageRoutes(c *C) {
+	yml := `version: 0.1
+storage:
+  filesystem:
+    rootdirectory: /var/lib/registry
+  routes:
+    ml/:
+      s3:
+        bucket: cheap
+        region: us-east-1
+    cache/: inmemory
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Storage.Type(), Equals, "filesystem")
+
+	routes, err := config.Storage.Routes()
+	c.Assert(err, IsNil)
+	c.Assert(routes, DeepEquals, map[string]Storage{
+		"ml":    {"s3": Parameters{"bucket": "cheap", "region": "us-east-1"}},
+		"cache": {"inmemory": Parameters{}},
+	})
+
+	// prefixes are normalized like the prefixes of the proxy remotes
+	config, err = Parse(bytes.NewReader([]byte(strings.Replace(yml, "cache/: inmemory", "cache/*: inmemory\n    cache: inmemory", 1))))
+	c.Assert(err, IsNil)
+	_, err = config.Storage.Routes()
+	c.Assert(err, NotNil)
+
+	// a route must configure a single driver
+	yml = strings.Replace(yml, "cache/: inmemory", "cache/: [inmemory, filesystem]", 1)
+	config, err = Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	_, err = config.Storage.Routes()
+	c.Assert(err, NotNil)
+}
+
+// TestParseStorageMetadata validates that the metadata database is parsed
+func (suite *ConfigSuite) TestParseStorageMetadata(c *C) {
+	yml := `version: 0.1
+storage:
+  filesystem:
+    rootdirectory: /var/lib/registry
+  metadata:
+    database: /var/lib/registry-metadata/metadata.db
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Storage.Type(), Equals, "filesystem")
+
+	database, err := config.Storage.MetadataDatabase()
+	c.Assert(err, IsNil)
+	c.Assert(database, Equals, "/var/lib/registry-metadata/metadata.db")
+
+	yml = strings.Replace(yml, "database: /var/lib/registry-metadata/metadata.db", "enabled: true", 1)
+	config, err = Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	_, err = config.Storage.MetadataDatabase()
+	c.Assert(err, NotNil)
+}
+
+// TestParseStorageAutomount validates that the policy of automatic mounts is
+// parsed
+func (suite *ConfigSuite) TestParseStorageAutomount(c *C) {
+	yml := `version: 0.1
+storage:
+  inmemory:
+  automount:
+    enabled: true
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Storage.Type(), Equals, "inmemory")
+
+	policy, err := config.Storage.Automount()
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, AutomountRepository)
+
+	config, err = Parse(bytes.NewReader([]byte(yml + "    policy: any\n")))
+	c.Assert(err, IsNil)
+	policy, err = config.Storage.Automount()
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, AutomountAny)
+
+	config, err = Parse(bytes.NewReader([]byte(strings.Replace(yml, "enabled: true", "enabled: false", 1))))
+	c.Assert(err, IsNil)
+	policy, err = config.Storage.Automount()
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, "")
+
+	config, err = Parse(bytes.NewReader([]byte(yml + "    policy: everyone\n")))
+	c.Assert(err, IsNil)
+	_, err = config.Storage.Automount()
+	c.Assert(err, NotNil)
+}
+
+// TestParseStorageSlowlog validates that the slowlog thresholds are parsed,
+// and that invalid thresholds are rejected
+func (suite *ConfigSuite) TestParseStorageSlowlog(c *C) {
+	yml := `version: 0.1
+storage:
+  inmemory:
+  slowlog:
+    threshold: 1s
+    reader: 1m
+    walk: 0
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+
+	threshold, actions, err := config.Storage.Slowlog()
+	c.Assert(err, IsNil)
+	c.Assert(threshold, Equals, time.Second)
+	c.Assert(actions, DeepEquals, map[string]time.Duration{"reader": time.Minute, "walk": 0})
+
+	_, err = Parse(bytes.NewReader([]byte(strings.Replace(yml, "reader: 1m", "reader: 1 minute", 1))))
+	c.Assert(err, NotNil)
+
+	_, err = Parse(bytes.NewReader([]byte(strings.Replace(yml, "reader: 1m", "reader: 60", 1))))
+	c.Assert(err, NotNil)
+}
+
+// TestParseProxyMode validates that the proxy mode is parsed
+func (suite *ConfigSuite) TestParseProxyMode(c *C) {
+	yml := `version: 0.1
+storage: inmemory
+proxy:
+  mode: hybrid
+  remotes:
+    - prefix: docker.io
+      remoteurl: https://registry-1.docker.io
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Proxy.Mode, Equals, ProxyModeHybrid)
+	c.Assert(config.Proxy.Enabled(), Equals, true)
+	c.Assert(config.Proxy.CacheOnly(), Equals, false)
+
+	// the top-level remoteurl leaves no local repository
+	for _, mode := range []string{ProxyModeHybrid, ProxyModeFallback} {
+		_, err = Parse(bytes.NewReader([]byte(strings.Replace(yml, "mode: hybrid", "mode: "+mode+"\n  remoteurl: https://registry-1.docker.io", 1))))
+		c.Assert(err, NotNil)
+	}
+}
+
 // TestParseWithDifferentEnvReporting validates that environment variables
 // properly override reporting parameters
 func (suite *ConfigSuite) TestParseWithDifferentEnvReporting(c *C) {
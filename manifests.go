@@ -65,7 +65,9 @@ type ManifestService interface {
 
 // ManifestEnumerator enables iterating over manifests
 type ManifestEnumerator interface {
-	// Enumerate calls ingester for each manifest.
+	// Enumerate calls ingester for each manifest, in no particular order.
+	// The ingester may be called concurrently and must be safe for
+	// concurrent use.
 	Enumerate(ctx context.Context, ingester func(digest.Digest) error) error
 }
 
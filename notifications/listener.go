@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"context"
+	"io"
 	"net/http"
 
 	"github.com/docker/distribution"
@@ -214,3 +215,17 @@ func (bwl *blobWriterListener) Commit(ctx context.Context, desc distribution.Des
 
 	return committed, err
 }
+
+func (bwl *blobWriterListener) WriteChunk(ctx context.Context, offset int64, r io.Reader) (int64, error) {
+	if cw, ok := bwl.BlobWriter.(distribution.ChunkedBlobWriter); ok {
+		return cw.WriteChunk(ctx, offset, r)
+	}
+	return 0, distribution.ErrUnsupported
+}
+
+func (bwl *blobWriterListener) Chunked(ctx context.Context) (bool, error) {
+	if cw, ok := bwl.BlobWriter.(distribution.ChunkedBlobWriter); ok {
+		return cw.Chunked(ctx)
+	}
+	return false, nil
+}
@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+)
+
+// NewTransport returns an http transport configured with the client tls
+// settings for an endpoint. If no tls settings are present, nil is returned
+// and the endpoint will use the default transport.
+func NewTransport(config configuration.EndpointTLS) (*http.Transport, error) {
+	if len(config.CAs) == 0 && config.Certificate == "" && config.Key == "" &&
+		config.ServerName == "" && !config.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConf := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if len(config.CAs) != 0 {
+		pool := x509.NewCertPool()
+
+		for _, ca := range config.CAs {
+			caPem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok := pool.AppendCertsFromPEM(caPem); !ok {
+				return nil, fmt.Errorf("could not add CA %s to pool", ca)
+			}
+		}
+
+		tlsConf.RootCAs = pool
+	}
+
+	if config.Certificate != "" || config.Key != "" {
+		if config.Certificate == "" || config.Key == "" {
+			return nil, fmt.Errorf("both certificate and key must be specified for client tls")
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConf,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package notifications
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+)
+
+func TestNewTransportEmpty(t *testing.T) {
+	transport, err := NewTransport(configuration.EndpointTLS{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if transport != nil {
+		t.Fatalf("expected nil transport for empty tls config, got %#v", transport)
+	}
+}
+
+func TestNewTransportInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifications-tls")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+
+	for _, config := range []configuration.EndpointTLS{
+		{CAs: []string{filepath.Join(dir, "missing.pem")}},
+		{CAs: []string{garbage}},
+		{Certificate: garbage},
+		{Certificate: garbage, Key: garbage},
+	} {
+		if _, err := NewTransport(config); err == nil {
+			t.Fatalf("expected error for config %#v", config)
+		}
+	}
+}
+
+// TestNewTransportMutualTLS checks that a sink using a transport from
+// NewTransport verifies the server against the configured CA and presents
+// the configured client certificate.
+func TestNewTransportMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifications-tls")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeClientCertificate(t, dir)
+
+	var peerCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCerts = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatalf("unexpected error writing ca: %v", err)
+	}
+
+	transport, err := NewTransport(configuration.EndpointTLS{
+		CAs:         []string{caFile},
+		Certificate: certFile,
+		Key:         keyFile,
+		ServerName:  "example.com",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %v", err)
+	}
+
+	sink := newHTTPSink(server.URL, 0, nil, transport)
+	defer sink.Close()
+	if err := sink.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+		t.Fatalf("unexpected error writing events: %v", err)
+	}
+
+	if peerCerts != 1 {
+		t.Fatalf("expected client certificate to be presented, got %d", peerCerts)
+	}
+}
+
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "notifications"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("unexpected error writing key: %v", err)
+	}
+
+	return certFile, keyFile
+}
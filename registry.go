@@ -51,6 +51,8 @@ type Namespace interface {
 
 // RepositoryEnumerator describes an operation to enumerate repositories
 type RepositoryEnumerator interface {
+	// Enumerate calls ingester for each repository. The ingester is not
+	// called concurrently.
 	Enumerate(ctx context.Context, ingester func(string) error) error
 }
 
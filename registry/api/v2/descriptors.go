@@ -1290,7 +1290,7 @@ var routeDescriptors = []RouteDescriptor{
 								Type:        "header",
 								Format:      "<start of range>-<end of range, inclusive>",
 								Required:    true,
-								Description: "Range of bytes identifying the desired block of content represented by the body. Start must the end offset retrieved via status check plus one. Note that this is a non-standard use of the `Content-Range` header.",
+								Description: "Range of bytes identifying the desired block of content represented by the body. Start must the end offset retrieved via status check plus one, or be beyond it to upload the chunk out of order. Note that this is a non-standard use of the `Content-Range` header.",
 							},
 							{
 								Name:        "Content-Length",
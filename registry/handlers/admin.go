@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/proxy"
+	"github.com/docker/distribution/registry/replication"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/gorilla/handlers"
+)
+
+// RegisterAdminHandlers registers the administrative API on mux. These
+// handlers perform no authorization and delete content, so mux should only be
+// served on its own trusted interface, not on the debug server.
+func (app *App) RegisterAdminHandlers(mux *http.ServeMux) {
+	mux.Handle("/admin/proxy/warm", handlers.MethodHandler{
+		"POST": http.HandlerFunc(app.warmProxy),
+	})
+	mux.Handle("/admin/replication", handlers.MethodHandler{
+		"GET": http.HandlerFunc(app.replicationStatus),
+	})
+	mux.Handle("/admin/trash", handlers.MethodHandler{
+		"GET": http.HandlerFunc(app.listTrash),
+	})
+	mux.Handle("/admin/trash/restore", handlers.MethodHandler{
+		"POST": http.HandlerFunc(app.restoreTrash),
+	})
+	mux.Handle("/admin/repositories/", handlers.MethodHandler{
+		"DELETE": http.HandlerFunc(app.trashRepository),
+	})
+	mux.Handle("/admin/uploads", handlers.MethodHandler{
+		"GET": http.HandlerFunc(app.listUploads),
+	})
+	mux.Handle("/admin/uploads/purge", handlers.MethodHandler{
+		"POST": http.HandlerFunc(app.purgeUploads),
+	})
+	mux.Handle("/admin/uploads/", handlers.MethodHandler{
+		"DELETE": http.HandlerFunc(app.cancelUpload),
+	})
+}
+
+var (
+	errorCodeTrashItemUnknown = errcode.Register("registry.api.admin", errcode.ErrorDescriptor{
+		Value:          "TRASH_ITEM_UNKNOWN",
+		Message:        "trash item unknown",
+		Description:    "The item is not in the trash, or has expired.",
+		HTTPStatusCode: http.StatusNotFound,
+	})
+	errorCodeTrashConflict = errcode.Register("registry.api.admin", errcode.ErrorDescriptor{
+		Value:          "TRASH_CONFLICT",
+		Message:        "trash item conflicts with newer content",
+		Description:    "Restoring the item would overwrite a link changed since it was deleted, such as a tag pushed again.",
+		HTTPStatusCode: http.StatusConflict,
+	})
+)
+
+type warmRequest struct {
+	References []string `json:"references"`
+}
+
+type warmResult struct {
+	Reference string `json:"reference"`
+	Error     string `json:"error,omitempty"`
+}
+
+type warmResponse struct {
+	Results []warmResult `json:"results"`
+}
+
+// warmProxy fetches the requested references from the remotes of a pull
+// through cache, reporting the outcome for each reference.
+func (app *App) warmProxy(w http.ResponseWriter, r *http.Request) {
+	warmer, ok := app.registry.(proxy.Warmer)
+	if !ok {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnsupported.WithMessage("registry is not configured as a pull through cache"))
+		return
+	}
+
+	var req warmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithMessage("invalid request body").WithDetail(err))
+		return
+	}
+
+	ctx := r.Context()
+	var resp warmResponse
+	for _, s := range req.References {
+		result := warmResult{Reference: s}
+
+		ref, err := reference.Parse(s)
+		if err == nil {
+			named, ok := ref.(reference.Named)
+			if !ok {
+				err = reference.ErrNameEmpty
+			} else {
+				err = warmer.Warm(ctx, named)
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type replicationResponse struct {
+	Targets []replication.TargetStatus `json:"targets"`
+}
+
+// replicationStatus reports the state of replication to each target.
+func (app *App) replicationStatus(w http.ResponseWriter, r *http.Request) {
+	if app.replicator == nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnsupported.WithMessage("replication is not configured"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(replicationResponse{Targets: app.replicator.Status()})
+}
+
+type trashResponse struct {
+	Items []storage.TrashedItem `json:"items"`
+}
+
+// listTrash lists the deleted manifests, tags and repositories which can
+// still be restored.
+func (app *App) listTrash(w http.ResponseWriter, r *http.Request) {
+	items, err := storage.ListTrash(r.Context(), app.storageRegistry)
+	if err != nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(trashResponse{Items: items})
+}
+
+type restoreRequest struct {
+	ID string `json:"id"`
+}
+
+// restoreTrash restores an item of the trash.
+func (app *App) restoreTrash(w http.ResponseWriter, r *http.Request) {
+	if app.readOnly {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode"))
+		return
+	}
+
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithMessage("invalid request body").WithDetail(err))
+		return
+	}
+
+	item, err := storage.RestoreTrash(r.Context(), app.storageRegistry, req.ID)
+	if err != nil {
+		switch err := err.(type) {
+		case storage.ErrTrashItemUnknown:
+			errcode.ServeJSON(w, errorCodeTrashItemUnknown.WithDetail(req.ID))
+		case storage.ErrTrashConflict:
+			errcode.ServeJSON(w, errorCodeTrashConflict.WithDetail(err.Path))
+		default:
+			errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(item)
+}
+
+// trashRepository moves the repository named by the path to the trash.
+func (app *App) trashRepository(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/repositories/")
+	if _, err := reference.WithName(name); err != nil {
+		errcode.ServeJSON(w, v2.ErrorCodeNameInvalid.WithDetail(err))
+		return
+	}
+	if app.readOnly {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode"))
+		return
+	}
+
+	item, err := storage.TrashRepository(r.Context(), app.storageRegistry, name)
+	if err == distribution.ErrUnsupported {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnsupported.WithMessage("repository deletion requires deletes and the trash to be enabled"))
+		return
+	} else if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+		errcode.ServeJSON(w, v2.ErrorCodeNameUnknown.WithDetail(name))
+		return
+	} else if err != nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(item)
+}
+
+type uploadSession struct {
+	storage.UploadSession
+	Age string `json:"age"`
+}
+
+type uploadsResponse struct {
+	Uploads []uploadSession `json:"uploads"`
+}
+
+func newUploadsResponse(sessions []storage.UploadSession) uploadsResponse {
+	resp := uploadsResponse{Uploads: []uploadSession{}}
+	for _, session := range sessions {
+		resp.Uploads = append(resp.Uploads, uploadSession{
+			UploadSession: session,
+			Age:           time.Since(session.StartedAt).Round(time.Second).String(),
+		})
+	}
+	return resp
+}
+
+// serveUploadsError serves an error returned by the upload session
+// functions of the storage package.
+func serveUploadsError(w http.ResponseWriter, err error) {
+	if err == distribution.ErrBlobUploadUnknown {
+		errcode.ServeJSON(w, v2.ErrorCodeBlobUploadUnknown)
+	} else if err, ok := err.(distribution.ErrRepositoryNameInvalid); ok {
+		errcode.ServeJSON(w, v2.ErrorCodeNameInvalid.WithDetail(err.Name))
+	} else {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
+
+// listUploads lists the blob uploads in progress, of the repository given by
+// the repository query parameter or of all repositories.
+func (app *App) listUploads(w http.ResponseWriter, r *http.Request) {
+	sessions, err := storage.ListUploads(r.Context(), app.storageRegistry, r.URL.Query().Get("repository"))
+	if err != nil {
+		serveUploadsError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(newUploadsResponse(sessions))
+}
+
+// cancelUpload removes the blob upload named by the path, the repository
+// followed by the upload id.
+func (app *App) cancelUpload(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/uploads/")
+	i := strings.LastIndex(rest, "/")
+	if i < 0 {
+		errcode.ServeJSON(w, v2.ErrorCodeBlobUploadUnknown)
+		return
+	}
+	if app.readOnly {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode"))
+		return
+	}
+
+	if err := storage.CancelUpload(r.Context(), app.storageRegistry, rest[:i], rest[i+1:]); err != nil {
+		serveUploadsError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type purgeUploadsRequest struct {
+	// OlderThan is the minimum age of the uploads to remove, as a duration
+	// such as "24h".
+	OlderThan  string `json:"olderThan"`
+	Repository string `json:"repository"`
+	DryRun     bool   `json:"dryRun"`
+}
+
+// purgeUploads removes the blob uploads older than requested, reporting
+// those removed.
+func (app *App) purgeUploads(w http.ResponseWriter, r *http.Request) {
+	var req purgeUploadsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithMessage("invalid request body").WithDetail(err))
+		return
+	}
+	age, err := time.ParseDuration(req.OlderThan)
+	if err != nil || age < 0 {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithMessage("invalid olderThan duration").WithDetail(req.OlderThan))
+		return
+	}
+	if app.readOnly && !req.DryRun {
+		errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode"))
+		return
+	}
+
+	purged, err := storage.PurgeUploadSessions(r.Context(), app.storageRegistry, req.Repository, time.Now().Add(-age), req.DryRun)
+	if err != nil {
+		serveUploadsError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(newUploadsResponse(purged))
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -18,7 +19,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/configuration"
@@ -31,6 +34,8 @@ import (
 	"github.com/docker/distribution/registry/api/v2"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/docker/distribution/registry/storage/driver/faults"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
 	_ "github.com/docker/distribution/registry/storage/driver/testdriver"
 	"github.com/docker/distribution/testutil"
 	"github.com/docker/libtrust"
@@ -310,6 +315,152 @@ func TestBlobDelete(t *testing.T) {
 	testBlobDelete(t, env, args)
 }
 
+// TestBlobAutomount checks that a blob is mounted from a repository linking
+// it when the client does not name one.
+func TestBlobAutomount(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"automount":  configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	args := makeBlobArgs(t)
+	uploadURLBase, _ := startPushLayer(t, env, args.imageName)
+	pushLayer(t, env.builder, args.imageName, args.layerDigest, uploadURLBase, args.layerFile)
+
+	mount := func(name reference.Named, dgst digest.Digest) *http.Response {
+		mountURL, err := env.builder.BuildBlobUploadURL(name, url.Values{"mount": []string{dgst.String()}})
+		if err != nil {
+			t.Fatalf("unexpected error building mount url: %v", err)
+		}
+		resp, err := http.Post(mountURL, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error mounting blob: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	target, _ := reference.WithName("foo/automount")
+	resp := mount(target, args.layerDigest)
+	checkResponse(t, "mounting a blob without source", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{args.layerDigest.String()},
+	})
+
+	ref, _ := reference.WithDigest(target, args.layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building blob url: %v", err)
+	}
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking mounted blob: %v", err)
+	}
+	checkResponse(t, "checking mounted blob", resp, http.StatusOK)
+
+	// an unknown blob starts an upload
+	resp = mount(target, digest.FromString("unknown"))
+	checkResponse(t, "mounting an unknown blob", resp, http.StatusAccepted)
+}
+
+// TestBlobUploadChunksOutOfOrder pushes the chunks of a blob concurrently,
+// all with the upload URL returned when starting the upload.
+func TestBlobUploadChunksOutOfOrder(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/chunks")
+	content := make([]byte, 3000)
+	rand.Read(content)
+	dgst := digest.FromBytes(content)
+
+	patch := func(uploadURL string, start, end int64) *http.Response {
+		req, err := http.NewRequest("PATCH", uploadURL, bytes.NewReader(content[start:end+1]))
+		if err != nil {
+			t.Fatalf("unexpected error creating new request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, end))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	uploadURLBase, _ := startPushLayer(t, env, name)
+
+	// the first chunk is written in order
+	resp := patch(uploadURLBase, 0, 999)
+	checkResponse(t, "pushing the first chunk", resp, http.StatusAccepted)
+	checkHeaders(t, resp, http.Header{
+		"Range": []string{"0-999"},
+	})
+
+	// a chunk overlapping the data written in order is rejected
+	resp = patch(uploadURLBase, 500, 1499)
+	checkResponse(t, "pushing an overlapping chunk", resp, http.StatusRequestedRangeNotSatisfiable)
+
+	// the next chunks are stored out of order, unless one reaches the end of
+	// the data written in order first, while the upload URL carries the
+	// offset of the upload start
+	var wg sync.WaitGroup
+	responses := make([]*http.Response, 2)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := int64(1000 * (len(responses) - i))
+			responses[i] = patch(uploadURLBase, start, start+999)
+		}(i)
+	}
+	wg.Wait()
+	for i, resp := range responses {
+		start := 1000 * (len(responses) - i)
+		checkResponse(t, "pushing a chunk out of order", resp, http.StatusAccepted)
+		if rng := resp.Header.Get("Range"); !strings.HasSuffix(rng, fmt.Sprintf("-%d", start+999)) {
+			t.Fatalf("unexpected range %q of the chunk at %d", rng, start)
+		}
+	}
+
+	finishUpload(t, env.builder, name, uploadURLBase, dgst)
+
+	ref, _ := reference.WithDigest(name, dgst)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building blob url: %v", err)
+	}
+	resp, err = http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching assembled blob: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching assembled blob", resp, http.StatusOK)
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || !bytes.Equal(body, content) {
+		t.Fatalf("assembled blob does not match its chunks: %v", err)
+	}
+
+	// chunks leaving a gap cannot be committed
+	uploadURLBase, _ = startPushLayer(t, env, name)
+	checkResponse(t, "pushing a chunk after a gap", patch(uploadURLBase, 1000, 1999), http.StatusAccepted)
+	resp, err = doPushLayer(t, env.builder, name, dgst, uploadURLBase, nil)
+	if err != nil {
+		t.Fatalf("unexpected error completing upload: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "completing an upload with a gap", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "completing an upload with a gap", resp, v2.ErrorCodeBlobUploadInvalid)
+}
+
 func TestRelativeURL(t *testing.T) {
 	config := configuration.Configuration{
 		Storage: configuration.Storage{
@@ -832,6 +983,7 @@ func (factory *storageManifestErrDriverFactory) Create(parameters map[string]int
 	// Initialize the mock driver
 	var errGenericStorage = errors.New("generic storage error")
 	return &mockErrorDriver{
+		StorageDriver: inmemory.New(),
 		returnErrs: []mockErrorMapping{
 			{
 				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestNotFound),
@@ -905,6 +1057,78 @@ func TestGetManifestWithStorageError(t *testing.T) {
 	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
 }
 
+func TestGetManifestWithStorageFaults(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{Name: "faults", Options: configuration.Parameters{"seed": 1}}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/faults")
+	testManifestAPISchema2(t, env, imageName)
+
+	tagRef, _ := reference.WithTag(imageName, "schema2tag")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	faultsDriver := env.app.driver.(*faults.Driver)
+	for _, testcase := range []struct {
+		description string
+		rule        faults.Rule
+		status      int
+		code        errcode.ErrorCode
+	}{
+		{
+			description: "slow storage",
+			rule:        faults.Rule{Latency: time.Millisecond, Jitter: time.Millisecond},
+			status:      http.StatusOK,
+		},
+		{
+			description: "tag link not found yet",
+			rule: faults.Rule{
+				Actions:      []string{"GetContent"},
+				Path:         regexp.MustCompile("/_manifests/tags/schema2tag/current/link$"),
+				NotFoundRate: 1,
+			},
+			status: http.StatusNotFound,
+			code:   v2.ErrorCodeManifestUnknown,
+		},
+		{
+			description: "failing storage",
+			rule: faults.Rule{
+				Actions:   []string{"GetContent", "Stat"},
+				Path:      regexp.MustCompile("/blobs/"),
+				ErrorRate: 1,
+			},
+			status: http.StatusInternalServerError,
+			code:   errcode.ErrorCodeUnknown,
+		},
+	} {
+		faultsDriver.SetRules([]faults.Rule{testcase.rule})
+
+		resp, err := http.Get(manifestURL)
+		if err != nil {
+			t.Fatalf("unexpected error getting manifest: %v", err)
+		}
+		checkResponse(t, "getting manifest with "+testcase.description, resp, testcase.status)
+		if testcase.code != (errcode.ErrorCode(0)) {
+			checkBodyHasErrorCodes(t, "getting manifest with "+testcase.description, resp, testcase.code)
+		}
+		resp.Body.Close()
+	}
+}
+
 func TestManifestDelete(t *testing.T) {
 	schema1Repo, _ := reference.WithName("foo/schema1")
 	schema2Repo, _ := reference.WithName("foo/schema2")
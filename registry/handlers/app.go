@@ -29,12 +29,16 @@ import (
 	registrymiddleware "github.com/docker/distribution/registry/middleware/registry"
 	repositorymiddleware "github.com/docker/distribution/registry/middleware/repository"
 	"github.com/docker/distribution/registry/proxy"
+	"github.com/docker/distribution/registry/replication"
 	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache"
 	memorycache "github.com/docker/distribution/registry/storage/cache/memory"
 	rediscache "github.com/docker/distribution/registry/storage/cache/redis"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/base"
 	"github.com/docker/distribution/registry/storage/driver/factory"
 	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+	"github.com/docker/distribution/registry/storage/metadata"
 	"github.com/docker/distribution/version"
 	"github.com/docker/go-metrics"
 	"github.com/docker/libtrust"
@@ -50,6 +54,11 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+// defaultMetadataTTL bounds how long cached tags and manifests are served
+// after a change the registry does not invalidate, such as a deletion by
+// another registry sharing the storage without sharing the cache.
+const defaultMetadataTTL = 5 * time.Minute
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -61,6 +70,7 @@ type App struct {
 	router           *mux.Router                 // main application router, configured with dispatchers
 	driver           storagedriver.StorageDriver // driver maintains the app global storage driver instance.
 	registry         distribution.Namespace      // registry is the primary registry backend for the app instance.
+	storageRegistry  distribution.Namespace      // storageRegistry is the registry backend before any middleware.
 	accessController auth.AccessController       // main access controller for application
 
 	// httpHost is a parsed representation of the http.host parameter from
@@ -73,6 +83,10 @@ type App struct {
 		source notifications.SourceRecord
 	}
 
+	// replicator copies pushes and deletes to other registries, if
+	// configured.
+	replicator *replication.Replicator
+
 	redis *redis.Pool
 
 	// trustKey is a deprecated key used to sign manifests converted to
@@ -81,10 +95,15 @@ type App struct {
 	trustKey libtrust.PrivateKey
 
 	// isCache is true if this registry is configured as a pull through cache
+	// serving no local repositories
 	isCache bool
 
 	// readOnly is true if the registry is in a read-only maintenance mode
 	readOnly bool
+
+	// automount is the policy of automatic cross-repository mounts, empty
+	// unless they are enabled
+	automount string
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -95,7 +114,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		Config:  config,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.CacheOnly(),
 	}
 
 	// Register the handler dispatchers.
@@ -124,8 +143,24 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		// a health check.
 		panic(err)
 	}
+	setSlowThresholds(app.driver, config.Storage)
+
+	database, err := config.Storage.MetadataDatabase()
+	if err != nil {
+		panic(err)
+	}
+	if database != "" {
+		app.driver, err = metadata.New(app, app.driver, database)
+		if err != nil {
+			panic(fmt.Sprintf("unable to open metadata database: %v", err))
+		}
+		dcontext.GetLogger(app).Infof("repository metadata indexed in %s", database)
+	} else if err := metadata.Invalidate(app, app.driver); err != nil {
+		panic(fmt.Sprintf("unable to invalidate the metadata database: %v", err))
+	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
+	var sweepConfig map[interface{}]interface{}
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
 			purgeConfig, ok = v.(map[interface{}]interface{})
@@ -133,6 +168,12 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("uploadpurging config key must contain additional keys")
 			}
 		}
+		if v, ok := mc["blobsweeping"]; ok {
+			sweepConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("blobsweeping config key must contain additional keys")
+			}
+		}
 		if v, ok := mc["readonly"]; ok {
 			readOnly, ok := v.(map[interface{}]interface{})
 			if !ok {
@@ -147,19 +188,24 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
-	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
-
-	app.driver, err = applyStorageMiddleware(app.driver, config.Middleware["storage"])
+	app.driver, err = ApplyStorageMiddleware(app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
 
+	// the purger reads the start time of uploads, which middlewares such as
+	// encrypt transform
+	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+
+	routeOptions := app.configureStorageRoutes(config, purgeConfig)
+
 	app.configureSecret(config)
 	app.configureEvents(config)
 	app.configureRedis(config)
 	app.configureLogHook(config)
 
 	options := registrymiddleware.GetRegistryOptions()
+	options = append(options, routeOptions...)
 	if config.Compatibility.Schema1.TrustKey != "" {
 		app.trustKey, err = libtrust.LoadKeyFile(config.Compatibility.Schema1.TrustKey)
 		if err != nil {
@@ -188,7 +234,19 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.DisableDigestResumption)
 	}
 
+	// configure reference counting for the blob sweeper and automatic mounts
+	app.automount, err = config.Storage.Automount()
+	if err != nil {
+		panic(err.Error())
+	}
+	if sweepConfig["enabled"] == true {
+		options = append(options, storage.EnableReferenceCounting)
+	} else if app.automount != "" {
+		options = append(options, storage.EnableLinkTracking)
+	}
+
 	// configure deletion
+	var trashRetention time.Duration
 	if d, ok := config.Storage["delete"]; ok {
 		e, ok := d["enabled"]
 		if ok {
@@ -196,6 +254,17 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				options = append(options, storage.EnableDelete)
 			}
 		}
+		if r, ok := d["retention"]; ok {
+			retention, ok := r.(string)
+			if !ok {
+				panic("delete's retention config key must be a duration string")
+			}
+			trashRetention, err = time.ParseDuration(retention)
+			if err != nil || trashRetention <= 0 {
+				panic(fmt.Sprintf("invalid delete retention %q", retention))
+			}
+			options = append(options, storage.EnableTrash(trashRetention))
+		}
 	}
 
 	// configure redirects
@@ -254,6 +323,10 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 
 	// configure storage caches
 	if cc, ok := config.Storage["cache"]; ok {
+		if provider := app.metadataCacheProvider(cc); provider != nil {
+			options = append(options, storage.MetadataCacheProvider(provider))
+		}
+
 		v, ok := cc["blobdescriptor"]
 		if !ok {
 			// Backwards compatible: "layerinfo" == "blobdescriptor"
@@ -273,7 +346,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			}
 			dcontext.GetLogger(app).Infof("using redis blob descriptor cache")
 		case "inmemory":
-			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider()
+			cacheProvider := memorycache.NewBoundedInMemoryBlobDescriptorCacheProvider(inMemoryBlobDescriptorCacheOptions(cc))
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -295,6 +368,18 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	app.storageRegistry = app.registry
+	startBlobSweeper(app, app.registry, dcontext.GetLogger(app), sweepConfig)
+	if app.automount != "" {
+		startReferenceBuilder(app, app.registry, dcontext.GetLogger(app))
+	}
+	if trashRetention > 0 {
+		startTrashPurger(app, app.registry, dcontext.GetLogger(app), trashRetention)
+	}
+	if config.HTTP.Debug.Prometheus.Enabled {
+		startUploadMonitor(app, app.registry, dcontext.GetLogger(app), purgeConfig)
+	}
+
 	app.registry, err = applyRegistryMiddleware(app, app.registry, config.Middleware["registry"])
 	if err != nil {
 		panic(err)
@@ -312,13 +397,28 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
+	if config.Proxy.Enabled() {
 		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
 		if err != nil {
 			panic(err.Error())
 		}
-		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		app.isCache = config.Proxy.CacheOnly()
+		if config.Proxy.RemoteURL != "" {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		}
+		for _, remote := range config.Proxy.Remotes {
+			dcontext.GetLogger(app).Infof("Registry configured as a proxy cache to %s for %s", remote.RemoteURL, remote.Prefix)
+		}
+	}
+
+	if len(config.Replication.Targets) > 0 {
+		app.replicator, err = replication.New(app, app.registry, config.Replication)
+		if err != nil {
+			panic(fmt.Sprintf("unable to configure replication: %v", err))
+		}
+		for _, target := range config.Replication.Targets {
+			dcontext.GetLogger(app).Infof("configured replication target %v (%v)", target.Name, target.URL)
+		}
 	}
 
 	return app
@@ -443,6 +543,11 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 			continue
 		}
 
+		transport, err := notifications.NewTransport(endpoint.TLS)
+		if err != nil {
+			panic(fmt.Sprintf("unable to configure tls for endpoint %s: %v", endpoint.Name, err))
+		}
+
 		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
 		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
 			Timeout:           endpoint.Timeout,
@@ -451,6 +556,7 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 			Headers:           endpoint.Headers,
 			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
 			Ignore:            endpoint.Ignore,
+			Transport:         transport,
 		})
 
 		sinks = append(sinks, endpoint)
@@ -700,6 +806,10 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 				repository,
 				app.eventBridge(context, r))
 
+			if app.replicator != nil {
+				context.Repository = notifications.Listen(context.Repository, app.replicator)
+			}
+
 			context.Repository, err = applyRepoMiddleware(app, context.Repository, app.Config.Middleware["repository"])
 			if err != nil {
 				dcontext.GetLogger(context).Errorf("error initializing repository middleware: %v", err)
@@ -972,8 +1082,60 @@ func applyRepoMiddleware(ctx context.Context, repository distribution.Repository
 	return repository, nil
 }
 
-// applyStorageMiddleware wraps a storage driver with the configured middlewares
-func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
+// setSlowThresholds configures the logging of the slow actions of a storage
+// driver, if the driver logs them.
+func setSlowThresholds(driver storagedriver.StorageDriver, storage configuration.Storage) {
+	threshold, actions, err := storage.Slowlog()
+	if err != nil {
+		panic(err)
+	}
+
+	if d, ok := driver.(interface {
+		SetSlowThresholds(base.SlowThresholds)
+	}); ok {
+		d.SetSlowThresholds(base.SlowThresholds{Default: threshold, Actions: actions})
+	}
+}
+
+// configureStorageRoutes creates the storage drivers of the repositories
+// routed to their own backend, and returns the registry options placing the
+// repositories on them. Each driver gets its own upload purger and the
+// configured storage middlewares.
+func (app *App) configureStorageRoutes(config *configuration.Configuration, purgeConfig map[interface{}]interface{}) []storage.RegistryOption {
+	routes, err := config.Storage.Routes()
+	if err != nil {
+		panic(err)
+	}
+
+	var options []storage.RegistryOption
+	for prefix, routeStorage := range routes {
+		parameters := make(map[string]interface{})
+		for k, v := range routeStorage.Parameters() {
+			parameters[k] = v
+		}
+		parameters["useragent"] = fmt.Sprintf("docker-distribution/%s %s", version.Version, runtime.Version())
+
+		driver, err := factory.Create(routeStorage.Type(), parameters)
+		if err != nil {
+			panic(fmt.Sprintf("unable to configure storage route %q: %v", prefix, err))
+		}
+		setSlowThresholds(driver, config.Storage)
+
+		driver, err = ApplyStorageMiddleware(driver, config.Middleware["storage"])
+		if err != nil {
+			panic(err)
+		}
+
+		startUploadPurger(app, driver, dcontext.GetLogger(app), purgeConfig)
+
+		options = append(options, storage.Route(prefix, driver))
+		dcontext.GetLogger(app).Infof("repositories starting with %q stored on %s", prefix, routeStorage.Type())
+	}
+	return options
+}
+
+// ApplyStorageMiddleware wraps a storage driver with the configured middlewares
+func ApplyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
 	for _, mw := range middlewares {
 		smw, err := storagemiddleware.Get(mw.Name, mw.Options, driver)
 		if err != nil {
@@ -996,6 +1158,190 @@ func uploadPurgeDefaultConfig() map[interface{}]interface{} {
 	return config
 }
 
+// metadataCacheProvider returns the tag and manifest cache configured in the
+// storage cache parameters, or nil if none is configured.
+func (app *App) metadataCacheProvider(cc configuration.Parameters) cache.MetadataCacheProvider {
+	ttl := defaultMetadataTTL
+	if v, ok := cc["metadatattl"]; ok {
+		ttlStr, ok := v.(string)
+		if !ok {
+			panic("metadatattl is not a string")
+		}
+
+		var err error
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse metadatattl: %v", err))
+		}
+	}
+
+	switch v := cc["metadata"]; v {
+	case "redis":
+		if app.redis == nil {
+			panic("redis configuration required to use for metadata cache")
+		}
+		dcontext.GetLogger(app).Infof("using redis metadata cache")
+		return rediscache.NewRedisMetadataCacheProvider(app.redis, ttl)
+	case "inmemory":
+		dcontext.GetLogger(app).Infof("using inmemory metadata cache")
+		return memorycache.NewInMemoryMetadataCacheProvider(ttl)
+	default:
+		if v != nil && v != "" {
+			dcontext.GetLogger(app).Warnf("unknown metadata cache type %q, metadata caching disabled", v)
+		}
+		return nil
+	}
+}
+
+// inMemoryBlobDescriptorCacheOptions returns the bounds of the inmemory blob
+// descriptor cache configured in the storage cache parameters.
+func inMemoryBlobDescriptorCacheOptions(cc configuration.Parameters) memorycache.Options {
+	options := memorycache.Options{
+		Tracker: storage.BlobDescriptorCacheMetrics(),
+	}
+
+	if v, ok := cc["blobdescriptormaxentries"]; ok {
+		maxEntries, ok := v.(int)
+		if !ok || maxEntries < 0 {
+			panic(fmt.Sprintf("blobdescriptormaxentries must be a non-negative integer, got %v", v))
+		}
+		options.MaxEntries = maxEntries
+	}
+
+	if v, ok := cc["blobdescriptormaxbytes"]; ok {
+		maxBytes, ok := v.(int)
+		if !ok || maxBytes < 0 {
+			panic(fmt.Sprintf("blobdescriptormaxbytes must be a non-negative integer, got %v", v))
+		}
+		options.MaxBytes = int64(maxBytes)
+	}
+
+	if v, ok := cc["blobdescriptorttl"]; ok {
+		ttlStr, ok := v.(string)
+		if !ok {
+			panic("blobdescriptorttl is not a string")
+		}
+
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse blobdescriptorttl: %v", err))
+		}
+		options.TTL = ttl
+	}
+
+	return options
+}
+
+// startBlobSweeper schedules a goroutine which will periodically delete
+// the blobs no longer referenced by any manifest, once they have been
+// unreferenced for longer than the configured age.
+func startBlobSweeper(ctx context.Context, registry distribution.Namespace, log dcontext.Logger, config map[interface{}]interface{}) {
+	if config["enabled"] != true {
+		return
+	}
+
+	durations := map[string]time.Duration{"age": 24 * time.Hour, "interval": time.Hour}
+	for key := range durations {
+		v, ok := config[key]
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			panic(fmt.Sprintf("Unable to parse blob sweeping configuration: %s is not a string", key))
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to parse blob sweeping configuration: cannot parse %s: %v", key, err))
+		}
+		durations[key] = d
+	}
+
+	dryRun, ok := config["dryrun"].(bool)
+	if _, set := config["dryrun"]; set && !ok {
+		panic("Unable to parse blob sweeping configuration: cannot parse dryrun")
+	}
+
+	go func() {
+		for {
+			log.Infof("Starting blob sweep in %s", durations["interval"])
+			time.Sleep(durations["interval"])
+
+			swept, err := storage.SweepBlobs(ctx, registry, time.Now().Add(-durations["age"]), dryRun)
+			if err != nil {
+				log.Errorf("blob sweep failed: %v", err)
+			}
+			for _, dgst := range swept {
+				log.Infof("swept unreferenced blob %s (dryrun=%t)", dgst, dryRun)
+			}
+		}
+	}()
+}
+
+// startReferenceBuilder starts a goroutine recording the links of the blobs
+// stored before automatic mounts were enabled, so that they can be mounted
+// too. Once recorded, later starts only check that they were.
+func startReferenceBuilder(ctx context.Context, registry distribution.Namespace, log dcontext.Logger) {
+	go func() {
+		if err := storage.BuildReferences(ctx, registry); err != nil {
+			log.Errorf("failed to build the references of the blobs: %v", err)
+		}
+	}()
+}
+
+// startTrashPurger schedules a goroutine which will periodically purge the
+// items of the trash which have expired.
+func startTrashPurger(ctx context.Context, registry distribution.Namespace, log dcontext.Logger, retention time.Duration) {
+	interval := time.Hour
+	if retention < interval {
+		interval = retention
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			purged, err := storage.PurgeTrash(ctx, registry, time.Now())
+			if err != nil {
+				log.Errorf("trash purge failed: %v", err)
+			}
+			for _, item := range purged {
+				log.Infof("purged expired %s %s of %s from the trash", item.Kind, item.Digest, item.Repository)
+			}
+		}
+	}()
+}
+
+// startUploadMonitor schedules a goroutine which will periodically list the
+// blob uploads in progress to update their metrics, if the upload purging
+// configuration sets a monitorinterval. Listing walks all repositories.
+func startUploadMonitor(ctx context.Context, registry distribution.Namespace, log dcontext.Logger, config map[interface{}]interface{}) {
+	v, ok := config["monitorinterval"]
+	if !ok {
+		return
+	}
+	intervalStr, ok := v.(string)
+	if !ok {
+		badPurgeUploadConfig("monitorinterval is not a string")
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		badPurgeUploadConfig(fmt.Sprintf("Cannot parse monitorinterval: %s", err.Error()))
+	}
+	if interval <= 0 {
+		badPurgeUploadConfig("monitorinterval must be positive")
+	}
+
+	go func() {
+		for {
+			if _, err := storage.ListUploads(ctx, registry, ""); err != nil {
+				log.Errorf("listing uploads failed: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
 func badPurgeUploadConfig(reason string) {
 	panic(fmt.Sprintf("Unable to parse upload purge configuration: %s", reason))
 }
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
 	dcontext "github.com/docker/distribution/context"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/api/errcode"
@@ -75,7 +78,7 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 		}
 		buh.Upload = upload
 
-		if size := upload.Size(); size != buh.State.Offset {
+		if size := upload.Size(); size != buh.State.Offset && appendsData(r) {
 			defer upload.Close()
 			dcontext.GetLogger(ctx).Errorf("upload resumed at wrong offest: %d != %d", size, buh.State.Offset)
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -115,6 +118,10 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 		if opt != nil && err == nil {
 			options = append(options, opt)
 		}
+	} else if mountDigest != "" && buh.App.automount != "" {
+		if opt := buh.automountOption(mountDigest); opt != nil {
+			options = append(options, opt)
+		}
 	}
 
 	blobs := buh.Repository.Blobs(buh)
@@ -177,7 +184,26 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// TODO(dmcgowan): support Content-Range header to seek and write range
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		var start, end int64
+		if n, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil || n != 2 || start < 0 || end < start || start < buh.Upload.Size() {
+			dcontext.GetLogger(buh).Infof("invalid Content-Range %q at offset %d", contentRange, buh.Upload.Size())
+			if err := buh.blobUploadResponse(w, r, false); err != nil {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+				return
+			}
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if ok, err := buh.writesChunk(start); err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		} else if ok {
+			buh.patchChunk(w, r, start, end)
+			return
+		}
+	}
 
 	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
@@ -192,6 +218,88 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// writesChunk returns true if the chunk of a PATCH starting at start must be
+// written out of order: it starts beyond the data written in order, which is
+// left as is once chunks have been written.
+func (buh *blobUploadHandler) writesChunk(start int64) (bool, error) {
+	cw, ok := buh.Upload.(distribution.ChunkedBlobWriter)
+	if !ok {
+		return false, nil
+	}
+	if start > buh.Upload.Size() {
+		return true, nil
+	}
+	return cw.Chunked(buh)
+}
+
+// patchChunk writes the chunk of a PATCH out of order. The Range of the
+// response is the range of the chunk written.
+func (buh *blobUploadHandler) patchChunk(w http.ResponseWriter, r *http.Request, start, end int64) {
+	body := &exactReader{r: r.Body, n: end - start + 1}
+	if _, err := buh.Upload.(distribution.ChunkedBlobWriter).WriteChunk(buh, start, body); err != nil {
+		if err == distribution.ErrUnsupported {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
+		} else {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		}
+		return
+	}
+
+	if err := buh.blobUploadResponse(w, r, false); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Range", fmt.Sprintf("%d-%d", start, end))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// appendsData returns true if the request may append data to the upload at
+// the offset of its state, which must then match the size of the upload. A
+// PATCH with a Content-Range writes at the offset of its range, and a PUT
+// without a body only commits the upload: both may come with the state of a
+// request sent concurrently, as the chunks of a blob uploaded in parallel.
+func appendsData(r *http.Request) bool {
+	switch r.Method {
+	case "PATCH":
+		return r.Header.Get("Content-Range") == ""
+	case "PUT":
+		return r.ContentLength != 0
+	}
+	return true
+}
+
+// exactReader reads exactly n bytes from r, failing if it ends before or
+// has more to read.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (er *exactReader) Read(p []byte) (int, error) {
+	if er.n <= 0 {
+		// the reader must be at EOF as well
+		var b [1]byte
+		if n, _ := er.r.Read(b[:]); n > 0 {
+			return 0, errors.New("request body is larger than its Content-Range")
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > er.n {
+		p = p[:er.n]
+	}
+	n, err := er.r.Read(p)
+	er.n -= int64(n)
+	if err == io.EOF && er.n > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
 // PutBlobUploadComplete takes the final request of a blob upload. The
 // request may include all the blob data or no blob data. Any data
 // provided is received and verified. If successful, the blob is linked
@@ -347,6 +455,50 @@ func (buh *blobUploadHandler) createBlobMountOption(fromRepo, mountDigest string
 	return storage.WithMountFrom(canonical), nil
 }
 
+// automountOption returns an option mounting the blob from a repository
+// linking it, or nil if there is none. Unless the policy allows mounting
+// from any repository, the client must be authorized to pull from it.
+func (buh *blobUploadHandler) automountOption(mountDigest string) distribution.BlobCreateOption {
+	dgst, err := digest.Parse(mountDigest)
+	if err != nil {
+		return nil
+	}
+
+	names, err := storage.LinkingRepositories(buh, buh.App.storageRegistry, dgst)
+	if err != nil {
+		dcontext.GetLogger(buh).Errorf("error looking up the repositories linking %s: %v", dgst, err)
+		return nil
+	}
+
+	for _, name := range names {
+		if buh.App.automount != configuration.AutomountAny && buh.App.accessController != nil {
+			if _, err := buh.App.accessController.Authorized(buh, appendAccessRecords(nil, "GET", name)...); err != nil {
+				continue
+			}
+		}
+
+		named, err := reference.WithName(name)
+		if err != nil {
+			continue
+		}
+		repo, err := buh.App.storageRegistry.Repository(buh, named)
+		if err != nil {
+			continue
+		}
+		// the recorded link may have been removed since
+		if _, err := repo.Blobs(buh).Stat(buh, dgst); err != nil {
+			continue
+		}
+
+		opt, err := buh.createBlobMountOption(name, mountDigest)
+		if err == nil {
+			dcontext.GetLogger(buh).Debugf("mounting %s automatically from %s", dgst, name)
+			return opt
+		}
+	}
+	return nil
+}
+
 // writeBlobCreatedHeaders writes the standard headers describing a newly
 // created blob. A 201 Created is written as well as the canonical URL and
 // blob digest.
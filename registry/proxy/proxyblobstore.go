@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
@@ -15,25 +16,28 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
-// todo(richardscothern): from cache control header or config file
-const blobTTL = time.Duration(24 * 7 * time.Hour)
-
 type proxyBlobStore struct {
 	localStore     distribution.BlobStore
 	remoteStore    distribution.BlobService
 	scheduler      *scheduler.TTLExpirationScheduler
+	ttl            time.Duration
 	repositoryName reference.Named
 	authChallenger authChallenger
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
 
-// inflight tracks currently downloading blobs
-var inflight = make(map[digest.Digest]struct{})
+// inflight tracks currently downloading blobs, with a channel closed once the
+// download is over
+var inflight = make(map[digest.Digest]chan struct{})
 
 // mu protects inflight
 var mu sync.Mutex
 
+// errBlobTooLarge is returned when storing a blob larger than the maximum
+// size of the cache.
+var errBlobTooLarge = errors.New("blob is larger than the maximum size of the cache")
+
 func setResponseHeaders(w http.ResponseWriter, length int64, mediaType string, digest digest.Digest) {
 	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
 	w.Header().Set("Content-Type", mediaType)
@@ -77,6 +81,12 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 	}
 
 	if err == nil {
+		if pbs.scheduler != nil {
+			if blobRef, err := reference.WithDigest(pbs.repositoryName, dgst); err == nil {
+				pbs.scheduler.Touch(blobRef)
+			}
+		}
+
 		proxyMetrics.BlobPush(uint64(localDesc.Size))
 		return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 	}
@@ -85,10 +95,13 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 
 }
 
-func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) error {
+func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	defer func() {
 		mu.Lock()
-		delete(inflight, dgst)
+		if done, ok := inflight[dgst]; ok {
+			close(done)
+			delete(inflight, dgst)
+		}
 		mu.Unlock()
 	}()
 
@@ -96,22 +109,34 @@ func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) e
 	var err error
 	var bw distribution.BlobWriter
 
+	if pbs.scheduler != nil {
+		if maxSize := pbs.scheduler.MaxSize(); maxSize > 0 {
+			desc, err = pbs.remoteStore.Stat(ctx, dgst)
+			if err != nil {
+				return distribution.Descriptor{}, err
+			}
+			if desc.Size > maxSize {
+				return distribution.Descriptor{}, errBlobTooLarge
+			}
+		}
+	}
+
 	bw, err = pbs.localStore.Create(ctx)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	desc, err = pbs.copyContent(ctx, dgst, bw)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	_, err = bw.Commit(ctx, desc)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	return nil
+	return desc, nil
 }
 
 func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -136,21 +161,19 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 		_, err := pbs.copyContent(ctx, dgst, w)
 		return err
 	}
-	inflight[dgst] = struct{}{}
+	inflight[dgst] = make(chan struct{})
 	mu.Unlock()
 
 	go func(dgst digest.Digest) {
-		if err := pbs.storeLocal(ctx, dgst); err != nil {
-			dcontext.GetLogger(ctx).Errorf("Error committing to storage: %s", err.Error())
-		}
-
-		blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
-		if err != nil {
-			dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		desc, err := pbs.storeLocal(ctx, dgst)
+		if err == errBlobTooLarge {
+			dcontext.GetLogger(ctx).Infof("Not caching blob %s: %s", dgst, err)
 			return
+		} else if err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error committing to storage: %s", err.Error())
 		}
 
-		pbs.scheduler.AddBlob(blobRef, repositoryTTL)
+		pbs.schedule(ctx, dgst, desc.Size)
 	}(dgst)
 
 	_, err = pbs.copyContent(ctx, dgst, w)
@@ -160,6 +183,85 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 	return nil
 }
 
+// schedule schedules a blob stored from the remote for removal.
+func (pbs *proxyBlobStore) schedule(ctx context.Context, dgst digest.Digest, size int64) {
+	if pbs.scheduler == nil {
+		return
+	}
+
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		return
+	}
+
+	pbs.scheduler.AddBlob(blobRef, pbs.ttl, size)
+}
+
+// prefetch stores the blob locally if it is not already present, without
+// serving it to a client.
+func (pbs *proxyBlobStore) prefetch(ctx context.Context, dgst digest.Digest) error {
+	if _, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+		if pbs.scheduler != nil {
+			if blobRef, err := reference.WithDigest(pbs.repositoryName, dgst); err == nil {
+				pbs.scheduler.Touch(blobRef)
+			}
+		}
+		return nil
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	if _, ok := inflight[dgst]; ok {
+		// a pull is already storing the blob
+		mu.Unlock()
+		return nil
+	}
+	inflight[dgst] = make(chan struct{})
+	mu.Unlock()
+
+	desc, err := pbs.storeLocal(ctx, dgst)
+	if err == errBlobTooLarge {
+		dcontext.GetLogger(ctx).Infof("Not caching blob %s: %s", dgst, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pbs.schedule(ctx, dgst, desc.Size)
+	return nil
+}
+
+// fetch stores the blob locally, waiting for any pull already storing it and
+// storing it again only if that pull did not store it in this repository.
+func (pbs *proxyBlobStore) fetch(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	for {
+		mu.Lock()
+		done, ok := inflight[dgst]
+		if !ok {
+			inflight[dgst] = make(chan struct{})
+			mu.Unlock()
+			break
+		}
+		mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return distribution.Descriptor{}, ctx.Err()
+		}
+
+		if desc, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+			return desc, nil
+		}
+	}
+
+	return pbs.storeLocal(ctx, dgst)
+}
+
 func (pbs *proxyBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	desc, err := pbs.localStore.Stat(ctx, dgst)
 	if err == nil {
@@ -298,6 +298,20 @@ func TestProxyStoreStat(t *testing.T) {
 
 }
 
+func TestProxyStoreSkipsLargeBlobs(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+	te.store.scheduler.SetMaxSize(5)
+
+	populate(t, te, 1, 10, 1)
+	if err := te.store.prefetch(te.ctx, te.inRemote[0].Digest); err != nil {
+		t.Fatalf("unexpected error prefetching: %v", err)
+	}
+
+	if _, err := te.store.localStore.Stat(te.ctx, te.inRemote[0].Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected blob larger than the cache not to be stored, got %v", err)
+	}
+}
+
 func TestProxyStoreServeHighConcurrency(t *testing.T) {
 	te := makeTestEnv(t, "foo/bar")
 	blobSize := 200
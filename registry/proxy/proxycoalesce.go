@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+)
+
+// coalescedRequestTimeout bounds a request shared by coalesced callers, as it
+// is not bound to the context of any of them.
+const coalescedRequestTimeout = 2 * time.Minute
+
+// requestGroup coalesces concurrent requests for the same key, so that only
+// one of them reaches the remote and the others share its result. A nil
+// requestGroup performs every request.
+type requestGroup struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+type groupCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func newRequestGroup() *requestGroup {
+	return &requestGroup{calls: make(map[string]*groupCall)}
+}
+
+// do calls fn, unless a call for key is already in flight, in which case it
+// waits for that call and returns its result. The call runs with a context
+// carrying the values of ctx but detached from its cancellation, so that a
+// caller going away does not fail the others; each caller stops waiting when
+// its own context ends.
+func (g *requestGroup) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		c = &groupCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.call(ctx, key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *requestGroup) call(ctx context.Context, key string, c *groupCall, fn func(context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, coalescedRequestTimeout)
+	defer cancel()
+
+	c.val, c.err = fn(ctx)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+}
+
+// detachedContext carries the values of a context without its deadline and
+// cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
+
+// tagCache remembers tag resolutions from the remote for a short time, so
+// that repeated lookups of a tag do not reach the remote. A nil tagCache
+// remembers nothing.
+type tagCache struct {
+	mu        sync.Mutex
+	freshness time.Duration
+	entries   map[string]tagCacheEntry
+}
+
+type tagCacheEntry struct {
+	desc    distribution.Descriptor
+	fetched time.Time
+}
+
+// newTagCache returns a cache keeping tag resolutions for freshness. If
+// freshness is not positive, nil is returned.
+func newTagCache(freshness time.Duration) *tagCache {
+	if freshness <= 0 {
+		return nil
+	}
+
+	return &tagCache{
+		freshness: freshness,
+		entries:   make(map[string]tagCacheEntry),
+	}
+}
+
+func (tc *tagCache) get(key string) (distribution.Descriptor, bool) {
+	if tc == nil {
+		return distribution.Descriptor{}, false
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry, ok := tc.entries[key]
+	if !ok {
+		return distribution.Descriptor{}, false
+	}
+
+	if time.Since(entry.fetched) > tc.freshness {
+		delete(tc.entries, key)
+		return distribution.Descriptor{}, false
+	}
+
+	return entry.desc, true
+}
+
+func (tc *tagCache) add(key string, desc distribution.Descriptor) {
+	if tc == nil {
+		return
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	now := time.Now()
+	tc.entries[key] = tagCacheEntry{desc: desc, fetched: now}
+
+	// drop expired entries so the cache does not grow without bound
+	for k, entry := range tc.entries {
+		if now.Sub(entry.fetched) > tc.freshness {
+			delete(tc.entries, k)
+		}
+	}
+}
+
+func (tc *tagCache) remove(key string) {
+	if tc == nil {
+		return
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	delete(tc.entries, key)
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+)
+
+func TestRequestGroupCoalesces(t *testing.T) {
+	g := newRequestGroup()
+	release := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := g.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	// give the goroutines a chance to join the in-flight call
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected a single call, got %d", calls)
+	}
+
+	for _, v := range results {
+		if v != "value" {
+			t.Fatalf("unexpected result: %v", v)
+		}
+	}
+
+	// once complete, the next call is performed again
+	if _, err := g.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected a second call, got %d", calls)
+	}
+}
+
+func TestRequestGroupLeaderCancelled(t *testing.T) {
+	g := newRequestGroup()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := g.do(leaderCtx, "key", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			select {
+			case <-release:
+				return "value", nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+		leaderErr <- err
+	}()
+	<-started
+
+	followerResult := make(chan interface{}, 1)
+	go func() {
+		v, err := g.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+			t.Errorf("expected the follower to join the in-flight call")
+			return nil, nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error for the follower: %v", err)
+		}
+		followerResult <- v
+	}()
+
+	// the leader's client goes away
+	cancel()
+	if err := <-leaderErr; err != context.Canceled {
+		t.Fatalf("expected the leader to stop waiting, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if v := <-followerResult; v != "value" {
+		t.Fatalf("unexpected result for the follower: %v", v)
+	}
+}
+
+func TestTagCacheFreshness(t *testing.T) {
+	if newTagCache(0) != nil {
+		t.Fatalf("expected nil cache without freshness")
+	}
+
+	tc := newTagCache(20 * time.Millisecond)
+	desc := distribution.Descriptor{Size: 42}
+	tc.add("foo:latest", desc)
+
+	if d, ok := tc.get("foo:latest"); !ok || d.Size != desc.Size {
+		t.Fatalf("expected fresh entry, got %v %v", d, ok)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := tc.get("foo:latest"); ok {
+		t.Fatalf("expected entry to expire")
+	}
+}
+
+func TestGetCoalescedAndCached(t *testing.T) {
+	remoteDesc := distribution.Descriptor{Size: 42}
+	proxyTags := testProxyTagService(nil, map[string]distribution.Descriptor{"latest": remoteDesc})
+	name, err := reference.WithName("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyTags.repositoryName = name
+	proxyTags.requests = newRequestGroup()
+	proxyTags.cache = newTagCache(time.Hour)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		d, err := proxyTags.Get(ctx, "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Size != remoteDesc.Size {
+			t.Fatalf("unexpected descriptor: %v", d)
+		}
+	}
+
+	if proxyTags.authChallenger.(*mockChallenger).count != 1 {
+		t.Fatalf("expected a single remote lookup, got %d", proxyTags.authChallenger.(*mockChallenger).count)
+	}
+
+	// untagging forgets the cached lookup
+	if err := proxyTags.Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxyTags.Get(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if proxyTags.authChallenger.(*mockChallenger).count != 2 {
+		t.Fatalf("expected a second remote lookup, got %d", proxyTags.authChallenger.(*mockChallenger).count)
+	}
+}
+
+func TestLimitedTransport(t *testing.T) {
+	var current, max int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&current, -1)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newLimitedTransport(http.DefaultTransport, 2)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if max != 2 {
+		t.Fatalf("expected at most 2 concurrent requests, got %d", max)
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/opencontainers/go-digest"
+)
+
+// fallbackRepository is a local, writable repository which fetches content
+// from a remote only when it is missing locally.
+type fallbackRepository struct {
+	distribution.Repository // the local repository
+	proxied                 *proxiedRepository
+}
+
+func (fr *fallbackRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	localManifests, err := fr.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fallbackManifestStore{
+		ManifestService: localManifests,
+		proxied:         fr.proxied.manifests.(*proxyManifestStore),
+		blobs:           fr.proxied.blobStore.(*proxyBlobStore),
+	}, nil
+}
+
+func (fr *fallbackRepository) Blobs(ctx context.Context) distribution.BlobStore {
+	return &fallbackBlobStore{
+		BlobStore: fr.Repository.Blobs(ctx),
+		proxied:   fr.proxied.blobStore.(*proxyBlobStore),
+	}
+}
+
+func (fr *fallbackRepository) Tags(ctx context.Context) distribution.TagService {
+	return &fallbackTagService{
+		TagService: fr.Repository.Tags(ctx),
+		proxied:    fr.proxied.tags.(*proxyTagService),
+	}
+}
+
+// fallbackBlobStore reads blobs through the proxy, which serves local content
+// first. All writes go to the local store.
+type fallbackBlobStore struct {
+	distribution.BlobStore
+	proxied *proxyBlobStore
+}
+
+var _ distribution.BlobStore = &fallbackBlobStore{}
+
+func (fbs *fallbackBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return fbs.proxied.Stat(ctx, dgst)
+}
+
+func (fbs *fallbackBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	return fbs.proxied.Get(ctx, dgst)
+}
+
+func (fbs *fallbackBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
+	return fbs.proxied.ServeBlob(ctx, w, r, dgst)
+}
+
+// fallbackManifestStore reads manifests through the proxy, which serves local
+// content first. Manifests are written to the local store after any content
+// they reference that is only available from the remote has been fetched.
+type fallbackManifestStore struct {
+	distribution.ManifestService
+	proxied *proxyManifestStore
+	blobs   *proxyBlobStore
+}
+
+var _ distribution.ManifestService = &fallbackManifestStore{}
+
+func (fms *fallbackManifestStore) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	return fms.proxied.Exists(ctx, dgst)
+}
+
+func (fms *fallbackManifestStore) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	return fms.proxied.Get(ctx, dgst, options...)
+}
+
+func (fms *fallbackManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	// A client may skip uploading content which the remote reports as
+	// present, so make sure it is available locally before verification.
+	for _, desc := range manifest.References() {
+		if err := fms.fetchMissing(ctx, manifest, desc); err != nil {
+			// leave verification of the reference to the local store
+			dcontext.GetLogger(ctx).Warnf("Unable to fetch %s from remote: %v", desc.Digest, err)
+		}
+	}
+
+	return fms.ManifestService.Put(ctx, manifest, options...)
+}
+
+func (fms *fallbackManifestStore) fetchMissing(ctx context.Context, manifest distribution.Manifest, desc distribution.Descriptor) error {
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		exists, err := fms.proxied.localManifests.Exists(ctx, desc.Digest)
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = fms.proxied.Get(ctx, desc.Digest)
+		return err
+	}
+
+	_, err := fms.blobs.localStore.Stat(ctx, desc.Digest)
+	if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	if err := fms.blobs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+
+	_, err = fms.blobs.fetch(ctx, desc.Digest)
+	return err
+}
+
+// fallbackTagService resolves tags locally, asking the remote only for tags
+// which are unknown locally. Tags are written to the local store.
+type fallbackTagService struct {
+	distribution.TagService
+	proxied *proxyTagService
+}
+
+var _ distribution.TagService = &fallbackTagService{}
+
+func (fts *fallbackTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	desc, err := fts.TagService.Get(ctx, tag)
+	if err == nil {
+		return desc, nil
+	}
+
+	if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		return distribution.Descriptor{}, err
+	}
+
+	return fts.proxied.Get(ctx, tag)
+}
+
+// All returns the union of the local tags and the tags known to the remote.
+func (fts *fallbackTagService) All(ctx context.Context) ([]string, error) {
+	tags, localErr := fts.TagService.All(ctx)
+	if localErr != nil {
+		if _, ok := localErr.(distribution.ErrRepositoryUnknown); !ok {
+			return nil, localErr
+		}
+	}
+
+	if err := fts.proxied.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return tags, localErr
+	}
+
+	remoteTags, err := fts.proxied.remoteTags.All(ctx)
+	if err != nil {
+		return tags, localErr
+	}
+
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		seen[tag] = struct{}{}
+	}
+
+	for _, tag := range remoteTags {
+		if _, ok := seen[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func newFallbackTestRepositories(t *testing.T, name string) (distribution.Repository, distribution.Repository, *fallbackRepository) {
+	ctx := context.Background()
+	nameRef, err := reference.WithName(name)
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+
+	var repos []distribution.Repository
+	for i := 0; i < 2; i++ {
+		registry, err := storage.NewRegistry(ctx, inmemory.New(),
+			storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+
+		repo, err := registry.Repository(ctx, nameRef)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		repos = append(repos, repo)
+	}
+	localRepo, remoteRepo := repos[0], repos[1]
+
+	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &mockChallenger{}
+	return localRepo, remoteRepo, &fallbackRepository{
+		Repository: localRepo,
+		proxied: &proxiedRepository{
+			blobStore: &proxyBlobStore{
+				localStore:     localRepo.Blobs(ctx),
+				remoteStore:    remoteRepo.Blobs(ctx),
+				repositoryName: nameRef,
+				authChallenger: c,
+			},
+			manifests: &proxyManifestStore{
+				ctx:             ctx,
+				localManifests:  localManifests,
+				remoteManifests: remoteManifests,
+				repositoryName:  nameRef,
+				authChallenger:  c,
+			},
+			name: nameRef,
+			tags: &proxyTagService{
+				localTags:      localRepo.Tags(ctx),
+				remoteTags:     remoteRepo.Tags(ctx),
+				authChallenger: c,
+			},
+		},
+	}
+}
+
+func TestFallbackTags(t *testing.T) {
+	ctx := context.Background()
+	localRepo, remoteRepo, repo := newFallbackTestRepositories(t, "foo/bar")
+
+	localDesc := distribution.Descriptor{Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111", Size: 1}
+	remoteDesc := distribution.Descriptor{Digest: "sha256:2222222222222222222222222222222222222222222222222222222222222222", Size: 2}
+
+	if err := remoteRepo.Tags(ctx).Tag(ctx, "shared", remoteDesc); err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteRepo.Tags(ctx).Tag(ctx, "remote", remoteDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := repo.Tags(ctx)
+	if err := tags.Tag(ctx, "shared", localDesc); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+
+	desc, err := tags.Get(ctx, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != localDesc.Digest {
+		t.Fatalf("expected local tag to be preferred, got %s", desc.Digest)
+	}
+
+	desc, err = tags.Get(ctx, "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != remoteDesc.Digest {
+		t.Fatalf("expected remote tag to be resolved, got %s", desc.Digest)
+	}
+
+	// the remote tag is now cached locally
+	if _, err := localRepo.Tags(ctx).Get(ctx, "remote"); err != nil {
+		t.Fatalf("expected remote tag to be stored locally: %v", err)
+	}
+
+	all, err := tags.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0] != "remote" || all[1] != "shared" {
+		t.Fatalf("unexpected tags: %v", all)
+	}
+}
+
+func TestFallbackPushReferencingRemoteContent(t *testing.T) {
+	ctx := context.Background()
+	localRepo, remoteRepo, repo := newFallbackTestRepositories(t, "foo/bar")
+
+	layer, err := remoteRepo.Blobs(ctx).Put(ctx, schema2.MediaTypeLayer, []byte("remote layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := repo.Blobs(ctx)
+	if _, err := blobs.Stat(ctx, layer.Digest); err != nil {
+		t.Fatalf("expected remote blob to be visible: %v", err)
+	}
+
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		t.Fatalf("expected blob uploads to be supported: %v", err)
+	}
+	if err := bw.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := schema2.NewManifestBuilder(blobs, schema2.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`))
+	if err := builder.AppendReference(layer); err != nil {
+		t.Fatal(err)
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+
+	if _, err := localRepo.Blobs(ctx).Stat(ctx, layer.Digest); err != nil {
+		t.Fatalf("expected remote layer to be stored locally: %v", err)
+	}
+
+	exists, err := manifests.Exists(ctx, dgst)
+	if err != nil || !exists {
+		t.Fatalf("expected manifest to exist: %v", err)
+	}
+}
+
+func TestFallbackFetchWaitsForInflight(t *testing.T) {
+	ctx := context.Background()
+	localRepo, remoteRepo, repo := newFallbackTestRepositories(t, "foo/bar")
+
+	layer, err := remoteRepo.Blobs(ctx).Put(ctx, schema2.MediaTypeLayer, []byte("remote layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a concurrent pull is storing the blob
+	done := make(chan struct{})
+	mu.Lock()
+	inflight[layer.Digest] = done
+	mu.Unlock()
+
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := repo.proxied.blobStore.(*proxyBlobStore).fetch(ctx, layer.Digest)
+		fetched <- err
+	}()
+
+	select {
+	case err := <-fetched:
+		t.Fatalf("expected fetch to wait for the inflight pull, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	if inflight[layer.Digest] != done {
+		t.Fatalf("expected the inflight pull to remain registered")
+	}
+	delete(inflight, layer.Digest)
+	close(done)
+	mu.Unlock()
+
+	// the pull did not store the blob in this repository, so fetch does
+	if err := <-fetched; err != nil {
+		t.Fatalf("unexpected error fetching: %v", err)
+	}
+	if _, err := localRepo.Blobs(ctx).Stat(ctx, layer.Digest); err != nil {
+		t.Fatalf("expected remote layer to be stored locally: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := inflight[layer.Digest]; ok {
+		t.Fatalf("expected the fetch to be unregistered")
+	}
+}
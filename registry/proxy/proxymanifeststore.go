@@ -11,7 +11,8 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
-// todo(richardscothern): from cache control header or config
+// repositoryTTL is the default duration cached content is kept for.
+// todo(richardscothern): from cache control header
 const repositoryTTL = time.Duration(24 * 7 * time.Hour)
 
 type proxyManifestStore struct {
@@ -20,7 +21,9 @@ type proxyManifestStore struct {
 	remoteManifests distribution.ManifestService
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
+	ttl             time.Duration
 	authChallenger  authChallenger
+	requests        *requestGroup
 }
 
 var _ distribution.ManifestService = &proxyManifestStore{}
@@ -45,11 +48,7 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 	var fromRemote bool
 	manifest, err := pms.localManifests.Get(ctx, dgst, options...)
 	if err != nil {
-		if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
-			return nil, err
-		}
-
-		manifest, err = pms.remoteManifests.Get(ctx, dgst, options...)
+		manifest, err = pms.getRemote(ctx, dgst, options...)
 		if err != nil {
 			return nil, err
 		}
@@ -62,14 +61,59 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 	}
 
 	proxyMetrics.ManifestPush(uint64(len(payload)))
-	if fromRemote {
+	if !fromRemote && pms.scheduler != nil {
+		if repoManifest, err := reference.WithDigest(pms.repositoryName, dgst); err == nil {
+			pms.scheduler.Touch(repoManifest)
+		}
+	}
+
+	return manifest, err
+}
+
+// getRemote fetches the manifest from the remote and caches it locally.
+// Concurrent fetches of the same manifest are coalesced into one request.
+func (pms proxyManifestStore) getRemote(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	key := pms.repositoryName.Name() + "@" + dgst.String()
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			key += ":" + opt.Tag
+		}
+	}
+
+	v, err := pms.requests.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+			return nil, err
+		}
+
+		manifest, err := pms.remoteManifests.Get(ctx, dgst, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		_, payload, err := manifest.Payload()
+		if err != nil {
+			return nil, err
+		}
+
 		proxyMetrics.ManifestPull(uint64(len(payload)))
 
+		if pms.scheduler != nil {
+			if maxSize := pms.scheduler.MaxSize(); maxSize > 0 && int64(len(payload)) > maxSize {
+				// the manifest cannot be scheduled for removal, so it is
+				// not cached
+				return manifest, nil
+			}
+		}
+
 		_, err = pms.localManifests.Put(ctx, manifest)
 		if err != nil {
 			return nil, err
 		}
 
+		if pms.scheduler == nil {
+			return manifest, nil
+		}
+
 		// Schedule the manifest blob for removal
 		repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
 		if err != nil {
@@ -77,13 +121,17 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 			return nil, err
 		}
 
-		pms.scheduler.AddManifest(repoBlob, repositoryTTL)
+		pms.scheduler.AddManifest(repoBlob, pms.ttl, int64(len(payload)))
 		// Ensure the manifest blob is cleaned up
 		//pms.scheduler.AddBlob(blobRef, repositoryTTL)
 
+		return manifest, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return manifest, err
+	return v.(distribution.Manifest), nil
 }
 
 func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
@@ -13,6 +13,7 @@ type Metrics struct {
 	Misses      uint64
 	BytesPulled uint64
 	BytesPushed uint64
+	StaleServes uint64
 }
 
 type proxyMetricsCollector struct {
@@ -46,6 +47,12 @@ func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPushed, bytesPushed)
 }
 
+// ManifestStale tracks tags resolved from the cache while the remote is
+// unreachable
+func (pmc *proxyMetricsCollector) ManifestStale() {
+	atomic.AddUint64(&pmc.manifestMetrics.StaleServes, 1)
+}
+
 // proxyMetrics tracks metrics about the proxy cache.  This is
 // kept globally and made available via expvar.
 var proxyMetrics = &proxyMetricsCollector{}
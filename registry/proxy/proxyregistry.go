@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/configuration"
@@ -22,15 +25,41 @@ import (
 
 // proxyingRegistry fetches content from a remote registry and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
+	embedded  distribution.Namespace // provides local registry functionality
+	scheduler *scheduler.TTLExpirationScheduler
+	ttl       time.Duration
+	stale     configuration.ProxyStale
+	remotes   []proxyRemote // ordered by descending prefix length
+	mode      string
+}
+
+// proxyRemote is a remote registry serving the repositories under prefix. An
+// empty prefix matches every repository.
+type proxyRemote struct {
+	prefix         string
 	remoteURL      url.URL
+	dockerHub      bool
 	authChallenger authChallenger
+	transport      http.RoundTripper
+	requests       *requestGroup
+	tags           *tagCache
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
 func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+	mode := config.Mode
+	switch mode {
+	case "":
+		mode = configuration.ProxyModeCache
+	case configuration.ProxyModeCache, configuration.ProxyModeHybrid, configuration.ProxyModeFallback:
+	default:
+		return nil, fmt.Errorf("unknown proxy mode %q", config.Mode)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	remotes, err := configureRemotes(config)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +86,12 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			return err
 		}
 
+		// In hybrid mode the blob may be shared with pushed repositories, so
+		// only its link is removed, leaving the data to garbage collection.
+		if mode == configuration.ProxyModeHybrid {
+			return nil
+		}
+
 		err = v.RemoveBlob(r.Digest().String())
 		if err != nil {
 			return err
@@ -88,26 +123,132 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 		return nil
 	})
 
-	err = s.Start()
+	warmRefs, err := parseWarmReferences(config.Warm.References)
 	if err != nil {
 		return nil, err
 	}
 
-	cs, err := configureAuth(config.Username, config.Password, config.RemoteURL)
+	s.SetMaxSize(config.MaxSize)
+	s.SetSizeFunc(func(ref reference.Canonical) (int64, error) {
+		desc, err := registry.BlobStatter().Stat(ctx, ref.Digest())
+		return desc.Size, err
+	})
+	err = s.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	return &proxyingRegistry{
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = repositoryTTL
+	}
+
+	pr := &proxyingRegistry{
 		embedded:  registry,
 		scheduler: s,
-		remoteURL: *remoteURL,
-		authChallenger: &remoteAuthChallenger{
+		ttl:       ttl,
+		stale:     config.Stale,
+		remotes:   remotes,
+		mode:      mode,
+	}
+
+	if config.Warm.Interval > 0 && len(warmRefs) > 0 {
+		go warmPeriodically(ctx, pr, warmRefs, config.Warm.Interval)
+	}
+
+	return pr, nil
+}
+
+// configureRemotes returns the remotes described by config, ordered so that
+// the most specific prefix is matched first.
+func configureRemotes(config configuration.Proxy) ([]proxyRemote, error) {
+	remoteConfigs := append([]configuration.ProxyRemote(nil), config.Remotes...)
+	if config.RemoteURL != "" {
+		remoteConfigs = append(remoteConfigs, configuration.ProxyRemote{
+			RemoteURL: config.RemoteURL,
+			Username:  config.Username,
+			Password:  config.Password,
+		})
+	}
+
+	seen := make(map[string]struct{})
+	var remotes []proxyRemote
+	for _, rc := range remoteConfigs {
+		prefix := configuration.RepositoryPrefix(rc.Prefix)
+		if _, ok := seen[prefix]; ok {
+			return nil, fmt.Errorf("duplicate proxy remote prefix %q", rc.Prefix)
+		}
+		seen[prefix] = struct{}{}
+
+		if rc.RemoteURL == "" {
+			return nil, fmt.Errorf("proxy remote for prefix %q requires a remoteurl", rc.Prefix)
+		}
+
+		remoteURL, err := url.Parse(rc.RemoteURL)
+		if err != nil {
+			return nil, err
+		}
+
+		cs, err := configureAuth(rc.Username, rc.Password, rc.RemoteURL)
+		if err != nil {
+			return nil, err
+		}
+
+		remotes = append(remotes, proxyRemote{
+			prefix:    prefix,
 			remoteURL: *remoteURL,
-			cm:        challenge.NewSimpleManager(),
-			cs:        cs,
-		},
-	}, nil
+			dockerHub: dockerHubHosts[remoteURL.Host],
+			authChallenger: &remoteAuthChallenger{
+				remoteURL: *remoteURL,
+				cm:        challenge.NewSimpleManager(),
+				cs:        cs,
+			},
+			transport: newLimitedTransport(http.DefaultTransport, config.MaxConcurrentRequests),
+			requests:  newRequestGroup(),
+			tags:      newTagCache(config.TagFreshness),
+		})
+	}
+
+	sort.SliceStable(remotes, func(i, j int) bool {
+		return len(remotes[i].prefix) > len(remotes[j].prefix)
+	})
+
+	return remotes, nil
+}
+
+// dockerHubHosts are the hosts of the Docker Hub registry, which serves the
+// official images under the "library" namespace.
+var dockerHubHosts = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// remote returns the remote serving the named repository and the name of the
+// repository on that remote.
+func (pr *proxyingRegistry) remote(name string) (*proxyRemote, string, bool) {
+	for i := range pr.remotes {
+		r := &pr.remotes[i]
+		if r.prefix == "" {
+			return r, r.remoteName(name), true
+		}
+
+		if strings.HasPrefix(name, r.prefix+"/") {
+			return r, r.remoteName(strings.TrimPrefix(name, r.prefix+"/")), true
+		}
+	}
+
+	return nil, "", false
+}
+
+// remoteName returns the name of a repository on the remote, adding the
+// "library" namespace to the names of the official images of Docker Hub.
+func (r *proxyRemote) remoteName(name string) string {
+	if r.dockerHub && !strings.Contains(name, "/") {
+		return "library/" + name
+	}
+	return name
 }
 
 func (pr *proxyingRegistry) Scope() distribution.Scope {
@@ -119,21 +260,36 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 }
 
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
+	remote, remoteName, ok := pr.remote(name.Name())
+	if !ok {
+		if pr.mode == configuration.ProxyModeCache {
+			return nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+		}
+
+		// repositories not served by a remote are regular local repositories
+		return pr.embedded.Repository(ctx, name)
+	}
+
+	remoteNamed, err := reference.WithName(remoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	c := remote.authChallenger
 
 	tkopts := auth.TokenHandlerOptions{
 		Transport:   http.DefaultTransport,
 		Credentials: c.credentialStore(),
 		Scopes: []auth.Scope{
 			auth.RepositoryScope{
-				Repository: name.Name(),
+				Repository: remoteName,
 				Actions:    []string{"pull"},
 			},
 		},
 		Logger: dcontext.GetLogger(ctx),
 	}
 
-	tr := transport.NewTransport(http.DefaultTransport,
+	tr := transport.NewTransport(remote.transport,
 		auth.NewAuthorizer(c.challengeManager(),
 			auth.NewTokenHandlerWithOptions(tkopts)))
 
@@ -146,7 +302,7 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
+	remoteRepo, err := client.NewRepository(remoteNamed, remote.remoteURL.String(), tr)
 	if err != nil {
 		return nil, err
 	}
@@ -156,29 +312,53 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	return &proxiedRepository{
+	// Content fetched into a fallback repository may be shared with pushed
+	// manifests, so it is never scheduled for expiry.
+	s := pr.scheduler
+	if pr.mode == configuration.ProxyModeFallback {
+		s = nil
+	}
+
+	proxied := &proxiedRepository{
 		blobStore: &proxyBlobStore{
 			localStore:     localRepo.Blobs(ctx),
 			remoteStore:    remoteRepo.Blobs(ctx),
-			scheduler:      pr.scheduler,
+			scheduler:      s,
+			ttl:            pr.ttl,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: remote.authChallenger,
 		},
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
 			localManifests:  localManifests, // Options?
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
-			scheduler:       pr.scheduler,
-			authChallenger:  pr.authChallenger,
+			scheduler:       s,
+			ttl:             pr.ttl,
+			authChallenger:  remote.authChallenger,
+			requests:        remote.requests,
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
 			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			repositoryName: name,
+			authChallenger: remote.authChallenger,
+			requests:       remote.requests,
+			cache:          remote.tags,
+			serveStale:     pr.stale.Enabled,
+			staleTimeout:   pr.stale.Timeout,
 		},
-	}, nil
+	}
+
+	if pr.mode == configuration.ProxyModeFallback {
+		return &fallbackRepository{
+			Repository: localRepo,
+			proxied:    proxied,
+		}, nil
+	}
+
+	return proxied, nil
 }
 
 func (pr *proxyingRegistry) Blobs() distribution.BlobEnumerator {
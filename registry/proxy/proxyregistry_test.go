@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestConfigureRemotes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	remotes, err := configureRemotes(configuration.Proxy{
+		RemoteURL: server.URL,
+		Remotes: []configuration.ProxyRemote{
+			{Prefix: "docker.io", RemoteURL: server.URL},
+			{Prefix: "docker.io/library/*", RemoteURL: server.URL},
+			{Prefix: "quay.io/", RemoteURL: server.URL},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error configuring remotes: %v", err)
+	}
+
+	pr := &proxyingRegistry{remotes: remotes}
+	for _, testcase := range []struct {
+		name       string
+		prefix     string
+		remoteName string
+	}{
+		{"docker.io/library/ubuntu", "docker.io/library", "ubuntu"},
+		{"docker.io/foo/bar", "docker.io", "foo/bar"},
+		{"quay.io/coreos/etcd", "quay.io", "coreos/etcd"},
+		{"quay.iox/coreos/etcd", "", "quay.iox/coreos/etcd"},
+		{"quay.io", "", "quay.io"},
+	} {
+		remote, remoteName, ok := pr.remote(testcase.name)
+		if !ok {
+			t.Fatalf("expected a remote for %s", testcase.name)
+		}
+
+		if remote.prefix != testcase.prefix {
+			t.Errorf("unexpected prefix for %s: %q != %q", testcase.name, remote.prefix, testcase.prefix)
+		}
+
+		if remoteName != testcase.remoteName {
+			t.Errorf("unexpected remote name for %s: %q != %q", testcase.name, remoteName, testcase.remoteName)
+		}
+	}
+
+	// official images of Docker Hub are in the library namespace
+	pr.remotes[0].dockerHub = true
+	pr.remotes[1].dockerHub = true
+	for name, expected := range map[string]string{
+		"docker.io/library/ubuntu": "library/ubuntu",
+		"docker.io/nginx":          "library/nginx",
+		"docker.io/foo/bar":        "foo/bar",
+	} {
+		if _, remoteName, _ := pr.remote(name); remoteName != expected {
+			t.Errorf("unexpected remote name for %s: %q != %q", name, remoteName, expected)
+		}
+	}
+
+	// without a default remote, unmatched repositories have no remote
+	pr.remotes = pr.remotes[:len(pr.remotes)-1]
+	if _, _, ok := pr.remote("ghcr.io/foo/bar"); ok {
+		t.Fatalf("unexpected remote for unmatched repository")
+	}
+}
+
+func TestConfigureRemotesKeepsConfiguration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := configuration.Proxy{
+		RemoteURL: server.URL,
+		Remotes:   make([]configuration.ProxyRemote, 1, 2),
+	}
+	config.Remotes[0] = configuration.ProxyRemote{Prefix: "quay.io", RemoteURL: server.URL}
+
+	if _, err := configureRemotes(config); err != nil {
+		t.Fatalf("unexpected error configuring remotes: %v", err)
+	}
+	if extra := config.Remotes[:2][1]; extra.RemoteURL != "" {
+		t.Fatalf("configuration modified: %#v", extra)
+	}
+}
+
+func TestConfigureRemotesInvalid(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, config := range []configuration.Proxy{
+		{
+			Remotes: []configuration.ProxyRemote{
+				{Prefix: "docker.io", RemoteURL: server.URL},
+				{Prefix: "docker.io/*", RemoteURL: server.URL},
+			},
+		},
+		{
+			RemoteURL: server.URL,
+			Remotes: []configuration.ProxyRemote{
+				{RemoteURL: server.URL},
+			},
+		},
+		{
+			Remotes: []configuration.ProxyRemote{
+				{Prefix: "docker.io"},
+			},
+		},
+	} {
+		if _, err := configureRemotes(config); err == nil {
+			t.Fatalf("expected error configuring remotes %#v", config)
+		}
+	}
+}
+
+func TestUnmatchedRepositoryMode(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	name, err := reference.WithName("local/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &proxyingRegistry{
+		embedded: registry,
+		remotes:  []proxyRemote{{prefix: "docker.io", authChallenger: &mockChallenger{}}},
+		mode:     configuration.ProxyModeCache,
+	}
+
+	if _, err := pr.Repository(ctx, name); err == nil {
+		t.Fatalf("expected unmatched repository to be unknown in cache mode")
+	} else if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, mode := range []string{configuration.ProxyModeHybrid, configuration.ProxyModeFallback} {
+		pr.mode = mode
+		repo, err := pr.Repository(ctx, name)
+		if err != nil {
+			t.Fatalf("unexpected error getting repository in %s mode: %v", mode, err)
+		}
+
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err != nil {
+			t.Fatalf("expected unmatched repository to be pushable in %s mode: %v", mode, err)
+		}
+		bw.Cancel(ctx)
+	}
+}
+
+func TestHybridExpiryKeepsSharedBlobs(t *testing.T) {
+	ctx := context.Background()
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer remote.Close()
+
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	pr, err := NewRegistryPullThroughCache(ctx, registry, driver, configuration.Proxy{
+		Mode:    configuration.ProxyModeHybrid,
+		Remotes: []configuration.ProxyRemote{{Prefix: "docker.io", RemoteURL: remote.URL}},
+	})
+	if err != nil {
+		t.Fatalf("error creating proxy: %v", err)
+	}
+
+	localName, _ := reference.WithName("local/app")
+	proxiedName, _ := reference.WithName("docker.io/library/app")
+	content := []byte("shared layer")
+	var repos []distribution.Repository
+	var desc distribution.Descriptor
+	for _, name := range []reference.Named{localName, proxiedName} {
+		repo, err := registry.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err = repo.Blobs(ctx).Put(ctx, "application/octet-stream", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, repo)
+	}
+
+	ref, err := reference.WithDigest(proxiedName, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.(*proxyingRegistry).scheduler.AddBlob(ref, time.Millisecond, desc.Size)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := repos[1].Blobs(ctx).Stat(ctx, desc.Digest); err == distribution.ErrBlobUnknown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the proxied blob to expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p, err := repos[0].Blobs(ctx).Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("expected the blob of the local repository to remain: %v", err)
+	}
+	if string(p) != string(content) {
+		t.Fatalf("unexpected content of the local blob: %q", p)
+	}
+}
@@ -2,15 +2,36 @@ package proxy
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
 )
 
+// staleWarning is added to responses for tags resolved from the cache while
+// the remote is unreachable.
+const staleWarning = `110 - "Response is Stale"`
+
 // proxyTagService supports local and remote lookup of tags.
 type proxyTagService struct {
 	localTags      distribution.TagService
 	remoteTags     distribution.TagService
+	repositoryName reference.Named
 	authChallenger authChallenger
+
+	// requests coalesces concurrent lookups of a tag and cache remembers
+	// recent remote lookups. Both are shared by repositories of a remote.
+	requests *requestGroup
+	cache    *tagCache
+
+	// serveStale resolves tags from the cache when the remote is
+	// unreachable or does not respond within staleTimeout.
+	serveStale   bool
+	staleTimeout time.Duration
 }
 
 var _ distribution.TagService = proxyTagService{}
@@ -19,30 +40,127 @@ var _ distribution.TagService = proxyTagService{}
 // tag service first and then caching it locally.  If the remote is unavailable
 // the local association is returned
 func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
-	err := pt.authChallenger.tryEstablishChallenges(ctx)
+	if pt.serveStale {
+		return pt.getStale(ctx, tag)
+	}
+
+	desc, err := pt.getRemote(ctx, tag)
 	if err == nil {
-		desc, err := pt.remoteTags.Get(ctx, tag)
-		if err == nil {
-			err := pt.localTags.Tag(ctx, tag, desc)
-			if err != nil {
-				return distribution.Descriptor{}, err
-			}
-			return desc, nil
+		return desc, nil
+	}
+
+	desc, err = pt.localTags.Get(ctx, tag)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// getStale resolves the tag from the remote, falling back to the cached
+// association if the remote is unreachable or too slow to respond. A remote
+// response arriving after the timeout still updates the cache.
+func (pt proxyTagService) getStale(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	type result struct {
+		desc distribution.Descriptor
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		desc, err := pt.getRemote(ctx, tag)
+		ch <- result{desc, err}
+	}()
+
+	var timeout <-chan time.Time
+	if pt.staleTimeout > 0 {
+		timer := time.NewTimer(pt.staleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var remoteErr error
+	select {
+	case r := <-ch:
+		if r.err == nil {
+			return r.desc, nil
 		}
+		remoteErr = r.err
+	case <-timeout:
+		remoteErr = fmt.Errorf("timed out after %s", pt.staleTimeout)
 	}
 
 	desc, err := pt.localTags.Get(ctx, tag)
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
+
+	if remoteUnavailable(remoteErr) {
+		dcontext.GetLogger(ctx).Warnf("Serving cached tag %s, remote unavailable: %v", tag, remoteErr)
+		proxyMetrics.ManifestStale()
+		if w, err := dcontext.GetResponseWriter(ctx); err == nil {
+			w.Header().Add("Warning", staleWarning)
+		}
+	}
+
 	return desc, nil
 }
 
+// getRemote resolves the tag from the remote and caches the association.
+// Concurrent lookups of the same tag are coalesced into one request, and
+// recent lookups are answered without contacting the remote.
+func (pt proxyTagService) getRemote(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	key := pt.cacheKey(tag)
+	if desc, ok := pt.cache.get(key); ok {
+		return desc, nil
+	}
+
+	v, err := pt.requests.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if err := pt.authChallenger.tryEstablishChallenges(ctx); err != nil {
+			return nil, err
+		}
+
+		desc, err := pt.remoteTags.Get(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pt.localTags.Tag(ctx, tag, desc); err != nil {
+			return nil, err
+		}
+
+		pt.cache.add(key, desc)
+		return desc, nil
+	})
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	return v.(distribution.Descriptor), nil
+}
+
+func (pt proxyTagService) cacheKey(tag string) string {
+	if pt.repositoryName == nil {
+		return tag
+	}
+	return pt.repositoryName.Name() + ":" + tag
+}
+
+// remoteUnavailable returns true if err does not come from a response of the
+// remote registry, such as a network error, a timeout or a server error.
+func remoteUnavailable(err error) bool {
+	switch err.(type) {
+	case errcode.Error, errcode.Errors, errcode.ErrorCode, *client.UnexpectedHTTPResponseError, distribution.ErrTagUnknown:
+		return false
+	}
+	return true
+}
+
 func (pt proxyTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
 	return distribution.ErrUnsupported
 }
 
 func (pt proxyTagService) Untag(ctx context.Context, tag string) error {
+	pt.cache.remove(pt.cacheKey(tag))
 	err := pt.localTags.Untag(ctx, tag)
 	if err != nil {
 		return err
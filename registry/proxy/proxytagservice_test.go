@@ -2,12 +2,16 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
 )
 
 type mockTagStore struct {
@@ -180,3 +184,77 @@ func TestGet(t *testing.T) {
 		t.Fatalf("Expected 4 auth challenge calls, got %#v", proxyTags.authChallenger)
 	}
 }
+
+// unavailableTagStore simulates a remote which fails or hangs
+type unavailableTagStore struct {
+	mockTagStore
+	block chan struct{}
+}
+
+func (u *unavailableTagStore) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	if u.block != nil {
+		<-u.block
+	}
+	return distribution.Descriptor{}, errors.New("connection refused")
+}
+
+func TestGetStale(t *testing.T) {
+	localDesc := distribution.Descriptor{Size: 42}
+	proxyTags := testProxyTagService(map[string]distribution.Descriptor{"cached": localDesc}, nil)
+	proxyTags.serveStale = true
+
+	for _, testcase := range []struct {
+		name    string
+		remote  *unavailableTagStore
+		timeout time.Duration
+	}{
+		{name: "failure", remote: &unavailableTagStore{}},
+		{name: "timeout", remote: &unavailableTagStore{block: make(chan struct{})}, timeout: 10 * time.Millisecond},
+	} {
+		proxyTags.remoteTags = testcase.remote
+		proxyTags.staleTimeout = testcase.timeout
+		before := proxyMetrics.manifestMetrics.StaleServes
+
+		ctx, w := dcontext.WithResponseWriter(context.Background(), httptest.NewRecorder())
+		d, err := proxyTags.Get(ctx, "cached")
+		if testcase.remote.block != nil {
+			close(testcase.remote.block)
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", testcase.name, err)
+		}
+
+		if !reflect.DeepEqual(d, localDesc) {
+			t.Fatalf("%s: unexpected descriptor: %v", testcase.name, d)
+		}
+
+		if w.Header().Get("Warning") != staleWarning {
+			t.Fatalf("%s: expected warning header, got %q", testcase.name, w.Header().Get("Warning"))
+		}
+
+		if proxyMetrics.manifestMetrics.StaleServes != before+1 {
+			t.Fatalf("%s: expected stale serve to be counted", testcase.name)
+		}
+
+		if _, err := proxyTags.Get(context.Background(), "uncached"); err == nil {
+			t.Fatalf("%s: expected error for uncached tag", testcase.name)
+		}
+	}
+
+	// a remote which knows the tag is not stale
+	remoteDesc := distribution.Descriptor{Size: 43}
+	proxyTags.remoteTags = &mockTagStore{mapping: map[string]distribution.Descriptor{"cached": remoteDesc}}
+	ctx, w := dcontext.WithResponseWriter(context.Background(), httptest.NewRecorder())
+	d, err := proxyTags.Get(ctx, "cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(d, remoteDesc) {
+		t.Fatalf("unexpected descriptor: %v", d)
+	}
+
+	if w.Header().Get("Warning") != "" {
+		t.Fatalf("unexpected warning header: %q", w.Header().Get("Warning"))
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// limitedTransport bounds the number of concurrent requests to a remote. A
+// request holds its slot until the response body is closed, so streaming
+// blobs count against the limit for as long as they are read.
+type limitedTransport struct {
+	base http.RoundTripper
+	sem  chan struct{}
+}
+
+// newLimitedTransport returns a transport allowing at most limit concurrent
+// requests through base. If limit is not positive, base is returned.
+func newLimitedTransport(base http.RoundTripper, limit int) http.RoundTripper {
+	if limit <= 0 {
+		return base
+	}
+
+	return &limitedTransport{
+		base: base,
+		sem:  make(chan struct{}, limit),
+	}
+}
+
+func (lt *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case lt.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := lt.base.RoundTrip(req)
+	if err != nil {
+		<-lt.sem
+		return nil, err
+	}
+
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: func() { <-lt.sem }}
+	return resp, nil
+}
+
+// releasingReadCloser calls release once when it is closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
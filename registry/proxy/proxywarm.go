@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Warmer is implemented by registries which can fetch content from a remote
+// ahead of the first client request.
+type Warmer interface {
+	// Warm stores the manifest identified by ref locally, along with the
+	// manifests and blobs it references. ref must include a tag or digest.
+	Warm(ctx context.Context, ref reference.Named) error
+}
+
+var _ Warmer = &proxyingRegistry{}
+
+// Warm fetches the manifest identified by ref from its remote and stores it
+// locally, along with the child manifests of a manifest list and every layer
+// and configuration blob.
+func (pr *proxyingRegistry) Warm(ctx context.Context, ref reference.Named) error {
+	repo, err := pr.Repository(ctx, reference.TrimNamed(ref))
+	if err != nil {
+		return err
+	}
+
+	var proxied *proxiedRepository
+	switch r := repo.(type) {
+	case *proxiedRepository:
+		proxied = r
+	case *fallbackRepository:
+		proxied = r.proxied
+	default:
+		return fmt.Errorf("repository %s is not served by a remote", ref.Name())
+	}
+
+	var dgst digest.Digest
+	switch r := ref.(type) {
+	case reference.Canonical:
+		dgst = r.Digest()
+	case reference.Tagged:
+		desc, err := proxied.tags.Get(ctx, r.Tag())
+		if err != nil {
+			return err
+		}
+		dgst = desc.Digest
+	default:
+		return fmt.Errorf("reference %s requires a tag or digest", ref.String())
+	}
+
+	return proxied.warmManifest(ctx, dgst)
+}
+
+// warmManifest stores the manifest and the content it references locally.
+func (pr *proxiedRepository) warmManifest(ctx context.Context, dgst digest.Digest) error {
+	manifest, err := pr.manifests.Get(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	_, isList := manifest.(*manifestlist.DeserializedManifestList)
+	for _, desc := range manifest.References() {
+		if isList {
+			err = pr.warmManifest(ctx, desc.Digest)
+		} else {
+			err = pr.blobStore.(*proxyBlobStore).prefetch(ctx, desc.Digest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// warmPeriodically warms refs every interval until ctx is done, so that the
+// cached content of frequently used tags stays current.
+func warmPeriodically(ctx context.Context, w Warmer, refs []reference.Named, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, ref := range refs {
+			if err := w.Warm(ctx, ref); err != nil {
+				dcontext.GetLogger(ctx).Errorf("Error warming %s: %v", ref, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseWarmReferences parses the references of the warm list, which must
+// each include a tag or digest.
+func parseWarmReferences(refs []string) ([]reference.Named, error) {
+	var named []reference.Named
+	for _, r := range refs {
+		parsed, err := reference.Parse(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid warm reference %q: %v", r, err)
+		}
+
+		ref, ok := parsed.(reference.Named)
+		if !ok {
+			return nil, fmt.Errorf("warm reference %q requires a repository name", r)
+		}
+
+		_, tagged := ref.(reference.Tagged)
+		_, canonical := ref.(reference.Canonical)
+		if !tagged && !canonical {
+			return nil, fmt.Errorf("warm reference %q requires a tag or digest", r)
+		}
+		named = append(named, ref)
+	}
+
+	return named, nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestWarmManifestList(t *testing.T) {
+	ctx := context.Background()
+	localRepo, remoteRepo, repo := newFallbackTestRepositories(t, "foo/bar")
+
+	remoteBlobs := remoteRepo.Blobs(ctx)
+	layer, err := remoteBlobs.Put(ctx, schema2.MediaTypeLayer, []byte("remote layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := schema2.NewManifestBuilder(remoteBlobs, schema2.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`))
+	if err := builder.AppendReference(layer); err != nil {
+		t.Fatal(err)
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childDigest, err := remoteManifests.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, payload, err := m.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{
+		Descriptor: distribution.Descriptor{
+			MediaType: schema2.MediaTypeManifest,
+			Digest:    childDigest,
+			Size:      int64(len(payload)),
+		},
+		Platform: manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest, err := remoteManifests.Put(ctx, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.proxied.warmManifest(ctx, listDigest); err != nil {
+		t.Fatalf("unexpected error warming: %v", err)
+	}
+
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range []digest.Digest{listDigest, childDigest} {
+		exists, err := localManifests.Exists(ctx, dgst)
+		if err != nil || !exists {
+			t.Fatalf("expected manifest %s to be stored locally: %v", dgst, err)
+		}
+	}
+
+	for _, desc := range m.References() {
+		if _, err := localRepo.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+			t.Fatalf("expected blob %s to be stored locally: %v", desc.Digest, err)
+		}
+	}
+
+	// warming content which is already local succeeds without the remote
+	if err := repo.proxied.warmManifest(ctx, listDigest); err != nil {
+		t.Fatalf("unexpected error warming again: %v", err)
+	}
+}
+
+func TestParseWarmReferences(t *testing.T) {
+	refs, err := parseWarmReferences([]string{
+		"docker.io/library/ubuntu:latest",
+		"foo/bar@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(refs) != 2 || refs[0].Name() != "docker.io/library/ubuntu" || refs[1].Name() != "foo/bar" {
+		t.Fatalf("unexpected references: %v", refs)
+	}
+
+	for _, invalid := range []string{"foo/bar", "Foo:latest", ""} {
+		if _, err := parseWarmReferences([]string{invalid}); err == nil {
+			t.Fatalf("expected error parsing %q", invalid)
+		}
+	}
+}
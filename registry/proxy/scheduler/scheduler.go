@@ -1,9 +1,11 @@
 package scheduler
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -24,17 +26,37 @@ const (
 // schedulerEntry represents an entry in the scheduler
 // fields are exported for serialization
 type schedulerEntry struct {
-	Key       string    `json:"Key"`
-	Expiry    time.Time `json:"ExpiryData"`
-	EntryType int       `json:"EntryType"`
+	Key        string    `json:"Key"`
+	Expiry     time.Time `json:"ExpiryData"`
+	EntryType  int       `json:"EntryType"`
+	Size       int64     `json:"Size,omitempty"`
+	LastAccess time.Time `json:"LastAccess,omitempty"`
 
 	timer *time.Timer
 }
 
+// expiration is an entry removed from the scheduler, and the function called
+// for its expiry.
+type expiration struct {
+	entry *schedulerEntry
+	f     expiryFunc
+}
+
+// lruGroup is the set of entries sharing storage, such as the entries of a
+// digest in different repositories. Its size is the largest size of its
+// entries.
+type lruGroup struct {
+	entries map[string]*schedulerEntry
+	size    int64
+	element *list.Element
+}
+
 // New returns a new instance of the scheduler
 func New(ctx context.Context, driver driver.StorageDriver, path string) *TTLExpirationScheduler {
 	return &TTLExpirationScheduler{
 		entries:         make(map[string]*schedulerEntry),
+		groups:          make(map[string]*lruGroup),
+		lru:             list.New(),
 		driver:          driver,
 		pathToStateFile: path,
 		ctx:             ctx,
@@ -51,6 +73,13 @@ type TTLExpirationScheduler struct {
 
 	entries map[string]*schedulerEntry
 
+	// groups holds the entries by shared storage, and lru orders the groups
+	// from the least to the most recently used. totalSize is the sum of the
+	// sizes of the groups.
+	groups    map[string]*lruGroup
+	lru       *list.List
+	totalSize int64
+
 	driver          driver.StorageDriver
 	ctx             context.Context
 	pathToStateFile string
@@ -60,6 +89,14 @@ type TTLExpirationScheduler struct {
 	onBlobExpire     expiryFunc
 	onManifestExpire expiryFunc
 
+	// maxSize is the total size of the scheduled content above which the
+	// least recently used entries are expired early. Zero means unbounded.
+	maxSize int64
+
+	// sizeOf returns the size of content scheduled without a size, such as
+	// in a state written before sizes were recorded.
+	sizeOf func(reference.Canonical) (int64, error)
+
 	indexDirty bool
 	saveTimer  *time.Ticker
 	doneChan   chan struct{}
@@ -81,21 +118,78 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
-// AddBlob schedules a blob cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration) error {
+// SetMaxSize bounds the total size of the scheduled content. When the bound
+// is exceeded, the least recently used content is expired before its TTL.
+// A size of zero disables the bound.
+func (ttles *TTLExpirationScheduler) SetMaxSize(size int64) {
+	ttles.Lock()
+	ttles.maxSize = size
+	var evicted []expiration
+	if !ttles.stopped {
+		evicted = ttles.evict()
+	}
+	ttles.Unlock()
+
+	ttles.expire(evicted)
+}
+
+// MaxSize returns the maximum total size of the scheduled content, or zero
+// if it is unbounded. Content larger than the maximum size cannot be
+// scheduled, so it should not be cached.
+func (ttles *TTLExpirationScheduler) MaxSize() int64 {
 	ttles.Lock()
 	defer ttles.Unlock()
 
+	return ttles.maxSize
+}
+
+// SetSizeFunc sets the function used on Start to find the size of the
+// scheduled content which was written to the state without a size.
+func (ttles *TTLExpirationScheduler) SetSizeFunc(f func(reference.Canonical) (int64, error)) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	ttles.sizeOf = f
+}
+
+// AddBlob schedules a blob cleanup after ttl expires. The size of the blob
+// is accounted against the maximum size of the scheduler.
+func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration, size int64) error {
+	return ttles.schedule(blobRef, ttl, entryTypeBlob, size)
+}
+
+// AddManifest schedules a manifest cleanup after ttl expires. The size of
+// the manifest is accounted against the maximum size of the scheduler.
+func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration, size int64) error {
+	return ttles.schedule(manifestRef, ttl, entryTypeManifest, size)
+}
+
+// schedule adds an entry and evicts the least recently used content if the
+// maximum size is exceeded. The evicted content is expired once the lock is
+// released, so that adding content does not wait for storage.
+func (ttles *TTLExpirationScheduler) schedule(r reference.Canonical, ttl time.Duration, eType int, size int64) error {
+	ttles.Lock()
 	if ttles.stopped {
+		ttles.Unlock()
 		return fmt.Errorf("scheduler not started")
 	}
+	if ttles.maxSize > 0 && size > ttles.maxSize {
+		ttles.Unlock()
+		return fmt.Errorf("%s is larger than the maximum size of the scheduler", r)
+	}
+
+	ttles.add(r, ttl, eType, size)
+	evicted := ttles.evict()
+	ttles.Unlock()
 
-	ttles.add(blobRef, ttl, entryTypeBlob)
+	ttles.expire(evicted)
 	return nil
 }
 
-// AddManifest schedules a manifest cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration) error {
+// Touch records an access to scheduled content, making it less likely to
+// be evicted when the maximum size is exceeded. Unscheduled content is
+// ignored.
+func (ttles *TTLExpirationScheduler) Touch(ref reference.Canonical) error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
@@ -103,32 +197,54 @@ func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(manifestRef, ttl, entryTypeManifest)
+	if entry, ok := ttles.entries[ref.String()]; ok {
+		entry.LastAccess = time.Now()
+		if g, ok := ttles.groups[groupKey(entry)]; ok {
+			ttles.lru.MoveToBack(g.element)
+		}
+		ttles.indexDirty = true
+	}
 	return nil
 }
 
 // Start starts the scheduler
 func (ttles *TTLExpirationScheduler) Start() error {
 	ttles.Lock()
-	defer ttles.Unlock()
 
 	err := ttles.readState()
 	if err != nil {
+		ttles.Unlock()
 		return err
 	}
 
 	if !ttles.stopped {
+		ttles.Unlock()
 		return fmt.Errorf("Scheduler already started")
 	}
 
 	dcontext.GetLogger(ttles.ctx).Infof("Starting cached object TTL expiration scheduler...")
 	ttles.stopped = false
 
-	// Start timer for each deserialized entry
+	// Track each deserialized entry, from the least recently used, and start
+	// its timer
+	entries := make([]*schedulerEntry, 0, len(ttles.entries))
 	for _, entry := range ttles.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastAccess.Before(entries[j].LastAccess)
+	})
+	for _, entry := range entries {
+		if entry.Size == 0 && ttles.sizeOf != nil {
+			ttles.sizeEntry(entry)
+		}
+		ttles.track(entry)
 		entry.timer = ttles.startTimer(entry, entry.Expiry.Sub(time.Now()))
 	}
 
+	// The maximum size may have been lowered since the state was written
+	evicted := ttles.evict()
+
 	// Start a ticker to periodically save the entries index
 
 	go func() {
@@ -155,54 +271,195 @@ func (ttles *TTLExpirationScheduler) Start() error {
 		}
 	}()
 
+	ttles.Unlock()
+	ttles.expire(evicted)
 	return nil
 }
 
-func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, eType int) {
+func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, eType int, size int64) {
+	now := time.Now()
 	entry := &schedulerEntry{
-		Key:       r.String(),
-		Expiry:    time.Now().Add(ttl),
-		EntryType: eType,
+		Key:        r.String(),
+		Expiry:     now.Add(ttl),
+		EntryType:  eType,
+		Size:       size,
+		LastAccess: now,
 	}
 	dcontext.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, entry.Expiry.Sub(time.Now()))
-	if oldEntry, present := ttles.entries[entry.Key]; present && oldEntry.timer != nil {
-		oldEntry.timer.Stop()
+	if oldEntry, present := ttles.entries[entry.Key]; present {
+		if oldEntry.timer != nil {
+			oldEntry.timer.Stop()
+		}
+		ttles.untrack(oldEntry)
 	}
 	ttles.entries[entry.Key] = entry
+	ttles.track(entry)
 	entry.timer = ttles.startTimer(entry, ttl)
 	ttles.indexDirty = true
 }
 
+// sizeEntry sets the size of an entry scheduled without a size.
+func (ttles *TTLExpirationScheduler) sizeEntry(entry *schedulerEntry) {
+	ref, err := reference.Parse(entry.Key)
+	if err != nil {
+		return
+	}
+	canonical, ok := ref.(reference.Canonical)
+	if !ok {
+		return
+	}
+
+	size, err := ttles.sizeOf(canonical)
+	if err != nil {
+		dcontext.GetLogger(ttles.ctx).Warnf("Unable to find the size of scheduler entry %s: %s", entry.Key, err)
+		return
+	}
+	entry.Size = size
+	ttles.indexDirty = true
+}
+
+// groupKey returns the key of the group of entry. Entries for the same
+// digest in different repositories share storage, so they are grouped.
+func groupKey(entry *schedulerEntry) string {
+	if ref, err := reference.Parse(entry.Key); err == nil {
+		if canonical, ok := ref.(reference.Canonical); ok {
+			return fmt.Sprintf("%d@%s", entry.EntryType, canonical.Digest())
+		}
+	}
+	return entry.Key
+}
+
+// track adds entry to its group as the most recently used. The caller must
+// hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) track(entry *schedulerEntry) {
+	key := groupKey(entry)
+	g, ok := ttles.groups[key]
+	if !ok {
+		g = &lruGroup{entries: make(map[string]*schedulerEntry)}
+		g.element = ttles.lru.PushBack(key)
+		ttles.groups[key] = g
+	} else {
+		ttles.lru.MoveToBack(g.element)
+	}
+
+	g.entries[entry.Key] = entry
+	if entry.Size > g.size {
+		ttles.totalSize += entry.Size - g.size
+		g.size = entry.Size
+	}
+}
+
+// untrack removes entry from its group, removing the group once empty. The
+// caller must hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) untrack(entry *schedulerEntry) {
+	key := groupKey(entry)
+	g, ok := ttles.groups[key]
+	if !ok || g.entries[entry.Key] != entry {
+		return
+	}
+
+	delete(g.entries, entry.Key)
+	if len(g.entries) == 0 {
+		ttles.lru.Remove(g.element)
+		delete(ttles.groups, key)
+		ttles.totalSize -= g.size
+		return
+	}
+
+	if entry.Size == g.size {
+		var size int64
+		for _, e := range g.entries {
+			if e.Size > size {
+				size = e.Size
+			}
+		}
+		ttles.totalSize -= g.size - size
+		g.size = size
+	}
+}
+
 func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
 	return time.AfterFunc(ttl, func() {
 		ttles.Lock()
-		defer ttles.Unlock()
+		expired, ok := ttles.remove(entry)
+		ttles.Unlock()
 
-		var f expiryFunc
+		if ok {
+			ttles.expire([]expiration{expired})
+		}
+	})
+}
 
-		switch entry.EntryType {
-		case entryTypeBlob:
-			f = ttles.onBlobExpire
-		case entryTypeManifest:
-			f = ttles.onManifestExpire
-		default:
-			f = func(reference.Reference) error {
-				return fmt.Errorf("scheduler entry type")
-			}
+// remove removes entry from the scheduler and returns its expiration. It
+// returns false if the entry was replaced or evicted while waiting for the
+// lock. The caller must hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) remove(entry *schedulerEntry) (expiration, bool) {
+	if ttles.entries[entry.Key] != entry {
+		return expiration{}, false
+	}
+
+	var f expiryFunc
+
+	switch entry.EntryType {
+	case entryTypeBlob:
+		f = ttles.onBlobExpire
+	case entryTypeManifest:
+		f = ttles.onManifestExpire
+	default:
+		f = func(reference.Reference) error {
+			return fmt.Errorf("scheduler entry type")
 		}
+	}
 
-		ref, err := reference.Parse(entry.Key)
-		if err == nil {
-			if err := f(ref); err != nil {
-				dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
-			}
-		} else {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	ttles.untrack(entry)
+	delete(ttles.entries, entry.Key)
+	ttles.indexDirty = true
+	return expiration{entry: entry, f: f}, true
+}
+
+// expire calls the expiry functions of removed entries. The caller must not
+// hold the scheduler lock, as the expiry functions delete from storage.
+func (ttles *TTLExpirationScheduler) expire(expired []expiration) {
+	for _, e := range expired {
+		ref, err := reference.Parse(e.entry.Key)
+		if err != nil {
 			dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+			continue
 		}
+		if err := e.f(ref); err != nil {
+			dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", e.entry.Key, err)
+		}
+	}
+}
 
-		delete(ttles.entries, entry.Key)
-		ttles.indexDirty = true
-	})
+// evict removes the least recently used content until the total size of the
+// scheduled content is within the maximum size, and returns the removed
+// entries to expire. Entries for the same digest in different repositories
+// share storage, so they are accounted once and evicted together. The caller
+// must hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) evict() []expiration {
+	if ttles.maxSize <= 0 {
+		return nil
+	}
+
+	var evicted []expiration
+	for e := ttles.lru.Front(); e != nil && ttles.totalSize > ttles.maxSize; {
+		next := e.Next()
+		g := ttles.groups[e.Value.(string)]
+		if g.size > 0 {
+			for _, entry := range g.entries {
+				dcontext.GetLogger(ttles.ctx).Infof("Evicting scheduler entry for %s to reduce cache size", entry.Key)
+				if expired, ok := ttles.remove(entry); ok {
+					evicted = append(evicted, expired)
+				}
+			}
+		}
+		e = next
+	}
+	return evicted
 }
 
 // Stop stops the scheduler.
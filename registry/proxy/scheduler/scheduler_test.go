@@ -42,6 +42,10 @@ func TestSchedule(t *testing.T) {
 	var mu sync.Mutex
 	s := New(context.Background(), inmemory.New(), "/ttl")
 	deleteFunc := func(repoName reference.Reference) error {
+		// expiry functions are called concurrently
+		mu.Lock()
+		defer mu.Unlock()
+
 		if len(remainingRepos) == 0 {
 			t.Fatalf("Incorrect expiry count")
 		}
@@ -50,9 +54,7 @@ func TestSchedule(t *testing.T) {
 			t.Fatalf("Trying to remove nonexistent repo: %s", repoName)
 		}
 		t.Log("removing", repoName)
-		mu.Lock()
 		delete(remainingRepos, repoName.String())
-		mu.Unlock()
 
 		return nil
 	}
@@ -62,12 +64,12 @@ func TestSchedule(t *testing.T) {
 		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
 	}
 
-	s.add(ref1, 3*timeUnit, entryTypeBlob)
-	s.add(ref2, 1*timeUnit, entryTypeBlob)
+	s.add(ref1, 3*timeUnit, entryTypeBlob, 0)
+	s.add(ref2, 1*timeUnit, entryTypeBlob, 0)
 
 	func() {
 		s.Lock()
-		s.add(ref3, 1*timeUnit, entryTypeBlob)
+		s.add(ref3, 1*timeUnit, entryTypeBlob, 0)
 		s.Unlock()
 
 	}()
@@ -173,8 +175,8 @@ func TestStopRestore(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	s.add(ref1, 300*timeUnit, entryTypeBlob)
-	s.add(ref2, 100*timeUnit, entryTypeBlob)
+	s.add(ref1, 300*timeUnit, entryTypeBlob, 0)
+	s.add(ref2, 100*timeUnit, entryTypeBlob, 0)
 
 	// Start and stop before all operations complete
 	// state will be written to fs
@@ -209,3 +211,167 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatalf("Scheduler started twice without error")
 	}
 }
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+
+	// the same blob cached in another repository shares storage with ref1
+	ref1Other, err := reference.Parse("otherrepo@" + ref1.(reference.Canonical).Digest().String())
+	if err != nil {
+		t.Fatalf("could not parse reference: %v", err)
+	}
+
+	var mu sync.Mutex
+	var removed []string
+	deleteFunc := func(r reference.Reference) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, r.String())
+		return nil
+	}
+
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(deleteFunc)
+	s.SetMaxSize(250)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(ref1.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(ref1Other.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.AddBlob(ref2.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// ref1 is now the most recently used
+	if err := s.Touch(ref1.(reference.Canonical)); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if len(removed) != 0 {
+		t.Fatalf("unexpected eviction within max size: %v", removed)
+	}
+	mu.Unlock()
+
+	if err := s.AddBlob(ref3.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(removed) != 1 || removed[0] != ref2.String() {
+		t.Fatalf("expected only %s to be evicted, got %v", ref2, removed)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[ref2.String()]; ok {
+		t.Fatalf("evicted entry still scheduled")
+	}
+	if len(s.entries) != 3 {
+		t.Fatalf("unexpected number of entries: %d", len(s.entries))
+	}
+}
+
+func TestEvictOutsideLock(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+
+	s := New(context.Background(), inmemory.New(), "/ttl")
+	var removed []string
+	s.OnBlobExpire(func(r reference.Reference) error {
+		// the expiry function may use the scheduler
+		if err := s.Touch(ref2.(reference.Canonical)); err != nil {
+			t.Error(err)
+		}
+		removed = append(removed, r.String())
+		return nil
+	})
+	s.SetMaxSize(150)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(ref1.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// content larger than the maximum size is not scheduled
+	if err := s.AddBlob(ref3.(reference.Canonical), time.Hour, 200); err == nil {
+		t.Fatalf("expected error scheduling content larger than the maximum size")
+	}
+	if len(removed) != 0 {
+		t.Fatalf("unexpected eviction: %v", removed)
+	}
+
+	if err := s.AddBlob(ref2.(reference.Canonical), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != ref1.String() {
+		t.Fatalf("expected only %s to be evicted, got %v", ref1, removed)
+	}
+}
+
+func TestEvictRestoredWithoutSize(t *testing.T) {
+	ref1, ref2, _ := testRefs(t)
+
+	serialized, err := json.Marshal(&map[string]schedulerEntry{
+		ref1.String(): {
+			Expiry:    time.Now().Add(time.Hour),
+			Key:       ref1.String(),
+			EntryType: entryTypeBlob,
+		},
+		ref2.String(): {
+			Expiry:    time.Now().Add(time.Hour),
+			Key:       ref2.String(),
+			EntryType: entryTypeBlob,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error serializing test data: %s", err.Error())
+	}
+
+	ctx := context.Background()
+	fs := inmemory.New()
+	if err := fs.PutContent(ctx, "/ttl", serialized); err != nil {
+		t.Fatal("Unable to write serialized data to fs")
+	}
+
+	var mu sync.Mutex
+	var removed []string
+	s := New(ctx, fs, "/ttl")
+	s.OnBlobExpire(func(r reference.Reference) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, r.String())
+		return nil
+	})
+	s.SetSizeFunc(func(reference.Canonical) (int64, error) {
+		return 100, nil
+	})
+	s.SetMaxSize(150)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(removed) != 1 {
+		t.Fatalf("expected one restored entry to be evicted, got %v", removed)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) != 1 || s.totalSize != 100 {
+		t.Fatalf("unexpected entries after eviction: %d entries of %d bytes", len(s.entries), s.totalSize)
+	}
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/spf13/cobra"
+)
+
+var purgeUploadsOlderThan time.Duration
+var purgeUploadsDryRun bool
+var purgeUploadsRepository string
+
+func init() {
+	RootCmd.AddCommand(PurgeUploadsCmd)
+	PurgeUploadsCmd.Flags().DurationVarP(&purgeUploadsOlderThan, "older-than", "o", 168*time.Hour, "remove the uploads started longer ago than this")
+	PurgeUploadsCmd.Flags().BoolVarP(&purgeUploadsDryRun, "dry-run", "d", false, "list the uploads which would be removed without removing them")
+	PurgeUploadsCmd.Flags().StringVarP(&purgeUploadsRepository, "repository", "r", "", "only remove the uploads of this repository")
+}
+
+type purgeUploadsResult struct {
+	OlderThan time.Time               `json:"olderThan"`
+	DryRun    bool                    `json:"dryRun"`
+	Uploads   []storage.UploadSession `json:"uploads"`
+}
+
+// PurgeUploadsCmd is the cobra command that corresponds to the purge-uploads
+// subcommand
+var PurgeUploadsCmd = &cobra.Command{
+	Use:   "purge-uploads <config>",
+	Short: "`purge-uploads` removes abandoned blob uploads",
+	Long:  "`purge-uploads` removes the blob uploads started before the given age, printing them as JSON",
+	Run: func(cmd *cobra.Command, args []string) {
+		if purgeUploadsOlderThan < 0 {
+			fmt.Fprintln(os.Stderr, "--older-than must not be negative")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		withStorageRegistry(cmd, args, func(ctx context.Context, registry distribution.Namespace) error {
+			return purgeUploads(ctx, registry, os.Stdout)
+		})
+	},
+}
+
+// purgeUploads removes the uploads selected by the flags of PurgeUploadsCmd
+// from registry, and prints them to out.
+func purgeUploads(ctx context.Context, registry distribution.Namespace, out io.Writer) error {
+	result := purgeUploadsResult{
+		OlderThan: time.Now().Add(-purgeUploadsOlderThan).UTC().Truncate(time.Second),
+		DryRun:    purgeUploadsDryRun,
+		Uploads:   []storage.UploadSession{},
+	}
+
+	// The uploads removed before a failure are printed too.
+	purged, purgeErr := storage.PurgeUploadSessions(ctx, registry, purgeUploadsRepository, result.OlderThan, purgeUploadsDryRun)
+	result.Uploads = append(result.Uploads, purged...)
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return err
+	}
+	if purgeErr != nil {
+		return fmt.Errorf("failed to purge uploads: %v", purgeErr)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/uuid"
+)
+
+// TestPurgeUploadsCmd checks that the flags of the purge-uploads command
+// select the uploads it removes.
+func TestPurgeUploadsCmd(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	uploads := map[string]struct {
+		repository string
+		startedAt  time.Time
+	}{
+		"old":       {"foo/bar", now.Add(-10 * 24 * time.Hour)},
+		"recent":    {"foo/bar", now.Add(-time.Hour)},
+		"other-old": {"baz", now.Add(-10 * 24 * time.Hour)},
+	}
+
+	defer func() {
+		purgeUploadsOlderThan, purgeUploadsDryRun, purgeUploadsRepository = 168*time.Hour, false, ""
+	}()
+	for _, tc := range []struct {
+		args    []string
+		removed []string
+		dryRun  bool
+	}{
+		{args: []string{}, removed: []string{"old", "other-old"}},
+		{args: []string{"--older-than=30m"}, removed: []string{"old", "other-old", "recent"}},
+		{args: []string{"--repository=foo/bar"}, removed: []string{"old"}},
+		{args: []string{"-o", "30m", "-r", "baz"}, removed: []string{"other-old"}},
+		{args: []string{"--dry-run"}, removed: []string{"old", "other-old"}, dryRun: true},
+	} {
+		d := inmemory.New()
+		registry, err := storage.NewRegistry(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := make(map[string]string)
+		for name, upload := range uploads {
+			id := uuid.Generate().String()
+			ids[id] = name
+			dir := path.Join("/docker/registry/v2/repositories", upload.repository, "_uploads", id)
+			if err := d.PutContent(ctx, path.Join(dir, "data"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.PutContent(ctx, path.Join(dir, "startedat"), []byte(upload.startedAt.UTC().Format(time.RFC3339))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		purgeUploadsOlderThan, purgeUploadsDryRun, purgeUploadsRepository = 168*time.Hour, false, ""
+		if err := PurgeUploadsCmd.ParseFlags(tc.args); err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+
+		var out bytes.Buffer
+		if err := purgeUploads(ctx, registry, &out); err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		var result purgeUploadsResult
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			t.Fatalf("%v: unexpected output %q: %v", tc.args, out.String(), err)
+		}
+		if result.DryRun != tc.dryRun {
+			t.Fatalf("%v: unexpected dry run %v", tc.args, result.DryRun)
+		}
+		var removed []string
+		for _, upload := range result.Uploads {
+			removed = append(removed, ids[upload.ID])
+		}
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, tc.removed) {
+			t.Fatalf("%v: unexpected uploads removed: %v", tc.args, removed)
+		}
+
+		remaining, err := storage.ListUploads(ctx, registry, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := len(uploads) - len(tc.removed)
+		if tc.dryRun {
+			expected = len(uploads)
+		}
+		if len(remaining) != expected {
+			t.Fatalf("%v: unexpected uploads remaining: %v", tc.args, remaining)
+		}
+		for _, upload := range remaining {
+			for _, name := range tc.removed {
+				if ids[upload.ID] == name && !tc.dryRun {
+					t.Fatalf("%v: upload %s was not removed", tc.args, name)
+				}
+			}
+		}
+	}
+}
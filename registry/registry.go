@@ -59,6 +59,17 @@ var ServeCmd = &cobra.Command{
 			log.Fatalln(err)
 		}
 
+		if config.HTTP.Admin.Addr != "" {
+			mux := http.NewServeMux()
+			registry.app.RegisterAdminHandlers(mux)
+			go func(addr string) {
+				log.Infof("admin server listening %v", addr)
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					log.Fatalf("error listening on admin interface: %v", err)
+				}
+			}(config.HTTP.Admin.Addr)
+		}
+
 		if config.HTTP.Debug.Prometheus.Enabled {
 			path := config.HTTP.Debug.Prometheus.Path
 			if path == "" {
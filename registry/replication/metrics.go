@@ -0,0 +1,40 @@
+package replication
+
+import (
+	"expvar"
+	"sync"
+)
+
+// replicators is the global registry of replicators reporting their status
+// to expvar.
+var replicators struct {
+	registered []*Replicator
+	mu         sync.Mutex
+}
+
+// register places the replicator into expvar so that its status is tracked.
+func register(r *Replicator) {
+	replicators.mu.Lock()
+	defer replicators.mu.Unlock()
+
+	replicators.registered = append(replicators.registered, r)
+}
+
+func init() {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+
+	registry.(*expvar.Map).Set("replication", expvar.Func(func() interface{} {
+		replicators.mu.Lock()
+		defer replicators.mu.Unlock()
+
+		targets := []TargetStatus{}
+		for _, r := range replicators.registered {
+			targets = append(targets, r.Status()...)
+		}
+
+		return targets
+	}))
+}
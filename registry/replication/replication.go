@@ -0,0 +1,272 @@
+// Package replication copies manifests pushed to the registry, along with the
+// blobs they reference, to other registries, and replicates manifest deletes.
+//
+// A Replicator is a notifications.Listener, so it observes the same pushes
+// and deletes as the notification bridge. Each target registry has its own
+// queue, processed in order by a single worker, so that a push and a later
+// delete of the same manifest are applied in the order they happened. Failed
+// replications are retried until they succeed or exhaust their attempts.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultBackoff     = time.Second
+	defaultMaxAttempts = 5
+)
+
+// Replicator replicates pushes and deletes of manifests to a set of target
+// registries.
+type Replicator struct {
+	ctx      context.Context
+	registry distribution.Namespace
+	targets  []*target
+}
+
+var _ notifications.Listener = &Replicator{}
+
+// New returns a Replicator reading content from registry and replicating it
+// to the targets in config. Workers for each target are started immediately
+// and run until Close is called.
+func New(ctx context.Context, registry distribution.Namespace, config configuration.Replication) (*Replicator, error) {
+	r := &Replicator{
+		ctx:      ctx,
+		registry: registry,
+	}
+
+	for _, tc := range config.Targets {
+		if tc.Disabled {
+			dcontext.GetLogger(ctx).Infof("replication target %s disabled, skipping", tc.Name)
+			continue
+		}
+
+		t, err := newTarget(tc)
+		if err != nil {
+			return nil, fmt.Errorf("replication target %s: %v", tc.Name, err)
+		}
+
+		r.targets = append(r.targets, t)
+	}
+
+	for _, t := range r.targets {
+		go t.run(ctx, registry)
+	}
+
+	register(r)
+
+	return r, nil
+}
+
+// Close stops the workers. Pending replications are discarded.
+func (r *Replicator) Close() error {
+	for _, t := range r.targets {
+		t.queue.close()
+	}
+
+	return nil
+}
+
+// Status reports the state of replication to each target.
+func (r *Replicator) Status() []TargetStatus {
+	statuses := make([]TargetStatus, 0, len(r.targets))
+	for _, t := range r.targets {
+		statuses = append(statuses, t.status())
+	}
+
+	return statuses
+}
+
+// ManifestPushed queues replication of the manifest to matching targets.
+func (r *Replicator) ManifestPushed(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error {
+	mt, p, err := sm.Payload()
+	if err != nil {
+		return err
+	}
+
+	_, desc, err := distribution.UnmarshalManifest(mt, p)
+	if err != nil {
+		return err
+	}
+
+	t := task{
+		action:     notifications.EventActionPush,
+		repository: repo,
+		digest:     desc.Digest,
+	}
+
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			t.tag = opt.Tag
+			break
+		}
+	}
+
+	r.enqueue(t)
+	return nil
+}
+
+// ManifestDeleted queues deletion of the manifest from matching targets.
+func (r *Replicator) ManifestDeleted(repo reference.Named, dgst digest.Digest) error {
+	r.enqueue(task{
+		action:     notifications.EventActionDelete,
+		repository: repo,
+		digest:     dgst,
+	})
+	return nil
+}
+
+// ManifestPulled is ignored, pulls are not replicated.
+func (r *Replicator) ManifestPulled(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error {
+	return nil
+}
+
+// BlobPushed is ignored. Blobs are replicated with the manifests referencing
+// them.
+func (r *Replicator) BlobPushed(repo reference.Named, desc distribution.Descriptor) error {
+	return nil
+}
+
+// BlobPulled is ignored, pulls are not replicated.
+func (r *Replicator) BlobPulled(repo reference.Named, desc distribution.Descriptor) error {
+	return nil
+}
+
+// BlobMounted is ignored. Blobs are replicated with the manifests
+// referencing them.
+func (r *Replicator) BlobMounted(repo reference.Named, desc distribution.Descriptor, fromRepo reference.Named) error {
+	return nil
+}
+
+// BlobDeleted is ignored. Blobs are removed from targets by their own
+// garbage collection.
+func (r *Replicator) BlobDeleted(repo reference.Named, desc digest.Digest) error {
+	return nil
+}
+
+func (r *Replicator) enqueue(t task) {
+	for _, target := range r.targets {
+		if target.matches(t.repository.Name()) {
+			target.queue.push(t)
+		}
+	}
+}
+
+// task is a replication of a single manifest push or delete.
+type task struct {
+	action     string
+	repository reference.Named
+	digest     digest.Digest
+	tag        string
+	attempts   int
+}
+
+func (t task) String() string {
+	if t.tag != "" {
+		return fmt.Sprintf("%s %s:%s@%s", t.action, t.repository.Name(), t.tag, t.digest)
+	}
+	return fmt.Sprintf("%s %s@%s", t.action, t.repository.Name(), t.digest)
+}
+
+// taskQueue is an unbounded queue of tasks for a single worker.
+type taskQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tasks  []task
+	closed bool
+}
+
+func newTaskQueue() *taskQueue {
+	q := &taskQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *taskQueue) push(t task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.tasks = append(q.tasks, t)
+	q.cond.Signal()
+}
+
+// next blocks until a task is available and returns it without removing it,
+// so that it remains counted as pending while it is replicated. It returns
+// false once the queue is closed.
+func (q *taskQueue) next() (task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return task{}, false
+	}
+
+	return q.tasks[0], true
+}
+
+// done removes the task returned by next.
+func (q *taskQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.tasks) > 0 {
+		q.tasks = q.tasks[1:]
+	}
+}
+
+// retry replaces the task returned by next, keeping its place in the queue.
+func (q *taskQueue) retry(t task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.tasks) > 0 {
+		q.tasks[0] = t
+	}
+}
+
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.tasks)
+}
+
+func (q *taskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.tasks = nil
+	q.cond.Broadcast()
+}
+
+// matchAny returns true if name matches one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,233 @@
+package replication_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/handlers"
+	"github.com/docker/distribution/registry/replication"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+// newTargetRegistry starts a registry receiving replicated content.
+func newTargetRegistry(t *testing.T) *httptest.Server {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Log.Level = "error"
+
+	return httptest.NewServer(handlers.NewApp(context.Background(), &config))
+}
+
+// pushImage stores an image with a single layer in the local repository.
+func pushImage(t *testing.T, repo distribution.Repository, layer []byte) distribution.Manifest {
+	ctx := context.Background()
+	blobs := repo.Blobs(ctx)
+
+	desc, err := blobs.Put(ctx, schema2.MediaTypeLayer, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := schema2.NewManifestBuilder(blobs, schema2.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`))
+	if err := builder.AppendReference(desc); err != nil {
+		t.Fatal(err)
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifests.Put(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// waitReplicated waits until the target has completed n replications.
+func waitReplicated(t *testing.T, r *replication.Replicator, n uint64) replication.TargetStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := r.Status()[0]
+		if status.Replicated+status.Failed >= n && status.Pending == 0 {
+			if status.Failed > 0 {
+				t.Fatalf("replication failed: %s", status.LastError)
+			}
+			return status
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for replication: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicatePushAndDelete(t *testing.T) {
+	ctx := context.Background()
+	server := newTargetRegistry(t)
+	defer server.Close()
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New(), storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := replication.New(ctx, registry, configuration.Replication{
+		Targets: []configuration.ReplicationTarget{{
+			Name:         "dr",
+			URL:          server.URL,
+			Repositories: []string{"foo/*"},
+			Exclude:      []string{"foo/private"},
+			Backoff:      10 * time.Millisecond,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var pushed []distribution.Manifest
+	for _, name := range []string{"foo/bar", "foo/baz", "foo/private", "other/bar"} {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := pushImage(t, repo, []byte("shared layer"))
+		if err := r.ManifestPushed(named, m, distribution.WithTag("latest")); err != nil {
+			t.Fatal(err)
+		}
+		pushed = append(pushed, m)
+	}
+
+	waitReplicated(t, r, 2)
+
+	for i, name := range []string{"foo/bar", "foo/baz", "foo/private", "other/bar"} {
+		named, _ := reference.WithName(name)
+		remote, err := client.NewRepository(named, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		desc, err := remote.Tags(ctx).Get(ctx, "latest")
+		if i >= 2 {
+			if err == nil {
+				t.Fatalf("unexpected replication of %s", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected %s to be replicated: %v", name, err)
+		}
+
+		for _, ref := range pushed[i].References() {
+			if _, err := remote.Blobs(ctx).Stat(ctx, ref.Digest); err != nil {
+				t.Fatalf("expected blob %s in %s: %v", ref.Digest, name, err)
+			}
+		}
+
+		if name != "foo/bar" {
+			continue
+		}
+
+		if err := r.ManifestDeleted(named, desc.Digest); err != nil {
+			t.Fatal(err)
+		}
+		waitReplicated(t, r, 3)
+
+		manifests, err := remote.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists, err := manifests.Exists(ctx, desc.Digest); err != nil || exists {
+			t.Fatalf("expected manifest to be deleted from the target: %v", err)
+		}
+	}
+}
+
+func TestReplicateRetriesAndFails(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTargetRegistry(t)
+	server.Close()
+
+	r, err := replication.New(ctx, registry, configuration.Replication{
+		Targets: []configuration.ReplicationTarget{{
+			Name:        "unreachable",
+			URL:         server.URL,
+			Backoff:     time.Millisecond,
+			MaxAttempts: 3,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	named, _ := reference.WithName("foo/bar")
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pushImage(t, repo, []byte("layer"))
+	if err := r.ManifestPushed(named, m); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := r.Status()[0]
+		if status.Failed == 1 {
+			if status.Retries != 2 || status.Pending != 0 || status.LastError == "" {
+				t.Fatalf("unexpected status: %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for failure: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewInvalidTarget(t *testing.T) {
+	for _, target := range []configuration.ReplicationTarget{
+		{Name: "nourl"},
+		{Name: "badpattern", URL: "http://localhost", Repositories: []string{"["}},
+	} {
+		if _, err := replication.New(context.Background(), nil, configuration.Replication{
+			Targets: []configuration.ReplicationTarget{target},
+		}); err == nil {
+			t.Fatalf("expected error configuring target %s", target.Name)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxMountSources bounds the number of blobs remembered as mountable on a
+// target.
+const maxMountSources = 10000
+
+// TargetStatus reports the state of replication to a target.
+type TargetStatus struct {
+	Name           string    `json:"name"`
+	URL            string    `json:"url"`
+	Pending        int       `json:"pending"`    // replications waiting in the queue
+	Replicated     uint64    `json:"replicated"` // replications completed
+	Retries        uint64    `json:"retries"`    // failed attempts which were retried
+	Failed         uint64    `json:"failed"`     // replications dropped after exhausting attempts
+	LastReplicated time.Time `json:"lastreplicated,omitempty"`
+	LastError      string    `json:"lasterror,omitempty"`
+	LastErrorTime  time.Time `json:"lasterrortime,omitempty"`
+}
+
+// target is a registry receiving replicated content.
+type target struct {
+	name    string
+	url     string
+	include []string
+	exclude []string
+
+	timeout     time.Duration
+	backoff     time.Duration
+	maxAttempts int
+
+	transport   http.RoundTripper
+	challenges  challenge.Manager
+	credentials auth.CredentialStore
+
+	queue *taskQueue
+
+	mu sync.Mutex
+	// mounts remembers a repository on the target holding each blob
+	// replicated, so that other repositories can mount it.
+	mounts map[digest.Digest]string
+	stats  TargetStatus
+}
+
+func newTarget(config configuration.ReplicationTarget) (*target, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", config.URL)
+	}
+
+	for _, pattern := range append(append([]string{}, config.Repositories...), config.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+
+	var tr http.RoundTripper = http.DefaultTransport
+	tlsTransport, err := notifications.NewTransport(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsTransport != nil {
+		tr = tlsTransport
+	}
+
+	t := &target{
+		name:        config.Name,
+		url:         strings.TrimSuffix(config.URL, "/"),
+		include:     config.Repositories,
+		exclude:     config.Exclude,
+		timeout:     config.Timeout,
+		backoff:     config.Backoff,
+		maxAttempts: config.MaxAttempts,
+		transport:   tr,
+		challenges:  challenge.NewSimpleManager(),
+		credentials: basicCredentials{username: config.Username, password: config.Password},
+		queue:       newTaskQueue(),
+		mounts:      make(map[digest.Digest]string),
+	}
+
+	if t.name == "" {
+		t.name = t.url
+	}
+	if t.backoff <= 0 {
+		t.backoff = defaultBackoff
+	}
+	if t.maxAttempts <= 0 {
+		t.maxAttempts = defaultMaxAttempts
+	}
+
+	t.stats.Name = t.name
+	t.stats.URL = t.url
+
+	return t, nil
+}
+
+// matches returns true if the named repository is replicated to the target.
+func (t *target) matches(name string) bool {
+	if matchAny(t.exclude, name) {
+		return false
+	}
+
+	return len(t.include) == 0 || matchAny(t.include, name)
+}
+
+func (t *target) status() TargetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := t.stats
+	status.Pending = t.queue.len()
+	return status
+}
+
+// run replicates queued tasks until the queue is closed.
+func (t *target) run(ctx context.Context, registry distribution.Namespace) {
+	for {
+		tk, ok := t.queue.next()
+		if !ok {
+			return
+		}
+
+		err := t.attempt(ctx, registry, tk)
+		if err == nil {
+			t.queue.done()
+			t.mu.Lock()
+			t.stats.Replicated++
+			t.stats.LastReplicated = time.Now()
+			t.mu.Unlock()
+			continue
+		}
+
+		tk.attempts++
+		t.mu.Lock()
+		t.stats.LastError = fmt.Sprintf("%s: %v", tk, err)
+		t.stats.LastErrorTime = time.Now()
+		if tk.attempts < t.maxAttempts {
+			t.stats.Retries++
+		} else {
+			t.stats.Failed++
+		}
+		t.mu.Unlock()
+
+		if tk.attempts >= t.maxAttempts {
+			dcontext.GetLogger(ctx).Errorf("replication to %s failed, giving up after %d attempts: %s: %v", t.name, tk.attempts, tk, err)
+			t.queue.done()
+			continue
+		}
+
+		dcontext.GetLogger(ctx).Warnf("replication to %s failed, retrying: %s: %v", t.name, tk, err)
+		t.queue.retry(tk)
+		time.Sleep(t.backoff)
+	}
+}
+
+// attempt performs a single attempt at replicating the task.
+func (t *target) attempt(ctx context.Context, registry distribution.Namespace, tk task) error {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	switch tk.action {
+	case notifications.EventActionPush:
+		return t.push(ctx, registry, tk)
+	case notifications.EventActionDelete:
+		return t.delete(ctx, tk)
+	default:
+		return fmt.Errorf("unknown replication action %q", tk.action)
+	}
+}
+
+// push copies the manifest, the manifests it references and their blobs to
+// the target.
+func (t *target) push(ctx context.Context, registry distribution.Namespace, tk task) error {
+	local, err := registry.Repository(ctx, tk.repository)
+	if err != nil {
+		return err
+	}
+
+	localManifests, err := local.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	var c collection
+	if err := c.collect(ctx, localManifests, tk.digest); err != nil {
+		return err
+	}
+
+	remote, err := t.repository(ctx, tk.repository, t.mountRepositories(tk.repository.Name(), c.blobs))
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range c.blobs {
+		if err := t.pushBlob(ctx, local, remote, desc); err != nil {
+			return err
+		}
+	}
+
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	// referenced manifests are collected first, so that they exist on the
+	// target when the manifest list referencing them is put
+	for i, manifest := range c.manifests {
+		var options []distribution.ManifestServiceOption
+		if i == len(c.manifests)-1 && tk.tag != "" {
+			options = append(options, distribution.WithTag(tk.tag))
+		}
+
+		if _, err := remoteManifests.Put(ctx, manifest, options...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collection holds a manifest, the manifests it references and their blobs.
+type collection struct {
+	manifests []distribution.Manifest
+	blobs     []distribution.Descriptor
+}
+
+// collect adds the manifest to the collection, after the manifests and blobs
+// it references.
+func (c *collection) collect(ctx context.Context, manifests distribution.ManifestService, dgst digest.Digest) error {
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	_, isList := manifest.(*manifestlist.DeserializedManifestList)
+	for _, desc := range manifest.References() {
+		if !isList {
+			c.blobs = append(c.blobs, desc)
+			continue
+		}
+
+		if err := c.collect(ctx, manifests, desc.Digest); err != nil {
+			return err
+		}
+	}
+
+	c.manifests = append(c.manifests, manifest)
+	return nil
+}
+
+// pushBlob copies the blob to the target, unless it already exists there.
+// The blob is mounted from another repository on the target if possible.
+func (t *target) pushBlob(ctx context.Context, local, remote distribution.Repository, desc distribution.Descriptor) error {
+	name := remote.Named().Name()
+	remoteBlobs := remote.Blobs(ctx)
+
+	if _, err := remoteBlobs.Stat(ctx, desc.Digest); err == nil {
+		t.rememberMount(desc.Digest, name)
+		return nil
+	} else if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	var options []distribution.BlobCreateOption
+	if from, ok := t.mountSource(desc.Digest, name); ok {
+		options = append(options, client.WithMountFrom(from))
+	}
+
+	bw, err := remoteBlobs.Create(ctx, options...)
+	if err != nil {
+		if _, ok := err.(distribution.ErrBlobMounted); ok {
+			t.rememberMount(desc.Digest, name)
+			return nil
+		}
+		return err
+	}
+
+	rc, err := local.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		bw.Cancel(ctx)
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := io.Copy(bw, rc); err != nil {
+		bw.Cancel(ctx)
+		return err
+	}
+
+	if _, err := bw.Commit(ctx, desc); err != nil {
+		return err
+	}
+
+	t.rememberMount(desc.Digest, name)
+	return nil
+}
+
+// delete removes the manifest from the target. Manifests which are already
+// unknown to the target are considered deleted.
+func (t *target) delete(ctx context.Context, tk task) error {
+	remote, err := t.repository(ctx, tk.repository, nil)
+	if err != nil {
+		return err
+	}
+
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = remoteManifests.Delete(ctx, tk.digest)
+	if isManifestUnknown(err) {
+		return nil
+	}
+	return err
+}
+
+// repository returns a client for the named repository on the target,
+// authorized to push to it and to pull from the mount repositories.
+func (t *target) repository(ctx context.Context, name reference.Named, mounts []string) (distribution.Repository, error) {
+	if err := t.ping(ctx); err != nil {
+		return nil, err
+	}
+
+	scopes := []auth.Scope{
+		auth.RepositoryScope{
+			Repository: name.Name(),
+			Actions:    []string{"pull", "push"},
+		},
+	}
+	for _, from := range mounts {
+		scopes = append(scopes, auth.RepositoryScope{
+			Repository: from,
+			Actions:    []string{"pull"},
+		})
+	}
+
+	tkopts := auth.TokenHandlerOptions{
+		Transport:   t.transport,
+		Credentials: t.credentials,
+		Scopes:      scopes,
+		Logger:      dcontext.GetLogger(ctx),
+	}
+
+	tr := transport.NewTransport(t.transport,
+		auth.NewAuthorizer(t.challenges,
+			auth.NewTokenHandlerWithOptions(tkopts),
+			auth.NewBasicHandler(t.credentials)))
+
+	return client.NewRepository(name, t.url, tr)
+}
+
+// ping establishes the authentication challenges of the target, if none are
+// known yet.
+func (t *target) ping(ctx context.Context) error {
+	endpoint, err := url.Parse(t.url + "/v2/")
+	if err != nil {
+		return err
+	}
+
+	challenges, err := t.challenges.GetChallenges(*endpoint)
+	if err != nil {
+		return err
+	}
+	if len(challenges) > 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return t.challenges.AddResponse(resp)
+}
+
+// mountSource returns a reference to the blob in another repository on the
+// target, if one is known.
+func (t *target) mountSource(dgst digest.Digest, name string) (reference.Canonical, bool) {
+	t.mu.Lock()
+	from, ok := t.mounts[dgst]
+	t.mu.Unlock()
+
+	if !ok || from == name {
+		return nil, false
+	}
+
+	named, err := reference.WithName(from)
+	if err != nil {
+		return nil, false
+	}
+
+	ref, err := reference.WithDigest(named, dgst)
+	if err != nil {
+		return nil, false
+	}
+
+	return ref, true
+}
+
+// mountRepositories returns the repositories on the target from which the
+// blobs may be mounted into the named repository.
+func (t *target) mountRepositories(name string, blobs []distribution.Descriptor) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	var repos []string
+	for _, desc := range blobs {
+		from, ok := t.mounts[desc.Digest]
+		if !ok || from == name {
+			continue
+		}
+		if _, ok := seen[from]; ok {
+			continue
+		}
+		seen[from] = struct{}{}
+		repos = append(repos, from)
+	}
+
+	return repos
+}
+
+func (t *target) rememberMount(dgst digest.Digest, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.mounts[dgst]; !ok && len(t.mounts) >= maxMountSources {
+		t.mounts = make(map[digest.Digest]string)
+	}
+	t.mounts[dgst] = name
+}
+
+// isManifestUnknown returns true if err reports the manifest is not known to
+// the target.
+func isManifestUnknown(err error) bool {
+	switch err := err.(type) {
+	case errcode.Errors:
+		for _, e := range err {
+			if isManifestUnknown(e) {
+				return true
+			}
+		}
+	case errcode.Error:
+		return err.Code == v2.ErrorCodeManifestUnknown
+	case distribution.ErrManifestUnknownRevision:
+		return true
+	}
+
+	return false
+}
+
+// basicCredentials provides the same username and password to every realm.
+type basicCredentials struct {
+	username string
+	password string
+}
+
+func (c basicCredentials) Basic(*url.URL) (string, string) {
+	return c.username, c.password
+}
+
+func (c basicCredentials) RefreshToken(*url.URL, string) string {
+	return ""
+}
+
+func (c basicCredentials) SetRefreshToken(realm *url.URL, service, token string) {
+}
@@ -1,12 +1,18 @@
 package registry
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
 	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/handlers"
 	"github.com/docker/distribution/registry/storage"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/docker/distribution/registry/storage/metadata"
 	"github.com/docker/distribution/version"
 	"github.com/docker/libtrust"
 	"github.com/spf13/cobra"
@@ -52,12 +58,6 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
-			os.Exit(1)
-		}
-
 		ctx := dcontext.Background()
 		ctx, err = configureLogging(ctx, config)
 		if err != nil {
@@ -65,17 +65,12 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		k, err := libtrust.GenerateECP256PrivateKey()
+		driver, registry, closeRegistry, err := newStorageRegistry(ctx, config)
 		if err != nil {
 			fmt.Fprint(os.Stderr, err)
 			os.Exit(1)
 		}
-
-		registry, err := storage.NewRegistry(ctx, driver, storage.Schema1SigningKey(k))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
-			os.Exit(1)
-		}
+		defer closeRegistry()
 
 		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
 			DryRun:         dryRun,
@@ -87,3 +82,72 @@ var GCCmd = &cobra.Command{
 		}
 	},
 }
+
+// newStorageRegistry constructs the registry of the storage configuration,
+// outside of the app, for the maintenance commands. Its drivers are wrapped
+// with the configured storage middlewares, like those of the app, so that
+// the commands read and write content transformed by them, such as
+// encrypted content. The returned function closes the metadata database, if
+// any.
+func newStorageRegistry(ctx context.Context, config *configuration.Configuration) (driver storagedriver.StorageDriver, registry distribution.Namespace, closeRegistry func(), err error) {
+	closeDB := func() {}
+	defer func() {
+		if err != nil {
+			closeDB()
+		}
+	}()
+
+	driver, err = factory.Create(config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to construct %s driver: %v", config.Storage.Type(), err)
+	}
+
+	database, err := config.Storage.MetadataDatabase()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("configuration error: %v", err)
+	}
+	if database != "" {
+		metadataDriver, err := metadata.New(ctx, driver, database)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to open metadata database: %v", err)
+		}
+		closeDB = func() { metadataDriver.Close() }
+		driver = metadataDriver
+	} else if err := metadata.Invalidate(ctx, driver); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to invalidate the metadata database: %v", err)
+	}
+
+	driver, err = handlers.ApplyStorageMiddleware(driver, config.Middleware["storage"])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	k, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	options := []storage.RegistryOption{storage.Schema1SigningKey(k)}
+
+	routes, err := config.Storage.Routes()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("configuration error: %v", err)
+	}
+	for prefix, routeStorage := range routes {
+		routeDriver, err := factory.Create(routeStorage.Type(), routeStorage.Parameters())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to construct %s driver for %q: %v", routeStorage.Type(), prefix, err)
+		}
+		routeDriver, err = handlers.ApplyStorageMiddleware(routeDriver, config.Middleware["storage"])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		options = append(options, storage.Route(prefix, routeDriver))
+	}
+
+	registry, err = storage.NewRegistry(ctx, driver, options...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to construct registry: %v", err)
+	}
+	return driver, registry, closeDB, nil
+}
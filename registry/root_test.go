@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	_ "github.com/docker/distribution/registry/storage/driver/filesystem"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/encrypt"
+)
+
+// TestStorageRegistryMiddleware checks that the maintenance commands write
+// through the configured storage middlewares.
+func TestStorageRegistryMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte("k"), 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"filesystem": configuration.Parameters{"rootdirectory": root},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{
+				Name: "encrypt",
+				Options: configuration.Parameters{
+					"keys":       map[interface{}]interface{}{"a": keyPath},
+					"currentkey": "a",
+				},
+			}},
+		},
+	}
+
+	ctx := context.Background()
+	driver, _, closeRegistry, err := newStorageRegistry(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRegistry()
+
+	if err := driver.PutContent(ctx, "/link", []byte("plaintext")); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("plaintext")) {
+		t.Fatalf("content written by the maintenance commands is not encrypted")
+	}
+}
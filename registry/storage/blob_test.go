@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"reflect"
@@ -15,6 +16,8 @@ import (
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
 	"github.com/docker/distribution/registry/storage/driver/testdriver"
 	"github.com/docker/distribution/testutil"
 	"github.com/opencontainers/go-digest"
@@ -533,6 +536,84 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestBlobUploadChunks writes the chunks of a blob out of order, with drivers
+// concatenating them natively or not.
+func TestBlobUploadChunks(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	content := make([]byte, 3000)
+	rand.Read(content)
+	dgst := digest.FromBytes(content)
+
+	for _, d := range []driver.StorageDriver{inmemory.New(), testdriver.New()} {
+		registry, err := NewRegistry(ctx, d, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+		repository, err := registry.Repository(ctx, imageName)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		bs := repository.Blobs(ctx)
+
+		resume := func(id string) distribution.ChunkedBlobWriter {
+			wr, err := bs.Resume(ctx, id)
+			if err != nil {
+				t.Fatalf("unexpected error resuming upload: %v", err)
+			}
+			return wr.(distribution.ChunkedBlobWriter)
+		}
+
+		wr, err := bs.Create(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error starting upload: %v", err)
+		}
+		if _, err := wr.Write(content[:1000]); err != nil {
+			t.Fatalf("unexpected error writing in order: %v", err)
+		}
+		wr.Close()
+
+		for _, offset := range []int64{2000, 1000} {
+			cw := resume(wr.ID())
+			if n, err := cw.WriteChunk(ctx, offset, bytes.NewReader(content[offset:offset+1000])); err != nil || n != 1000 {
+				t.Fatalf("unexpected error writing chunk at %d: %d, %v", offset, n, err)
+			}
+			cw.Close()
+		}
+
+		cw := resume(wr.ID())
+		if _, err := cw.WriteChunk(ctx, 500, bytes.NewReader(content[500:1500])); err == nil {
+			t.Fatalf("expected chunk overlapping the data written in order to be rejected")
+		}
+		if chunked, err := cw.Chunked(ctx); err != nil || !chunked {
+			t.Fatalf("expected upload to be chunked: %v", err)
+		}
+
+		desc, err := cw.Commit(ctx, distribution.Descriptor{Digest: dgst})
+		if err != nil {
+			t.Fatalf("unexpected error committing chunks: %v", err)
+		}
+		if desc.Digest != dgst || desc.Size != int64(len(content)) {
+			t.Fatalf("unexpected descriptor %v", desc)
+		}
+		if p, err := bs.Get(ctx, dgst); err != nil || !bytes.Equal(p, content) {
+			t.Fatalf("assembled blob does not match its chunks: %v", err)
+		}
+
+		// chunks leaving a gap cannot be committed
+		wr, err = bs.Create(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error starting upload: %v", err)
+		}
+		if _, err := wr.(distribution.ChunkedBlobWriter).WriteChunk(ctx, 1000, bytes.NewReader(content[1000:2000])); err != nil {
+			t.Fatalf("unexpected error writing chunk: %v", err)
+		}
+		if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst}); err != distribution.ErrBlobInvalidLength {
+			t.Fatalf("expected chunks leaving a gap to be rejected, got %v", err)
+		}
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
@@ -612,3 +693,45 @@ func addBlob(ctx context.Context, bs distribution.BlobIngester, desc distributio
 
 	return wr.Commit(ctx, desc)
 }
+
+// TestBlobDescriptorCacheMetrics checks that a lookup is counted once, even
+// when it misses the repository cache and falls through to the registry one.
+func TestBlobDescriptorCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := inmemory.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	desc, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("content"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	// a registry with empty caches
+	registry, err = NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err = registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	before := blobStatterCacheMetrics.Metrics()
+	if _, err := repository.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error stating blob: %v", err)
+	}
+	after := blobStatterCacheMetrics.Metrics()
+	if requests := after.Requests - before.Requests; requests != 1 {
+		t.Fatalf("expected a single cache request, got %d", requests)
+	}
+	if misses := after.Misses - before.Misses; misses != 1 {
+		t.Fatalf("expected a single cache miss, got %d", misses)
+	}
+}
@@ -23,6 +23,10 @@ func (bsc *blobStatCollector) Miss() {
 	atomic.AddUint64(&bsc.metrics.Misses, 1)
 }
 
+func (bsc *blobStatCollector) Evict() {
+	atomic.AddUint64(&bsc.metrics.Evictions, 1)
+}
+
 func (bsc *blobStatCollector) Metrics() cache.Metrics {
 	return bsc.metrics
 }
@@ -35,7 +39,18 @@ func (bsc *blobStatCollector) Logger(ctx context.Context) cache.Logger {
 // cache requests. Note this is kept globally and made available via expvar.
 // For more detailed metrics, its recommend to instrument a particular cache
 // implementation.
-var blobStatterCacheMetrics cache.MetricsTracker = &blobStatCollector{}
+var blobStatterCacheMetrics cache.MetricsTracker = &blobStatCollectorMetrics
+
+// blobStatCollectorMetrics is a global variable, so that its counters are
+// 64-bit aligned for atomic access on 32-bit platforms.
+var blobStatCollectorMetrics blobStatCollector
+
+// BlobDescriptorCacheMetrics returns the tracker of the blob descriptor cache
+// metrics. It implements cache.EvictionTracker, so that cache implementations
+// can report evictions to it.
+func BlobDescriptorCacheMetrics() cache.MetricsTracker {
+	return blobStatterCacheMetrics
+}
 
 func init() {
 	registry := expvar.Get("registry")
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/docker/distribution"
@@ -43,7 +45,7 @@ type blobWriter struct {
 	committed              bool
 }
 
-var _ distribution.BlobWriter = &blobWriter{}
+var _ distribution.ChunkedBlobWriter = &blobWriter{}
 
 // ID returns the identifier for this upload.
 func (bw *blobWriter) ID() string {
@@ -66,6 +68,12 @@ func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor)
 	bw.Close()
 	desc.Size = bw.Size()
 
+	if chunked, size, err := bw.assembleChunks(ctx); err != nil {
+		return distribution.Descriptor{}, err
+	} else if chunked {
+		desc.Size = size
+	}
+
 	canonical, err := bw.validateBlob(ctx, desc)
 	if err != nil {
 		return distribution.Descriptor{}, err
@@ -151,6 +159,133 @@ func (bw *blobWriter) Close() error {
 	return bw.fileWriter.Close()
 }
 
+// WriteChunk writes the chunk of the blob starting at offset to a file of its
+// own, which is assembled with the data written in order on Commit.
+func (bw *blobWriter) WriteChunk(ctx context.Context, offset int64, r io.Reader) (int64, error) {
+	if size := bw.Size(); offset < size {
+		return 0, fmt.Errorf("chunk offset %d is before the end of the data written at %d", offset, size)
+	}
+
+	chunkPath, err := pathFor(uploadChunkPathSpec{
+		name:   bw.blobStore.repository.Named().Name(),
+		id:     bw.id,
+		offset: offset,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fw, err := bw.driver.Writer(ctx, chunkPath, false)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(fw, r)
+	if err != nil {
+		fw.Cancel()
+		return n, err
+	}
+	if err := fw.Commit(); err != nil {
+		fw.Cancel()
+		return n, err
+	}
+	return n, fw.Close()
+}
+
+// Chunked returns true if chunks have been written out of order.
+func (bw *blobWriter) Chunked(ctx context.Context) (bool, error) {
+	chunks, err := bw.chunks(ctx)
+	return len(chunks) > 0, err
+}
+
+// chunks returns the chunks written out of order, sorted by offset.
+func (bw *blobWriter) chunks(ctx context.Context) ([]chunk, error) {
+	chunksPath, err := pathFor(uploadChunkPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+		list: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []chunk
+	err = bw.driver.Walk(ctx, chunksPath, func(fileInfo storagedriver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+		offset, err := strconv.ParseInt(path.Base(fileInfo.Path()), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid chunk %s: %v", fileInfo.Path(), err)
+		}
+		chunks = append(chunks, chunk{path: fileInfo.Path(), offset: offset, size: fileInfo.Size()})
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].offset < chunks[j].offset
+	})
+	return chunks, nil
+}
+
+type chunk struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// assembleChunks concatenates the data written in order and the chunks
+// written out of order into a single file, which becomes the data of the
+// upload, and returns its size. The data is then validated by hashing it
+// entirely, the resumable digest only covering the data written in order.
+// It returns false if no chunk was written.
+func (bw *blobWriter) assembleChunks(ctx context.Context) (bool, int64, error) {
+	chunks, err := bw.chunks(ctx)
+	if err != nil || len(chunks) == 0 {
+		return false, 0, err
+	}
+
+	var size int64
+	var sourcePaths []string
+	if fi, err := bw.driver.Stat(ctx, bw.path); err == nil {
+		size = fi.Size()
+		sourcePaths = append(sourcePaths, bw.path)
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		return false, 0, err
+	}
+
+	for _, c := range chunks {
+		if c.offset != size {
+			dcontext.GetLogger(ctx).Errorf("chunk of upload %s at %d does not start at the end of the data at %d", bw.id, c.offset, size)
+			return false, 0, distribution.ErrBlobInvalidLength
+		}
+		size += c.size
+		sourcePaths = append(sourcePaths, c.path)
+	}
+
+	assembledPath, err := pathFor(uploadAssembledPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	if err := storagedriver.Concat(ctx, bw.driver, assembledPath, sourcePaths); err != nil {
+		return false, 0, err
+	}
+
+	bw.path = assembledPath
+	bw.resumableDigestEnabled = false
+	bw.digester = digest.Canonical.Digester()
+	bw.written = 0
+	return true, size, nil
+}
+
 // validateBlob checks the data against the digest, returning an error if it
 // does not match. The canonical descriptor is returned.
 func (bw *blobWriter) validateBlob(ctx context.Context, desc distribution.Descriptor) (distribution.Descriptor, error) {
@@ -0,0 +1,134 @@
+package cachecheck
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+// CheckMetadataCache takes a metadata cache implementation through a common
+// set of operations. If adding new tests, please add them here so new
+// implementations get the benefit. This should be used for unit tests.
+func CheckMetadataCache(t *testing.T, provider cache.MetadataCacheProvider) {
+	ctx := context.Background()
+
+	checkMetadataCacheTags(ctx, t, provider)
+	checkMetadataCacheManifests(ctx, t, provider)
+}
+
+func checkMetadataCacheTags(ctx context.Context, t *testing.T, provider cache.MetadataCacheProvider) {
+	if _, err := provider.RepositoryScoped(""); err == nil {
+		t.Fatalf("expected an error when asking for invalid repo")
+	}
+
+	mc, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+
+	_, version, err := mc.GetTag(ctx, "latest")
+	if err != cache.ErrNotCached {
+		t.Fatalf("expected tag not to be cached: %v", err)
+	}
+
+	desc := distribution.Descriptor{
+		Digest:    "sha256:abc1111111111111111111111111111111111111111111111111111111111111",
+		Size:      10,
+		MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+	}
+
+	if err := mc.SetTag(ctx, "latest", distribution.Descriptor{}, version); err == nil {
+		t.Fatalf("expected error setting tag to invalid descriptor")
+	}
+
+	if err := mc.SetTag(ctx, "latest", desc, version); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+
+	cached, _, err := mc.GetTag(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error getting tag: %v", err)
+	}
+	if !reflect.DeepEqual(cached, desc) {
+		t.Fatalf("unexpected descriptor: %#v != %#v", cached, desc)
+	}
+
+	// tags are scoped to the repository
+	other, err := provider.RepositoryScoped("foo/other")
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	if _, _, err := other.GetTag(ctx, "latest"); err != cache.ErrNotCached {
+		t.Fatalf("expected tag not to be cached in other repository: %v", err)
+	}
+
+	// a fill which started before an invalidation is dropped
+	if err := mc.InvalidateTag(ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error invalidating tag: %v", err)
+	}
+	_, version, err = mc.GetTag(ctx, "latest")
+	if err != cache.ErrNotCached {
+		t.Fatalf("expected invalidated tag not to be cached: %v", err)
+	}
+	if err := mc.InvalidateTag(ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error invalidating tag: %v", err)
+	}
+	if err := mc.SetTag(ctx, "latest", desc, version); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	if _, _, err := mc.GetTag(ctx, "latest"); err != cache.ErrNotCached {
+		t.Fatalf("expected stale fill to be dropped: %v", err)
+	}
+}
+
+func checkMetadataCacheManifests(ctx context.Context, t *testing.T, provider cache.MetadataCacheProvider) {
+	mc, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+
+	if _, _, _, err := mc.GetManifest(ctx, ""); err != digest.ErrDigestInvalidFormat {
+		t.Fatalf("expected error getting manifest with empty digest: %v", err)
+	}
+
+	payload := []byte(`{"schemaVersion": 2}`)
+	dgst := digest.FromBytes(payload)
+	mediaType := "application/vnd.docker.distribution.manifest.v2+json"
+
+	_, _, version, err := mc.GetManifest(ctx, dgst)
+	if err != cache.ErrNotCached {
+		t.Fatalf("expected manifest not to be cached: %v", err)
+	}
+
+	if err := mc.SetManifest(ctx, dgst, mediaType, payload, version); err != nil {
+		t.Fatalf("unexpected error setting manifest: %v", err)
+	}
+
+	mt, p, _, err := mc.GetManifest(ctx, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	if mt != mediaType || !bytes.Equal(p, payload) {
+		t.Fatalf("unexpected manifest: %s %s", mt, p)
+	}
+
+	if err := mc.InvalidateManifest(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error invalidating manifest: %v", err)
+	}
+	if _, _, _, err := mc.GetManifest(ctx, dgst); err != cache.ErrNotCached {
+		t.Fatalf("expected invalidated manifest not to be cached: %v", err)
+	}
+
+	// a fill with the version from before the invalidation is dropped
+	if err := mc.SetManifest(ctx, dgst, mediaType, payload, version); err != nil {
+		t.Fatalf("unexpected error setting manifest: %v", err)
+	}
+	if _, _, _, err := mc.GetManifest(ctx, dgst); err != cache.ErrNotCached {
+		t.Fatalf("expected stale fill to be dropped: %v", err)
+	}
+}
@@ -10,11 +10,13 @@ import (
 
 // Metrics is used to hold metric counters
 // related to the number of times a cache was
-// hit or missed.
+// hit or missed, and the number of entries
+// it evicted.
 type Metrics struct {
-	Requests uint64
-	Hits     uint64
-	Misses   uint64
+	Requests  uint64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
 }
 
 // Logger can be provided on the MetricsTracker to log errors.
@@ -33,6 +35,12 @@ type MetricsTracker interface {
 	Logger(context.Context) Logger
 }
 
+// EvictionTracker may be implemented by a MetricsTracker
+// to also count the entries evicted by a cache.
+type EvictionTracker interface {
+	Evict()
+}
+
 type cachedBlobStatter struct {
 	cache   distribution.BlobDescriptorService
 	backend distribution.BlobDescriptorService
@@ -63,6 +71,17 @@ func NewCachedBlobStatterWithMetrics(cache distribution.BlobDescriptorService, b
 	}
 }
 
+// NewCachedBlobDescriptorServiceWithMetrics is like
+// NewCachedBlobStatterWithMetrics, but returns a descriptor service which can
+// be stacked like the statters returned by NewCachedBlobStatter.
+func NewCachedBlobDescriptorServiceWithMetrics(cache distribution.BlobDescriptorService, backend distribution.BlobDescriptorService, tracker MetricsTracker) distribution.BlobDescriptorService {
+	return &cachedBlobStatter{
+		cache:   cache,
+		backend: backend,
+		tracker: tracker,
+	}
+}
+
 func (cbds *cachedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	cacheCount.WithValues("Request").Inc(1)
 	desc, err := cbds.cache.Stat(ctx, dgst)
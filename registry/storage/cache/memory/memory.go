@@ -1,8 +1,10 @@
 package memory
 
 import (
+	"container/list"
 	"context"
 	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
@@ -10,18 +12,61 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
+// entryOverhead approximates the memory used by a cache entry in addition to
+// its strings.
+const entryOverhead = 200
+
+// Options bound the in-memory blob descriptor cache. Zero values leave the
+// cache unbounded.
+type Options struct {
+	// MaxEntries is the number of descriptors above which the least
+	// recently used descriptors are evicted.
+	MaxEntries int
+
+	// MaxBytes is the approximate memory used by the descriptors above which
+	// the least recently used descriptors are evicted.
+	MaxBytes int64
+
+	// TTL is how long a descriptor is cached.
+	TTL time.Duration
+
+	// Tracker, if set and implementing cache.EvictionTracker, counts
+	// evicted and expired descriptors.
+	Tracker cache.MetricsTracker
+}
+
+// inMemoryBlobDescriptorCacheProvider keeps the global and repository scoped
+// descriptors in a single least recently used list, so that the bounds apply
+// to all of them.
 type inMemoryBlobDescriptorCacheProvider struct {
-	global       *mapBlobDescriptorCache
-	repositories map[string]*mapBlobDescriptorCache
-	mu           sync.RWMutex
+	options Options
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int64
+	mu      sync.Mutex
+}
+
+type lruEntry struct {
+	key     string
+	desc    distribution.Descriptor
+	size    int64
+	expires time.Time
 }
 
 // NewInMemoryBlobDescriptorCacheProvider returns a new mapped-based cache for
 // storing blob descriptor data.
 func NewInMemoryBlobDescriptorCacheProvider() cache.BlobDescriptorCacheProvider {
+	return NewBoundedInMemoryBlobDescriptorCacheProvider(Options{})
+}
+
+// NewBoundedInMemoryBlobDescriptorCacheProvider returns a new map-based cache
+// for storing blob descriptor data, evicting the least recently used
+// descriptors to stay within options.
+func NewBoundedInMemoryBlobDescriptorCacheProvider(options Options) cache.BlobDescriptorCacheProvider {
 	return &inMemoryBlobDescriptorCacheProvider{
-		global:       newMapBlobDescriptorCache(),
-		repositories: make(map[string]*mapBlobDescriptorCache),
+		options: options,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
 	}
 }
 
@@ -30,22 +75,23 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) RepositoryScoped(repo string)
 		return nil, err
 	}
 
-	imbdcp.mu.RLock()
-	defer imbdcp.mu.RUnlock()
-
 	return &repositoryScopedInMemoryBlobDescriptorCache{
-		repo:       repo,
-		parent:     imbdcp,
-		repository: imbdcp.repositories[repo],
+		repo:   repo,
+		parent: imbdcp,
 	}, nil
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	return imbdcp.global.Stat(ctx, dgst)
+	if err := dgst.Validate(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	return imbdcp.get(dgst.String())
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) Clear(ctx context.Context, dgst digest.Digest) error {
-	return imbdcp.global.Clear(ctx, dgst)
+	imbdcp.remove(dgst.String())
+	return nil
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
@@ -54,126 +100,150 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Con
 
 		if dgst.Algorithm() != desc.Digest.Algorithm() && dgst != desc.Digest {
 			// if the digests differ, set the other canonical mapping
-			if err := imbdcp.global.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			if err := imbdcp.set(desc.Digest, desc.Digest.String(), desc); err != nil {
 				return err
 			}
 		}
 
 		// unknown, just set it
-		return imbdcp.global.SetDescriptor(ctx, dgst, desc)
+		return imbdcp.set(dgst, dgst.String(), desc)
 	}
 
 	// we already know it, do nothing
 	return err
 }
 
-// repositoryScopedInMemoryBlobDescriptorCache provides the request scoped
-// repository cache. Instances are not thread-safe but the delegated
-// operations are.
-type repositoryScopedInMemoryBlobDescriptorCache struct {
-	repo       string
-	parent     *inMemoryBlobDescriptorCacheProvider // allows lazy allocation of repo's map
-	repository *mapBlobDescriptorCache
-}
+// get returns the descriptor cached at key, marking it as recently used.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) get(key string) (distribution.Descriptor, error) {
+	imbdcp.mu.Lock()
+	defer imbdcp.mu.Unlock()
 
-func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	rsimbdcp.parent.mu.Lock()
-	repo := rsimbdcp.repository
-	rsimbdcp.parent.mu.Unlock()
+	element, ok := imbdcp.entries[key]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
 
-	if repo == nil {
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		imbdcp.evict(element)
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
 
-	return repo.Stat(ctx, dgst)
+	imbdcp.lru.MoveToFront(element)
+	return entry.desc, nil
 }
 
-func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
-	rsimbdcp.parent.mu.Lock()
-	repo := rsimbdcp.repository
-	rsimbdcp.parent.mu.Unlock()
-
-	if repo == nil {
-		return distribution.ErrBlobUnknown
+// set caches the descriptor at key, evicting the least recently used
+// descriptors if the cache exceeds its bounds.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) set(dgst digest.Digest, key string, desc distribution.Descriptor) error {
+	if err := dgst.Validate(); err != nil {
+		return err
 	}
 
-	return repo.Clear(ctx, dgst)
-}
+	if err := cache.ValidateDescriptor(desc); err != nil {
+		return err
+	}
 
-func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
-	rsimbdcp.parent.mu.Lock()
-	repo := rsimbdcp.repository
-	if repo == nil {
-		// allocate map since we are setting it now.
-		var ok bool
-		// have to read back value since we may have allocated elsewhere.
-		repo, ok = rsimbdcp.parent.repositories[rsimbdcp.repo]
-		if !ok {
-			repo = newMapBlobDescriptorCache()
-			rsimbdcp.parent.repositories[rsimbdcp.repo] = repo
-		}
-		rsimbdcp.repository = repo
+	entry := &lruEntry{
+		key:  key,
+		desc: desc,
+		size: entrySize(key, desc),
+	}
+	if imbdcp.options.TTL > 0 {
+		entry.expires = time.Now().Add(imbdcp.options.TTL)
 	}
-	rsimbdcp.parent.mu.Unlock()
 
-	if err := repo.SetDescriptor(ctx, dgst, desc); err != nil {
-		return err
+	imbdcp.mu.Lock()
+	defer imbdcp.mu.Unlock()
+
+	if element, ok := imbdcp.entries[key]; ok {
+		imbdcp.bytes -= element.Value.(*lruEntry).size
+		element.Value = entry
+		imbdcp.lru.MoveToFront(element)
+	} else {
+		imbdcp.entries[key] = imbdcp.lru.PushFront(entry)
 	}
+	imbdcp.bytes += entry.size
 
-	return rsimbdcp.parent.SetDescriptor(ctx, dgst, desc)
-}
+	for imbdcp.exceeded() {
+		imbdcp.evict(imbdcp.lru.Back())
+	}
 
-// mapBlobDescriptorCache provides a simple map-based implementation of the
-// descriptor cache.
-type mapBlobDescriptorCache struct {
-	descriptors map[digest.Digest]distribution.Descriptor
-	mu          sync.RWMutex
+	return nil
 }
 
-var _ distribution.BlobDescriptorService = &mapBlobDescriptorCache{}
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) remove(key string) {
+	imbdcp.mu.Lock()
+	defer imbdcp.mu.Unlock()
 
-func newMapBlobDescriptorCache() *mapBlobDescriptorCache {
-	return &mapBlobDescriptorCache{
-		descriptors: make(map[digest.Digest]distribution.Descriptor),
+	if element, ok := imbdcp.entries[key]; ok {
+		imbdcp.lru.Remove(element)
+		delete(imbdcp.entries, key)
+		imbdcp.bytes -= element.Value.(*lruEntry).size
 	}
 }
 
-func (mbdc *mapBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	if err := dgst.Validate(); err != nil {
-		return distribution.Descriptor{}, err
+// exceeded returns true if the cache holds more entries or bytes than
+// allowed. The most recently used entry is always kept.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) exceeded() bool {
+	if imbdcp.lru.Len() <= 1 {
+		return false
 	}
 
-	mbdc.mu.RLock()
-	defer mbdc.mu.RUnlock()
+	return (imbdcp.options.MaxEntries > 0 && imbdcp.lru.Len() > imbdcp.options.MaxEntries) ||
+		(imbdcp.options.MaxBytes > 0 && imbdcp.bytes > imbdcp.options.MaxBytes)
+}
 
-	desc, ok := mbdc.descriptors[dgst]
-	if !ok {
-		return distribution.Descriptor{}, distribution.ErrBlobUnknown
-	}
+// evict removes the element, counting it as an eviction.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) evict(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+	imbdcp.lru.Remove(element)
+	delete(imbdcp.entries, entry.key)
+	imbdcp.bytes -= entry.size
 
-	return desc, nil
+	if tracker, ok := imbdcp.options.Tracker.(cache.EvictionTracker); ok {
+		tracker.Evict()
+	}
 }
 
-func (mbdc *mapBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
-	mbdc.mu.Lock()
-	defer mbdc.mu.Unlock()
+// entrySize approximates the memory used by an entry.
+func entrySize(key string, desc distribution.Descriptor) int64 {
+	size := int64(entryOverhead + len(key) + len(desc.Digest) + len(desc.MediaType))
+	for _, u := range desc.URLs {
+		size += int64(len(u))
+	}
+	return size
+}
 
-	delete(mbdc.descriptors, dgst)
-	return nil
+// repositoryScopedInMemoryBlobDescriptorCache provides the request scoped
+// repository cache. Descriptors are stored in the parent, keyed by
+// repository.
+type repositoryScopedInMemoryBlobDescriptorCache struct {
+	repo   string
+	parent *inMemoryBlobDescriptorCacheProvider
 }
 
-func (mbdc *mapBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	if err := dgst.Validate(); err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	if err := cache.ValidateDescriptor(desc); err != nil {
+	return rsimbdcp.parent.get(rsimbdcp.key(dgst))
+}
+
+func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
+	rsimbdcp.parent.remove(rsimbdcp.key(dgst))
+	return nil
+}
+
+func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	if err := rsimbdcp.parent.set(dgst, rsimbdcp.key(dgst), desc); err != nil {
 		return err
 	}
 
-	mbdc.mu.Lock()
-	defer mbdc.mu.Unlock()
+	return rsimbdcp.parent.SetDescriptor(ctx, dgst, desc)
+}
 
-	mbdc.descriptors[dgst] = desc
-	return nil
+func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) key(dgst digest.Digest) string {
+	return rsimbdcp.repo + "@" + dgst.String()
 }
@@ -1,9 +1,15 @@
 package memory
 
 import (
+	"context"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage/cache"
 	"github.com/docker/distribution/registry/storage/cache/cachecheck"
+	"github.com/opencontainers/go-digest"
 )
 
 // TestInMemoryBlobInfoCache checks the in memory implementation is working
@@ -11,3 +17,109 @@ import (
 func TestInMemoryBlobInfoCache(t *testing.T) {
 	cachecheck.CheckBlobDescriptorCache(t, NewInMemoryBlobDescriptorCacheProvider())
 }
+
+// TestInMemoryMetadataCache checks the in memory metadata cache is working
+// correctly.
+func TestInMemoryMetadataCache(t *testing.T) {
+	cachecheck.CheckMetadataCache(t, NewInMemoryMetadataCacheProvider(0))
+}
+
+// TestBoundedInMemoryBlobInfoCache checks the bounded in memory
+// implementation is working correctly.
+func TestBoundedInMemoryBlobInfoCache(t *testing.T) {
+	cachecheck.CheckBlobDescriptorCache(t, NewBoundedInMemoryBlobDescriptorCacheProvider(Options{
+		MaxEntries: 100,
+		MaxBytes:   1 << 20,
+		TTL:        time.Hour,
+	}))
+}
+
+type evictionCounter struct {
+	cache.MetricsTracker
+	evictions int
+}
+
+func (ec *evictionCounter) Evict() {
+	ec.evictions++
+}
+
+func testDescriptor(i int) distribution.Descriptor {
+	return distribution.Descriptor{
+		Digest:    digest.FromString(strconv.Itoa(i)),
+		Size:      int64(i),
+		MediaType: "application/octet-stream",
+	}
+}
+
+func TestInMemoryBlobInfoCacheMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	tracker := &evictionCounter{}
+	provider := NewBoundedInMemoryBlobDescriptorCacheProvider(Options{MaxEntries: 2, Tracker: tracker})
+
+	for i := 0; i < 3; i++ {
+		desc := testDescriptor(i)
+		if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 1 {
+			// mark the first descriptor as recently used
+			if _, err := provider.Stat(ctx, testDescriptor(0).Digest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := provider.Stat(ctx, testDescriptor(1).Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected least recently used descriptor to be evicted, got %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if _, err := provider.Stat(ctx, testDescriptor(i).Digest); err != nil {
+			t.Fatalf("unexpected error getting descriptor %d: %v", i, err)
+		}
+	}
+	if tracker.evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", tracker.evictions)
+	}
+}
+
+func TestInMemoryBlobInfoCacheMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	desc := testDescriptor(0)
+	size := entrySize(desc.Digest.String(), desc)
+	provider := NewBoundedInMemoryBlobDescriptorCacheProvider(Options{MaxBytes: 3 * size})
+
+	// the repository scoped descriptor also sets the global one
+	repo, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		desc := testDescriptor(i)
+		if err := repo.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := repo.Stat(ctx, testDescriptor(0).Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected first descriptor to be evicted, got %v", err)
+	}
+	if _, err := repo.Stat(ctx, testDescriptor(1).Digest); err != nil {
+		t.Fatalf("unexpected error getting descriptor: %v", err)
+	}
+}
+
+func TestInMemoryBlobInfoCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	provider := NewBoundedInMemoryBlobDescriptorCacheProvider(Options{TTL: time.Millisecond})
+
+	desc := testDescriptor(0)
+	if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := provider.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected expired descriptor to be unknown, got %v", err)
+	}
+}
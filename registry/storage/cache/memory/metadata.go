@@ -0,0 +1,166 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+// inMemoryMetadataCacheProvider provides a map-based implementation of
+// MetadataCacheProvider. It is only coherent within a single registry
+// instance.
+type inMemoryMetadataCacheProvider struct {
+	ttl       time.Duration
+	entries   map[string]metadataEntry
+	versions  map[string]int64
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type metadataEntry struct {
+	desc      distribution.Descriptor // set for tags
+	mediaType string                  // set for manifests
+	payload   []byte                  // set for manifests
+	expires   time.Time
+}
+
+// NewInMemoryMetadataCacheProvider returns a new map-based cache for tag
+// resolutions and manifest payloads. Entries expire after ttl, unless it is
+// zero.
+func NewInMemoryMetadataCacheProvider(ttl time.Duration) cache.MetadataCacheProvider {
+	return &inMemoryMetadataCacheProvider{
+		ttl:      ttl,
+		entries:  make(map[string]metadataEntry),
+		versions: make(map[string]int64),
+	}
+}
+
+func (immcp *inMemoryMetadataCacheProvider) RepositoryScoped(repo string) (cache.MetadataCache, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		return nil, err
+	}
+
+	return &repositoryScopedInMemoryMetadataCache{
+		repo:   repo,
+		parent: immcp,
+	}, nil
+}
+
+func (immcp *inMemoryMetadataCacheProvider) get(key string) (metadataEntry, int64, error) {
+	immcp.mu.Lock()
+	defer immcp.mu.Unlock()
+
+	version := immcp.versions[key]
+	entry, ok := immcp.entries[key]
+	if !ok {
+		return metadataEntry{}, version, cache.ErrNotCached
+	}
+
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(immcp.entries, key)
+		return metadataEntry{}, version, cache.ErrNotCached
+	}
+
+	return entry, version, nil
+}
+
+func (immcp *inMemoryMetadataCacheProvider) set(key string, entry metadataEntry, version int64) {
+	immcp.mu.Lock()
+	defer immcp.mu.Unlock()
+
+	if immcp.versions[key] != version {
+		return
+	}
+
+	if immcp.ttl > 0 {
+		now := time.Now()
+		entry.expires = now.Add(immcp.ttl)
+
+		// drop expired entries which were not looked up again
+		if now.Sub(immcp.lastSweep) > immcp.ttl {
+			for k, e := range immcp.entries {
+				if now.After(e.expires) {
+					delete(immcp.entries, k)
+				}
+			}
+			immcp.lastSweep = now
+		}
+	}
+	immcp.entries[key] = entry
+}
+
+func (immcp *inMemoryMetadataCacheProvider) invalidate(key string) {
+	immcp.mu.Lock()
+	defer immcp.mu.Unlock()
+
+	delete(immcp.entries, key)
+	immcp.versions[key]++
+}
+
+// repositoryScopedInMemoryMetadataCache provides the request scoped
+// repository cache.
+type repositoryScopedInMemoryMetadataCache struct {
+	repo   string
+	parent *inMemoryMetadataCacheProvider
+}
+
+var _ cache.MetadataCache = &repositoryScopedInMemoryMetadataCache{}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) GetTag(ctx context.Context, tag string) (distribution.Descriptor, int64, error) {
+	entry, version, err := rsimmc.parent.get(rsimmc.tagKey(tag))
+	return entry.desc, version, err
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) SetTag(ctx context.Context, tag string, desc distribution.Descriptor, version int64) error {
+	if err := cache.ValidateDescriptor(desc); err != nil {
+		return err
+	}
+
+	rsimmc.parent.set(rsimmc.tagKey(tag), metadataEntry{desc: desc}, version)
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) InvalidateTag(ctx context.Context, tag string) error {
+	rsimmc.parent.invalidate(rsimmc.tagKey(tag))
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) GetManifest(ctx context.Context, dgst digest.Digest) (string, []byte, int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", nil, 0, err
+	}
+
+	entry, version, err := rsimmc.parent.get(rsimmc.manifestKey(dgst))
+	return entry.mediaType, entry.payload, version, err
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) SetManifest(ctx context.Context, dgst digest.Digest, mediaType string, payload []byte, version int64) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	rsimmc.parent.set(rsimmc.manifestKey(dgst), metadataEntry{mediaType: mediaType, payload: payload}, version)
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) InvalidateManifest(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	rsimmc.parent.invalidate(rsimmc.manifestKey(dgst))
+	return nil
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) tagKey(tag string) string {
+	return rsimmc.repo + "::tags::" + tag
+}
+
+func (rsimmc *repositoryScopedInMemoryMetadataCache) manifestKey(dgst digest.Digest) string {
+	return rsimmc.repo + "::manifests::" + dgst.String()
+}
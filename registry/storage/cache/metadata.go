@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrNotCached is returned by a MetadataCache when an entry is not cached.
+var ErrNotCached = errors.New("cache: not cached")
+
+// MetadataCacheProvider provides repository scoped caches of tag
+// resolutions and manifest payloads.
+type MetadataCacheProvider interface {
+	RepositoryScoped(repo string) (MetadataCache, error)
+}
+
+// MetadataCache caches the tag resolutions and manifest payloads of a
+// repository.
+//
+// Entries are versioned so that a cache shared by several registry instances
+// is never filled with stale data. A lookup returns the current version of
+// the entry along with ErrNotCached on a miss. The caller then reads the
+// backend and fills the entry with that version. If the entry was
+// invalidated meanwhile, its version has changed and the fill is dropped.
+type MetadataCache interface {
+	// GetTag returns the descriptor the tag resolves to.
+	GetTag(ctx context.Context, tag string) (distribution.Descriptor, int64, error)
+
+	// SetTag caches the descriptor the tag resolves to, unless the tag was
+	// invalidated since version was returned by GetTag.
+	SetTag(ctx context.Context, tag string, desc distribution.Descriptor, version int64) error
+
+	// InvalidateTag removes the tag from the cache.
+	InvalidateTag(ctx context.Context, tag string) error
+
+	// GetManifest returns the media type and payload of the manifest.
+	GetManifest(ctx context.Context, dgst digest.Digest) (string, []byte, int64, error)
+
+	// SetManifest caches the media type and payload of the manifest, unless
+	// the manifest was invalidated since version was returned by
+	// GetManifest.
+	SetManifest(ctx context.Context, dgst digest.Digest, mediaType string, payload []byte, version int64) error
+
+	// InvalidateManifest removes the manifest from the cache.
+	InvalidateManifest(ctx context.Context, dgst digest.Digest) error
+}
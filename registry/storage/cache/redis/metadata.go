@@ -0,0 +1,216 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/cache"
+	"github.com/garyburd/redigo/redis"
+	"github.com/opencontainers/go-digest"
+)
+
+// versionTTL is how long the version of an invalidated entry is kept. It
+// must exceed the time between a lookup and the matching fill.
+const versionTTL = 24 * time.Hour
+
+// setIfVersion sets the fields of the hash at KEYS[2] if the version stored
+// at KEYS[1] matches ARGV[1], expiring the hash after ARGV[2] milliseconds.
+// The remaining arguments are the field and value pairs.
+var setIfVersion = redis.NewScript(2, `
+local version = redis.call('GET', KEYS[1]) or '0'
+if version ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+redis.call('HMSET', KEYS[2], unpack(ARGV, 3))
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// redisMetadataCacheProvider provides an implementation of
+// MetadataCacheProvider based on redis. Tags and manifests are stored in a
+// redis hash per entry. Invalidating an entry deletes the hash and increments
+// a version counter, so that fills racing with the invalidation, from this
+// or another registry instance, are dropped.
+type redisMetadataCacheProvider struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+// NewRedisMetadataCacheProvider returns a new redis-based
+// MetadataCacheProvider using the provided redis connection pool. Entries
+// expire after ttl, unless it is zero.
+func NewRedisMetadataCacheProvider(pool *redis.Pool, ttl time.Duration) cache.MetadataCacheProvider {
+	return &redisMetadataCacheProvider{
+		pool: pool,
+		ttl:  ttl,
+	}
+}
+
+// RepositoryScoped returns the cache of the named repository.
+func (rmcp *redisMetadataCacheProvider) RepositoryScoped(repo string) (cache.MetadataCache, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		return nil, err
+	}
+
+	return &repositoryScopedRedisMetadataCache{
+		repo:     repo,
+		upstream: rmcp,
+	}, nil
+}
+
+type repositoryScopedRedisMetadataCache struct {
+	repo     string
+	upstream *redisMetadataCacheProvider
+}
+
+var _ cache.MetadataCache = &repositoryScopedRedisMetadataCache{}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) GetTag(ctx context.Context, tag string) (distribution.Descriptor, int64, error) {
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	reply, version, err := rsrmc.get(conn, rsrmc.tagKey(tag), "digest", "size", "mediatype")
+	if err != nil {
+		return distribution.Descriptor{}, version, err
+	}
+
+	var desc distribution.Descriptor
+	if _, err := redis.Scan(reply, &desc.Digest, &desc.Size, &desc.MediaType); err != nil {
+		return distribution.Descriptor{}, version, err
+	}
+
+	return desc, version, nil
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) SetTag(ctx context.Context, tag string, desc distribution.Descriptor, version int64) error {
+	if err := cache.ValidateDescriptor(desc); err != nil {
+		return err
+	}
+
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	return rsrmc.set(conn, rsrmc.tagKey(tag), version,
+		"digest", desc.Digest,
+		"size", desc.Size,
+		"mediatype", desc.MediaType)
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) InvalidateTag(ctx context.Context, tag string) error {
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	return rsrmc.invalidate(conn, rsrmc.tagKey(tag))
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) GetManifest(ctx context.Context, dgst digest.Digest) (string, []byte, int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", nil, 0, err
+	}
+
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	reply, version, err := rsrmc.get(conn, rsrmc.manifestKey(dgst), "mediatype", "payload")
+	if err != nil {
+		return "", nil, version, err
+	}
+
+	var mediaType string
+	var payload []byte
+	if _, err := redis.Scan(reply, &mediaType, &payload); err != nil {
+		return "", nil, version, err
+	}
+
+	return mediaType, payload, version, nil
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) SetManifest(ctx context.Context, dgst digest.Digest, mediaType string, payload []byte, version int64) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	return rsrmc.set(conn, rsrmc.manifestKey(dgst), version,
+		"mediatype", mediaType,
+		"payload", payload)
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) InvalidateManifest(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	conn := rsrmc.upstream.pool.Get()
+	defer conn.Close()
+
+	return rsrmc.invalidate(conn, rsrmc.manifestKey(dgst))
+}
+
+// get reads the fields of the hash at key along with its version. It returns
+// ErrNotCached if the hash does not exist.
+func (rsrmc *repositoryScopedRedisMetadataCache) get(conn redis.Conn, key string, fields ...interface{}) ([]interface{}, int64, error) {
+	conn.Send("MULTI")
+	conn.Send("GET", versionKey(key))
+	conn.Send("HMGET", append([]interface{}{key}, fields...)...)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var version int64
+	if reply[0] != nil {
+		if version, err = redis.Int64(reply[0], nil); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	values, err := redis.Values(reply[1], nil)
+	if err != nil {
+		return nil, version, err
+	}
+
+	for _, v := range values {
+		if v == nil {
+			return nil, version, cache.ErrNotCached
+		}
+	}
+
+	return values, version, nil
+}
+
+// set replaces the hash at key if its version still matches.
+func (rsrmc *repositoryScopedRedisMetadataCache) set(conn redis.Conn, key string, version int64, fieldValues ...interface{}) error {
+	args := append([]interface{}{versionKey(key), key, version, int64(rsrmc.upstream.ttl / time.Millisecond)}, fieldValues...)
+	_, err := setIfVersion.Do(conn, args...)
+	return err
+}
+
+// invalidate deletes the hash at key and increments its version.
+func (rsrmc *repositoryScopedRedisMetadataCache) invalidate(conn redis.Conn, key string) error {
+	conn.Send("MULTI")
+	conn.Send("INCR", versionKey(key))
+	conn.Send("PEXPIRE", versionKey(key), int64(versionTTL/time.Millisecond))
+	conn.Send("DEL", key)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) tagKey(tag string) string {
+	return "repository::" + rsrmc.repo + "::tags::" + tag
+}
+
+func (rsrmc *repositoryScopedRedisMetadataCache) manifestKey(dgst digest.Digest) string {
+	return "repository::" + rsrmc.repo + "::manifests::" + dgst.String()
+}
+
+func versionKey(key string) string {
+	return key + "::version"
+}
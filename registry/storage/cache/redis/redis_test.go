@@ -50,4 +50,5 @@ func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
 	conn.Close()
 
 	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
+	cachecheck.CheckMetadataCache(t, NewRedisMetadataCacheProvider(pool, time.Minute))
 }
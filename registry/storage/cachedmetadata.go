@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxCachedManifestSize is the largest manifest payload kept in the metadata
+// cache. Larger manifests are always read from storage.
+const maxCachedManifestSize = 64 << 10
+
+// cachedTagService resolves tags through a metadata cache, invalidating
+// cached tags when they change.
+type cachedTagService struct {
+	distribution.TagService
+	cache cache.MetadataCache
+}
+
+var _ distribution.TagService = &cachedTagService{}
+
+func (cts *cachedTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	desc, version, err := cts.cache.GetTag(ctx, tag)
+	if err == nil {
+		return desc, nil
+	}
+	if err != cache.ErrNotCached {
+		dcontext.GetLogger(ctx).Errorf("error retrieving tag %s from cache: %v", tag, err)
+	}
+
+	desc, err = cts.TagService.Get(ctx, tag)
+	if err != nil {
+		return desc, err
+	}
+
+	if err := cts.cache.SetTag(ctx, tag, desc, version); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error adding tag %s to cache: %v", tag, err)
+	}
+
+	return desc, nil
+}
+
+func (cts *cachedTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	err := cts.TagService.Tag(ctx, tag, desc)
+	cts.invalidate(ctx, tag)
+	return err
+}
+
+func (cts *cachedTagService) Untag(ctx context.Context, tag string) error {
+	err := cts.TagService.Untag(ctx, tag)
+	cts.invalidate(ctx, tag)
+	return err
+}
+
+// invalidate removes the tag from the cache. It is called even if the
+// backend fails, since the backend may have been partially updated.
+func (cts *cachedTagService) invalidate(ctx context.Context, tag string) {
+	if err := cts.cache.InvalidateTag(ctx, tag); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error invalidating tag %s in cache: %v", tag, err)
+	}
+}
+
+// cachedManifestService serves small manifests from a metadata cache,
+// invalidating cached manifests when they are put or deleted.
+type cachedManifestService struct {
+	distribution.ManifestService
+	cache cache.MetadataCache
+}
+
+var _ distribution.ManifestService = &cachedManifestService{}
+
+func (cms *cachedManifestService) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if _, _, _, err := cms.cache.GetManifest(ctx, dgst); err == nil {
+		return true, nil
+	}
+
+	return cms.ManifestService.Exists(ctx, dgst)
+}
+
+func (cms *cachedManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	mediaType, payload, version, err := cms.cache.GetManifest(ctx, dgst)
+	if err == nil {
+		manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+		if err == nil {
+			return manifest, nil
+		}
+		dcontext.GetLogger(ctx).Errorf("error unmarshaling manifest %s from cache: %v", dgst, err)
+	} else if err != cache.ErrNotCached {
+		dcontext.GetLogger(ctx).Errorf("error retrieving manifest %s from cache: %v", dgst, err)
+	}
+
+	manifest, err := cms.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, payload, err = manifest.Payload()
+	if err == nil && len(payload) <= maxCachedManifestSize {
+		if err := cms.cache.SetManifest(ctx, dgst, mediaType, payload, version); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error adding manifest %s to cache: %v", dgst, err)
+		}
+	}
+
+	return manifest, nil
+}
+
+func (cms *cachedManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	dgst, err := cms.ManifestService.Put(ctx, manifest, options...)
+	if err != nil {
+		return dgst, err
+	}
+
+	cms.invalidate(ctx, dgst)
+	return dgst, nil
+}
+
+func (cms *cachedManifestService) Delete(ctx context.Context, dgst digest.Digest) error {
+	err := cms.ManifestService.Delete(ctx, dgst)
+	cms.invalidate(ctx, dgst)
+	return err
+}
+
+// Enumerate lists the manifests of the backend, if it supports enumeration.
+func (cms *cachedManifestService) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
+	enumerator, ok := cms.ManifestService.(distribution.ManifestEnumerator)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+
+	return enumerator.Enumerate(ctx, ingester)
+}
+
+func (cms *cachedManifestService) invalidate(ctx context.Context, dgst digest.Digest) {
+	if err := cms.cache.InvalidateManifest(ctx, dgst); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error invalidating manifest %s in cache: %v", dgst, err)
+	}
+}
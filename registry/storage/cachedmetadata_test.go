@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/cache"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+// testCachedRepositories returns two repositories sharing storage and a
+// metadata cache, as replicas of a registry would.
+func testCachedRepositories(t *testing.T, provider cache.MetadataCacheProvider) (distribution.Repository, distribution.Repository) {
+	ctx := context.Background()
+	d := inmemory.New()
+	name, _ := reference.WithName("a/b")
+
+	var repos []distribution.Repository
+	for i := 0; i < 2; i++ {
+		reg, err := NewRegistry(ctx, d, EnableDelete, MetadataCacheProvider(provider))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo, err := reg.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos[0], repos[1]
+}
+
+func TestCachedTagService(t *testing.T) {
+	ctx := context.Background()
+	a, b := testCachedRepositories(t, memory.NewInMemoryMetadataCacheProvider(0))
+
+	d1 := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	d2 := distribution.Descriptor{Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}
+
+	if err := a.Tags(ctx).Tag(ctx, "latest", d1); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := b.Tags(ctx).Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != d1.Digest {
+		t.Fatalf("unexpected digest: %s", desc.Digest)
+	}
+
+	// retagging through one replica is seen by the other
+	if err := a.Tags(ctx).Tag(ctx, "latest", d2); err != nil {
+		t.Fatal(err)
+	}
+	desc, err = b.Tags(ctx).Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != d2.Digest {
+		t.Fatalf("expected retagged digest, got %s", desc.Digest)
+	}
+
+	if err := a.Tags(ctx).Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Tags(ctx).Get(ctx, "latest"); err == nil {
+		t.Fatalf("expected untagged tag to be unknown")
+	} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCachedManifestService(t *testing.T) {
+	ctx := context.Background()
+	a, b := testCachedRepositories(t, memory.NewInMemoryMetadataCacheProvider(0))
+
+	blobs := a.Blobs(ctx)
+	layer, err := blobs.Put(ctx, schema2.MediaTypeLayer, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := schema2.NewManifestBuilder(blobs, schema2.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`))
+	if err := builder.AppendReference(layer); err != nil {
+		t.Fatal(err)
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ma, err := a.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := b.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, err := ma.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		fetched, err := mb.Get(ctx, dgst)
+		if err != nil {
+			t.Fatalf("unexpected error getting manifest: %v", err)
+		}
+		if _, ok := fetched.(*schema2.DeserializedManifest); !ok {
+			t.Fatalf("unexpected manifest type: %T", fetched)
+		}
+	}
+
+	if _, ok := mb.(distribution.ManifestEnumerator); !ok {
+		t.Fatalf("expected cached manifest service to be enumerable")
+	}
+
+	if err := ma.Delete(ctx, dgst); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := mb.Exists(ctx, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("expected deleted manifest not to exist")
+	}
+	if _, err := mb.Get(ctx, dgst); err == nil {
+		t.Fatalf("expected error getting deleted manifest")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/docker/distribution/registry/storage/driver"
@@ -56,18 +57,81 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 	return n, err
 }
 
-// Enumerate applies ingester to each repository
+// walkConcurrency is the number of directories listed at once when
+// enumerating the content of the storage driver.
+const walkConcurrency = 16
+
+// Enumerate applies ingester to each repository, in order. The directories
+// of the repositories are listed in parallel, ahead of the walk.
 func (reg *registry) Enumerate(ctx context.Context, ingester func(string) error) error {
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return err
 	}
 
-	err = reg.blobStore.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
-		return handleRepository(fileInfo, root, "", ingester)
-	})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	return enumerateRepositories(ctx, reg.blobStore.driver, root, root, listDir(ctx, reg.blobStore.driver, root), ingester)
+}
+
+// listing is the sorted content of a directory.
+type listing struct {
+	children []string
+	err      error
+}
+
+// listDir lists dir in the background.
+func listDir(ctx context.Context, d driver.StorageDriver, dir string) <-chan listing {
+	c := make(chan listing, 1)
+	go func() {
+		children, err := d.List(ctx, dir)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// the directory was deleted since its parent was listed
+			children, err = nil, nil
+		}
+		sort.Strings(children)
+		c <- listing{children: children, err: err}
+	}()
+	return c
+}
+
+// enumerateRepositories applies ingester to dir, if it is a repository, then
+// to the repositories under it, in order. The listing of dir is pending. Each
+// directory level is sorted on its own, and at most walkConcurrency
+// subdirectories are listed ahead of the one being walked, so only the
+// listings of the directories on the path being walked are held.
+func enumerateRepositories(ctx context.Context, d driver.StorageDriver, root, dir string, pending <-chan listing, ingester func(string) error) error {
+	l := <-pending
+	if l.err != nil {
+		return l.err
+	}
 
-	return err
+	var subdirs []string
+	for _, child := range l.children {
+		switch name := path.Base(child); {
+		case name == "_layers" && dir != root:
+			if err := ingester(dir[len(root)+1:]); err != nil {
+				return err
+			}
+		case !strings.HasPrefix(name, "_"):
+			subdirs = append(subdirs, child)
+		}
+	}
+
+	listings := make([]<-chan listing, len(subdirs))
+	for i := 0; i < len(subdirs) && i < walkConcurrency; i++ {
+		listings[i] = listDir(ctx, d, subdirs[i])
+	}
+	for i, subdir := range subdirs {
+		if next := i + walkConcurrency; next < len(subdirs) {
+			listings[next] = listDir(ctx, d, subdirs[next])
+		}
+		if err := enumerateRepositories(ctx, d, root, subdir, listings[i], ingester); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // lessPath returns true if one path a is less than path b.
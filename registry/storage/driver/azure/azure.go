@@ -342,6 +342,12 @@ func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
 
+// WalkParallel traverses a filesystem defined within driver, starting from
+// the given path, listing up to maxConcurrency directories at once.
+func (d *driver) WalkParallel(ctx context.Context, path string, maxConcurrency int, f storagedriver.WalkFn) error {
+	return storagedriver.WalkParallelFallback(ctx, d, path, maxConcurrency, f)
+}
+
 // directDescendants will find direct descendants (blobs or virtual containers)
 // of from list of blob paths and will return their full paths. Elements in blobs
 // list must be prefixed with a "/" and
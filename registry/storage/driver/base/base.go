@@ -61,6 +61,8 @@ func init() {
 // common path and bounds checking.
 type Base struct {
 	storagedriver.StorageDriver
+
+	slowThresholds SlowThresholds
 }
 
 // Format errors received from the storage driver
@@ -101,8 +103,10 @@ func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
 
 	start := time.Now()
 	b, e := base.StorageDriver.GetContent(ctx, path)
-	storageAction.WithValues(base.Name(), "GetContent").UpdateSince(start)
-	return b, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "GetContent", path, start, e)
+	storageBytes.WithValues(base.Name(), "GetContent").Inc(float64(len(b)))
+	return b, e
 }
 
 // PutContent wraps PutContent of underlying storage driver.
@@ -116,7 +120,10 @@ func (base *Base) PutContent(ctx context.Context, path string, content []byte) e
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.PutContent(ctx, path, content))
-	storageAction.WithValues(base.Name(), "PutContent").UpdateSince(start)
+	base.observe(ctx, "PutContent", path, start, err)
+	if err == nil {
+		storageBytes.WithValues(base.Name(), "PutContent").Inc(float64(len(content)))
+	}
 	return err
 }
 
@@ -133,8 +140,14 @@ func (base *Base) Reader(ctx context.Context, path string, offset int64) (io.Rea
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	start := time.Now()
 	rc, e := base.StorageDriver.Reader(ctx, path, offset)
-	return rc, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "Reader", path, start, e)
+	if e != nil {
+		return rc, e
+	}
+	return &countingReader{ReadCloser: rc, bytes: storageBytes.WithValues(base.Name(), "Reader")}, nil
 }
 
 // Writer wraps Writer of underlying storage driver.
@@ -146,8 +159,14 @@ func (base *Base) Writer(ctx context.Context, path string, append bool) (storage
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	start := time.Now()
 	writer, e := base.StorageDriver.Writer(ctx, path, append)
-	return writer, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "Writer", path, start, e)
+	if e != nil {
+		return writer, e
+	}
+	return &countingWriter{FileWriter: writer, bytes: storageBytes.WithValues(base.Name(), "Writer")}, nil
 }
 
 // Stat wraps Stat of underlying storage driver.
@@ -161,8 +180,9 @@ func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo
 
 	start := time.Now()
 	fi, e := base.StorageDriver.Stat(ctx, path)
-	storageAction.WithValues(base.Name(), "Stat").UpdateSince(start)
-	return fi, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "Stat", path, start, e)
+	return fi, e
 }
 
 // List wraps List of underlying storage driver.
@@ -176,8 +196,9 @@ func (base *Base) List(ctx context.Context, path string) ([]string, error) {
 
 	start := time.Now()
 	str, e := base.StorageDriver.List(ctx, path)
-	storageAction.WithValues(base.Name(), "List").UpdateSince(start)
-	return str, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "List", path, start, e)
+	return str, e
 }
 
 // Move wraps Move of underlying storage driver.
@@ -193,7 +214,7 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Move(ctx, sourcePath, destPath))
-	storageAction.WithValues(base.Name(), "Move").UpdateSince(start)
+	base.observe(ctx, "Move", sourcePath, start, err)
 	return err
 }
 
@@ -208,7 +229,7 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Delete(ctx, path))
-	storageAction.WithValues(base.Name(), "Delete").UpdateSince(start)
+	base.observe(ctx, "Delete", path, start, err)
 	return err
 }
 
@@ -223,8 +244,9 @@ func (base *Base) URLFor(ctx context.Context, path string, options map[string]in
 
 	start := time.Now()
 	str, e := base.StorageDriver.URLFor(ctx, path, options)
-	storageAction.WithValues(base.Name(), "URLFor").UpdateSince(start)
-	return str, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe(ctx, "URLFor", path, start, e)
+	return str, e
 }
 
 // Walk wraps Walk of underlying storage driver.
@@ -236,5 +258,45 @@ func (base *Base) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.Walk(ctx, path, f))
+	start := time.Now()
+	err := base.setDriverName(base.StorageDriver.Walk(ctx, path, f))
+	base.observe(ctx, "Walk", path, start, err)
+	return err
+}
+
+// WalkParallel wraps WalkParallel of underlying storage driver, falling back
+// to its Walk if it does not implement storagedriver.ParallelWalker.
+func (base *Base) WalkParallel(ctx context.Context, path string, maxConcurrency int, f storagedriver.WalkFn) error {
+	ctx, done := dcontext.WithTrace(ctx)
+	defer done("%s.WalkParallel(%q)", base.Name(), path)
+
+	if !storagedriver.PathRegexp.MatchString(path) && path != "/" {
+		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+	}
+
+	start := time.Now()
+	err := base.setDriverName(storagedriver.WalkParallel(ctx, base.StorageDriver, path, maxConcurrency, f))
+	base.observe(ctx, "WalkParallel", path, start, err)
+	return err
+}
+
+// Concat wraps Concat of underlying storage driver, falling back to copying
+// the files if it does not implement storagedriver.Concatenator.
+func (base *Base) Concat(ctx context.Context, destPath string, sourcePaths []string) error {
+	ctx, done := dcontext.WithTrace(ctx)
+	defer done("%s.Concat(%q, %q)", base.Name(), destPath, sourcePaths)
+
+	if !storagedriver.PathRegexp.MatchString(destPath) {
+		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
+	}
+	for _, sourcePath := range sourcePaths {
+		if !storagedriver.PathRegexp.MatchString(sourcePath) {
+			return storagedriver.InvalidPathError{Path: sourcePath, DriverName: base.StorageDriver.Name()}
+		}
+	}
+
+	start := time.Now()
+	err := base.setDriverName(storagedriver.Concat(ctx, base.StorageDriver, destPath, sourcePaths))
+	base.observe(ctx, "Concat", destPath, start, err)
+	return err
 }
@@ -0,0 +1,105 @@
+package base
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	prometheus "github.com/docker/distribution/metrics"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// storageErrors is the number of failed storage actions, by kind of error
+	storageErrors = prometheus.StorageNamespace.NewLabeledCounter("errors", "The number of storage actions which failed", "driver", "action", "kind")
+
+	// storageBytes is the number of bytes read and written by storage actions
+	storageBytes = prometheus.StorageNamespace.NewLabeledCounter("bytes", "The number of bytes transferred by storage actions", "driver", "action")
+)
+
+// SlowThresholds configures the logging of slow storage actions. An action
+// taking longer than its threshold is logged as a warning.
+type SlowThresholds struct {
+	// Default applies to the actions without a threshold in Actions. Zero
+	// disables the logging of these actions.
+	Default time.Duration
+
+	// Actions maps action names, such as GetContent or Stat, to their
+	// thresholds.
+	Actions map[string]time.Duration
+}
+
+// SetSlowThresholds configures the logging of the slow actions of the
+// driver. It must be called before the driver is used.
+func (base *Base) SetSlowThresholds(thresholds SlowThresholds) {
+	actions := make(map[string]time.Duration, len(thresholds.Actions))
+	for action, threshold := range thresholds.Actions {
+		actions[strings.ToLower(action)] = threshold
+	}
+	base.slowThresholds = SlowThresholds{Default: thresholds.Default, Actions: actions}
+}
+
+func (base *Base) slowThreshold(action string) time.Duration {
+	if threshold, ok := base.slowThresholds.Actions[strings.ToLower(action)]; ok {
+		return threshold
+	}
+	return base.slowThresholds.Default
+}
+
+// observe records the duration and the error of an action, and logs it if it
+// was slow.
+func (base *Base) observe(ctx context.Context, action, path string, start time.Time, err error) {
+	duration := time.Since(start)
+	storageAction.WithValues(base.Name(), action).Update(duration)
+
+	if err != nil {
+		storageErrors.WithValues(base.Name(), action, errorKind(err)).Inc(1)
+	}
+
+	if threshold := base.slowThreshold(action); threshold > 0 && duration > threshold {
+		dcontext.GetLogger(ctx).Warnf("slow storage action: %s.%s(%q) took %s", base.Name(), action, path, duration)
+	}
+}
+
+// errorKind returns the label of the kind of a storage driver error.
+func errorKind(err error) string {
+	switch err.(type) {
+	case storagedriver.PathNotFoundError:
+		return "path_not_found"
+	case storagedriver.InvalidPathError:
+		return "invalid_path"
+	case storagedriver.InvalidOffsetError:
+		return "invalid_offset"
+	case storagedriver.ErrUnsupportedMethod:
+		return "unsupported_method"
+	default:
+		return "other"
+	}
+}
+
+// countingReader counts the bytes read from a storage driver.
+type countingReader struct {
+	io.ReadCloser
+	bytes metrics.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes.Inc(float64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to a storage driver.
+type countingWriter struct {
+	storagedriver.FileWriter
+	bytes metrics.Counter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.FileWriter.Write(p)
+	cw.bytes.Inc(float64(n))
+	return n, err
+}
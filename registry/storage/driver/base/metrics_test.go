@@ -0,0 +1,42 @@
+package base
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+func TestSlowThresholds(t *testing.T) {
+	var base Base
+	base.SetSlowThresholds(SlowThresholds{
+		Default: time.Second,
+		Actions: map[string]time.Duration{"Reader": time.Minute, "stat": 0},
+	})
+
+	for action, expected := range map[string]time.Duration{
+		"GetContent": time.Second,
+		"Reader":     time.Minute,
+		"reader":     time.Minute,
+		"Stat":       0,
+	} {
+		if threshold := base.slowThreshold(action); threshold != expected {
+			t.Fatalf("unexpected threshold for %s: %s != %s", action, threshold, expected)
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	for err, expected := range map[error]string{
+		storagedriver.PathNotFoundError{}:    "path_not_found",
+		storagedriver.InvalidPathError{}:     "invalid_path",
+		storagedriver.InvalidOffsetError{}:   "invalid_offset",
+		storagedriver.ErrUnsupportedMethod{}: "unsupported_method",
+		errors.New("unavailable"):            "other",
+	} {
+		if kind := errorKind(err); kind != expected {
+			t.Fatalf("unexpected kind of %T: %s != %s", err, kind, expected)
+		}
+	}
+}
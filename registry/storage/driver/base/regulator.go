@@ -139,3 +139,19 @@ func (r *regulator) URLFor(ctx context.Context, path string, options map[string]
 
 	return r.StorageDriver.URLFor(ctx, path, options)
 }
+
+// WalkParallel traverses the filesystem with WalkParallel of the underlying
+// storage driver, or its Walk if it does not implement
+// storagedriver.ParallelWalker.
+func (r *regulator) WalkParallel(ctx context.Context, path string, maxConcurrency int, f storagedriver.WalkFn) error {
+	return storagedriver.WalkParallel(ctx, r.StorageDriver, path, maxConcurrency, f)
+}
+
+// Concat concatenates the files with Concat of the underlying storage driver,
+// or by copying them if it does not implement storagedriver.Concatenator.
+func (r *regulator) Concat(ctx context.Context, destPath string, sourcePaths []string) error {
+	r.enter()
+	defer r.exit()
+
+	return storagedriver.Concat(ctx, r.StorageDriver, destPath, sourcePaths)
+}
@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"context"
+	"io"
+)
+
+// Concatenator is implemented by storage drivers which can concatenate files
+// natively, such as with a multipart upload copying its parts from the files
+// in the backend.
+type Concatenator interface {
+	// Concat writes the content of the files at sourcePaths, in order, to
+	// the file at destPath, replacing it. It returns ErrUnsupportedMethod
+	// if these files cannot be concatenated natively.
+	Concat(ctx context.Context, destPath string, sourcePaths []string) error
+}
+
+// Concat concatenates the files at sourcePaths into destPath with the Concat
+// method of driver if it implements Concatenator, or by copying them through
+// a FileWriter otherwise.
+func Concat(ctx context.Context, driver StorageDriver, destPath string, sourcePaths []string) error {
+	if c, ok := driver.(Concatenator); ok {
+		err := c.Concat(ctx, destPath, sourcePaths)
+		if _, ok := err.(ErrUnsupportedMethod); !ok {
+			return err
+		}
+	}
+	return ConcatFallback(ctx, driver, destPath, sourcePaths)
+}
+
+// ConcatFallback concatenates the files at sourcePaths into destPath by
+// reading them and writing their content with a FileWriter.
+func ConcatFallback(ctx context.Context, driver StorageDriver, destPath string, sourcePaths []string) error {
+	fw, err := driver.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+
+	for _, sourcePath := range sourcePaths {
+		if err := copyFile(ctx, driver, fw, sourcePath); err != nil {
+			fw.Cancel()
+			return err
+		}
+	}
+
+	if err := fw.Commit(); err != nil {
+		fw.Cancel()
+		return err
+	}
+	return fw.Close()
+}
+
+func copyFile(ctx context.Context, driver StorageDriver, w io.Writer, sourcePath string) error {
+	rc, err := driver.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
@@ -0,0 +1,396 @@
+// Package faults provides a storage driver wrapper which injects faults into
+// the calls to another storage driver, to test the registry under failure
+// modes such as a slow backend, failing requests, partial writes and
+// eventually consistent listings.
+//
+// The wrapper is registered as the "faults" storage middleware, and can be
+// constructed directly with New.
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// ErrInjected is the error returned by calls failing due to a Rule, unless
+// the rule sets its own error.
+var ErrInjected = errors.New("injected fault")
+
+// Rule describes the faults injected into the calls matching it.
+type Rule struct {
+	// Actions restricts the rule to calls of these methods, such as Stat or
+	// Writer, regardless of case. Write and Commit match the calls to the
+	// writers returned by Writer. The rule matches all methods if empty.
+	Actions []string
+
+	// Path restricts the rule to calls on paths matching it. For Move, the
+	// source path is matched. The rule matches all paths if nil.
+	Path *regexp.Regexp
+
+	// Latency delays the matching calls, by up to Jitter more.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// ErrorRate is the probability of a matching call failing with Err.
+	ErrorRate float64
+
+	// Err is returned by calls failing due to ErrorRate, ErrInjected if nil.
+	Err error
+
+	// NotFoundRate is the probability of a matching call failing with a
+	// PathNotFoundError, as if the path had not appeared yet or had just
+	// been deleted.
+	NotFoundRate float64
+
+	// PartialWriteRate is the probability of a PutContent call, or of a
+	// Write to a writer, storing only part of the content before failing.
+	PartialWriteRate float64
+
+	// Limit is the maximum number of failures injected by the rule. There
+	// is no limit if zero.
+	Limit int
+
+	failures int
+}
+
+// matches returns true if the rule applies to a call of action on path.
+func (r *Rule) matches(action, path string) bool {
+	if r.Path != nil && !r.Path.MatchString(path) {
+		return false
+	}
+	if len(r.Actions) == 0 {
+		return true
+	}
+	for _, a := range r.Actions {
+		if strings.EqualFold(a, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// fault is the outcome of the rules for a call.
+type fault struct {
+	delay   time.Duration
+	err     error
+	partial bool
+}
+
+// Driver is a storage driver injecting faults into the calls to another one.
+type Driver struct {
+	storagedriver.StorageDriver
+
+	mu    sync.Mutex
+	rules []*Rule
+	rand  *rand.Rand
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// New returns a Driver injecting faults described by rules into the calls to
+// sd. The faults are drawn from a pseudo-random sequence started at seed.
+func New(sd storagedriver.StorageDriver, rules []Rule, seed int64) *Driver {
+	d := &Driver{
+		StorageDriver: sd,
+		rand:          rand.New(rand.NewSource(seed)),
+	}
+	d.SetRules(rules)
+	return d
+}
+
+// SetRules replaces the rules of the driver.
+func (d *Driver) SetRules(rules []Rule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rules = make([]*Rule, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		rule.failures = 0
+		d.rules[i] = &rule
+	}
+}
+
+// inject draws the fault of a call of action on path from the matching rules.
+func (d *Driver) inject(action, path string) fault {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var f fault
+	for _, r := range d.rules {
+		if !r.matches(action, path) {
+			continue
+		}
+
+		f.delay += r.Latency
+		if r.Jitter > 0 {
+			f.delay += time.Duration(d.rand.Int63n(int64(r.Jitter)))
+		}
+
+		if f.err != nil || f.partial || (r.Limit > 0 && r.failures >= r.Limit) {
+			continue
+		}
+		switch {
+		case d.rand.Float64() < r.ErrorRate:
+			f.err = r.Err
+			if f.err == nil {
+				f.err = storagedriver.Error{DriverName: d.StorageDriver.Name(), Enclosed: ErrInjected}
+			}
+		case d.rand.Float64() < r.NotFoundRate:
+			f.err = storagedriver.PathNotFoundError{Path: path, DriverName: d.StorageDriver.Name()}
+		case (action == "PutContent" || action == "Write") && d.rand.Float64() < r.PartialWriteRate:
+			f.partial = true
+		default:
+			continue
+		}
+		r.failures++
+	}
+	return f
+}
+
+// call waits for the latency of the fault of a call, and returns its error.
+func (d *Driver) call(ctx context.Context, action, path string) fault {
+	f := d.inject(action, path)
+	if f.delay > 0 {
+		timer := time.NewTimer(f.delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	return f
+}
+
+// GetContent retrieves the content stored at "path".
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if f := d.call(ctx, "GetContent", path); f.err != nil {
+		return nil, f.err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+// PutContent stores the content at "path", or part of it before failing.
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte) error {
+	f := d.call(ctx, "PutContent", path)
+	if f.err != nil {
+		return f.err
+	}
+	if f.partial {
+		if err := d.StorageDriver.PutContent(ctx, path, content[:len(content)/2]); err != nil {
+			return err
+		}
+		return storagedriver.Error{DriverName: d.StorageDriver.Name(), Enclosed: io.ErrShortWrite}
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Reader retrieves a stream of the content stored at "path".
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if f := d.call(ctx, "Reader", path); f.err != nil {
+		return nil, f.err
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+// Writer returns a FileWriter for "path", whose writes may be partial.
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if f := d.call(ctx, "Writer", path); f.err != nil {
+		return nil, f.err
+	}
+	fw, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{FileWriter: fw, d: d, ctx: ctx, path: path}, nil
+}
+
+// Stat retrieves the FileInfo for "path".
+func (d *Driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if f := d.call(ctx, "Stat", path); f.err != nil {
+		return nil, f.err
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+// List returns the direct descendants of "path".
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	if f := d.call(ctx, "List", path); f.err != nil {
+		return nil, f.err
+	}
+	return d.StorageDriver.List(ctx, path)
+}
+
+// Move moves the content at sourcePath to destPath.
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if f := d.call(ctx, "Move", sourcePath); f.err != nil {
+		return f.err
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete deletes the content at "path" and its subpaths.
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	if f := d.call(ctx, "Delete", path); f.err != nil {
+		return f.err
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+// URLFor returns a URL for the content at "path".
+func (d *Driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	if f := d.call(ctx, "URLFor", path); f.err != nil {
+		return "", f.err
+	}
+	return d.StorageDriver.URLFor(ctx, path, options)
+}
+
+// Walk traverses the filesystem from "path". The faults of Walk apply to
+// the start of the traversal, the faults of List and Stat to the calls made
+// by the traversal.
+func (d *Driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	if f := d.call(ctx, "Walk", path); f.err != nil {
+		return f.err
+	}
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// writer injects faults into the writes to a FileWriter.
+type writer struct {
+	storagedriver.FileWriter
+	d    *Driver
+	ctx  context.Context
+	path string
+}
+
+// Write writes p, or part of it before failing.
+func (w *writer) Write(p []byte) (int, error) {
+	f := w.d.call(w.ctx, "Write", w.path)
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.partial {
+		n, err := w.FileWriter.Write(p[:len(p)/2])
+		if err == nil {
+			err = storagedriver.Error{DriverName: w.d.StorageDriver.Name(), Enclosed: io.ErrShortWrite}
+		}
+		return n, err
+	}
+	return w.FileWriter.Write(p)
+}
+
+// Commit flushes the content written to the writer.
+func (w *writer) Commit() error {
+	if f := w.d.call(w.ctx, "Commit", w.path); f.err != nil {
+		return f.err
+	}
+	return w.FileWriter.Commit()
+}
+
+// newFaultsStorageMiddleware constructs the middleware from the options:
+//
+// seed: the seed of the pseudo-random faults, the current time by default
+// rules: a list of rules, with the keys actions, path, latency, jitter,
+// errorrate, notfoundrate, partialwriterate and limit.
+func newFaultsStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	seed := time.Now().UnixNano()
+	if v, ok := options["seed"]; ok {
+		var err error
+		if seed, err = strconv.ParseInt(fmt.Sprint(v), 10, 64); err != nil {
+			return nil, fmt.Errorf("seed must be an integer, %v invalid", v)
+		}
+	}
+
+	var rules []Rule
+	if v, ok := options["rules"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rules must be a list, %#v invalid", v)
+		}
+		for i, item := range list {
+			rule, err := parseRule(item)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return New(sd, rules, seed), nil
+}
+
+// parseRule parses a rule from the options of the middleware.
+func parseRule(v interface{}) (Rule, error) {
+	options := make(map[string]interface{})
+	switch m := v.(type) {
+	case map[string]interface{}:
+		options = m
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			options[fmt.Sprint(k)] = v
+		}
+	default:
+		return Rule{}, fmt.Errorf("must be a map, %#v invalid", v)
+	}
+
+	var rule Rule
+	for key, value := range options {
+		var err error
+		switch strings.ToLower(key) {
+		case "actions":
+			actions, ok := value.([]interface{})
+			if !ok {
+				return Rule{}, fmt.Errorf("actions must be a list, %#v invalid", value)
+			}
+			for _, action := range actions {
+				rule.Actions = append(rule.Actions, fmt.Sprint(action))
+			}
+		case "path":
+			rule.Path, err = regexp.Compile(fmt.Sprint(value))
+		case "latency":
+			rule.Latency, err = time.ParseDuration(fmt.Sprint(value))
+		case "jitter":
+			rule.Jitter, err = time.ParseDuration(fmt.Sprint(value))
+		case "errorrate":
+			rule.ErrorRate, err = parseRate(value)
+		case "notfoundrate":
+			rule.NotFoundRate, err = parseRate(value)
+		case "partialwriterate":
+			rule.PartialWriteRate, err = parseRate(value)
+		case "limit":
+			rule.Limit, err = strconv.Atoi(fmt.Sprint(value))
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid %s %v: %v", key, value, err)
+		}
+	}
+	return rule, nil
+}
+
+func parseRate(v interface{}) (float64, error) {
+	rate, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+func init() {
+	storagemiddleware.Register("faults", storagemiddleware.InitFunc(newFaultsStorageMiddleware))
+}
@@ -0,0 +1,175 @@
+package faults
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	// without rules, the driver must behave like the driver it wraps
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return New(inmemory.New(), nil, 1), nil
+	}, testsuites.NeverSkip)
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	d := New(inmemory.New(), []Rule{{
+		Actions:   []string{"getcontent"},
+		Path:      regexp.MustCompile("^/a"),
+		ErrorRate: 1,
+		Limit:     2,
+	}}, 1)
+
+	for _, p := range []string{"/a", "/b"} {
+		if err := d.PutContent(ctx, p, []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := d.GetContent(ctx, "/a")
+		if e, ok := err.(storagedriver.Error); !ok || e.Enclosed != ErrInjected {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+	}
+	if _, err := d.GetContent(ctx, "/a"); err != nil {
+		t.Fatalf("expected no error past the limit, got %v", err)
+	}
+	if _, err := d.GetContent(ctx, "/b"); err != nil {
+		t.Fatalf("expected no error on unmatched path, got %v", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ctx := context.Background()
+	d := New(inmemory.New(), []Rule{{Actions: []string{"Stat", "List"}, NotFoundRate: 1}}, 1)
+
+	if err := d.PutContent(ctx, "/a/b", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "/a/b"); err != (storagedriver.PathNotFoundError{Path: "/a/b", DriverName: "inmemory"}) {
+		t.Fatalf("expected PathNotFoundError, got %v", err)
+	}
+	if err := d.Walk(ctx, "/", func(storagedriver.FileInfo) error { return nil }); err == nil {
+		t.Fatalf("expected walk to fail")
+	}
+
+	d.SetRules(nil)
+	if _, err := d.Stat(ctx, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	ctx := context.Background()
+	d := New(inmemory.New(), []Rule{{PartialWriteRate: 1}}, 1)
+
+	if err := d.PutContent(ctx, "/a", []byte("content!")); err == nil {
+		t.Fatalf("expected partial write to fail")
+	}
+
+	fw, err := d.Writer(ctx, "/b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fw.Write([]byte("content!")); n != 4 || err == nil {
+		t.Fatalf("expected partial write, wrote %d: %v", n, err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.SetRules(nil)
+	for _, p := range []string{"/a", "/b"} {
+		content, err := d.GetContent(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "cont" {
+			t.Fatalf("unexpected content of %s: %q", p, content)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ctx := context.Background()
+	d := New(inmemory.New(), []Rule{{
+		Actions: []string{"PutContent", "GetContent"},
+		Latency: 20 * time.Millisecond,
+		Jitter:  30 * time.Millisecond,
+	}}, 1)
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if elapsed < 20*time.Millisecond {
+			t.Fatalf("expected call to be delayed, took %s", elapsed)
+		}
+
+		// latency alone must not change the result of the call
+		content, err := d.GetContent(ctx, "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content" {
+			t.Fatalf("unexpected content: %q", content)
+		}
+	}
+
+	start := time.Now()
+	d.Stat(ctx, "/a")
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Fatalf("expected unmatched call not to be delayed, took %s", elapsed)
+	}
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	sd, err := newFaultsStorageMiddleware(inmemory.New(), map[string]interface{}{
+		"seed": 1,
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"actions":          []interface{}{"PutContent", "Write"},
+				"path":             "/_uploads/",
+				"latency":          "10ms",
+				"errorrate":        0.5,
+				"partialwriterate": "0.1",
+				"limit":            3,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := sd.(*Driver).rules[0]
+	if len(rule.Actions) != 2 || rule.Path.String() != "/_uploads/" || rule.Latency != 10*time.Millisecond ||
+		rule.ErrorRate != 0.5 || rule.PartialWriteRate != 0.1 || rule.Limit != 3 {
+		t.Fatalf("unexpected rule: %#v", rule)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"seed": "random"},
+		{"rules": "all"},
+		{"rules": []interface{}{"all"}},
+		{"rules": []interface{}{map[string]interface{}{"errorrate": 2}}},
+		{"rules": []interface{}{map[string]interface{}{"path": "("}}},
+		{"rules": []interface{}{map[string]interface{}{"unknown": 1}}},
+	} {
+		if _, err := newFaultsStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Fatalf("expected error for options %v", options)
+		}
+	}
+}
@@ -785,6 +785,12 @@ func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
 
+// WalkParallel traverses a filesystem defined within driver, starting from
+// the given path, listing up to maxConcurrency directories at once.
+func (d *driver) WalkParallel(ctx context.Context, path string, maxConcurrency int, f storagedriver.WalkFn) error {
+	return storagedriver.WalkParallelFallback(ctx, d, path, maxConcurrency, f)
+}
+
 func startSession(client *http.Client, bucket string, name string) (uri string, err error) {
 	u := &url.URL{
 		Scheme:   "https",
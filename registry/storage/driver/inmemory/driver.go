@@ -246,6 +246,42 @@ func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
 
+// WalkParallel traverses a filesystem defined within driver, starting from
+// the given path, listing up to maxConcurrency directories at once.
+func (d *driver) WalkParallel(ctx context.Context, path string, maxConcurrency int, f storagedriver.WalkFn) error {
+	return storagedriver.WalkParallelFallback(ctx, d, path, maxConcurrency, f)
+}
+
+// Concat writes the content of the files at sourcePaths, in order, to the
+// file at destPath.
+func (d *driver) Concat(ctx context.Context, destPath string, sourcePaths []string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var contents []byte
+	for _, sourcePath := range sourcePaths {
+		normalized := normalize(sourcePath)
+		found := d.root.find(normalized)
+		if found.path() != normalized {
+			return storagedriver.PathNotFoundError{Path: sourcePath}
+		}
+		if found.isdir() {
+			return fmt.Errorf("%q is a directory", sourcePath)
+		}
+		contents = append(contents, found.(*file).data...)
+	}
+
+	f, err := d.root.mkfile(normalize(destPath))
+	if err != nil {
+		return fmt.Errorf("not a file")
+	}
+
+	f.truncate()
+	f.WriteAt(contents, 0)
+
+	return nil
+}
+
 type writer struct {
 	d         *driver
 	f         *file
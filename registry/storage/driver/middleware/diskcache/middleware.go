@@ -0,0 +1,408 @@
+// Package middleware - local disk read-through cache for storage drivers
+//
+// Blob data is immutable once written, so copies of it can be kept on local
+// disk and served without going to the storage backend. Paths outside of the
+// blob store, such as tag links, always go to the backend.
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+// defaultPrefix is the path of the blob store of the registry.
+const defaultPrefix = "/docker/registry/v2/blobs/"
+
+type diskCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	prefix  string
+	dataDir string
+	tmpDir  string
+	maxSize int64
+
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	size    int64
+	mu      sync.Mutex
+}
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+var _ storagedriver.StorageDriver = &diskCacheStorageMiddleware{}
+
+// newDiskCacheStorageMiddleware constructs the middleware. The options are:
+//
+// rootdirectory: the local directory holding the cached files
+// maxsize: the number of bytes above which the least recently used files are evicted
+// prefix: the paths to cache, defaults to the blob store of the registry
+func newDiskCacheStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	root, ok := options["rootdirectory"]
+	if !ok || fmt.Sprint(root) == "" {
+		return nil, fmt.Errorf("no rootdirectory provided")
+	}
+
+	var maxSize int64
+	switch v := options["maxsize"].(type) {
+	case int:
+		maxSize = int64(v)
+	case int64:
+		maxSize = v
+	case string:
+		var err error
+		if maxSize, err = strconv.ParseInt(v, 0, 64); err != nil {
+			return nil, fmt.Errorf("maxsize must be an integer, %v invalid", v)
+		}
+	case nil:
+		return nil, fmt.Errorf("no maxsize provided")
+	default:
+		return nil, fmt.Errorf("invalid value for maxsize: %#v", v)
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxsize must be positive")
+	}
+
+	prefix := defaultPrefix
+	if p, ok := options["prefix"]; ok {
+		prefix = fmt.Sprint(p)
+	}
+
+	dcsm := &diskCacheStorageMiddleware{
+		StorageDriver: sd,
+		prefix:        prefix,
+		dataDir:       filepath.Join(fmt.Sprint(root), "data"),
+		tmpDir:        filepath.Join(fmt.Sprint(root), "tmp"),
+		maxSize:       maxSize,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+
+	if err := dcsm.load(); err != nil {
+		return nil, fmt.Errorf("unable to load disk cache: %v", err)
+	}
+
+	return dcsm, nil
+}
+
+// load indexes the files cached by a previous run, ordered by their
+// modification time, and removes incomplete files.
+func (dcsm *diskCacheStorageMiddleware) load() error {
+	if err := os.RemoveAll(dcsm.tmpDir); err != nil {
+		return err
+	}
+	for _, dir := range []string{dcsm.dataDir, dcsm.tmpDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	err := filepath.Walk(dcsm.dataDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dcsm.dataDir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{path: "/" + filepath.ToSlash(rel), size: fi.Size(), modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		dcsm.entries[f.path] = dcsm.lru.PushBack(&cacheEntry{path: f.path, size: f.size})
+		dcsm.size += f.size
+	}
+	dcsm.evict()
+
+	return nil
+}
+
+// GetContent retrieves the content stored at "path", from the cache if
+// possible.
+func (dcsm *diskCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !dcsm.cacheable(path) {
+		return dcsm.StorageDriver.GetContent(ctx, path)
+	}
+
+	if f, err := dcsm.open(path); err == nil {
+		defer f.Close()
+		if content, err := ioutil.ReadAll(f); err == nil {
+			return content, nil
+		}
+	}
+
+	content, err := dcsm.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(dcsm.tmpDir, "content-")
+	if err == nil {
+		_, err = tmp.Write(content)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = dcsm.add(path, tmp.Name(), int64(len(content)))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: failed to cache %s: %v", path, err)
+	}
+
+	return content, nil
+}
+
+// PutContent stores the content at "path", invalidating its cached copy.
+func (dcsm *diskCacheStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	dcsm.invalidate(path)
+	return dcsm.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path", from
+// the cache if possible. Reads of uncached content from the start populate
+// the cache once they reach the end of the content.
+func (dcsm *diskCacheStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !dcsm.cacheable(path) || offset < 0 {
+		return dcsm.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	if f, err := dcsm.open(path); err == nil {
+		if _, err := f.Seek(offset, io.SeekStart); err == nil {
+			return f, nil
+		}
+		f.Close()
+	}
+
+	rc, err := dcsm.StorageDriver.Reader(ctx, path, offset)
+	if err != nil || offset > 0 {
+		return rc, err
+	}
+
+	tmp, err := ioutil.TempFile(dcsm.tmpDir, "reader-")
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: failed to cache %s: %v", path, err)
+		return rc, nil
+	}
+
+	return &populatingReader{ReadCloser: rc, middleware: dcsm, ctx: ctx, path: path, tmp: tmp}, nil
+}
+
+// Writer returns a FileWriter for "path", invalidating its cached copy.
+func (dcsm *diskCacheStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	dcsm.invalidate(path)
+	return dcsm.StorageDriver.Writer(ctx, path, append)
+}
+
+// Move moves the content at sourcePath to destPath, invalidating the cached
+// copies of both.
+func (dcsm *diskCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	dcsm.invalidate(sourcePath)
+	dcsm.invalidate(destPath)
+	return dcsm.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete deletes the content at "path" and its subpaths, invalidating their
+// cached copies.
+func (dcsm *diskCacheStorageMiddleware) Delete(ctx context.Context, path string) error {
+	err := dcsm.StorageDriver.Delete(ctx, path)
+	dcsm.invalidate(path)
+	return err
+}
+
+// cacheable returns true if the content at path is immutable.
+func (dcsm *diskCacheStorageMiddleware) cacheable(path string) bool {
+	return strings.HasPrefix(path, dcsm.prefix) && !strings.Contains(path, "..")
+}
+
+func (dcsm *diskCacheStorageMiddleware) localPath(path string) string {
+	return filepath.Join(dcsm.dataDir, filepath.FromSlash(path))
+}
+
+// open opens the cached copy of path, marking it as recently used.
+func (dcsm *diskCacheStorageMiddleware) open(path string) (*os.File, error) {
+	dcsm.mu.Lock()
+	element, ok := dcsm.entries[path]
+	if ok {
+		dcsm.lru.MoveToFront(element)
+	}
+	dcsm.mu.Unlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	// persist the order of use across restarts
+	now := time.Now()
+	os.Chtimes(dcsm.localPath(path), now, now)
+
+	return os.Open(dcsm.localPath(path))
+}
+
+// add moves the complete temporary file into the cache as the copy of path,
+// evicting the least recently used files to stay within the maximum size.
+func (dcsm *diskCacheStorageMiddleware) add(path, tmp string, size int64) error {
+	if size > dcsm.maxSize {
+		return fmt.Errorf("size %d exceeds the maximum size of the cache", size)
+	}
+
+	local := dcsm.localPath(path)
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	dcsm.mu.Lock()
+	defer dcsm.mu.Unlock()
+
+	if err := os.Rename(tmp, local); err != nil {
+		return err
+	}
+
+	if element, ok := dcsm.entries[path]; ok {
+		dcsm.size -= element.Value.(*cacheEntry).size
+		element.Value.(*cacheEntry).size = size
+		dcsm.lru.MoveToFront(element)
+	} else {
+		dcsm.entries[path] = dcsm.lru.PushFront(&cacheEntry{path: path, size: size})
+	}
+	dcsm.size += size
+
+	dcsm.evict()
+	return nil
+}
+
+// evict removes the least recently used files until the cache is within its
+// maximum size. The caller must hold the lock.
+func (dcsm *diskCacheStorageMiddleware) evict() {
+	for dcsm.size > dcsm.maxSize {
+		dcsm.remove(dcsm.lru.Back())
+	}
+}
+
+func (dcsm *diskCacheStorageMiddleware) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	dcsm.lru.Remove(element)
+	delete(dcsm.entries, entry.path)
+	dcsm.size -= entry.size
+	os.Remove(dcsm.localPath(entry.path))
+}
+
+// invalidate removes the cached copies of path and its subpaths.
+func (dcsm *diskCacheStorageMiddleware) invalidate(path string) {
+	if !dcsm.cacheable(path) && !strings.HasPrefix(dcsm.prefix, path) {
+		return
+	}
+
+	dcsm.mu.Lock()
+	defer dcsm.mu.Unlock()
+
+	dir := strings.TrimSuffix(path, "/") + "/"
+	for p, element := range dcsm.entries {
+		if p == path || strings.HasPrefix(p, dir) {
+			dcsm.remove(element)
+		}
+	}
+}
+
+// populatingReader copies the content read from the backend to a temporary
+// file, which is added to the cache once the content is read completely.
+type populatingReader struct {
+	io.ReadCloser
+	middleware *diskCacheStorageMiddleware
+	ctx        context.Context
+	path       string
+	tmp        *os.File
+	size       int64
+	failed     bool // copying to the temporary file failed
+	done       bool // the temporary file was added or removed
+}
+
+func (pr *populatingReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	if n > 0 && !pr.failed && !pr.done {
+		if _, werr := pr.tmp.Write(p[:n]); werr != nil {
+			dcontext.GetLogger(pr.ctx).Warnf("diskcache: failed to cache %s: %v", pr.path, werr)
+			pr.failed = true
+		}
+		pr.size += int64(n)
+	}
+
+	if err == io.EOF && !pr.done {
+		pr.done = true
+		if pr.failed {
+			pr.discard()
+		} else {
+			pr.complete()
+		}
+	}
+	return n, err
+}
+
+// complete adds the temporary file to the cache if its size matches the
+// size of the content in the backend.
+func (pr *populatingReader) complete() {
+	err := pr.tmp.Close()
+	if err == nil {
+		var fi storagedriver.FileInfo
+		fi, err = pr.middleware.StorageDriver.Stat(pr.ctx, pr.path)
+		if err == nil && fi.Size() != pr.size {
+			err = fmt.Errorf("read %d bytes, expected %d", pr.size, fi.Size())
+		}
+	}
+	if err == nil {
+		err = pr.middleware.add(pr.path, pr.tmp.Name(), pr.size)
+	}
+	if err != nil {
+		dcontext.GetLogger(pr.ctx).Warnf("diskcache: failed to cache %s: %v", pr.path, err)
+		os.Remove(pr.tmp.Name())
+	}
+}
+
+func (pr *populatingReader) discard() {
+	pr.tmp.Close()
+	os.Remove(pr.tmp.Name())
+}
+
+func (pr *populatingReader) Close() error {
+	if !pr.done {
+		pr.done = true
+		pr.discard()
+	}
+	return pr.ReadCloser.Close()
+}
+
+func init() {
+	storagemiddleware.Register("diskcache", storagemiddleware.InitFunc(newDiskCacheStorageMiddleware))
+}
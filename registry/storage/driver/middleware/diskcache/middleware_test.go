@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+const (
+	blobPath  = "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	otherBlob = "/docker/registry/v2/blobs/sha256/ef/efgh/data"
+	linkPath  = "/docker/registry/v2/repositories/foo/_manifests/tags/latest/current/link"
+)
+
+// countingDriver counts the reads which reach the backend.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	reads int
+}
+
+func (cd *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	cd.reads++
+	return cd.StorageDriver.GetContent(ctx, path)
+}
+
+func (cd *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	cd.reads++
+	return cd.StorageDriver.Reader(ctx, path, offset)
+}
+
+func newTestMiddleware(t *testing.T, root string, maxSize int) (*diskCacheStorageMiddleware, *countingDriver) {
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	d, err := newDiskCacheStorageMiddleware(backend, map[string]interface{}{
+		"rootdirectory": root,
+		"maxsize":       maxSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*diskCacheStorageMiddleware), backend
+}
+
+func readAll(t *testing.T, d storagedriver.StorageDriver, path string, offset int64) string {
+	rc, err := d.Reader(context.Background(), path, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	content, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, backend := newTestMiddleware(t, root, 1024)
+	if err := d.PutContent(ctx, blobPath, []byte("blob content")); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readAll(t, d, blobPath, 0); content != "blob content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if content := readAll(t, d, blobPath, 5); content != "content" {
+		t.Fatalf("unexpected content at offset: %q", content)
+	}
+	content, err := d.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "blob content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if backend.reads != 1 {
+		t.Fatalf("expected 1 backend read, got %d", backend.reads)
+	}
+
+	// the cache survives restarts
+	d, backend = newTestMiddleware(t, root, 1024)
+	if content := readAll(t, d, blobPath, 0); content != "blob content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if backend.reads != 0 {
+		t.Fatalf("expected the restarted cache to serve the blob, got %d backend reads", backend.reads)
+	}
+}
+
+func TestMutablePathsNotCached(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, backend := newTestMiddleware(t, root, 1024)
+	for _, tag := range []string{"sha256:a", "sha256:b"} {
+		if err := d.PutContent(ctx, linkPath, []byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		content, err := d.GetContent(ctx, linkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != tag {
+			t.Fatalf("unexpected content: %q", content)
+		}
+	}
+	if backend.reads != 2 || len(d.entries) != 0 {
+		t.Fatalf("expected links not to be cached")
+	}
+}
+
+func TestPartialReadNotCached(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, _ := newTestMiddleware(t, root, 1024)
+	if err := d.PutContent(ctx, blobPath, []byte("blob content")); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := d.Reader(ctx, blobPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	if len(d.entries) != 0 {
+		t.Fatalf("expected partial read not to be cached")
+	}
+	if files, _ := ioutil.ReadDir(d.tmpDir); len(files) != 0 {
+		t.Fatalf("expected temporary files to be removed, found %d", len(files))
+	}
+}
+
+func TestEvictionAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, backend := newTestMiddleware(t, root, 16)
+	for _, p := range []string{blobPath, otherBlob} {
+		if err := d.PutContent(ctx, p, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, d, p, 0)
+	}
+
+	if _, ok := d.entries[blobPath]; ok {
+		t.Fatalf("expected least recently used blob to be evicted")
+	}
+	if _, err := os.Stat(d.localPath(blobPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected evicted file to be removed: %v", err)
+	}
+	if d.size != 10 {
+		t.Fatalf("unexpected cache size: %d", d.size)
+	}
+
+	if err := d.Delete(ctx, "/docker/registry/v2/blobs/sha256/ef"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.entries) != 0 {
+		t.Fatalf("expected deleted blob to be invalidated")
+	}
+	if _, err := d.Reader(ctx, otherBlob, 0); err == nil {
+		t.Fatalf("expected deleted blob not to be served")
+	}
+	if backend.reads != 3 {
+		t.Fatalf("expected 3 backend reads, got %d", backend.reads)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"rootdirectory": "/tmp"},
+		{"rootdirectory": "/tmp", "maxsize": "big"},
+		{"rootdirectory": "/tmp", "maxsize": -1},
+	} {
+		if _, err := newDiskCacheStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Fatalf("expected error for options %v", options)
+		}
+	}
+}
@@ -0,0 +1,719 @@
+// Package middleware - encryption at rest wrapper for storage drivers
+//
+// Content is encrypted with AES-256-GCM in chunks of chunkSize bytes. Each
+// file starts with a fixed size header holding the ID of the key it was
+// encrypted with and a random salt, from which the key of the file is
+// derived. Chunks are sealed with their index and whether they are the last
+// one, so that they can't be reordered or truncated, and the last chunk is
+// always shorter than chunkSize, so that the plaintext size of a file is
+// known from its stored size and reads may start at any offset.
+//
+// The content of files written by Writer is only sealed a chunk at a time.
+// When such a writer is closed without being committed, the content of the
+// incomplete last chunk is stored under pendingRoot, along with the header,
+// so that the file can be appended to on backends which do not expose
+// content before it is committed.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+const (
+	// headerMagic identifies content written by this middleware.
+	headerMagic = "RENC"
+
+	// headerVersion is the version of the header layout.
+	headerVersion = 2
+
+	// maxKeyIDLength is the longest key ID which fits the header.
+	maxKeyIDLength = 42
+
+	// saltSize is the size of the salt the key of a file is derived from.
+	saltSize = 32
+
+	// headerSize is the size of the header: the magic, the version, the
+	// length of the key ID, the key ID padded to maxKeyIDLength and the salt.
+	headerSize = len(headerMagic) + 2 + maxKeyIDLength + saltSize
+
+	// keySize is the size of the AES-256 keys.
+	keySize = 32
+
+	// chunkSize is the size of the plaintext of all chunks but the last.
+	chunkSize = 64 << 10
+
+	// tagSize is the size of the authentication tag of each chunk.
+	tagSize = 16
+
+	// sealedChunkSize is the stored size of all chunks but the last.
+	sealedChunkSize = chunkSize + tagSize
+
+	// nonceSize is the size of the GCM nonces.
+	nonceSize = 12
+
+	// stateRoot is the directory holding the state of the middleware,
+	// hidden from List and Walk.
+	stateRoot = "/_encrypt"
+
+	// pendingRoot is the directory holding the state of the files being
+	// written.
+	pendingRoot = stateRoot + "/pending"
+)
+
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+	keys    map[string][]byte
+	current string
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+// newEncryptStorageMiddleware constructs the middleware. The options are:
+//
+// keys: a map of key IDs to the paths of the files holding the keys
+// currentkey: the ID of the key used to encrypt new content
+func newEncryptStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	k, ok := options["keys"]
+	if !ok {
+		return nil, fmt.Errorf("no keys provided")
+	}
+
+	var keyPaths map[string]string
+	switch k := k.(type) {
+	case map[string]interface{}:
+		keyPaths = make(map[string]string, len(k))
+		for id, p := range k {
+			keyPaths[id] = fmt.Sprint(p)
+		}
+	case map[interface{}]interface{}:
+		keyPaths = make(map[string]string, len(k))
+		for id, p := range k {
+			keyPaths[fmt.Sprint(id)] = fmt.Sprint(p)
+		}
+	default:
+		return nil, fmt.Errorf("keys must be a map of key IDs to key files")
+	}
+	if len(keyPaths) == 0 {
+		return nil, fmt.Errorf("no keys provided")
+	}
+
+	c, ok := options["currentkey"]
+	if !ok {
+		return nil, fmt.Errorf("no currentkey provided")
+	}
+	current := fmt.Sprint(c)
+	if _, ok := keyPaths[current]; !ok {
+		return nil, fmt.Errorf("currentkey %q is not one of the keys", current)
+	}
+
+	keys := make(map[string][]byte, len(keyPaths))
+	for id, p := range keyPaths {
+		if id == "" || len(id) > maxKeyIDLength {
+			return nil, fmt.Errorf("key ID %q must be between 1 and %d bytes long", id, maxKeyIDLength)
+		}
+
+		key, err := loadKey(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %q: %v", id, err)
+		}
+		keys[id] = key
+	}
+
+	return &encryptStorageMiddleware{StorageDriver: sd, keys: keys, current: current}, nil
+}
+
+// loadKey reads a 32 byte key from a file, either raw or base64 encoded.
+func loadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == keySize {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s must hold a %d byte key, raw or base64 encoded", path, keySize)
+	}
+	return key, nil
+}
+
+// GetContent retrieves and decrypts the content stored at "path".
+func (esm *encryptStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := esm.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) < headerSize {
+		return nil, esm.errorf("content of %s is not encrypted", path)
+	}
+
+	header := content[:headerSize]
+	aead, err := esm.aeadFromHeader(path, header)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &decryptingReader{
+		ctx:    ctx,
+		esm:    esm,
+		path:   path,
+		rc:     ioutil.NopCloser(bytes.NewReader(content[headerSize:])),
+		aead:   aead,
+		header: header,
+	}
+	return ioutil.ReadAll(dr)
+}
+
+// PutContent encrypts the content with the current key and a random salt
+// and stores it at "path".
+func (esm *encryptStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	header, aead, err := esm.newHeader(esm.current)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, 0, headerSize+len(content)+(len(content)/chunkSize+1)*tagSize)
+	sealed = append(sealed, header...)
+	var index uint64
+	for len(content) >= chunkSize {
+		sealed = aead.Seal(sealed, chunkNonce(index, false), content[:chunkSize], header)
+		content = content[chunkSize:]
+		index++
+	}
+	sealed = aead.Seal(sealed, chunkNonce(index, true), content, header)
+	return esm.StorageDriver.PutContent(ctx, path, sealed)
+}
+
+// Reader retrieves an io.ReadCloser decrypting the content stored at "path",
+// starting at the given plaintext offset.
+func (esm *encryptStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: esm.Name()}
+	}
+
+	rc, err := esm.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readHeader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, esm.errorf("failed to read header of %s: %v", path, err)
+	}
+
+	aead, err := esm.aeadFromHeader(path, header)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	index := offset / chunkSize
+	if index > 0 {
+		rc.Close()
+		rc, err = esm.StorageDriver.Reader(ctx, path, int64(headerSize)+index*sealedChunkSize)
+		if err != nil {
+			if _, ok := err.(storagedriver.InvalidOffsetError); ok {
+				err = storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: esm.Name()}
+			}
+			return nil, err
+		}
+	}
+
+	return &decryptingReader{
+		ctx:    ctx,
+		esm:    esm,
+		path:   path,
+		rc:     rc,
+		aead:   aead,
+		header: header,
+		index:  uint64(index),
+		skip:   int(offset % chunkSize),
+	}, nil
+}
+
+// Writer returns a FileWriter encrypting the content written to it. New
+// files use the current key, while appending to a file continues with the
+// key and salt recorded when its writer was closed.
+func (esm *encryptStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if !append {
+		// the state of a previous, abandoned writer
+		if err := esm.deletePending(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := esm.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &encryptingWriter{
+		FileWriter: fw,
+		ctx:        ctx,
+		esm:        esm,
+		path:       path,
+	}
+	if fw.Size() > 0 {
+		err = ew.resume()
+	} else {
+		ew.header, ew.aead, err = esm.newHeader(esm.current)
+		if err == nil {
+			_, err = fw.Write(ew.header)
+		}
+	}
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	return ew, nil
+}
+
+// Stat retrieves the FileInfo for the given path, reporting the plaintext
+// size of files.
+func (esm *encryptStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := esm.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintextFileInfo(fi), nil
+}
+
+// List returns the children of the given path, hiding the state of the
+// files being written.
+func (esm *encryptStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := esm.StorageDriver.List(ctx, path)
+	if err != nil || path != "/" {
+		return children, err
+	}
+
+	listed := children[:0]
+	for _, child := range children {
+		if child != stateRoot {
+			listed = append(listed, child)
+		}
+	}
+	return listed, nil
+}
+
+// Walk traverses the storage, reporting the plaintext size of files and
+// hiding the state of the files being written.
+func (esm *encryptStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return esm.StorageDriver.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() && fi.Path() == stateRoot {
+			return storagedriver.ErrSkipDir
+		}
+		return f(plaintextFileInfo(fi))
+	})
+}
+
+// Move moves the content at sourcePath, and the state of its writer if it
+// is being written, to destPath.
+func (esm *encryptStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := esm.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+
+	err := esm.StorageDriver.Move(ctx, pendingPath(sourcePath), pendingPath(destPath))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Delete removes the content at path, and the state of the writers of the
+// files it holds.
+func (esm *encryptStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := esm.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	return esm.deletePending(ctx, path)
+}
+
+// URLFor is not supported, as the content would be served encrypted.
+func (esm *encryptStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: esm.Name()}
+}
+
+// newHeader returns the header of a file encrypted with the key and a random
+// salt, and the AEAD sealing its chunks.
+func (esm *encryptStorageMiddleware) newHeader(keyID string) ([]byte, cipher.AEAD, error) {
+	header := make([]byte, headerSize)
+	n := copy(header, headerMagic)
+	header[n] = headerVersion
+	header[n+1] = byte(len(keyID))
+	copy(header[n+2:], keyID)
+	if _, err := rand.Read(header[headerSize-saltSize:]); err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := fileAEAD(esm.keys[keyID], header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// aeadFromHeader returns the AEAD opening the chunks of the file described
+// by the header.
+func (esm *encryptStorageMiddleware) aeadFromHeader(path string, header []byte) (cipher.AEAD, error) {
+	n := len(headerMagic)
+	if !bytes.Equal(header[:n], []byte(headerMagic)) || header[n] != headerVersion {
+		return nil, esm.errorf("content of %s is not encrypted", path)
+	}
+
+	idLength := int(header[n+1])
+	if idLength > maxKeyIDLength {
+		return nil, esm.errorf("invalid header in %s", path)
+	}
+
+	keyID := string(header[n+2 : n+2+idLength])
+	key, ok := esm.keys[keyID]
+	if !ok {
+		return nil, esm.errorf("content of %s is encrypted with unknown key %q", path, keyID)
+	}
+
+	return fileAEAD(key, header)
+}
+
+// putPending stores the header of the file being written at path, and the
+// plaintext of its incomplete chunk at index, sealed with a random nonce.
+func (esm *encryptStorageMiddleware) putPending(ctx context.Context, path string, aead cipher.AEAD, header []byte, index uint64, tail []byte) error {
+	pending := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(tail)+tagSize)
+	copy(pending, header)
+	nonce := pending[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	pending = aead.Seal(pending, nonce, tail, pendingData(header, index))
+	return esm.StorageDriver.PutContent(ctx, pendingPath(path), pending)
+}
+
+// getPending returns the header of the file being written at path, and the
+// plaintext of its incomplete chunk at index.
+func (esm *encryptStorageMiddleware) getPending(ctx context.Context, path string, index uint64) ([]byte, cipher.AEAD, []byte, error) {
+	pending, err := esm.StorageDriver.GetContent(ctx, pendingPath(path))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil, nil, esm.errorf("content of %s is incomplete", path)
+		}
+		return nil, nil, nil, err
+	}
+	if len(pending) < headerSize+nonceSize {
+		return nil, nil, nil, esm.errorf("invalid writer state of %s", path)
+	}
+
+	header := pending[:headerSize]
+	aead, err := esm.aeadFromHeader(path, header)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tail, err := aead.Open(nil, pending[headerSize:headerSize+nonceSize], pending[headerSize+nonceSize:], pendingData(header, index))
+	if err != nil {
+		return nil, nil, nil, esm.errorf("invalid writer state of %s: %v", path, err)
+	}
+	return header, aead, tail, nil
+}
+
+// deletePending removes the state of the writers of the files under path.
+func (esm *encryptStorageMiddleware) deletePending(ctx context.Context, path string) error {
+	err := esm.StorageDriver.Delete(ctx, pendingPath(path))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (esm *encryptStorageMiddleware) errorf(format string, args ...interface{}) error {
+	return storagedriver.Error{
+		DriverName: esm.Name(),
+		Enclosed:   fmt.Errorf(format, args...),
+	}
+}
+
+// fileAEAD returns the AEAD of the file described by the header, keyed with
+// the key derived from the master key and the salt.
+func fileAEAD(masterKey, header []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(header[headerSize-saltSize:])
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk at index.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// pendingData returns the additional data authenticated with the incomplete
+// chunk at index of a file being written.
+func pendingData(header []byte, index uint64) []byte {
+	data := make([]byte, headerSize+8)
+	copy(data, header)
+	binary.BigEndian.PutUint64(data[headerSize:], index)
+	return data
+}
+
+func pendingPath(p string) string {
+	return path.Join(pendingRoot, p)
+}
+
+func readHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func plaintextFileInfo(fi storagedriver.FileInfo) storagedriver.FileInfo {
+	if fi.IsDir() {
+		return fi
+	}
+
+	var size int64
+	if stored := fi.Size() - int64(headerSize); stored > 0 {
+		size = stored / sealedChunkSize * chunkSize
+		if last := stored % sealedChunkSize; last > tagSize {
+			size += last - tagSize
+		}
+	}
+
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   false,
+	}}
+}
+
+type decryptingReader struct {
+	ctx    context.Context
+	esm    *encryptStorageMiddleware
+	path   string
+	rc     io.ReadCloser
+	aead   cipher.AEAD
+	header []byte
+	index  uint64
+	// skip is the number of plaintext bytes to skip from the first chunk.
+	skip   int
+	sealed []byte
+	plain  []byte
+	err    error
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		dr.plain, dr.err = dr.next()
+		if dr.skip > 0 {
+			if dr.skip > len(dr.plain) {
+				dr.skip = len(dr.plain)
+			}
+			dr.plain, dr.skip = dr.plain[dr.skip:], 0
+		}
+	}
+
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// next returns the plaintext of the next chunk, and io.EOF after the last
+// one.
+func (dr *decryptingReader) next() ([]byte, error) {
+	if dr.sealed == nil {
+		dr.sealed = make([]byte, sealedChunkSize)
+	}
+
+	n, err := io.ReadFull(dr.rc, dr.sealed)
+	switch err {
+	case nil:
+		plain, err := dr.aead.Open(dr.sealed[:0], chunkNonce(dr.index, false), dr.sealed, dr.header)
+		if err != nil {
+			return nil, dr.esm.errorf("failed to decrypt %s: %v", dr.path, err)
+		}
+		dr.index++
+		return plain, nil
+	case io.ErrUnexpectedEOF:
+		plain, err := dr.aead.Open(dr.sealed[:0], chunkNonce(dr.index, true), dr.sealed[:n], dr.header)
+		if err != nil {
+			return nil, dr.esm.errorf("failed to decrypt %s: %v", dr.path, err)
+		}
+		return plain, io.EOF
+	case io.EOF:
+		// the file is still being written
+		header, _, tail, err := dr.esm.getPending(dr.ctx, dr.path, dr.index)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(header, dr.header) {
+			return nil, dr.esm.errorf("invalid writer state of %s", dr.path)
+		}
+		return tail, io.EOF
+	default:
+		return nil, err
+	}
+}
+
+func (dr *decryptingReader) Close() error {
+	return dr.rc.Close()
+}
+
+type encryptingWriter struct {
+	storagedriver.FileWriter
+	ctx    context.Context
+	esm    *encryptStorageMiddleware
+	path   string
+	aead   cipher.AEAD
+	header []byte
+	// index is the index of the chunk being buffered.
+	index  uint64
+	buf    []byte
+	sealed []byte
+	size   int64
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+// resume continues the file written so far, from the state stored when its
+// previous writer was closed.
+func (ew *encryptingWriter) resume() error {
+	stored := ew.FileWriter.Size() - int64(headerSize)
+	if stored < 0 || stored%sealedChunkSize != 0 {
+		return ew.esm.errorf("content of %s is not being written", ew.path)
+	}
+
+	ew.index = uint64(stored / sealedChunkSize)
+	header, aead, tail, err := ew.esm.getPending(ew.ctx, ew.path, ew.index)
+	if err != nil {
+		return err
+	}
+
+	ew.header, ew.aead = header, aead
+	ew.buf = append(make([]byte, 0, chunkSize), tail...)
+	ew.size = stored/sealedChunkSize*chunkSize + int64(len(tail))
+	return nil
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	if ew.buf == nil {
+		ew.buf = make([]byte, 0, chunkSize)
+	}
+
+	var written int
+	for len(p) > 0 {
+		// full chunks are only sealed once more content follows, so that
+		// the last chunk is always shorter than chunkSize
+		if len(ew.buf) == chunkSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+		ew.size += int64(n)
+	}
+	return written, nil
+}
+
+// seal writes the buffered chunk.
+func (ew *encryptingWriter) seal(last bool) error {
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], chunkNonce(ew.index, last), ew.buf, ew.header)
+	if _, err := ew.FileWriter.Write(ew.sealed); err != nil {
+		return err
+	}
+	ew.index++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Size returns the number of plaintext bytes written to this FileWriter.
+func (ew *encryptingWriter) Size() int64 {
+	return ew.size
+}
+
+// Close stores the incomplete chunk of a file which is not committed, so
+// that it can be appended to.
+func (ew *encryptingWriter) Close() error {
+	if ew.closed {
+		return ew.FileWriter.Close()
+	}
+	ew.closed = true
+
+	if !ew.committed && !ew.cancelled {
+		if err := ew.esm.putPending(ew.ctx, ew.path, ew.aead, ew.header, ew.index, ew.buf); err != nil {
+			ew.FileWriter.Close()
+			return err
+		}
+	}
+	return ew.FileWriter.Close()
+}
+
+func (ew *encryptingWriter) Cancel() error {
+	ew.cancelled = true
+	if err := ew.FileWriter.Cancel(); err != nil {
+		return err
+	}
+	return ew.esm.deletePending(ew.ctx, ew.path)
+}
+
+func (ew *encryptingWriter) Commit() error {
+	if len(ew.buf) == chunkSize {
+		if err := ew.seal(false); err != nil {
+			return err
+		}
+	}
+	if err := ew.seal(true); err != nil {
+		return err
+	}
+	if err := ew.FileWriter.Commit(); err != nil {
+		return err
+	}
+	ew.committed = true
+	return ew.esm.deletePending(ew.ctx, ew.path)
+}
+
+func init() {
+	storagemiddleware.Register("encrypt", storagemiddleware.InitFunc(newEncryptStorageMiddleware))
+}
@@ -0,0 +1,257 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+var keyDir string
+
+func init() {
+	var err error
+	keyDir, err = ioutil.TempDir("", "encrypt-middleware")
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return newEncryptStorageMiddleware(inmemory.New(), testOptions(nil, "a", "a"))
+	}, testsuites.NeverSkip)
+}
+
+// testOptions writes a key file for each key ID, the first one raw and the
+// others base64 encoded, and returns the middleware options.
+func testOptions(t *testing.T, current string, ids ...string) map[string]interface{} {
+	keys := make(map[interface{}]interface{})
+	for i, id := range ids {
+		key := bytes.Repeat([]byte(id), keySize)[:keySize]
+		data := key
+		if i > 0 {
+			data = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+		}
+
+		p := filepath.Join(keyDir, id)
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			if t != nil {
+				t.Fatal(err)
+			}
+			panic(err)
+		}
+		keys[id] = p
+	}
+
+	return map[string]interface{}{
+		"keys":       keys,
+		"currentkey": current,
+	}
+}
+
+func TestEncryptsContent(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := newEncryptStorageMiddleware(backend, testOptions(t, "a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("plaintext"), 100)
+	if err := d.PutContent(ctx, "/put", content); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.Writer(ctx, "/writer", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	for _, p := range []string{"/put", "/writer"} {
+		stored, err := backend.GetContent(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(stored, []byte("plaintext")) {
+			t.Fatalf("%s is stored unencrypted", p)
+		}
+
+		fi, err := d.Stat(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(content)) {
+			t.Fatalf("unexpected size of %s: %d", p, fi.Size())
+		}
+	}
+
+	if _, err := d.URLFor(ctx, "/put", nil); err == nil {
+		t.Fatalf("expected URLFor to be unsupported")
+	} else if _, ok := err.(storagedriver.ErrUnsupportedMethod); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRewritesAreAuthenticated(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := newEncryptStorageMiddleware(backend, testOptions(t, "a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// content spanning several chunks, written twice at the same path
+	content := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/16*2+100)
+	var stored [][]byte
+	for i := 0; i < 2; i++ {
+		w, err := d.Writer(ctx, "/blob", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		s, err := backend.GetContent(ctx, "/blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, s)
+	}
+	if bytes.Equal(stored[0][headerSize:], stored[1][headerSize:]) {
+		t.Fatalf("rewriting a path reused its key stream")
+	}
+
+	r, err := d.Reader(ctx, "/blob", chunkSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, content[chunkSize+10:]) {
+		t.Fatalf("unexpected content read from an offset")
+	}
+
+	tampered := append([]byte(nil), stored[1]...)
+	tampered[headerSize+sealedChunkSize+1] ^= 1
+	if err := backend.PutContent(ctx, "/blob", tampered); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, "/blob"); err == nil {
+		t.Fatalf("expected error reading modified content")
+	}
+
+	truncated := stored[1][:headerSize+sealedChunkSize]
+	if err := backend.PutContent(ctx, "/blob", truncated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, "/blob"); err == nil {
+		t.Fatalf("expected error reading truncated content")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	old, err := newEncryptStorageMiddleware(backend, testOptions(t, "a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := old.PutContent(ctx, "/old", []byte("old content")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := old.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.Repeat([]byte("first "), chunkSize/6+1)
+	if _, err := w.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	rotated, err := newEncryptStorageMiddleware(backend, testOptions(t, "b", "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := rotated.GetContent(ctx, "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "old content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	// appending keeps the key the file was created with
+	w, err = rotated.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	content, err = rotated.GetContent(ctx, "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(first)+"second" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	// content written with a key which is no longer configured can't be read
+	if err := rotated.PutContent(ctx, "/new", []byte("new content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.GetContent(ctx, "/new"); err == nil {
+		t.Fatalf("expected error reading content encrypted with an unknown key")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"keys": "a"},
+		testOptions(t, "b", "a"),
+		{"keys": map[interface{}]interface{}{"a": filepath.Join(keyDir, "missing")}, "currentkey": "a"},
+	} {
+		if _, err := newEncryptStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Fatalf("expected error for options %v", options)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.RemoveAll(keyDir)
+	os.Exit(code)
+}
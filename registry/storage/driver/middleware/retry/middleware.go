@@ -0,0 +1,283 @@
+// Package middleware - retry, timeout and rate limit wrapper for storage drivers
+//
+// Every call to the storage driver waits for the rate limiter, and fails if
+// it does not return within the timeout. Idempotent calls which fail for
+// reasons other than the request itself, such as a missing path, are retried
+// with exponential backoff.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRetries    = 3
+	defaultBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// errTimeout is returned when a call to the storage driver does not return
+// within the timeout.
+var errTimeout = errors.New("timed out")
+
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	limiter    *rate.Limiter
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+// newRetryStorageMiddleware constructs the middleware. The options are:
+//
+// timeout: the duration after which a call fails, none by default
+// retries: the number of retries of failed idempotent calls, 3 by default
+// backoff: the delay before the first retry, doubled for each retry
+// maxbackoff: the maximum delay between retries
+// ratelimit: the maximum number of calls per second, unlimited by default
+// burst: the number of calls which may exceed the rate limit at once
+func newRetryStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	rsm := &retryStorageMiddleware{
+		StorageDriver: sd,
+		retries:       defaultRetries,
+		backoff:       defaultBackoff,
+		maxBackoff:    defaultMaxBackoff,
+	}
+
+	for name, d := range map[string]*time.Duration{
+		"timeout":    &rsm.timeout,
+		"backoff":    &rsm.backoff,
+		"maxbackoff": &rsm.maxBackoff,
+	} {
+		if v, ok := options[name]; ok {
+			duration, err := time.ParseDuration(fmt.Sprint(v))
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative duration, %v invalid", name, v)
+			}
+			*d = duration
+		}
+	}
+
+	if v, ok := options["retries"]; ok {
+		retries, err := strconv.Atoi(fmt.Sprint(v))
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("retries must be a non-negative integer, %v invalid", v)
+		}
+		rsm.retries = retries
+	}
+
+	if v, ok := options["ratelimit"]; ok {
+		limit, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("ratelimit must be a positive number, %v invalid", v)
+		}
+
+		burst := int(limit)
+		if burst < 1 {
+			burst = 1
+		}
+		if v, ok := options["burst"]; ok {
+			if burst, err = strconv.Atoi(fmt.Sprint(v)); err != nil || burst < 1 {
+				return nil, fmt.Errorf("burst must be a positive integer, %v invalid", v)
+			}
+		}
+		rsm.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+
+	return rsm, nil
+}
+
+// GetContent retrieves the content stored at "path", retrying on failure.
+func (rsm *retryStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	v, err := rsm.call(ctx, "GetContent", path, true, false, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.GetContent(ctx, path)
+	})
+	content, _ := v.([]byte)
+	return content, err
+}
+
+// PutContent stores the content at "path".
+func (rsm *retryStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	_, err := rsm.call(ctx, "PutContent", path, false, false, func(ctx context.Context) (interface{}, error) {
+		return nil, rsm.StorageDriver.PutContent(ctx, path, content)
+	})
+	return err
+}
+
+// Reader opens the content stored at "path", retrying on failure. The
+// timeout applies to opening the content, not to reading it.
+func (rsm *retryStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	v, err := rsm.call(ctx, "Reader", path, true, true, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.Reader(ctx, path, offset)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(io.ReadCloser), nil
+}
+
+// Writer opens a FileWriter for "path". The timeout applies to opening the
+// writer, not to writing to it.
+func (rsm *retryStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	v, err := rsm.call(ctx, "Writer", path, false, true, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.Writer(ctx, path, append)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(storagedriver.FileWriter), nil
+}
+
+// Stat retrieves the FileInfo for "path", retrying on failure.
+func (rsm *retryStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	v, err := rsm.call(ctx, "Stat", path, true, false, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.Stat(ctx, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(storagedriver.FileInfo), nil
+}
+
+// List returns the direct descendants of "path", retrying on failure.
+func (rsm *retryStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	v, err := rsm.call(ctx, "List", path, true, false, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.List(ctx, path)
+	})
+	children, _ := v.([]string)
+	return children, err
+}
+
+// Move moves the content at sourcePath to destPath.
+func (rsm *retryStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	_, err := rsm.call(ctx, "Move", sourcePath, false, false, func(ctx context.Context) (interface{}, error) {
+		return nil, rsm.StorageDriver.Move(ctx, sourcePath, destPath)
+	})
+	return err
+}
+
+// Delete deletes the content at "path" and its subpaths.
+func (rsm *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	_, err := rsm.call(ctx, "Delete", path, false, false, func(ctx context.Context) (interface{}, error) {
+		return nil, rsm.StorageDriver.Delete(ctx, path)
+	})
+	return err
+}
+
+// URLFor returns a URL for the content at "path".
+func (rsm *retryStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	v, err := rsm.call(ctx, "URLFor", path, false, false, func(ctx context.Context) (interface{}, error) {
+		return rsm.StorageDriver.URLFor(ctx, path, options)
+	})
+	url, _ := v.(string)
+	return url, err
+}
+
+// call calls op, retrying it if it is idempotent and fails for a reason
+// other than the request itself.
+func (rsm *retryStorageMiddleware) call(ctx context.Context, action, path string, idempotent, stream bool, op func(context.Context) (interface{}, error)) (interface{}, error) {
+	backoff := rsm.backoff
+	for attempt := 0; ; attempt++ {
+		v, err := rsm.attempt(ctx, stream, op)
+		if err == nil || !idempotent || attempt >= rsm.retries || !retryable(err) || ctx.Err() != nil {
+			return v, err
+		}
+
+		dcontext.GetLogger(ctx).Warnf("retrying %s.%s(%q) in %s: %v", rsm.Name(), action, path, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > rsm.maxBackoff {
+			backoff = rsm.maxBackoff
+		}
+	}
+}
+
+type result struct {
+	v   interface{}
+	err error
+}
+
+// attempt calls op once, after waiting for the rate limiter, and waits for
+// it at most for the timeout. The context of streams has no deadline, since
+// it governs reading or writing them after op returns. Results returned
+// after the timeout are closed.
+func (rsm *retryStorageMiddleware) attempt(ctx context.Context, stream bool, op func(context.Context) (interface{}, error)) (interface{}, error) {
+	if rsm.limiter != nil {
+		if err := rsm.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if rsm.timeout <= 0 {
+		return op(ctx)
+	}
+
+	opCtx, cancel := ctx, context.CancelFunc(func() {})
+	if !stream {
+		opCtx, cancel = context.WithTimeout(ctx, rsm.timeout)
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		v, err := op(opCtx)
+		done <- result{v: v, err: err}
+	}()
+
+	timer := time.NewTimer(rsm.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case r := <-done:
+		cancel()
+		return r.v, r.err
+	case <-timer.C:
+		err = storagedriver.Error{DriverName: rsm.Name(), Enclosed: errTimeout}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cancel()
+	go func() {
+		if r := <-done; r.err == nil {
+			if closer, ok := r.v.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}()
+	return nil, err
+}
+
+// retryable returns true if the error may not occur again.
+func retryable(err error) bool {
+	switch err.(type) {
+	case storagedriver.PathNotFoundError, storagedriver.InvalidPathError, storagedriver.InvalidOffsetError, storagedriver.ErrUnsupportedMethod:
+		return false
+	}
+	return true
+}
+
+func init() {
+	storagemiddleware.Register("retry", storagemiddleware.InitFunc(newRetryStorageMiddleware))
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return newRetryStorageMiddleware(inmemory.New(), map[string]interface{}{
+			"timeout":   "10s",
+			"backoff":   "1ms",
+			"ratelimit": 1000,
+		})
+	}, testsuites.NeverSkip)
+}
+
+// flakyDriver fails the first failures calls, and delays calls by delay.
+type flakyDriver struct {
+	storagedriver.StorageDriver
+	failures int
+	calls    int
+	delay    time.Duration
+}
+
+func (fd *flakyDriver) fail() error {
+	fd.calls++
+	time.Sleep(fd.delay)
+	if fd.calls <= fd.failures {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (fd *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := fd.fail(); err != nil {
+		return nil, err
+	}
+	return fd.StorageDriver.GetContent(ctx, path)
+}
+
+func (fd *flakyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := fd.fail(); err != nil {
+		return err
+	}
+	return fd.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (fd *flakyDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fd.calls++
+	return fd.StorageDriver.Stat(ctx, path)
+}
+
+func newTestMiddleware(t *testing.T, fd *flakyDriver, options map[string]interface{}) storagedriver.StorageDriver {
+	if _, ok := options["backoff"]; !ok {
+		options["backoff"] = "1ms"
+	}
+	d, err := newRetryStorageMiddleware(fd, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRetriesIdempotentCalls(t *testing.T) {
+	ctx := context.Background()
+	fd := &flakyDriver{StorageDriver: inmemory.New()}
+	d := newTestMiddleware(t, fd, map[string]interface{}{})
+
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	fd.calls, fd.failures = 0, 2
+	content, err := d.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" || fd.calls != 3 {
+		t.Fatalf("unexpected content %q after %d calls", content, fd.calls)
+	}
+
+	fd.calls, fd.failures = 0, 10
+	if _, err := d.GetContent(ctx, "/a"); err == nil {
+		t.Fatalf("expected error after exhausting retries")
+	}
+	if fd.calls != defaultRetries+1 {
+		t.Fatalf("expected %d calls, got %d", defaultRetries+1, fd.calls)
+	}
+}
+
+func TestDoesNotRetryWrites(t *testing.T) {
+	fd := &flakyDriver{StorageDriver: inmemory.New(), failures: 1}
+	d := newTestMiddleware(t, fd, map[string]interface{}{})
+
+	if err := d.PutContent(context.Background(), "/a", []byte("content")); err == nil {
+		t.Fatalf("expected write to fail")
+	}
+	if fd.calls != 1 {
+		t.Fatalf("expected 1 call, got %d", fd.calls)
+	}
+}
+
+func TestDoesNotRetryPathNotFound(t *testing.T) {
+	fd := &flakyDriver{StorageDriver: inmemory.New()}
+	d := newTestMiddleware(t, fd, map[string]interface{}{})
+
+	_, err := d.Stat(context.Background(), "/missing")
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("expected PathNotFoundError, got %v", err)
+	}
+	if fd.calls != 1 {
+		t.Fatalf("expected 1 call, got %d", fd.calls)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	fd := &flakyDriver{StorageDriver: inmemory.New(), delay: time.Second}
+	d := newTestMiddleware(t, fd, map[string]interface{}{
+		"timeout": "10ms",
+		"retries": 0,
+	})
+
+	start := time.Now()
+	err := d.PutContent(context.Background(), "/a", []byte("content"))
+	if e, ok := err.(storagedriver.Error); !ok || e.Enclosed != errTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected call to time out, took %s", elapsed)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	fd := &flakyDriver{StorageDriver: inmemory.New()}
+	d := newTestMiddleware(t, fd, map[string]interface{}{
+		"ratelimit": 20,
+		"burst":     1,
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected calls to be rate limited, took %s", elapsed)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"timeout": "soon"},
+		{"backoff": "-1s"},
+		{"retries": "many"},
+		{"retries": -1},
+		{"ratelimit": 0},
+		{"ratelimit": 10, "burst": 0},
+	} {
+		if _, err := newRetryStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Fatalf("expected error for options %v", options)
+		}
+	}
+}
@@ -0,0 +1,707 @@
+// Package mirror provides a storage driver which mirrors its content to
+// several storage drivers, so that the content survives the loss of any of
+// them.
+//
+// Writes are applied to all drivers and succeed if they succeed on any of
+// them. Reads are served by the primary driver, failing over to the
+// secondaries. Paths which differ between the drivers because a write failed
+// or a read had to fail over are recorded under stateRoot on all drivers,
+// served by the driver holding the expected content and repaired in the
+// background, and a periodic scan may copy files missing from any of the
+// drivers.
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/base"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+const (
+	driverName = "mirror"
+
+	defaultRepairInterval = time.Minute
+
+	// stateRoot is the directory holding the state of the driver, hidden
+	// from List and Walk.
+	stateRoot = "/_mirror"
+
+	// divergentRoot is the directory recording the divergent paths.
+	divergentRoot = stateRoot + "/divergent"
+)
+
+// errWritersFailed is returned by a writer whose mirrored writers all failed.
+var errWritersFailed = errors.New("mirror: all the writers failed")
+
+// DriverParameters represents all configuration options available for the
+// mirror driver.
+type DriverParameters struct {
+	// Primary serves reads while it is available.
+	Primary storagedriver.StorageDriver
+
+	// Secondaries receive all writes and serve reads when the primary
+	// fails.
+	Secondaries []storagedriver.StorageDriver
+
+	// RepairInterval is the interval between repairs of paths which differ
+	// between the drivers.
+	RepairInterval time.Duration
+
+	// ScanInterval is the interval between scans for files missing from any
+	// of the drivers. Zero disables scanning.
+	ScanInterval time.Duration
+}
+
+func init() {
+	factory.Register(driverName, &mirrorDriverFactory{})
+}
+
+// mirrorDriverFactory implements the factory.StorageDriverFactory interface
+type mirrorDriverFactory struct{}
+
+func (factory *mirrorDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	// drivers holds the primary driver followed by the secondaries.
+	drivers []storagedriver.StorageDriver
+
+	// divergent maps paths which may differ between the drivers to the
+	// index of a driver holding the expected content.
+	divergent map[string]int
+	mu        sync.Mutex
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation mirroring its
+// content to several storage drivers.
+type Driver struct {
+	baseEmbed
+}
+
+// FromParameters constructs a new Driver with a given parameters map.
+// Required parameters:
+// - primary: a map of a storage driver name to its parameters
+// - secondaries: a list of maps of storage driver names to their parameters
+// Optional parameters:
+// - repairinterval
+// - scaninterval
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params := DriverParameters{
+		RepairInterval: defaultRepairInterval,
+	}
+
+	primary, err := createDriver(parameters["primary"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary: %v", err)
+	}
+	params.Primary = primary
+
+	secondaries, ok := parameters["secondaries"].([]interface{})
+	if !ok || len(secondaries) == 0 {
+		return nil, fmt.Errorf("secondaries must be a non-empty list of storage drivers")
+	}
+	for i, s := range secondaries {
+		secondary, err := createDriver(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secondary %d: %v", i, err)
+		}
+		params.Secondaries = append(params.Secondaries, secondary)
+	}
+
+	for name, interval := range map[string]*time.Duration{
+		"repairinterval": &params.RepairInterval,
+		"scaninterval":   &params.ScanInterval,
+	} {
+		v, ok := parameters[name]
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		if d <= 0 && name == "repairinterval" {
+			return nil, fmt.Errorf("repairinterval must be positive")
+		}
+		*interval = d
+	}
+
+	return New(params), nil
+}
+
+// createDriver creates the storage driver described by a map of a single
+// storage driver name to its parameters.
+func createDriver(v interface{}) (storagedriver.StorageDriver, error) {
+	config, err := stringMap(v)
+	if err != nil || len(config) != 1 {
+		return nil, fmt.Errorf("must be a map of a single storage driver name to its parameters")
+	}
+
+	for name, p := range config {
+		var parameters map[string]interface{}
+		if p != nil && p != "" {
+			if parameters, err = stringMap(p); err != nil {
+				return nil, fmt.Errorf("parameters of %s must be a map", name)
+			}
+		}
+		return factory.Create(name, parameters)
+	}
+	return nil, nil
+}
+
+func stringMap(v interface{}) (map[string]interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = val
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("expected a map, got %T", v)
+	}
+}
+
+// New constructs a new Driver mirroring its content to the given drivers,
+// and starts repairing them in the background.
+func New(params DriverParameters) *Driver {
+	d := newDriver(params)
+	d.loadDivergent(context.Background())
+
+	go d.repairPeriodically(params.RepairInterval)
+	if params.ScanInterval > 0 {
+		go d.scanPeriodically(params.ScanInterval)
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}
+}
+
+// SetSlowThresholds configures the logging of the slow actions of the driver
+// and of the mirrored drivers.
+func (d *Driver) SetSlowThresholds(thresholds base.SlowThresholds) {
+	d.Base.SetSlowThresholds(thresholds)
+	for _, driver := range d.Base.StorageDriver.(*driver).drivers {
+		if driver, ok := driver.(interface {
+			SetSlowThresholds(base.SlowThresholds)
+		}); ok {
+			driver.SetSlowThresholds(thresholds)
+		}
+	}
+}
+
+func newDriver(params DriverParameters) *driver {
+	return &driver{
+		drivers:   append([]storagedriver.StorageDriver{params.Primary}, params.Secondaries...),
+		divergent: make(map[string]int),
+	}
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := d.read(ctx, path, func(sd storagedriver.StorageDriver) error {
+		var err error
+		content, err = sd.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	return d.write(ctx, []string{path}, func(sd storagedriver.StorageDriver) error {
+		return sd.PutContent(ctx, path, contents)
+	})
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.read(ctx, path, func(sd storagedriver.StorageDriver) error {
+		var err error
+		rc, err = sd.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" on all drivers.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{driver: d, ctx: ctx, path: path}
+	var firstErr error
+	for i, sd := range d.drivers {
+		fw, err := sd.Writer(ctx, path, appendMode)
+		if err != nil {
+			if i == 0 {
+				firstErr = err
+			}
+			logDriverError(ctx, sd, "Writer", path, err)
+			w.failed = true
+			continue
+		}
+
+		// drop writers appending to content which already differs
+		if len(w.writers) > 0 && fw.Size() != w.writers[0].fw.Size() {
+			dcontext.GetLogger(ctx).Warnf("mirror: dropping %s writer for %s: size %d differs from %d", sd.Name(), path, fw.Size(), w.writers[0].fw.Size())
+			fw.Close()
+			w.failed = true
+			continue
+		}
+
+		w.writers = append(w.writers, mirroredWriter{index: i, fw: fw})
+	}
+
+	if len(w.writers) == 0 {
+		return nil, firstErr
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := d.read(ctx, path, func(sd storagedriver.StorageDriver) error {
+		var err error
+		fi, err = sd.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	var children []string
+	err := d.failover(ctx, path, func(sd storagedriver.StorageDriver) error {
+		var err error
+		children, err = sd.List(ctx, path)
+		return err
+	})
+	if err != nil || path != "/" {
+		return children, err
+	}
+
+	listed := children[:0]
+	for _, child := range children {
+		if child != stateRoot {
+			listed = append(listed, child)
+		}
+	}
+	return listed, nil
+}
+
+// Move moves an object stored at sourcePath to destPath on all drivers.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return d.write(ctx, []string{sourcePath, destPath}, func(sd storagedriver.StorageDriver) error {
+		return sd.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Delete recursively deletes all objects stored at "path" on all drivers.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	return d.write(ctx, []string{path}, func(sd storagedriver.StorageDriver) error {
+		return sd.Delete(ctx, path)
+	})
+}
+
+// URLFor returns a URL of the first driver holding the content at "path".
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	var url string
+	err := d.failover(ctx, path, func(sd storagedriver.StorageDriver) error {
+		if _, err := sd.Stat(ctx, path); err != nil {
+			return err
+		}
+
+		var err error
+		url, err = sd.URLFor(ctx, path, options)
+		return err
+	})
+	return url, err
+}
+
+// Walk traverses the primary driver, or the first secondary driver which
+// can be walked if the primary fails before any file is visited.
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	var visited bool
+	var firstErr error
+	for i, sd := range d.drivers {
+		err := sd.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+			if fi.IsDir() && fi.Path() == stateRoot {
+				return storagedriver.ErrSkipDir
+			}
+			visited = true
+			return f(fi)
+		})
+		if err == nil || visited || isRequestError(err) {
+			return err
+		}
+
+		if i == 0 {
+			firstErr = err
+		}
+		logDriverError(ctx, sd, "Walk", path, err)
+	}
+	return firstErr
+}
+
+// read calls op on each driver until it succeeds, starting with the driver
+// holding the expected content of divergent paths, which is trusted to
+// report them missing. Paths found on a secondary driver only are marked as
+// divergent.
+func (d *driver) read(ctx context.Context, path string, op func(storagedriver.StorageDriver) error) error {
+	source, divergent := d.source(path)
+	var notFound bool
+	var firstErr error
+	for n, i := range d.order(source) {
+		sd := d.drivers[i]
+		err := op(sd)
+		if err == nil {
+			if notFound {
+				d.markDivergent(ctx, path, i)
+			}
+			return nil
+		}
+		if isRequestError(err) {
+			return err
+		}
+
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			if divergent && i == source {
+				return err
+			}
+			notFound = true
+		} else {
+			logDriverError(ctx, sd, "read", path, err)
+		}
+		if n == 0 {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// failover calls op on each driver until it succeeds, starting with the
+// driver holding the expected content of divergent paths, which is trusted
+// to report them missing.
+func (d *driver) failover(ctx context.Context, path string, op func(storagedriver.StorageDriver) error) error {
+	source, divergent := d.source(path)
+	var firstErr error
+	for n, i := range d.order(source) {
+		err := op(d.drivers[i])
+		if err == nil || isRequestError(err) {
+			return err
+		}
+		if _, ok := err.(storagedriver.PathNotFoundError); ok && divergent && i == source {
+			return err
+		}
+
+		if n == 0 {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// order returns the indexes of the drivers, starting with first.
+func (d *driver) order(first int) []int {
+	order := make([]int, 0, len(d.drivers))
+	order = append(order, first)
+	for i := range d.drivers {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// write calls op on all drivers concurrently. It succeeds if op succeeds on
+// any driver, marking the paths as divergent if it failed on others.
+func (d *driver) write(ctx context.Context, paths []string, op func(storagedriver.StorageDriver) error) error {
+	errs := make([]error, len(d.drivers))
+	var wg sync.WaitGroup
+	for i, sd := range d.drivers {
+		wg.Add(1)
+		go func(i int, sd storagedriver.StorageDriver) {
+			defer wg.Done()
+			errs[i] = op(sd)
+		}(i, sd)
+	}
+	wg.Wait()
+
+	source := -1
+	for i, err := range errs {
+		if err == nil {
+			source = i
+			break
+		}
+	}
+	if source < 0 {
+		return errs[0]
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			logDriverError(ctx, d.drivers[i], "write", paths[0], err)
+			for _, path := range paths {
+				d.markDivergent(ctx, path, source)
+			}
+		}
+	}
+	return nil
+}
+
+// divergentPath is the record of a divergent path stored under
+// divergentRoot.
+type divergentPath struct {
+	Path   string `json:"path"`
+	Source int    `json:"source"`
+}
+
+// markDivergent records that the content at path may differ between the
+// drivers, and that the driver at source holds the expected content. The
+// record is stored on all drivers which are available, so that it survives
+// restarts.
+func (d *driver) markDivergent(ctx context.Context, path string, source int) {
+	d.mu.Lock()
+	d.divergent[path] = source
+	d.mu.Unlock()
+
+	record, err := json.Marshal(divergentPath{Path: path, Source: source})
+	if err != nil {
+		return
+	}
+	for _, sd := range d.drivers {
+		if err := sd.PutContent(ctx, recordPath(path), record); err != nil {
+			logDriverError(ctx, sd, "record of divergent path", path, err)
+		}
+	}
+}
+
+// clearDivergent removes the stored records of a repaired path.
+func (d *driver) clearDivergent(ctx context.Context, path string) {
+	for _, sd := range d.drivers {
+		if err := sd.Delete(ctx, recordPath(path)); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				logDriverError(ctx, sd, "removal of divergent path record", path, err)
+			}
+		}
+	}
+}
+
+// loadDivergent loads the divergent paths recorded on all drivers.
+func (d *driver) loadDivergent(ctx context.Context) {
+	for _, sd := range d.drivers {
+		records, err := sd.List(ctx, divergentRoot)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				logDriverError(ctx, sd, "List", divergentRoot, err)
+			}
+			continue
+		}
+
+		for _, p := range records {
+			content, err := sd.GetContent(ctx, p)
+			if err != nil {
+				logDriverError(ctx, sd, "GetContent", p, err)
+				continue
+			}
+
+			var record divergentPath
+			if err := json.Unmarshal(content, &record); err != nil || record.Source < 0 || record.Source >= len(d.drivers) {
+				dcontext.GetLogger(ctx).Warnf("mirror: ignoring invalid record %s on %s", p, sd.Name())
+				continue
+			}
+
+			d.mu.Lock()
+			if _, ok := d.divergent[record.Path]; !ok {
+				d.divergent[record.Path] = record.Source
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// source returns the index of the driver holding the expected content of
+// path if it, or one of its parents, is divergent.
+func (d *driver) source(path string) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.divergent) == 0 {
+		return 0, false
+	}
+	for p := path; ; p = parent(p) {
+		if source, ok := d.divergent[p]; ok {
+			return source, true
+		}
+		if p == "/" || p == "" {
+			return 0, false
+		}
+	}
+}
+
+// parent returns the parent directory of path.
+func parent(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// recordPath returns the path of the record of a divergent path.
+func recordPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return divergentRoot + "/" + hex.EncodeToString(sum[:])
+}
+
+// isRequestError returns true if the error is caused by the request rather
+// than by the driver, so that other drivers would fail as well.
+func isRequestError(err error) bool {
+	switch err.(type) {
+	case storagedriver.InvalidPathError, storagedriver.InvalidOffsetError, storagedriver.ErrUnsupportedMethod:
+		return true
+	}
+	return false
+}
+
+func logDriverError(ctx context.Context, sd storagedriver.StorageDriver, op, path string, err error) {
+	dcontext.GetLogger(ctx).Warnf("mirror: %s of %s failed on %s: %v", op, path, sd.Name(), err)
+}
+
+type mirroredWriter struct {
+	index int
+	fw    storagedriver.FileWriter
+}
+
+// writer writes to a FileWriter per driver, dropping the writers which fail.
+type writer struct {
+	driver  *driver
+	ctx     context.Context
+	path    string
+	writers []mirroredWriter
+	size    int64 // the size once no writer remains
+	failed  bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	err := w.each("Write", func(fw storagedriver.FileWriter) error {
+		n, err := fw.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *writer) Size() int64 {
+	if len(w.writers) == 0 {
+		return w.size
+	}
+	return w.writers[0].fw.Size()
+}
+
+func (w *writer) Close() error {
+	if len(w.writers) == 0 {
+		// the writers were closed when they failed
+		return nil
+	}
+	err := w.each("Close", storagedriver.FileWriter.Close)
+	w.markFailed()
+	return err
+}
+
+func (w *writer) Cancel() error {
+	err := w.each("Cancel", storagedriver.FileWriter.Cancel)
+	w.markFailed()
+	return err
+}
+
+func (w *writer) Commit() error {
+	err := w.each("Commit", storagedriver.FileWriter.Commit)
+	w.markFailed()
+	return err
+}
+
+// each calls op on all remaining writers, closing and dropping those which
+// fail. It returns the error of the first writer if all fail.
+func (w *writer) each(name string, op func(storagedriver.FileWriter) error) error {
+	if len(w.writers) == 0 {
+		return errWritersFailed
+	}
+
+	var remaining []mirroredWriter
+	var firstErr error
+	for _, mw := range w.writers {
+		if err := op(mw.fw); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			logDriverError(w.ctx, w.driver.drivers[mw.index], name, w.path, err)
+			if name != "Close" {
+				mw.fw.Close()
+			}
+			continue
+		}
+		remaining = append(remaining, mw)
+	}
+
+	if len(remaining) == 0 {
+		w.size = w.writers[0].fw.Size()
+		w.writers = nil
+		return firstErr
+	}
+
+	if len(remaining) < len(w.writers) {
+		w.failed = true
+	}
+	w.writers = remaining
+	return nil
+}
+
+// markFailed marks the path as divergent if a writer was dropped while
+// others remain.
+func (w *writer) markFailed() {
+	if w.failed && len(w.writers) > 0 {
+		w.driver.markDivergent(w.ctx, w.path, w.writers[0].index)
+	}
+	w.failed = false
+}
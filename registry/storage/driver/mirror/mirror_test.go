@@ -0,0 +1,389 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return FromParameters(map[string]interface{}{
+			"primary": map[interface{}]interface{}{
+				"inmemory": nil,
+			},
+			"secondaries": []interface{}{
+				map[interface{}]interface{}{
+					"inmemory": nil,
+				},
+			},
+		})
+	}, testsuites.NeverSkip)
+}
+
+var errUnavailable = errors.New("unavailable")
+
+// unavailableDriver fails all operations while down is set.
+type unavailableDriver struct {
+	storagedriver.StorageDriver
+	down bool
+}
+
+func (ud *unavailableDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if ud.down {
+		return nil, errUnavailable
+	}
+	return ud.StorageDriver.GetContent(ctx, path)
+}
+
+func (ud *unavailableDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if ud.down {
+		return errUnavailable
+	}
+	return ud.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (ud *unavailableDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if ud.down {
+		return nil, errUnavailable
+	}
+	return ud.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (ud *unavailableDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if ud.down {
+		return nil, errUnavailable
+	}
+	return ud.StorageDriver.Writer(ctx, path, append)
+}
+
+func (ud *unavailableDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if ud.down {
+		return nil, errUnavailable
+	}
+	return ud.StorageDriver.Stat(ctx, path)
+}
+
+func (ud *unavailableDriver) Delete(ctx context.Context, path string) error {
+	if ud.down {
+		return errUnavailable
+	}
+	return ud.StorageDriver.Delete(ctx, path)
+}
+
+func newTestDriver() (*driver, *unavailableDriver, *unavailableDriver) {
+	primary := &unavailableDriver{StorageDriver: inmemory.New()}
+	secondary := &unavailableDriver{StorageDriver: inmemory.New()}
+	return newDriver(DriverParameters{
+		Primary:     primary,
+		Secondaries: []storagedriver.StorageDriver{secondary},
+	}), primary, secondary
+}
+
+// failingWriterDriver returns writers failing all writes, counting the
+// calls to their Close method.
+type failingWriterDriver struct {
+	storagedriver.StorageDriver
+	closes int
+}
+
+func (fd *failingWriterDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := fd.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{FileWriter: fw, driver: fd}, nil
+}
+
+type failingWriter struct {
+	storagedriver.FileWriter
+	driver *failingWriterDriver
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	return 0, errUnavailable
+}
+
+func (fw *failingWriter) Close() error {
+	fw.driver.closes++
+	return fw.FileWriter.Close()
+}
+
+func TestWritersAllFail(t *testing.T) {
+	ctx := context.Background()
+	primary := &failingWriterDriver{StorageDriver: inmemory.New()}
+	secondary := &failingWriterDriver{StorageDriver: inmemory.New()}
+	d := newDriver(DriverParameters{
+		Primary:     primary,
+		Secondaries: []storagedriver.StorageDriver{secondary},
+	})
+
+	fw, err := d.Writer(ctx, "/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("content")); err == nil {
+		t.Fatalf("expected write to fail")
+	}
+	if _, err := fw.Write([]byte("content")); err == nil {
+		t.Fatalf("expected write to fail once no writer remains")
+	}
+	if err := fw.Commit(); err == nil {
+		t.Fatalf("expected commit to fail once no writer remains")
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	if primary.closes != 1 || secondary.closes != 1 {
+		t.Fatalf("expected each writer to be closed once, got %d and %d", primary.closes, secondary.closes)
+	}
+	if len(d.divergent) != 0 {
+		t.Fatalf("unexpected divergent paths: %v", d.divergent)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	d, primary, _ := newTestDriver()
+
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down = true
+	content, err := d.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatalf("expected read to fail over: %v", err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	// writes succeed while a driver is down
+	if err := d.PutContent(ctx, "/b", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down = false
+	d.repair(ctx)
+
+	content, err = primary.GetContent(ctx, "/b")
+	if err != nil {
+		t.Fatalf("expected write to be repaired: %v", err)
+	}
+	if string(content) != "other" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if _, err := primary.Stat(ctx, "/a"); err == nil {
+		t.Fatalf("expected delete to be repaired")
+	}
+	if len(d.divergent) != 0 {
+		t.Fatalf("unexpected divergent paths: %v", d.divergent)
+	}
+}
+
+func TestRepairRetries(t *testing.T) {
+	ctx := context.Background()
+	d, _, secondary := newTestDriver()
+
+	secondary.down = true
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.repair(ctx)
+	if _, ok := d.divergent["/a"]; !ok {
+		t.Fatalf("expected failed repair to be retried")
+	}
+
+	secondary.down = false
+	d.repair(ctx)
+	if _, err := secondary.GetContent(ctx, "/a"); err != nil {
+		t.Fatalf("expected write to be repaired: %v", err)
+	}
+}
+
+func TestReadRepairsMissingFile(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestDriver()
+
+	// the primary lost its content
+	if err := secondary.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Stat(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	d.repair(ctx)
+
+	if _, err := primary.GetContent(ctx, "/a"); err != nil {
+		t.Fatalf("expected missing file to be repaired: %v", err)
+	}
+}
+
+func TestReadDivergentFromSource(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestDriver()
+
+	for p, content := range map[string]string{"/link": "aaaa", "/deleted": "content", "/scanned": "content"} {
+		if err := d.PutContent(ctx, p, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary.down = true
+	if err := d.PutContent(ctx, "/link", []byte("bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/scanned"); err != nil {
+		t.Fatal(err)
+	}
+	primary.down = false
+
+	// the primary still holds the previous content until it is repaired
+	content, err := d.GetContent(ctx, "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "bbbb" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if _, err := d.Stat(ctx, "/deleted"); err == nil {
+		t.Fatalf("expected deleted file to be missing")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the divergent paths are recorded in the drivers, hidden from listings
+	children, err := d.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, child := range children {
+		if child == stateRoot {
+			t.Fatalf("unexpected listing of %s", stateRoot)
+		}
+	}
+
+	restarted := newDriver(DriverParameters{
+		Primary:     primary,
+		Secondaries: []storagedriver.StorageDriver{secondary},
+	})
+	restarted.loadDivergent(ctx)
+	if len(restarted.divergent) != 3 {
+		t.Fatalf("unexpected divergent paths after restart: %v", restarted.divergent)
+	}
+
+	// repairing copies content of the same size, and the scan doesn't copy
+	// deleted files back
+	restarted.scan(ctx)
+	content, err = primary.GetContent(ctx, "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "bbbb" {
+		t.Fatalf("unexpected repaired content: %q", content)
+	}
+	for _, sd := range []storagedriver.StorageDriver{primary, secondary} {
+		for _, p := range []string{"/deleted", "/scanned"} {
+			if _, err := sd.Stat(ctx, p); err == nil {
+				t.Fatalf("expected %s to be deleted from %s", p, sd.Name())
+			}
+		}
+		if _, err := sd.Stat(ctx, divergentRoot); err == nil {
+			if records, _ := sd.List(ctx, divergentRoot); len(records) != 0 {
+				t.Fatalf("unexpected records of repaired paths: %v", records)
+			}
+		}
+	}
+}
+
+func TestScanComparesContent(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestDriver()
+
+	if err := secondary.PutContent(ctx, "/a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := primary.PutContent(ctx, "/a", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.scan(ctx)
+
+	content, err := secondary.GetContent(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	d, primary, secondary := newTestDriver()
+
+	if err := primary.PutContent(ctx, "/a/b", []byte("primary")); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.PutContent(ctx, "/a/c", []byte("secondary")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the most recently modified file wins
+	if err := secondary.PutContent(ctx, "/a/d", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := primary.PutContent(ctx, "/a/d", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.scan(ctx)
+
+	for _, sd := range []storagedriver.StorageDriver{primary, secondary} {
+		for p, expected := range map[string]string{"/a/b": "primary", "/a/c": "secondary", "/a/d": "newer"} {
+			content, err := sd.GetContent(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != expected {
+				t.Fatalf("unexpected content of %s: %q", p, content)
+			}
+		}
+	}
+}
+
+func TestFromParametersInvalid(t *testing.T) {
+	for _, parameters := range []map[string]interface{}{
+		{},
+		{"primary": map[interface{}]interface{}{"inmemory": nil}},
+		{"primary": map[interface{}]interface{}{"unknown": nil}, "secondaries": []interface{}{map[interface{}]interface{}{"inmemory": nil}}},
+		{"primary": map[interface{}]interface{}{"inmemory": nil}, "secondaries": []interface{}{"inmemory"}},
+		{"primary": map[interface{}]interface{}{"inmemory": nil}, "secondaries": []interface{}{map[interface{}]interface{}{"inmemory": nil}}, "repairinterval": "0s"},
+	} {
+		if _, err := FromParameters(parameters); err == nil {
+			t.Fatalf("expected error for parameters %v", parameters)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+func (d *driver) repairPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.repair(context.Background())
+	}
+}
+
+func (d *driver) scanPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.scan(context.Background())
+	}
+}
+
+// repair makes the divergent paths of all drivers match the driver holding
+// the expected content. Paths which fail to be repaired are retried on the
+// next repair.
+func (d *driver) repair(ctx context.Context) {
+	d.mu.Lock()
+	divergent := d.divergent
+	d.divergent = make(map[string]int)
+	d.mu.Unlock()
+
+	for path, source := range divergent {
+		err := d.repairPath(ctx, path, source)
+
+		d.mu.Lock()
+		_, marked := d.divergent[path]
+		if err != nil && !marked {
+			d.divergent[path] = source
+		}
+		d.mu.Unlock()
+
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: failed to repair %s: %v", path, err)
+		} else if !marked {
+			d.clearDivergent(ctx, path)
+		}
+	}
+}
+
+// repairPath copies the content at path from the source driver to the other
+// drivers, or deletes it from them if the source does not hold it.
+func (d *driver) repairPath(ctx context.Context, path string, source int) error {
+	src := d.drivers[source]
+	fi, err := src.Stat(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		for i, dst := range d.drivers {
+			if i == source {
+				continue
+			}
+			if err := dst.Delete(ctx, path); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, dst := range d.drivers {
+		if i == source {
+			continue
+		}
+
+		if !fi.IsDir() {
+			if err := copyIfDiffers(ctx, src, dst, fi); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := src.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+			if fi.IsDir() {
+				return nil
+			}
+			return copyIfDiffers(ctx, src, dst, fi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan copies the files missing from any driver, or differing in content,
+// from the other drivers. Differing files are copied from the driver holding
+// the most recently modified one. Divergent paths are repaired first, and
+// left to the next repair if they could not be, so that the files deleted or
+// moved while a driver was unavailable are not copied back to the others.
+func (d *driver) scan(ctx context.Context) {
+	d.repair(ctx)
+
+	for i, src := range d.drivers {
+		for j, dst := range d.drivers {
+			if i == j {
+				continue
+			}
+
+			err := src.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+				if fi.IsDir() {
+					if fi.Path() == stateRoot {
+						return storagedriver.ErrSkipDir
+					}
+					return nil
+				}
+				if _, divergent := d.source(fi.Path()); divergent {
+					return nil
+				}
+
+				dstInfo, err := dst.Stat(ctx, fi.Path())
+				if err == nil && dstInfo.ModTime().After(fi.ModTime()) {
+					return nil
+				}
+				if err == nil {
+					same, err := sameContent(ctx, src, dst, fi, dstInfo)
+					if err != nil || same {
+						return err
+					}
+				}
+				if _, ok := err.(storagedriver.PathNotFoundError); err != nil && !ok {
+					return err
+				}
+
+				if err := copyFile(ctx, src, dst, fi.Path()); err != nil {
+					dcontext.GetLogger(ctx).Errorf("mirror: failed to copy %s from %s: %v", fi.Path(), src.Name(), err)
+				}
+				return nil
+			})
+			if _, ok := err.(storagedriver.PathNotFoundError); err != nil && !ok {
+				dcontext.GetLogger(ctx).Errorf("mirror: failed to scan %s for files missing from %s: %v", src.Name(), dst.Name(), err)
+			}
+		}
+	}
+}
+
+// copyIfDiffers copies the file described by fi from src to dst, unless dst
+// holds the same content.
+func copyIfDiffers(ctx context.Context, src, dst storagedriver.StorageDriver, fi storagedriver.FileInfo) error {
+	dstInfo, err := dst.Stat(ctx, fi.Path())
+	if err == nil && !dstInfo.IsDir() {
+		same, err := sameContent(ctx, src, dst, fi, dstInfo)
+		if err != nil || same {
+			return err
+		}
+	}
+
+	return copyFile(ctx, src, dst, fi.Path())
+}
+
+// sameContent returns true if the files described by srcInfo and dstInfo
+// hold the same content, reading them until they differ.
+func sameContent(ctx context.Context, src, dst storagedriver.StorageDriver, srcInfo, dstInfo storagedriver.FileInfo) (bool, error) {
+	if srcInfo.Size() != dstInfo.Size() {
+		return false, nil
+	}
+
+	srcReader, err := src.Reader(ctx, srcInfo.Path(), 0)
+	if err != nil {
+		return false, err
+	}
+	defer srcReader.Close()
+
+	dstReader, err := dst.Reader(ctx, dstInfo.Path(), 0)
+	if err != nil {
+		return false, err
+	}
+	defer dstReader.Close()
+
+	srcBuf := make([]byte, 32*1024)
+	dstBuf := make([]byte, len(srcBuf))
+	for {
+		n, srcErr := io.ReadFull(srcReader, srcBuf)
+		m, dstErr := io.ReadFull(dstReader, dstBuf)
+		if n != m || !bytes.Equal(srcBuf[:n], dstBuf[:m]) {
+			return false, nil
+		}
+
+		srcEOF := srcErr == io.EOF || srcErr == io.ErrUnexpectedEOF
+		dstEOF := dstErr == io.EOF || dstErr == io.ErrUnexpectedEOF
+		switch {
+		case srcEOF && dstEOF:
+			return true, nil
+		case srcErr != nil && !srcEOF:
+			return false, srcErr
+		case dstErr != nil && !dstEOF:
+			return false, dstErr
+		case srcEOF || dstEOF:
+			return false, nil
+		}
+	}
+}
+
+func copyFile(ctx context.Context, src, dst storagedriver.StorageDriver, path string) error {
+	rc, err := src.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := dst.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel()
+		fw.Close()
+		return err
+	}
+
+	if err := fw.Commit(); err != nil {
+		fw.Close()
+		return err
+	}
+	return fw.Close()
+}
@@ -68,6 +68,9 @@ const (
 	defaultMultipartCopyThresholdSize = 32 << 20
 )
 
+// maxParts is the largest number of parts of a multipart upload allowed by S3.
+const maxParts = 10000
+
 // listMax is the largest amount of objects you can request from S3 in a list call
 const listMax = 1000
 
@@ -769,6 +772,125 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 	return err
 }
 
+// copyRange identifies the bytes of a source object copied to a part of a
+// multipart upload.
+type copyRange struct {
+	sourcePath string
+	firstByte  int64
+	lastByte   int64
+}
+
+// Concat writes the objects stored at sourcePaths, in order, to destPath
+// with a multipart upload copying each of them to its parts. S3 requires
+// all the parts but the last to be at least 5 MB: smaller objects are not
+// concatenated natively.
+func (d *driver) Concat(ctx context.Context, destPath string, sourcePaths []string) error {
+	var ranges []copyRange
+	for _, sourcePath := range sourcePaths {
+		fileInfo, err := d.Stat(ctx, sourcePath)
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return storagedriver.PathNotFoundError{Path: sourcePath}
+		}
+		size := fileInfo.Size()
+		if size == 0 {
+			continue
+		}
+
+		// split the objects larger than a part can be into parts of equal
+		// size, which are larger than minChunkSize
+		numParts := (size + maxChunkSize - 1) / maxChunkSize
+		partSize := (size + numParts - 1) / numParts
+		for firstByte := int64(0); firstByte < size; firstByte += partSize {
+			lastByte := firstByte + partSize - 1
+			if lastByte >= size {
+				lastByte = size - 1
+			}
+			ranges = append(ranges, copyRange{sourcePath: sourcePath, firstByte: firstByte, lastByte: lastByte})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return d.PutContent(ctx, destPath, nil)
+	}
+	if len(ranges) > maxParts {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	for _, r := range ranges[:len(ranges)-1] {
+		if r.lastByte-r.firstByte+1 < minChunkSize {
+			return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+		}
+	}
+
+	createResp, err := d.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(d.Bucket),
+		Key:                  aws.String(d.s3Path(destPath)),
+		ContentType:          d.getContentType(),
+		ACL:                  d.getACL(),
+		SSEKMSKeyId:          d.getSSEKMSKeyID(),
+		ServerSideEncryption: d.getEncryptionMode(),
+		StorageClass:         d.getStorageClass(),
+	})
+	if err != nil {
+		return err
+	}
+
+	completedParts := make([]*s3.CompletedPart, len(ranges))
+	errChan := make(chan error, len(ranges))
+	limiter := make(chan struct{}, d.MultipartCopyMaxConcurrency)
+
+	for i := range ranges {
+		i := i
+		go func() {
+			limiter <- struct{}{}
+			r := ranges[i]
+			uploadResp, err := d.S3.UploadPartCopy(&s3.UploadPartCopyInput{
+				Bucket:          aws.String(d.Bucket),
+				CopySource:      aws.String(d.Bucket + "/" + d.s3Path(r.sourcePath)),
+				Key:             aws.String(d.s3Path(destPath)),
+				PartNumber:      aws.Int64(int64(i + 1)),
+				UploadId:        createResp.UploadId,
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", r.firstByte, r.lastByte)),
+			})
+			if err == nil {
+				completedParts[i] = &s3.CompletedPart{
+					ETag:       uploadResp.CopyPartResult.ETag,
+					PartNumber: aws.Int64(int64(i + 1)),
+				}
+			} else {
+				err = parseError(r.sourcePath, err)
+			}
+			errChan <- err
+			<-limiter
+		}()
+	}
+
+	var copyErr error
+	for range ranges {
+		if err := <-errChan; err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	if copyErr != nil {
+		d.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(d.Bucket),
+			Key:      aws.String(d.s3Path(destPath)),
+			UploadId: createResp.UploadId,
+		})
+		return copyErr
+	}
+
+	_, err = d.S3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.Bucket),
+		Key:             aws.String(d.s3Path(destPath)),
+		UploadId:        createResp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	})
+	return err
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -901,6 +1023,71 @@ func (d *driver) Walk(ctx context.Context, from string, f storagedriver.WalkFn)
 	return nil
 }
 
+// WalkParallel traverses a filesystem defined within driver, starting from
+// the given path, listing up to maxConcurrency prefixes at once.
+func (d *driver) WalkParallel(ctx context.Context, from string, maxConcurrency int, f storagedriver.WalkFn) error {
+	prefix := ""
+	if d.s3Path("") == "" {
+		prefix = "/"
+	}
+
+	return storagedriver.WalkParallelList(ctx, from, maxConcurrency, func(ctx context.Context, path string) ([]storagedriver.FileInfo, error) {
+		fileInfos, err := d.listInfo(ctx, path, prefix)
+		if err == nil && len(fileInfos) == 0 && path == from {
+			// S3 doesn't have the concept of empty directories, while the
+			// prefixes below from which list empty were deleted since their
+			// parent was listed
+			err = storagedriver.PathNotFoundError{Path: path}
+		}
+		return fileInfos, err
+	}, f)
+}
+
+// listInfo returns the FileInfo of the direct descendants of path, from the
+// listing of its prefix.
+func (d *driver) listInfo(parentCtx context.Context, path, prefix string) ([]storagedriver.FileInfo, error) {
+	dir := path
+	if !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	s3Path := d.s3Path(dir)
+
+	listObjectsInput := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(d.Bucket),
+		Prefix:    aws.String(s3Path),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(listMax),
+	}
+
+	ctx, done := dcontext.WithTrace(parentCtx)
+	defer done("s3aws.ListObjectsV2Pages(%s)", s3Path)
+
+	var fileInfos []storagedriver.FileInfo
+	err := d.S3.ListObjectsV2PagesWithContext(ctx, listObjectsInput, func(objects *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, dir := range objects.CommonPrefixes {
+			commonPrefix := *dir.Prefix
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				IsDir: true,
+				Path:  strings.Replace(commonPrefix[:len(commonPrefix)-1], d.s3Path(""), prefix, 1),
+			}})
+		}
+
+		for _, file := range objects.Contents {
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				IsDir:   false,
+				Size:    *file.Size,
+				ModTime: *file.LastModified,
+				Path:    strings.Replace(*file.Key, d.s3Path(""), prefix, 1),
+			}})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, parseError(path, err)
+	}
+	return fileInfos, nil
+}
+
 type walkInfoContainer struct {
 	storagedriver.FileInfoFields
 	prefix *string
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -508,6 +509,118 @@ func (suite *DriverSuite) TestList(c *check.C) {
 	// 3. Ensure that we only respond to directory listings that end with a slash (maybe?).
 }
 
+// TestWalkParallel checks that WalkParallel visits the same files as Walk,
+// whether or not the driver implements it.
+func (suite *DriverSuite) TestWalkParallel(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	for i := 0; i < 5; i++ {
+		directory := rootDirectory + "/" + randomFilename(int64(8+rand.Intn(8)))
+		for j := 0; j < 5; j++ {
+			filePath := directory + "/" + randomFilename(int64(8+rand.Intn(8))) + "/" + randomFilename(int64(8+rand.Intn(8)))
+			err := suite.StorageDriver.PutContent(suite.ctx, filePath, randomContents(32))
+			c.Assert(err, check.IsNil)
+		}
+	}
+
+	var expected []string
+	err := suite.StorageDriver.Walk(suite.ctx, rootDirectory, func(fileInfo storagedriver.FileInfo) error {
+		expected = append(expected, fileInfo.Path())
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(expected, check.HasLen, 55)
+
+	var mu sync.Mutex
+	var walked []string
+	err = storagedriver.WalkParallel(suite.ctx, suite.StorageDriver, rootDirectory, 4, func(fileInfo storagedriver.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		walked = append(walked, fileInfo.Path())
+		if !fileInfo.IsDir() {
+			c.Check(fileInfo.Size(), check.Equals, int64(32))
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+
+	sort.Strings(expected)
+	sort.Strings(walked)
+	c.Assert(walked, check.DeepEquals, expected)
+
+	_, err = suite.StorageDriver.List(suite.ctx, rootDirectory)
+	c.Assert(err, check.IsNil)
+	err = storagedriver.WalkParallel(suite.ctx, suite.StorageDriver, path.Join(rootDirectory, "nonexistent"), 4, func(fileInfo storagedriver.FileInfo) error {
+		return nil
+	})
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	// directories deleted while walking are skipped: the first directory is
+	// deleted when visiting the second, after a sequential walk entered it
+	// but before a parallel walk lists it
+	var first string
+	err = storagedriver.WalkParallel(suite.ctx, suite.StorageDriver, rootDirectory, 1, func(fileInfo storagedriver.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if path.Dir(fileInfo.Path()) != rootDirectory {
+			return nil
+		}
+		if first == "" {
+			first = fileInfo.Path()
+		} else if first != "deleted" {
+			c.Assert(suite.StorageDriver.Delete(suite.ctx, first), check.IsNil)
+			first = "deleted"
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+}
+
+// TestWalkParallelSkipDir checks that WalkParallel does not enter directories
+// for which the WalkFn returns ErrSkipDir, and stops at the first error.
+func (suite *DriverSuite) TestWalkParallelSkipDir(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	skipped := rootDirectory + "/skipped"
+	for _, filePath := range []string{
+		skipped + "/a/file",
+		skipped + "/file",
+		rootDirectory + "/walked/a/file",
+		rootDirectory + "/walked/file",
+	} {
+		err := suite.StorageDriver.PutContent(suite.ctx, filePath, randomContents(32))
+		c.Assert(err, check.IsNil)
+	}
+
+	var mu sync.Mutex
+	var walked []string
+	err := storagedriver.WalkParallel(suite.ctx, suite.StorageDriver, rootDirectory, 4, func(fileInfo storagedriver.FileInfo) error {
+		if fileInfo.Path() == skipped {
+			return storagedriver.ErrSkipDir
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		walked = append(walked, fileInfo.Path())
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+
+	sort.Strings(walked)
+	c.Assert(walked, check.DeepEquals, []string{
+		rootDirectory + "/walked",
+		rootDirectory + "/walked/a",
+		rootDirectory + "/walked/a/file",
+		rootDirectory + "/walked/file",
+	})
+
+	err = storagedriver.WalkParallel(suite.ctx, suite.StorageDriver, rootDirectory, 4, func(fileInfo storagedriver.FileInfo) error {
+		return errors.New("walk failed")
+	})
+	c.Assert(err, check.ErrorMatches, ".*walk failed")
+}
+
 // TestMove checks that a moved object no longer exists at the source path and
 // does exist at the destination.
 func (suite *DriverSuite) TestMove(c *check.C) {
@@ -600,6 +713,44 @@ func (suite *DriverSuite) TestMoveInvalid(c *check.C) {
 	c.Assert(err, check.NotNil) // non-nil error
 }
 
+// TestConcat checks that concatenated files are written in order to the
+// destination, replacing its contents, whether the driver concatenates them
+// natively or not.
+func (suite *DriverSuite) TestConcat(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	// large parts first, which drivers using multipart copies concatenate
+	// natively, then a small one first, which they copy
+	for _, sizes := range [][]int64{{6 << 20, 6 << 20, 32}, {32, 6 << 20}} {
+		var sourcePaths []string
+		var expected []byte
+		for _, size := range sizes {
+			sourcePath := path.Join(rootDirectory, randomFilename(16))
+			contents := randomContents(size)
+			err := suite.StorageDriver.PutContent(suite.ctx, sourcePath, contents)
+			c.Assert(err, check.IsNil)
+			sourcePaths = append(sourcePaths, sourcePath)
+			expected = append(expected, contents...)
+		}
+
+		destPath := path.Join(rootDirectory, randomFilename(16))
+		err := suite.StorageDriver.PutContent(suite.ctx, destPath, randomContents(64))
+		c.Assert(err, check.IsNil)
+
+		err = storagedriver.Concat(suite.ctx, suite.StorageDriver, destPath, sourcePaths)
+		c.Assert(err, check.IsNil)
+
+		received, err := suite.StorageDriver.GetContent(suite.ctx, destPath)
+		c.Assert(err, check.IsNil)
+		c.Assert(len(received), check.Equals, len(expected))
+		c.Assert(bytes.Equal(received, expected), check.Equals, true)
+	}
+
+	err := storagedriver.Concat(suite.ctx, suite.StorageDriver, path.Join(rootDirectory, "dest"), []string{path.Join(rootDirectory, "nonexistent")})
+	c.Assert(err, check.NotNil)
+}
+
 // TestDelete checks that the delete operation removes data from the storage
 // driver
 func (suite *DriverSuite) TestDelete(c *check.C) {
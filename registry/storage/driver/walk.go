@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"sort"
+	"sync"
 )
 
 // ErrSkipDir is used as a return value from onFileFunc to indicate that
@@ -50,3 +51,162 @@ func WalkFallback(ctx context.Context, driver StorageDriver, from string, f Walk
 	}
 	return nil
 }
+
+// ParallelWalker is implemented by storage drivers which can list several
+// directories at once when traversing their filesystem.
+type ParallelWalker interface {
+	// WalkParallel traverses a filesystem defined within driver, starting
+	// from the given path, calling f on each file. At most maxConcurrency
+	// directories are listed at once, and f may be called concurrently and
+	// in any order. If f returns ErrSkipDir for a directory, the directory
+	// is not entered; ErrSkipDir returned for a file is ignored.
+	WalkParallel(ctx context.Context, path string, maxConcurrency int, f WalkFn) error
+}
+
+// WalkParallel traverses the filesystem of driver with its WalkParallel
+// method if it implements ParallelWalker, or with Walk otherwise. In both
+// cases, f must be safe to call concurrently and must not depend on the order
+// of the files.
+func WalkParallel(ctx context.Context, driver StorageDriver, from string, maxConcurrency int, f WalkFn) error {
+	if pw, ok := driver.(ParallelWalker); ok {
+		return pw.WalkParallel(ctx, from, maxConcurrency, f)
+	}
+	return driver.Walk(ctx, from, f)
+}
+
+// ListInfoFn returns the FileInfo of the direct descendants of a directory.
+type ListInfoFn func(ctx context.Context, path string) ([]FileInfo, error)
+
+// WalkParallelFallback implements WalkParallel with the List and Stat methods
+// of driver.
+func WalkParallelFallback(ctx context.Context, driver StorageDriver, from string, maxConcurrency int, f WalkFn) error {
+	return WalkParallelList(ctx, from, maxConcurrency, func(ctx context.Context, path string) ([]FileInfo, error) {
+		children, err := driver.List(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		fileInfos := make([]FileInfo, 0, len(children))
+		for _, child := range children {
+			fileInfo, err := driver.Stat(ctx, child)
+			if _, ok := err.(PathNotFoundError); ok {
+				// deleted since listed
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			fileInfos = append(fileInfos, fileInfo)
+		}
+		return fileInfos, nil
+	}, f)
+}
+
+// WalkParallelList implements WalkParallel with list, which is called by a
+// pool of maxConcurrency workers for each directory. The walk stops at the
+// first error returned by list or f, except for PathNotFoundError returned
+// for a directory other than from, which is walked as an empty directory as
+// it was deleted, or emptied, since its parent was listed.
+func WalkParallelList(ctx context.Context, from string, maxConcurrency int, list ListInfoFn, f WalkFn) error {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &parallelWalk{
+		from:    from,
+		list:    list,
+		f:       f,
+		pending: []string{from},
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx, cancel)
+		}()
+	}
+	wg.Wait()
+
+	return w.err
+}
+
+// parallelWalk holds the state shared by the workers of WalkParallelList.
+type parallelWalk struct {
+	from string
+	list ListInfoFn
+	f    WalkFn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string // directories waiting to be listed
+	active  int      // directories being listed
+	err     error
+}
+
+// work lists pending directories until none are left, or the walk fails.
+func (w *parallelWalk) work(ctx context.Context, cancel context.CancelFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		for len(w.pending) == 0 && w.active > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if len(w.pending) == 0 || w.err != nil {
+			w.cond.Broadcast()
+			return
+		}
+
+		// take the most recently found directory, so the walk is depth
+		// first and the pending directories stay few
+		dir := w.pending[len(w.pending)-1]
+		w.pending = w.pending[:len(w.pending)-1]
+		w.active++
+		w.mu.Unlock()
+
+		dirs, err := w.walkDir(ctx, dir)
+
+		w.mu.Lock()
+		w.active--
+		if err != nil && w.err == nil {
+			w.err = err
+			cancel()
+		}
+		w.pending = append(w.pending, dirs...)
+		w.cond.Broadcast()
+	}
+}
+
+// walkDir lists dir, calls f on its descendants and returns the
+// subdirectories to walk.
+func (w *parallelWalk) walkDir(ctx context.Context, dir string) ([]string, error) {
+	fileInfos, err := w.list(ctx, dir)
+	if _, ok := err.(PathNotFoundError); ok && dir != w.from {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, fileInfo := range fileInfos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		err := w.f(fileInfo)
+		if err == ErrSkipDir {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if fileInfo.IsDir() {
+			dirs = append(dirs, fileInfo.Path())
+		}
+	}
+	return dirs, nil
+}
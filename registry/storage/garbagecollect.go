@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
@@ -27,8 +29,31 @@ type ManifestDel struct {
 	Tags   []string
 }
 
-// MarkAndSweep performs a mark and sweep of registry data
+// MarkAndSweep performs a mark and sweep of registry data. A registry with
+// routes is collected one storage driver at a time: the blobs stored by a
+// driver are only kept if referenced by the repositories stored on it. The
+// manifests in the trash are kept, and the manifests their tags point to
+// are not untagged, until they expire; the expired items are purged first.
 func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
+	if rr, ok := registry.(*routedRegistry); ok {
+		collected := make(map[driver.StorageDriver]bool)
+		for _, backend := range rr.all() {
+			// backends sharing a driver share its repositories and blobs
+			if collected[backend.blobStore.driver] {
+				continue
+			}
+			collected[backend.blobStore.driver] = true
+
+			if err := markAndSweep(ctx, backend.blobStore.driver, backend, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return markAndSweep(ctx, storageDriver, registry, opts)
+}
+
+func markAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
@@ -37,7 +62,17 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	// mark
 	markSet := make(map[digest.Digest]struct{})
 	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+	// mu guards markSet and manifestArr, as the manifests are enumerated
+	// concurrently
+	var mu sync.Mutex
+
+	// the manifests in the trash are live until they expire
+	trashedTags, err := markTrash(ctx, registry, opts, markSet)
+	if err != nil {
+		return fmt.Errorf("failed to mark the trash: %v", err)
+	}
+
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
 		emit(repoName)
 
 		var err error
@@ -67,7 +102,7 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 				if err != nil {
 					return fmt.Errorf("failed to retrieve tags for digest %v: %v", dgst, err)
 				}
-				if len(tags) == 0 {
+				if len(tags) == 0 && !trashedTags[repoName][dgst] {
 					emit("manifest eligible for deletion: %s", dgst)
 					// fetch all tags from repository
 					// all of these tags could contain manifest in history
@@ -76,19 +111,24 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 					if err != nil {
 						return fmt.Errorf("failed to retrieve tags %v", err)
 					}
+					mu.Lock()
 					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
+					mu.Unlock()
 					return nil
 				}
 			}
-			// Mark the manifest's blob
-			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
-
 			manifest, err := manifestService.Get(ctx, dgst)
 			if err != nil {
 				return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
 			}
 
+			mu.Lock()
+			defer mu.Unlock()
+
+			// Mark the manifest's blob
+			emit("%s: marking manifest %s ", repoName, dgst)
+			markSet[dgst] = struct{}{}
+
 			descriptors := manifest.References()
 			for _, descriptor := range descriptors {
 				markSet[descriptor.Digest] = struct{}{}
@@ -124,11 +164,17 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			if err != nil {
 				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
 			}
+			if reg, err := namespaceBackend(registry, obj.Name); err == nil {
+				reg.invalidateManifest(ctx, obj.Name, obj.Digest)
+			}
 		}
 	}
 	blobService := registry.Blobs()
 	deleteSet := make(map[digest.Digest]struct{})
 	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
+		mu.Lock()
+		defer mu.Unlock()
+
 		// check if digest is in markSet. If not, delete it!
 		if _, ok := markSet[dgst]; !ok {
 			deleteSet[dgst] = struct{}{}
@@ -152,3 +198,52 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 
 	return err
 }
+
+// markTrash marks the manifests of the items of the trash which have not
+// expired, purging the others unless in a dry run. It returns the manifests
+// the trashed tags point to, by repository.
+func markTrash(ctx context.Context, namespace distribution.Namespace, opts GCOpts, markSet map[digest.Digest]struct{}) (map[string]map[digest.Digest]bool, error) {
+	trashedTags := make(map[string]map[digest.Digest]bool)
+	reg, ok := namespace.(*registry)
+	if !ok {
+		return trashedTags, nil
+	}
+
+	trashed, err := reg.liveTrash(ctx, time.Now(), opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range trashed {
+		for _, dgst := range record.manifests() {
+			emit("%s: marking trashed manifest %s", record.Repository, dgst)
+			if err := reg.markTrashedManifest(ctx, dgst, markSet); err != nil {
+				return nil, fmt.Errorf("failed to mark trashed manifest %s: %v", dgst, err)
+			}
+		}
+		for _, dgst := range record.tagged() {
+			if trashedTags[record.Repository] == nil {
+				trashedTags[record.Repository] = make(map[digest.Digest]bool)
+			}
+			trashedTags[record.Repository][dgst] = true
+		}
+	}
+	return trashedTags, nil
+}
+
+// markTrashedManifest marks a manifest of the trash and the blobs it
+// references. The manifest may have been deleted already, if only a tag
+// pointing to it was trashed.
+func (reg *registry) markTrashedManifest(ctx context.Context, dgst digest.Digest, markSet map[digest.Digest]struct{}) error {
+	manifest, err := reg.trashedManifest(ctx, dgst)
+	if err == distribution.ErrBlobUnknown {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	markSet[dgst] = struct{}{}
+	for _, descriptor := range manifest.References() {
+		markSet[descriptor.Digest] = struct{}{}
+	}
+	return nil
+}
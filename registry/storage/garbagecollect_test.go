@@ -2,14 +2,23 @@ package storage
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/cache/memory"
 	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/faults"
 	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/metadata"
 	"github.com/docker/distribution/testutil"
 	"github.com/docker/libtrust"
 	"github.com/opencontainers/go-digest"
@@ -68,7 +77,10 @@ func allManifests(t *testing.T, manifestService distribution.ManifestService) ma
 	if !ok {
 		t.Fatalf("unable to convert ManifestService into ManifestEnumerator")
 	}
+	var mu sync.Mutex
 	err := manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		mu.Lock()
+		defer mu.Unlock()
 		allManMap[dgst] = struct{}{}
 		return nil
 	})
@@ -82,7 +94,10 @@ func allBlobs(t *testing.T, registry distribution.Namespace) map[digest.Digest]s
 	ctx := context.Background()
 	blobService := registry.Blobs()
 	allBlobsMap := make(map[digest.Digest]struct{})
+	var mu sync.Mutex
 	err := blobService.Enumerate(ctx, func(dgst digest.Digest) error {
+		mu.Lock()
+		defer mu.Unlock()
 		allBlobsMap[dgst] = struct{}{}
 		return nil
 	})
@@ -500,3 +515,142 @@ func TestOrphanBlobDeleted(t *testing.T) {
 		}
 	}
 }
+
+func TestGCWithStorageFaults(t *testing.T) {
+	ctx := context.Background()
+	faultsDriver := faults.New(inmemory.New(), nil, 1)
+
+	registry := createRegistry(t, faultsDriver)
+	repo := makeRepository(t, registry, "komnenos")
+	uploadRandomSchema1Image(t, repo)
+	uploadRandomSchema2Image(t, repo)
+
+	before := allBlobs(t, registry)
+
+	// a slow backend doesn't change the outcome
+	faultsDriver.SetRules([]faults.Rule{{Latency: time.Millisecond, Jitter: time.Millisecond}})
+	err := MarkAndSweep(ctx, faultsDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	// failing to read the manifests of a repository aborts the collection
+	// before anything is deleted
+	faultsDriver.SetRules([]faults.Rule{{
+		Actions:   []string{"GetContent"},
+		Path:      regexp.MustCompile("/_manifests/revisions/"),
+		ErrorRate: 1,
+	}})
+	err = MarkAndSweep(ctx, faultsDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err == nil {
+		t.Fatalf("Expected mark and sweep to fail")
+	}
+
+	faultsDriver.SetRules(nil)
+	after := allBlobs(t, registry)
+	if len(before) != len(after) {
+		t.Fatalf("Garbage collection affected storage: %d != %d", len(before), len(after))
+	}
+}
+
+func TestGCWithMetadataIndex(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	faultsDriver := faults.New(inmemory.New(), nil, 1)
+
+	// an image stored before the metadata was indexed
+	legacyImage := uploadRandomSchema2Image(t, makeRepository(t, createRegistry(t, faultsDriver), "komnenos/legacy"))
+
+	metadataDriver, err := metadata.New(ctx, faultsDriver, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadataDriver.Close()
+
+	registry := createRegistry(t, metadataDriver)
+	repo := makeRepository(t, registry, "komnenos/alexios")
+	im := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	orphan := uploadRandomLayer(t, repo)
+
+	// the catalog, the tags and the mark phase don't list the repositories
+	// on the backend
+	faultsDriver.SetRules([]faults.Rule{{
+		Actions:   []string{"List", "Walk"},
+		Path:      regexp.MustCompile("^/docker/registry/v2/repositories"),
+		ErrorRate: 1,
+	}})
+
+	repos := make([]string, 10)
+	n, err := registry.Repositories(ctx, repos, "")
+	if err != io.EOF || n != 2 || repos[0] != "komnenos/alexios" || repos[1] != "komnenos/legacy" {
+		t.Fatalf("unexpected catalog %v: %v", repos[:n], err)
+	}
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil || len(tags) != 1 || tags[0] != "latest" {
+		t.Fatalf("unexpected tags %v: %v", tags, err)
+	}
+
+	err = MarkAndSweep(ctx, metadataDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	faultsDriver.SetRules(nil)
+	for _, layers := range []map[digest.Digest]io.ReadSeeker{legacyImage.layers, im.layers} {
+		for dgst := range layers {
+			if !blobExists(t, registry, dgst) {
+				t.Fatalf("referenced layer %s was deleted", dgst)
+			}
+		}
+	}
+	if blobExists(t, registry, orphan) {
+		t.Fatalf("orphan layer %s was not deleted", orphan)
+	}
+}
+
+func TestGCInvalidatesCachedManifests(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver, MetadataCacheProvider(memory.NewInMemoryMetadataCacheProvider(0)))
+	repo := makeRepository(t, registry, "cached")
+	image := uploadRandomSchema2Image(t, repo)
+	tagged := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := makeManifestService(t, repo)
+	if _, err := manifests.Get(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	if _, err := manifests.Get(ctx, image.manifestDigest); err == nil {
+		t.Fatalf("expected the collected manifest not to be served from the cache")
+	}
+}
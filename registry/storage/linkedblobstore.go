@@ -42,6 +42,9 @@ type linkedBlobStore struct {
 
 	// linkDirectoryPathSpec locates the root directories in which one might find links
 	linkDirectoryPathSpec pathSpec
+
+	// references records the links, if reference counting is enabled
+	references *referenceCounter
 }
 
 var _ distribution.BlobStore = &linkedBlobStore{}
@@ -232,12 +235,14 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 	return nil
 }
 
+// Enumerate applies ingestor to each linked blob, in no particular order. The
+// ingestor is called concurrently.
 func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.Digest) error) error {
 	rootPath, err := pathFor(lbs.linkDirectoryPathSpec)
 	if err != nil {
 		return err
 	}
-	return lbs.driver.Walk(ctx, rootPath, func(fileInfo driver.FileInfo) error {
+	return driver.WalkParallel(ctx, lbs.driver, rootPath, walkConcurrency, func(fileInfo driver.FileInfo) error {
 		// exit early if directory...
 		if fileInfo.IsDir() {
 			return nil
@@ -266,16 +271,16 @@ func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.
 			return err
 		}
 
-		err = ingestor(digest)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return ingestor(digest)
 	})
 }
 
 func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest, sourceStat *distribution.Descriptor) (distribution.Descriptor, error) {
+	if source := lbs.registry.backendFor(sourceRepo.Name()); source != lbs.registry {
+		// blobs can't be linked across storage backends
+		return lbs.copyBlob(ctx, source, sourceRepo, dgst)
+	}
+
 	var stat distribution.Descriptor
 	if sourceStat == nil {
 		// look up the blob info from the sourceRepo if not already provided
@@ -357,6 +362,9 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical distribution
 		}
 	}
 
+	if lbs.references != nil {
+		return lbs.references.link(ctx, lbs.repository.Named().Name(), canonical.Digest)
+	}
 	return nil
 }
 
@@ -112,22 +112,47 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	var handler ManifestHandler
 	switch manifest.(type) {
 	case *schema1.SignedManifest:
-		return ms.schema1Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema1Handler
 	case *schema2.DeserializedManifest:
-		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema2Handler
 	case *manifestlist.DeserializedManifestList:
-		return ms.manifestListHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.manifestListHandler
+	default:
+		return "", fmt.Errorf("unrecognized manifest type %T", manifest)
 	}
 
-	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	revision, err := handler.Put(ctx, manifest, ms.skipDependencyVerification)
+	if err != nil || ms.repository.references == nil {
+		return revision, err
+	}
+	return revision, ms.repository.references.add(ctx, ms.repository.Named().Name(), revision, manifest)
 }
 
 // Delete removes the revision of the specified manifest.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+	if ms.repository.trashRetention > 0 {
+		return ms.trash(ctx, dgst)
+	}
+	if ms.repository.references == nil {
+		return ms.blobStore.Delete(ctx, dgst)
+	}
+
+	// the references are removed once the revision is
+	manifest, err := ms.Get(ctx, dgst)
+	if err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+			return distribution.ErrBlobUnknown
+		}
+		return err
+	}
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	return ms.repository.references.remove(ctx, ms.repository.Named().Name(), dgst, manifest)
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
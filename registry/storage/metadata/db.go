@@ -0,0 +1,408 @@
+package metadata
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is the record of a file in the database.
+type entry struct {
+	// Inline is true if the content of the file is stored in the database.
+	Inline  bool      `json:"inline,omitempty"`
+	Content []byte    `json:"content,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// record is a line of the database log.
+type record struct {
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Entry *entry `json:"entry,omitempty"`
+}
+
+const (
+	opPut        = "put"
+	opDelete     = "delete" // deletes the key and the keys under it
+	opMigrated   = "migrated"
+	opGeneration = "generation" // the key is the generation
+
+	// compactThreshold is the minimum number of stale records in the log
+	// before it is compacted.
+	compactThreshold = 10000
+)
+
+// DB is an embedded database of files, keyed by path. It is kept in memory
+// and persisted to an append-only log, which is compacted when enough of its
+// records are stale.
+//
+// A database is opened by a single process at a time: Open takes an
+// exclusive lock on the file next to it, with the ".lock" extension.
+type DB struct {
+	mu         sync.RWMutex
+	path       string
+	lock       *os.File
+	file       *os.File
+	entries    map[string]*entry
+	keys       []string // sorted
+	records    int      // records in the log
+	migrated   bool
+	generation string
+}
+
+// Open opens the database at path, creating it if it does not exist. It
+// fails if the database is open in another process.
+func Open(path string) (*DB, error) {
+	db := &DB{
+		path:    path,
+		entries: make(map[string]*entry),
+	}
+
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	db.lock, db.file = lock, file
+	return db, nil
+}
+
+// load replays the log. A truncated last record, left by a crash while it
+// was appended, is discarded.
+func (db *DB) load() error {
+	file, err := os.Open(db.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err := os.Truncate(db.path, size); err != nil {
+					return err
+				}
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		size += int64(len(line))
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("corrupt metadata database %s: %v", db.path, err)
+		}
+		db.apply(r)
+		db.records++
+	}
+	return nil
+}
+
+// apply applies a record replayed from the log.
+func (db *DB) apply(r record) {
+	switch r.Op {
+	case opPut:
+		db.set(r.Key, r.Entry)
+	case opDelete:
+		db.remove(r.Key)
+	case opMigrated:
+		db.migrated = true
+	case opGeneration:
+		db.generation = r.Key
+	}
+}
+
+// Close closes the database and releases its lock.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.file.Close()
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// Migrated returns true once the database has been filled by Migrate.
+func (db *DB) Migrated() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.migrated
+}
+
+// Generation returns the generation of the storage backend the database was
+// last migrated from, or "" if it was not recorded.
+func (db *DB) Generation() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.generation
+}
+
+// SetGeneration records the generation of the storage backend the database
+// was migrated from.
+func (db *DB) SetGeneration(generation string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.append(record{Op: opGeneration, Key: generation}); err != nil {
+		return err
+	}
+	db.generation = generation
+	return nil
+}
+
+// append writes records to the log and syncs it.
+func (db *DB) append(records ...record) error {
+	w := bufio.NewWriter(db.file)
+	encoder := json.NewEncoder(w)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	db.records += len(records)
+	return db.file.Sync()
+}
+
+// get returns the entry of key.
+func (db *DB) get(key string) (*entry, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	e, ok := db.entries[key]
+	return e, ok
+}
+
+// put stores the entry of key.
+func (db *DB) put(key string, e *entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.append(record{Op: opPut, Key: key, Entry: e}); err != nil {
+		return err
+	}
+	db.set(key, e)
+	return db.maybeCompact()
+}
+
+// delete removes the entry of key and the entries under it, returning the
+// number of entries removed.
+func (db *DB) delete(key string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if start, end := db.span(key); start == end {
+		return 0, nil
+	}
+
+	if err := db.append(record{Op: opDelete, Key: key}); err != nil {
+		return 0, err
+	}
+	return db.remove(key), db.maybeCompact()
+}
+
+// set stores the entry of key, adding key to the sorted keys if it is new.
+func (db *DB) set(key string, e *entry) {
+	if _, ok := db.entries[key]; !ok {
+		i := sort.SearchStrings(db.keys, key)
+		db.keys = append(db.keys, "")
+		copy(db.keys[i+1:], db.keys[i:])
+		db.keys[i] = key
+	}
+	db.entries[key] = e
+}
+
+// remove removes the entry of key and the entries under it, found in the
+// span of key in the sorted keys, and returns the number of entries removed.
+func (db *DB) remove(key string) int {
+	start, end := db.span(key)
+	kept := db.keys[:start]
+	for _, k := range db.keys[start:end] {
+		if under(k, key) {
+			delete(db.entries, k)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	removed := end - start - (len(kept) - start)
+	db.keys = append(kept, db.keys[end:]...)
+	return removed
+}
+
+// span returns the range of the keys starting with key, which includes the
+// keys under it.
+func (db *DB) span(key string) (int, int) {
+	if key == "/" {
+		return 0, len(db.keys)
+	}
+	start := sort.SearchStrings(db.keys, key)
+	end := start
+	for end < len(db.keys) && strings.HasPrefix(db.keys[end], key) {
+		end++
+	}
+	return start, end
+}
+
+// children returns the direct descendants of dir, sorted.
+func (db *DB) children(dir string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = dir
+	}
+
+	var children []string
+	seen := make(map[string]bool)
+	for i := sort.SearchStrings(db.keys, prefix); i < len(db.keys) && strings.HasPrefix(db.keys[i], prefix); {
+		rest := db.keys[i][len(prefix):]
+		name := rest
+		if slash := strings.Index(rest, "/"); slash >= 0 {
+			name = rest[:slash]
+		}
+
+		child := prefix + name
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+
+		if name != rest {
+			// skip the rest of the subdirectory: '0' follows '/'
+			i = sort.SearchStrings(db.keys, child+"0")
+		} else {
+			i++
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// isDir returns true if there are entries under dir.
+func (db *DB) isDir(dir string) bool {
+	return len(db.children(dir)) > 0
+}
+
+// empty returns true if there are no entries.
+func (db *DB) empty() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.keys) == 0
+}
+
+// replace replaces all entries, and marks the database as migrated.
+func (db *DB) replace(entries map[string]*entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.entries = entries
+	db.keys = make([]string, 0, len(entries))
+	for key := range entries {
+		db.keys = append(db.keys, key)
+	}
+	sort.Strings(db.keys)
+	db.migrated = true
+	return db.compact()
+}
+
+// maybeCompact compacts the log once compactThreshold of its records are
+// stale, which bounds the records replayed when the database is opened.
+func (db *DB) maybeCompact() error {
+	if db.records-len(db.entries) < compactThreshold {
+		return nil
+	}
+	return db.compact()
+}
+
+// compact rewrites the log with a record per entry.
+func (db *DB) compact() error {
+	tmp := db.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	encoder := json.NewEncoder(w)
+	err = func() error {
+		if db.migrated {
+			if err := encoder.Encode(record{Op: opMigrated}); err != nil {
+				return err
+			}
+		}
+		if db.generation != "" {
+			if err := encoder.Encode(record{Op: opGeneration, Key: db.generation}); err != nil {
+				return err
+			}
+		}
+		for _, key := range db.keys {
+			if err := encoder.Encode(record{Op: opPut, Key: key, Entry: db.entries[key]}); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+
+	// reopen the log for appending
+	db.file.Close()
+	db.file, err = os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	db.records = len(db.keys)
+	if db.migrated {
+		db.records++
+	}
+	if db.generation != "" {
+		db.records++
+	}
+	return nil
+}
+
+// under returns true if key is dir or a path under it.
+func under(key, dir string) bool {
+	return dir == "/" || key == dir || strings.HasPrefix(key, dir+"/")
+}
@@ -0,0 +1,154 @@
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDB(t *testing.T) (*DB, string) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metadata.db")
+	db, err := Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+func TestDBPersistence(t *testing.T) {
+	db, path := tempDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for _, key := range []string{"/a/b/link", "/a/b/c/link", "/a/d", "/a-e/link", "/f"} {
+		if err := db.put(key, &entry{Inline: true, Content: []byte(key), Size: int64(len(key)), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err := db.delete("/a/b"); err != nil || removed != 2 {
+		t.Fatalf("expected 2 entries removed, got %d: %v", removed, err)
+	}
+	if err := db.SetGeneration("generation"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.replace(db.entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put("/a/g/link", &entry{Inline: true, Content: []byte("g")}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !db.Migrated() {
+		t.Fatalf("expected migrated database")
+	}
+	if generation := db.Generation(); generation != "generation" {
+		t.Fatalf("unexpected generation %q", generation)
+	}
+	if children := db.children("/"); !reflect.DeepEqual(children, []string{"/a", "/a-e", "/f"}) {
+		t.Fatalf("unexpected children of /: %v", children)
+	}
+	if children := db.children("/a"); !reflect.DeepEqual(children, []string{"/a/d", "/a/g"}) {
+		t.Fatalf("unexpected children of /a: %v", children)
+	}
+	if e, ok := db.get("/a/g/link"); !ok || string(e.Content) != "g" {
+		t.Fatalf("unexpected entry: %v", e)
+	}
+	if _, ok := db.get("/a/b/link"); ok {
+		t.Fatalf("expected deleted entry to stay deleted")
+	}
+}
+
+func TestDBLock(t *testing.T) {
+	db, path := tempDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if other, err := Open(path); err == nil {
+		other.Close()
+		t.Fatalf("expected the database to be locked")
+	}
+	db.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("expected the lock to be released: %v", err)
+	}
+	db.Close()
+}
+
+func TestDBTruncatedRecord(t *testing.T) {
+	db, path := tempDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := db.put("/a", &entry{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","key":"/b"`)
+	f.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put("/c", &entry{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if children := db.children("/"); !reflect.DeepEqual(children, []string{"/a", "/c"}) {
+		t.Fatalf("unexpected children: %v", children)
+	}
+}
+
+func TestDBCompaction(t *testing.T) {
+	db, path := tempDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+
+	// the stale records alone trigger the compaction, however many entries
+	// are live
+	entries := make(map[string]*entry)
+	for i := 0; i < 2*compactThreshold; i++ {
+		entries[fmt.Sprintf("/b/%d", i)] = &entry{}
+	}
+	if err := db.replace(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < compactThreshold+10; i++ {
+		if err := db.put("/a", &entry{Size: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stale := db.records - len(db.entries); stale >= compactThreshold {
+		t.Fatalf("expected log to be compacted, %d stale records", stale)
+	}
+	if e, _ := db.get("/a"); e.Size != compactThreshold+9 {
+		t.Fatalf("unexpected entry after compaction: %v", e)
+	}
+}
@@ -0,0 +1,552 @@
+// Package metadata provides an embedded database indexing the metadata of
+// the repositories: the links of their tags, manifest revisions and layers.
+//
+// The database is used through Driver, a storage driver wrapper which serves
+// the listings and the links under the repositories root from the database,
+// so that the catalog, tag listings and the mark phase of the garbage
+// collector do not walk the storage backend. Blobs stay on the backend.
+//
+// A database supports a single registry instance. New takes a lease on the
+// storage backend, which the driver refreshes until it is closed, and fails
+// while the database of another registry holds it.
+//
+// The database is only current while no other process writes to the
+// repositories. New records the generation of the database in a file of the
+// storage backend, which registries writing without the database delete with
+// Invalidate. The database is migrated again when it is opened and the
+// generation does not match, and the driver serves everything from the
+// storage backend once it does not match anymore.
+package metadata
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/uuid"
+)
+
+const (
+	// RepositoriesRoot is the root of the repositories in the layout of
+	// the registry storage.
+	RepositoriesRoot = "/docker/registry/v2/repositories"
+
+	// GenerationPath is the file of the storage backend holding the
+	// generation of the database the repositories are indexed in.
+	GenerationPath = "/docker/registry/v2/metadata/generation"
+
+	// LeasePath is the file of the storage backend holding the generation of
+	// the database of the running registry.
+	LeasePath = "/docker/registry/v2/metadata/lease"
+
+	// leaseInterval is the interval at which the lease is refreshed.
+	leaseInterval = 10 * time.Second
+
+	// leaseTimeout is the age past which the lease of a database is taken
+	// over by another one, such as when its registry did not stop cleanly.
+	leaseTimeout = time.Minute
+
+	// checkInterval is the maximum age of the last check of the generation
+	// when a file is read from the database. The listings of the root and of
+	// its ancestors, which start the catalog and the mark phase of the
+	// garbage collector, always check it.
+	checkInterval = 10 * time.Second
+)
+
+// ErrLeased is returned by New when the lease on the storage backend is held
+// by the database of another registry.
+var ErrLeased = errors.New("the repositories are indexed by the metadata database of another registry, which supports a single registry instance")
+
+// Driver is a storage driver indexing the files under a root in a DB.
+//
+// The content of the link files is stored in the database, the other files,
+// such as the uploads in progress, are only recorded by name. All writes go
+// through to the wrapped driver, which remains the source of truth: a
+// database lost or out of date can be rebuilt with Migrate.
+type Driver struct {
+	storagedriver.StorageDriver
+	db   *DB
+	root string
+
+	// checked is true if the generation of db is checked against the
+	// storage backend.
+	checked   bool
+	mu        sync.Mutex
+	lastCheck time.Time
+	stale     bool
+
+	// done is closed when the driver is closed, to release the lease.
+	done chan struct{}
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+var _ storagedriver.ParallelWalker = &Driver{}
+var _ storagedriver.Concatenator = &Driver{}
+
+// New opens the database at dbPath and returns a driver indexing the
+// repositories of sd in it. The database is filled from the content of sd
+// the first time it is opened, and again when the repositories were written
+// to without it. It fails with ErrLeased while the database of another
+// registry indexes sd.
+func New(ctx context.Context, sd storagedriver.StorageDriver, dbPath string) (*Driver, error) {
+	db, err := Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkLease(ctx, sd, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	generation, err := sd.GetContent(ctx, GenerationPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		generation, err = nil, nil
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if !db.Migrated() || db.Generation() == "" || string(generation) != db.Generation() {
+		if db.Migrated() {
+			dcontext.GetLogger(ctx).Warnf("the metadata database %s is out of date", dbPath)
+		}
+		dcontext.GetLogger(ctx).Infof("migrating the metadata of %s to %s", RepositoriesRoot, dbPath)
+		start := time.Now()
+		// the new generation is stored first, so that the writes made
+		// without the database while migrating invalidate it
+		generation := uuid.Generate().String()
+		err := sd.PutContent(ctx, GenerationPath, []byte(generation))
+		if err == nil {
+			err = Migrate(ctx, sd, db, RepositoriesRoot)
+		}
+		if err == nil {
+			err = db.SetGeneration(generation)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		dcontext.GetLogger(ctx).Infof("migrated the metadata in %s", time.Since(start))
+	}
+
+	if err := sd.PutContent(ctx, LeasePath, []byte(db.Generation())); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	d := Wrap(sd, db, RepositoriesRoot)
+	d.checked, d.lastCheck = true, time.Now()
+	d.done = make(chan struct{})
+	go d.holdLease(ctx)
+	return d, nil
+}
+
+// checkLease returns ErrLeased if the lease on sd is held by another
+// database and has not expired.
+func checkLease(ctx context.Context, sd storagedriver.StorageDriver, db *DB) error {
+	fi, err := sd.Stat(ctx, LeasePath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if time.Since(fi.ModTime()) >= leaseTimeout {
+		return nil
+	}
+
+	holder, err := sd.GetContent(ctx, LeasePath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if db.Generation() == "" || string(holder) != db.Generation() {
+		return ErrLeased
+	}
+	return nil
+}
+
+// holdLease refreshes the lease of the database until the driver is closed,
+// or the lease is taken over by another database.
+func (d *Driver) holdLease(ctx context.Context) {
+	ticker := time.NewTicker(leaseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		holder, err := d.StorageDriver.GetContent(ctx, LeasePath)
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok && err != nil {
+			dcontext.GetLogger(ctx).Errorf("error refreshing the lease of the metadata database: %v", err)
+			continue
+		}
+		if err == nil && string(holder) != d.db.Generation() {
+			dcontext.GetLogger(ctx).Errorf("the lease of the metadata database was taken over by the database of another registry: %v", ErrLeased)
+			return
+		}
+		if err := d.StorageDriver.PutContent(ctx, LeasePath, []byte(d.db.Generation())); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error refreshing the lease of the metadata database: %v", err)
+		}
+	}
+}
+
+// Invalidate marks the databases indexing the repositories of sd as out of
+// date. It must be called before writing to the repositories without a
+// database.
+func Invalidate(ctx context.Context, sd storagedriver.StorageDriver) error {
+	if _, err := sd.Stat(ctx, GenerationPath); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	err := sd.Delete(ctx, GenerationPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Wrap returns a driver indexing the files of sd under root in db, which
+// must have been migrated from sd.
+func Wrap(sd storagedriver.StorageDriver, db *DB, root string) *Driver {
+	return &Driver{StorageDriver: sd, db: db, root: root}
+}
+
+// Close releases the lease of the database, if the driver holds it, and
+// closes the database.
+func (d *Driver) Close() error {
+	if d.done != nil {
+		close(d.done)
+		ctx := context.Background()
+		if holder, err := d.StorageDriver.GetContent(ctx, LeasePath); err == nil && string(holder) == d.db.Generation() {
+			d.StorageDriver.Delete(ctx, LeasePath)
+		}
+	}
+	return d.db.Close()
+}
+
+// current returns true if the database is current, checking its generation
+// against the storage backend if the last check is older than maxAge. Once
+// the generation does not match, the database is out of date until it is
+// opened again, and the generation of the storage backend is deleted, as the
+// writes of this driver are missing from the other databases too.
+func (d *Driver) current(ctx context.Context, maxAge time.Duration) bool {
+	if !d.checked {
+		return true
+	}
+
+	d.mu.Lock()
+	if d.stale || time.Since(d.lastCheck) < maxAge {
+		stale := d.stale
+		d.mu.Unlock()
+		return !stale
+	}
+	d.mu.Unlock()
+
+	start := time.Now()
+	generation, err := d.StorageDriver.GetContent(ctx, GenerationPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok && err != nil {
+		// the database is not known to be current, but may still be
+		dcontext.GetLogger(ctx).Errorf("error checking the generation of the metadata database: %v", err)
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil && string(generation) == d.db.Generation() {
+		if start.After(d.lastCheck) {
+			d.lastCheck = start
+		}
+		return !d.stale
+	}
+	if !d.stale {
+		d.stale = true
+		dcontext.GetLogger(ctx).Errorf("the metadata database is out of date, serving the repositories from the storage backend until it is opened again")
+		if err := Invalidate(ctx, d.StorageDriver); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error invalidating the generation of the metadata database: %v", err)
+		}
+	}
+	return false
+}
+
+// fresh returns true if the database is current for the listing of p.
+func (d *Driver) fresh(ctx context.Context, p string) bool {
+	if p == d.root || d.ancestor(p) {
+		return d.current(ctx, 0)
+	}
+	return d.current(ctx, checkInterval)
+}
+
+// indexed returns true if p is a valid path under the root. Invalid paths
+// are left to the wrapped driver to reject.
+func (d *Driver) indexed(p string) bool {
+	return storagedriver.PathRegexp.MatchString(p) && under(p, d.root)
+}
+
+// indexedDir returns true if p is the root, which may be "/", or a valid
+// path under it.
+func (d *Driver) indexedDir(p string) bool {
+	return p == d.root || d.indexed(p)
+}
+
+// ancestor returns true if p is a parent directory of the root.
+func (d *Driver) ancestor(p string) bool {
+	return p != d.root && (p == "/" || strings.HasPrefix(d.root, p+"/"))
+}
+
+// inline returns true if the content of the file at p is stored in the
+// database.
+func inline(p string) bool {
+	return path.Base(p) == "link"
+}
+
+func (d *Driver) pathNotFound(p string) error {
+	return storagedriver.PathNotFoundError{Path: p, DriverName: d.StorageDriver.Name()}
+}
+
+// GetContent retrieves the content of links from the database.
+func (d *Driver) GetContent(ctx context.Context, p string) ([]byte, error) {
+	if !d.indexed(p) || !d.current(ctx, checkInterval) {
+		return d.StorageDriver.GetContent(ctx, p)
+	}
+
+	e, ok := d.db.get(p)
+	if !ok {
+		return nil, d.pathNotFound(p)
+	}
+	if !e.Inline {
+		return d.StorageDriver.GetContent(ctx, p)
+	}
+	content := make([]byte, len(e.Content))
+	copy(content, e.Content)
+	return content, nil
+}
+
+// PutContent stores the content in the wrapped driver and records it in the
+// database.
+func (d *Driver) PutContent(ctx context.Context, p string, content []byte) error {
+	if err := d.StorageDriver.PutContent(ctx, p, content); err != nil {
+		return err
+	}
+	if !d.indexed(p) {
+		return nil
+	}
+
+	e := &entry{Size: int64(len(content)), ModTime: time.Now()}
+	if inline(p) {
+		e.Inline = true
+		e.Content = append([]byte(nil), content...)
+	}
+	return d.db.put(p, e)
+}
+
+// Reader fails early for the indexed paths not in the database.
+func (d *Driver) Reader(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	if d.indexed(p) && d.current(ctx, checkInterval) {
+		if _, ok := d.db.get(p); !ok {
+			return nil, d.pathNotFound(p)
+		}
+	}
+	return d.StorageDriver.Reader(ctx, p, offset)
+}
+
+// Writer records the written files in the database, and removes them when
+// the writer is cancelled.
+func (d *Driver) Writer(ctx context.Context, p string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := d.StorageDriver.Writer(ctx, p, append)
+	if err != nil || !d.indexed(p) {
+		return fw, err
+	}
+
+	if err := d.db.put(p, &entry{ModTime: time.Now()}); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	return &writer{FileWriter: fw, db: d.db, path: p}, nil
+}
+
+type writer struct {
+	storagedriver.FileWriter
+	db   *DB
+	path string
+}
+
+func (w *writer) Cancel() error {
+	if err := w.FileWriter.Cancel(); err != nil {
+		return err
+	}
+	_, err := w.db.delete(w.path)
+	return err
+}
+
+// Stat answers from the database, except for the files whose content is
+// not stored in it.
+func (d *Driver) Stat(ctx context.Context, p string) (storagedriver.FileInfo, error) {
+	if !d.indexedDir(p) && !d.ancestor(p) || !d.current(ctx, checkInterval) {
+		return d.StorageDriver.Stat(ctx, p)
+	}
+	if d.ancestor(p) {
+		fi, err := d.StorageDriver.Stat(ctx, p)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok && !d.db.empty() {
+			return d.dirInfo(p), nil
+		}
+		return fi, err
+	}
+
+	e, ok := d.db.get(p)
+	if !ok {
+		if d.db.isDir(p) {
+			return d.dirInfo(p), nil
+		}
+		return nil, d.pathNotFound(p)
+	}
+	if !e.Inline {
+		fi, err := d.StorageDriver.Stat(ctx, p)
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return fi, err
+		}
+		// the file is being written, and does not exist on some backends
+		// until it is committed
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    p,
+		Size:    e.Size,
+		ModTime: e.ModTime,
+	}}, nil
+}
+
+func (d *Driver) dirInfo(p string) storagedriver.FileInfo {
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  p,
+		IsDir: true,
+	}}
+}
+
+// List answers from the database for the indexed paths.
+func (d *Driver) List(ctx context.Context, p string) ([]string, error) {
+	if !d.indexedDir(p) && !d.ancestor(p) || !d.fresh(ctx, p) {
+		return d.StorageDriver.List(ctx, p)
+	}
+	if d.ancestor(p) {
+		return d.listAncestor(ctx, p)
+	}
+
+	children := d.db.children(p)
+	if len(children) == 0 {
+		if _, ok := d.db.get(p); !ok && p != "/" {
+			return nil, d.pathNotFound(p)
+		}
+	}
+	return children, nil
+}
+
+// listAncestor adds the next directory towards the root to the files listed
+// by the wrapped driver.
+func (d *Driver) listAncestor(ctx context.Context, p string) ([]string, error) {
+	children, err := d.StorageDriver.List(ctx, p)
+	if d.db.empty() {
+		return children, err
+	}
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		children, err = nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prefix := p + "/"
+	if p == "/" {
+		prefix = p
+	}
+	next := prefix + strings.SplitN(strings.TrimPrefix(d.root, prefix), "/", 2)[0]
+	for _, child := range children {
+		if child == next {
+			return children, nil
+		}
+	}
+	return append(children, next), nil
+}
+
+// Move moves the file in the wrapped driver and in the database.
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := d.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+
+	e := &entry{ModTime: time.Now()}
+	if d.indexed(sourcePath) {
+		if source, ok := d.db.get(sourcePath); ok {
+			e.Inline, e.Content, e.Size = source.Inline, source.Content, source.Size
+		}
+		if _, err := d.db.delete(sourcePath); err != nil {
+			return err
+		}
+	}
+	if d.indexed(destPath) {
+		if e.Inline && !inline(destPath) {
+			e.Inline, e.Content = false, nil
+		}
+		return d.db.put(destPath, e)
+	}
+	return nil
+}
+
+// Concat concatenates the files in the wrapped driver and records the
+// destination in the database.
+func (d *Driver) Concat(ctx context.Context, destPath string, sourcePaths []string) error {
+	if err := storagedriver.Concat(ctx, d.StorageDriver, destPath, sourcePaths); err != nil {
+		return err
+	}
+	if !d.indexed(destPath) {
+		return nil
+	}
+	return d.db.put(destPath, &entry{ModTime: time.Now()})
+}
+
+// Delete deletes the files in the wrapped driver and in the database.
+func (d *Driver) Delete(ctx context.Context, p string) error {
+	err := d.StorageDriver.Delete(ctx, p)
+	if !d.indexedDir(p) && !d.ancestor(p) {
+		return err
+	}
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok && err != nil {
+		return err
+	}
+
+	removed, dbErr := d.db.delete(p)
+	if dbErr != nil {
+		return dbErr
+	}
+	if removed > 0 {
+		return nil
+	}
+	return err
+}
+
+// Walk walks the indexed paths using the database.
+func (d *Driver) Walk(ctx context.Context, p string, f storagedriver.WalkFn) error {
+	if !d.indexedDir(p) && !d.ancestor(p) || !d.fresh(ctx, p) {
+		return d.StorageDriver.Walk(ctx, p, f)
+	}
+	return storagedriver.WalkFallback(ctx, d, p, f)
+}
+
+// WalkParallel walks the indexed paths using the database.
+func (d *Driver) WalkParallel(ctx context.Context, p string, maxConcurrency int, f storagedriver.WalkFn) error {
+	if !d.indexedDir(p) && !d.ancestor(p) || !d.fresh(ctx, p) {
+		return storagedriver.WalkParallel(ctx, d.StorageDriver, p, maxConcurrency, f)
+	}
+	return storagedriver.WalkParallelFallback(ctx, d, p, maxConcurrency, f)
+}
@@ -0,0 +1,280 @@
+package metadata
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/faults"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	dir, err := ioutil.TempDir("", "metadata-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		panic(err)
+	}
+
+	// index the whole driver
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return Wrap(inmemory.New(), db, "/"), nil
+	}, testsuites.NeverSkip)
+}
+
+// failingListings are the rules failing the listings of the repositories
+// and the reads of their links.
+var failingListings = []faults.Rule{
+	{
+		Actions:   []string{"List", "Walk"},
+		Path:      regexp.MustCompile("^" + RepositoriesRoot),
+		ErrorRate: 1,
+	},
+	{
+		Actions:   []string{"Stat", "GetContent", "Reader"},
+		Path:      regexp.MustCompile("/link$"),
+		ErrorRate: 1,
+	},
+}
+
+func TestIndexedLinks(t *testing.T) {
+	ctx := context.Background()
+	db, path := tempDB(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+
+	sd := faults.New(inmemory.New(), nil, 1)
+	d := Wrap(sd, db, RepositoriesRoot)
+
+	link := RepositoriesRoot + "/a/b/_manifests/tags/latest/current/link"
+	upload := RepositoriesRoot + "/a/b/_uploads/id/startedat"
+	for _, p := range []string{link, upload, "/docker/registry/v2/blobs/data"} {
+		if err := d.PutContent(ctx, p, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sd.SetRules(failingListings)
+
+	if content, err := d.GetContent(ctx, link); err != nil || string(content) != link {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+	if fi, err := d.Stat(ctx, link); err != nil || fi.Size() != int64(len(link)) {
+		t.Fatalf("unexpected stat %v: %v", fi, err)
+	}
+	if children, err := d.List(ctx, RepositoriesRoot+"/a/b"); err != nil || !reflect.DeepEqual(children, []string{
+		RepositoriesRoot + "/a/b/_manifests",
+		RepositoriesRoot + "/a/b/_uploads",
+	}) {
+		t.Fatalf("unexpected listing %v: %v", children, err)
+	}
+	if children, err := d.List(ctx, "/docker/registry/v2"); err != nil || !reflect.DeepEqual(children, []string{
+		"/docker/registry/v2/blobs",
+		RepositoriesRoot,
+	}) {
+		t.Fatalf("unexpected listing %v: %v", children, err)
+	}
+
+	var walked []string
+	err := d.Walk(ctx, RepositoriesRoot, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			walked = append(walked, fi.Path())
+		}
+		return nil
+	})
+	sort.Strings(walked)
+	if err != nil || !reflect.DeepEqual(walked, []string{link, upload}) {
+		t.Fatalf("unexpected walk %v: %v", walked, err)
+	}
+
+	// writes go through to the wrapped driver
+	sd.SetRules(nil)
+	if err := d.Delete(ctx, RepositoriesRoot+"/a/b/_uploads"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.Stat(ctx, upload); err == nil {
+		t.Fatalf("expected upload to be deleted from the wrapped driver")
+	}
+	if _, err := d.Stat(ctx, upload); err == nil {
+		t.Fatalf("expected upload to be deleted from the database")
+	}
+	if content, err := sd.GetContent(ctx, link); err != nil || string(content) != link {
+		t.Fatalf("expected link in the wrapped driver, got %q: %v", content, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := inmemory.New()
+	link := RepositoriesRoot + "/a/_layers/sha256/abc/link"
+	for _, p := range []string{link, RepositoriesRoot + "/a/_uploads/id/data"} {
+		if err := sd.PutContent(ctx, p, []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := New(ctx, sd, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := d.db.get(link); !ok || !e.Inline || string(e.Content) != "content" {
+		t.Fatalf("expected link to be migrated, got %v", e)
+	}
+	if e, ok := d.db.get(RepositoriesRoot + "/a/_uploads/id/data"); !ok || e.Inline || e.Size != 7 {
+		t.Fatalf("expected upload to be recorded, got %v", e)
+	}
+
+	// the migration is not repeated once done
+	if err := sd.Delete(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	d, err = New(ctx, sd, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, ok := d.db.get(link); !ok {
+		t.Fatalf("expected migration to run once")
+	}
+}
+
+func TestMigrateOutOfDate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := inmemory.New()
+	d, err := New(ctx, sd, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// a registry writes to the repositories without the database
+	link := RepositoriesRoot + "/a/_layers/sha256/abc/link"
+	if err := Invalidate(ctx, sd); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.PutContent(ctx, link, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = New(ctx, sd, filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, ok := d.db.get(link); !ok {
+		t.Fatalf("expected the database to be migrated again")
+	}
+}
+
+func TestOutOfDate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := inmemory.New()
+	d, err := New(ctx, sd, filepath.Join(dir, "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the lease of d expires, such as when its registry hangs, and another
+	// registry indexes the repositories in its own database
+	if err := sd.Delete(ctx, LeasePath); err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(ctx, sd, filepath.Join(dir, "b.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.PutContent(ctx, RepositoriesRoot+"/b/_layers/sha256/abc/link", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the listings of the root check the generation
+	if children, err := d.List(ctx, RepositoriesRoot); err != nil || !reflect.DeepEqual(children, []string{RepositoriesRoot + "/b"}) {
+		t.Fatalf("unexpected listing %v: %v", children, err)
+	}
+	if content, err := d.GetContent(ctx, RepositoriesRoot+"/b/_layers/sha256/abc/link"); err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	// the writes of d are missing from the other database too
+	if err := d.PutContent(ctx, RepositoriesRoot+"/c/_layers/sha256/abc/link", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if children, err := other.List(ctx, RepositoriesRoot); err != nil || !reflect.DeepEqual(children, []string{
+		RepositoriesRoot + "/b",
+		RepositoriesRoot + "/c",
+	}) {
+		t.Fatalf("unexpected listing %v: %v", children, err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sd := inmemory.New()
+	d, err := New(ctx, sd, filepath.Join(dir, "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another registry cannot index the repositories while d holds the lease
+	if _, err := New(ctx, sd, filepath.Join(dir, "b.db")); err != ErrLeased {
+		t.Fatalf("expected ErrLeased, got %v", err)
+	}
+
+	// the registry of d restarts without releasing the lease
+	close(d.done)
+	d.db.Close()
+	d, err = New(ctx, sd, filepath.Join(dir, "a.db"))
+	if err != nil {
+		t.Fatalf("expected the database to take its own lease again: %v", err)
+	}
+
+	// the lease is released when the driver is closed
+	d.Close()
+	other, err := New(ctx, sd, filepath.Join(dir, "b.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+}
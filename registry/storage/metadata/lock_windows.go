@@ -0,0 +1,8 @@
+package metadata
+
+import "os"
+
+// lockFile opens the lock file at path. Files are not locked on Windows.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,48 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// migrateConcurrency is the number of concurrent calls to the storage driver
+// while migrating.
+const migrateConcurrency = 16
+
+// Migrate replaces the content of db with the files of sd under root, and
+// marks it as migrated. The content of the links is read from sd; the other
+// files are recorded by name.
+func Migrate(ctx context.Context, sd storagedriver.StorageDriver, db *DB, root string) error {
+	var mu sync.Mutex
+	entries := make(map[string]*entry)
+
+	err := storagedriver.WalkParallel(ctx, sd, root, migrateConcurrency, func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+
+		e := &entry{Size: fi.Size(), ModTime: fi.ModTime()}
+		if inline(fi.Path()) {
+			content, err := sd.GetContent(ctx, fi.Path())
+			if err != nil {
+				return err
+			}
+			e.Inline, e.Content = true, content
+		}
+
+		mu.Lock()
+		entries[fi.Path()] = e
+		mu.Unlock()
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.replace(entries)
+}
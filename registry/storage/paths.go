@@ -40,8 +40,16 @@ const (
 // 						data
 // 						startedat
 // 						hashstates/<algorithm>/<offset>
+// 						chunks/<offset>
 //			-> blob/<algorithm>
 //				<split directory content addressable storage>
+//			-> references/<algorithm>
+//				<split directory of the references to each blob>
+//			-> sweep/<algorithm>
+//				<blobs which may no longer be referenced>
+//			-> trash/
+//				items/<id>
+//				revisions/<name>/<algorithm>/<hex digest>/<id>
 //
 // The storage backend layout is broken up into a content-addressable blob
 // store and repositories. The content-addressable blob store holds most data
@@ -86,6 +94,7 @@ const (
 //
 // 	Blobs:
 //
+// 	layersPathSpec:               <root>/v2/repositories/<name>/_layers/
 // 	layerLinkPathSpec:            <root>/v2/repositories/<name>/_layers/<algorithm>/<hex digest>/link
 //
 //	Uploads:
@@ -93,6 +102,8 @@ const (
 // 	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 // 	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 // 	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+// 	uploadChunkPathSpec:            <root>/v2/repositories/<name>/_uploads/<id>/chunks/<offset>
+// 	uploadAssembledPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/assembled
 //
 //	Blob Store:
 //
@@ -101,6 +112,22 @@ const (
 // 	blobDataPathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 // 	blobMediaTypePathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 //
+//	References:
+//
+//	blobReferencesPathSpec:         <root>/v2/references/<algorithm>/<first two hex bytes of digest>/<hex digest>
+//	blobReferencePathSpec:          <root>/v2/references/<algorithm>/<first two hex bytes of digest>/<hex digest>/<name>/_manifests/<algorithm>/<hex digest>
+//	blobLinkReferencePathSpec:      <root>/v2/references/<algorithm>/<first two hex bytes of digest>/<hex digest>/<name>/_layers
+//	referencesBuiltAtPathSpec:      <root>/v2/references/builtat
+//	sweepCandidatesPathSpec:        <root>/v2/sweep/
+//	sweepCandidatePathSpec:         <root>/v2/sweep/<algorithm>/<hex digest>
+//
+//	Trash:
+//
+//	trashItemsPathSpec:             <root>/v2/trash/items/
+//	trashItemPathSpec:              <root>/v2/trash/items/<id>
+//	trashRevisionPathSpec:          <root>/v2/trash/revisions/<name>/<algorithm>/<hex digest>/
+//	trashRevisionEntryPathSpec:     <root>/v2/trash/revisions/<name>/<algorithm>/<hex digest>/<id>
+//
 // For more information on the semantic meaning of each path and their
 // contents, please see the path spec documentation.
 func pathFor(spec pathSpec) (string, error) {
@@ -205,6 +232,8 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, path.Join(components...)), nil
+	case layersPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_layers")...), nil
 	case layerLinkPathSpec:
 		components, err := digestPathComponents(v.digest, false)
 		if err != nil {
@@ -250,8 +279,71 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadChunkPathSpec:
+		offset := fmt.Sprintf("%d", v.offset)
+		if v.list {
+			offset = "" // Limit to the prefix for listing chunks.
+		}
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "chunks", offset)...), nil
+	case uploadAssembledPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "assembled")...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
+	case blobReferencesPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(rootPrefix, "references"), components...)...), nil
+	case blobReferencePathSpec:
+		root, err := pathFor(blobReferencesPathSpec{digest: v.digest})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append([]string{root, v.name, "_manifests"}, components...)...), nil
+	case blobLinkReferencePathSpec:
+		root, err := pathFor(blobReferencesPathSpec{digest: v.digest})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, v.name, "_layers"), nil
+	case referencesBuiltAtPathSpec:
+		return path.Join(append(rootPrefix, "references", "builtat")...), nil
+	case sweepCandidatesPathSpec:
+		return path.Join(append(rootPrefix, "sweep")...), nil
+	case sweepCandidatePathSpec:
+		components, err := digestPathComponents(v.digest, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(rootPrefix, "sweep"), components...)...), nil
+	case trashItemsPathSpec:
+		return path.Join(append(rootPrefix, "trash", "items")...), nil
+	case trashItemPathSpec:
+		return path.Join(append(rootPrefix, "trash", "items", v.id)...), nil
+	case trashRevisionPathSpec:
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(rootPrefix, "trash", "revisions", v.name), components...)...), nil
+	case trashRevisionEntryPathSpec:
+		root, err := pathFor(trashRevisionPathSpec{name: v.name, revision: v.revision})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, v.id), nil
 	default:
 		// TODO(sday): This is an internal error. Ensure it doesn't escape (panic?).
 		return "", fmt.Errorf("unknown path spec: %#v", v)
@@ -348,6 +440,14 @@ type manifestTagIndexEntryLinkPathSpec struct {
 
 func (manifestTagIndexEntryLinkPathSpec) pathSpec() {}
 
+// layersPathSpec describes the directory of the layer links of a
+// repository.
+type layersPathSpec struct {
+	name string
+}
+
+func (layersPathSpec) pathSpec() {}
+
 // blobLinkPathSpec specifies a path for a blob link, which is a file with a
 // blob id. The blob link will contain a content addressable blob id reference
 // into the blob store. The format of the contents is as follows:
@@ -433,12 +533,117 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// uploadChunkPathSpec defines the path parameters for the file that stores a
+// chunk of an upload written out of order, starting at a specific byte
+// offset. If `list` is set, then the path mapper will generate a list prefix
+// for all the chunks of the upload identified by the name and id.
+type uploadChunkPathSpec struct {
+	name   string
+	id     string
+	offset int64
+	list   bool
+}
+
+func (uploadChunkPathSpec) pathSpec() {}
+
+// uploadAssembledPathSpec defines the path parameters for the file that
+// stores the data of an upload assembled from its chunks when it is
+// committed.
+type uploadAssembledPathSpec struct {
+	name string
+	id   string
+}
+
+func (uploadAssembledPathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct {
 }
 
 func (repositoriesRootPathSpec) pathSpec() {}
 
+// blobReferencesPathSpec describes the directory of the references to a
+// blob, kept when reference counting is enabled.
+type blobReferencesPathSpec struct {
+	digest digest.Digest
+}
+
+func (blobReferencesPathSpec) pathSpec() {}
+
+// blobReferencePathSpec describes the file recording that a manifest
+// revision of the named repository references a blob. The contents of this
+// file should just be the digest of the revision.
+type blobReferencePathSpec struct {
+	digest   digest.Digest
+	name     string
+	revision digest.Digest
+}
+
+func (blobReferencePathSpec) pathSpec() {}
+
+// blobLinkReferencePathSpec describes the file recording that a blob is
+// linked into the named repository. It does not count as a reference.
+type blobLinkReferencePathSpec struct {
+	digest digest.Digest
+	name   string
+}
+
+func (blobLinkReferencePathSpec) pathSpec() {}
+
+// referencesBuiltAtPathSpec describes the file holding the time at which the
+// references to the blobs stored before reference counting was enabled were
+// built. Blobs are not swept before it exists.
+type referencesBuiltAtPathSpec struct{}
+
+func (referencesBuiltAtPathSpec) pathSpec() {}
+
+// sweepCandidatesPathSpec describes the directory of the blobs which may no
+// longer be referenced.
+type sweepCandidatesPathSpec struct{}
+
+func (sweepCandidatesPathSpec) pathSpec() {}
+
+// sweepCandidatePathSpec describes the file marking a blob as a candidate
+// for sweeping. It holds the time at which the blob became a candidate.
+type sweepCandidatePathSpec struct {
+	digest digest.Digest
+}
+
+func (sweepCandidatePathSpec) pathSpec() {}
+
+// trashItemsPathSpec describes the directory of the trashed items.
+type trashItemsPathSpec struct{}
+
+func (trashItemsPathSpec) pathSpec() {}
+
+// trashItemPathSpec describes the file recording a trashed item and the
+// content of the links it removed from its repository.
+type trashItemPathSpec struct {
+	id string
+}
+
+func (trashItemPathSpec) pathSpec() {}
+
+// trashRevisionPathSpec describes the directory of the trashed items holding
+// the link of a manifest revision of the named repository.
+type trashRevisionPathSpec struct {
+	name     string
+	revision digest.Digest
+}
+
+func (trashRevisionPathSpec) pathSpec() {}
+
+// trashRevisionEntryPathSpec describes the file recording that a trashed
+// item holds the link of a manifest revision. It holds the time at which the
+// item expires.
+type trashRevisionEntryPathSpec struct {
+	name     string
+	revision digest.Digest
+	id       string
+}
+
+func (trashRevisionEntryPathSpec) pathSpec() {}
+
 // digestPathComponents provides a consistent path breakdown for a given
 // digest. For a generic digest, it will be as follows:
 //
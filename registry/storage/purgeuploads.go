@@ -4,6 +4,7 @@ import (
 	"context"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	storageDriver "github.com/docker/distribution/registry/storage/driver"
@@ -61,18 +62,18 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 	var errors []error
 	uploads := make(map[string]uploadData, 0)
 
-	inUploadDir := false
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return uploads, append(errors, err)
 	}
 
-	err = driver.Walk(ctx, root, func(fileInfo storageDriver.FileInfo) error {
+	var mu sync.Mutex
+	err = storageDriver.WalkParallel(ctx, driver, root, walkConcurrency, func(fileInfo storageDriver.FileInfo) error {
 		filePath := fileInfo.Path()
 		_, file := path.Split(filePath)
 		if file[0] == '_' {
 			// Reserved directory
-			inUploadDir = (file == "_uploads")
+			inUploadDir := (file == "_uploads")
 
 			if fileInfo.IsDir() && !inUploadDir {
 				return storageDriver.ErrSkipDir
@@ -85,6 +86,16 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 			// Cannot reliably delete
 			return nil
 		}
+
+		var startedAt time.Time
+		var startedAtErr error
+		if file == "startedat" {
+			startedAt, startedAtErr = readStartedAtFile(driver, filePath)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
 		ud, ok := uploads[uuid]
 		if !ok {
 			ud = newUploadData()
@@ -93,10 +104,10 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 			ud.containingDir = filePath
 		}
 		if file == "startedat" {
-			if t, err := readStartedAtFile(driver, filePath); err == nil {
-				ud.startedAt = t
+			if startedAtErr == nil {
+				ud.startedAt = startedAt
 			} else {
-				errors = pushError(errors, filePath, err)
+				errors = pushError(errors, filePath, startedAtErr)
 			}
 
 		}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// referenceCounter records the manifest revisions referencing each blob, and
+// the repositories linking it. A blob which may no longer be referenced, or
+// which was just linked, becomes a candidate for SweepBlobs, which deletes it
+// after a grace period unless a revision references it by then.
+type referenceCounter struct {
+	driver driver.StorageDriver
+	// candidates is set if blobs are made candidates, which only SweepBlobs
+	// removes.
+	candidates bool
+}
+
+// references returns the blobs referenced by the revision of a manifest,
+// including the revision itself.
+func references(revision digest.Digest, manifest distribution.Manifest) []digest.Digest {
+	dgsts := []digest.Digest{revision}
+	for _, descriptor := range manifest.References() {
+		dgsts = append(dgsts, descriptor.Digest)
+	}
+	return dgsts
+}
+
+// add records the references of the revision of a manifest put in the named
+// repository.
+func (rc *referenceCounter) add(ctx context.Context, name string, revision digest.Digest, manifest distribution.Manifest) error {
+	for _, dgst := range references(revision, manifest) {
+		referencePath, err := pathFor(blobReferencePathSpec{digest: dgst, name: name, revision: revision})
+		if err != nil {
+			return err
+		}
+		if err := rc.driver.PutContent(ctx, referencePath, []byte(revision)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the references of the revision of a manifest deleted from
+// the named repository, making the blobs it referenced candidates.
+func (rc *referenceCounter) remove(ctx context.Context, name string, revision digest.Digest, manifest distribution.Manifest) error {
+	for _, dgst := range references(revision, manifest) {
+		referencePath, err := pathFor(blobReferencePathSpec{digest: dgst, name: name, revision: revision})
+		if err != nil {
+			return err
+		}
+		if err := rc.driver.Delete(ctx, referencePath); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+		if err := rc.candidate(ctx, dgst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// link records that a blob is linked into the named repository, and makes it
+// a candidate until a revision references it.
+func (rc *referenceCounter) link(ctx context.Context, name string, dgst digest.Digest) error {
+	linkReferencePath, err := pathFor(blobLinkReferencePathSpec{digest: dgst, name: name})
+	if err != nil {
+		return err
+	}
+	if err := rc.driver.PutContent(ctx, linkReferencePath, []byte(dgst)); err != nil {
+		return err
+	}
+	return rc.candidate(ctx, dgst)
+}
+
+// linked returns the repositories recorded as linking a blob.
+func (rc *referenceCounter) linked(ctx context.Context, dgst digest.Digest) ([]string, error) {
+	referencesPath, err := pathFor(blobReferencesPathSpec{digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = rc.driver.Walk(ctx, referencesPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			if path.Base(fileInfo.Path()) == "_manifests" {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		rel := strings.TrimPrefix(fileInfo.Path(), referencesPath+"/")
+		if strings.HasSuffix(rel, "/_layers") {
+			names = append(names, strings.TrimSuffix(rel, "/_layers"))
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	return names, err
+}
+
+// LinkingRepositories returns the repositories recorded as linking a blob,
+// which reference counting or link tracking records from the time it is
+// enabled, and BuildReferences records for the blobs linked before. The
+// links may have been removed since.
+func LinkingRepositories(ctx context.Context, namespace distribution.Namespace, dgst digest.Digest) ([]string, error) {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, backend := range backends {
+		if backend.references == nil {
+			return nil, fmt.Errorf("reference counting is not enabled")
+		}
+		linked, err := backend.references.linked(ctx, dgst)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, linked...)
+	}
+	return names, nil
+}
+
+// candidate makes a blob a candidate for sweeping, from now on.
+func (rc *referenceCounter) candidate(ctx context.Context, dgst digest.Digest) error {
+	if !rc.candidates {
+		return nil
+	}
+	candidatePath, err := pathFor(sweepCandidatePathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	return rc.driver.PutContent(ctx, candidatePath, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// referenced returns true if a revision still references a blob, and the
+// repositories linking it otherwise. A revision in the trash references its
+// blobs until it expires. The references of the revisions which no longer
+// exist, such as those removed by MarkAndSweep, are pruned.
+func (rc *referenceCounter) referenced(ctx context.Context, dgst digest.Digest) (bool, []string, error) {
+	referencesPath, err := pathFor(blobReferencesPathSpec{digest: dgst})
+	if err != nil {
+		return false, nil, err
+	}
+
+	var found bool
+	var names []string
+	err = rc.driver.Walk(ctx, referencesPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		rel := strings.TrimPrefix(fileInfo.Path(), referencesPath+"/")
+		if strings.HasSuffix(rel, "/_layers") {
+			names = append(names, strings.TrimSuffix(rel, "/_layers"))
+			return nil
+		}
+
+		i := strings.LastIndex(rel, "/_manifests/")
+		if i < 0 {
+			return nil
+		}
+		revision, err := digestFromPath(fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		revisionLinkPath, err := pathFor(manifestRevisionLinkPathSpec{name: rel[:i], revision: revision})
+		if err != nil {
+			return err
+		}
+
+		_, err = rc.driver.Stat(ctx, revisionLinkPath)
+		switch err.(type) {
+		case nil:
+			found = true
+			return errReferenced
+		case driver.PathNotFoundError:
+			trashed, err := rc.trashed(ctx, rel[:i], revision)
+			if err != nil {
+				return err
+			}
+			if trashed {
+				found = true
+				return errReferenced
+			}
+			return rc.driver.Delete(ctx, fileInfo.Path())
+		default:
+			return err
+		}
+	})
+	if found {
+		return true, nil, nil
+	}
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	return false, names, err
+}
+
+// trashed returns true if an item of the trash which has not expired holds
+// the revision of a manifest deleted from the named repository.
+func (rc *referenceCounter) trashed(ctx context.Context, name string, revision digest.Digest) (bool, error) {
+	entriesPath, err := pathFor(trashRevisionPathSpec{name: name, revision: revision})
+	if err != nil {
+		return false, err
+	}
+	entries, err := rc.driver.List(ctx, entriesPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, entryPath := range entries {
+		content, err := rc.driver.GetContent(ctx, entryPath)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		expiresAt, err := time.Parse(time.RFC3339Nano, string(content))
+		if err != nil {
+			return false, fmt.Errorf("invalid trash entry %s: %v", entryPath, err)
+		}
+		if expiresAt.After(time.Now()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// errReferenced stops the walk of the references of a blob at the first one.
+var errReferenced = errors.New("blob is referenced")
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
@@ -18,11 +20,16 @@ type registry struct {
 	blobServer                   *blobServer
 	statter                      *blobStatter // global statter service.
 	blobDescriptorCacheProvider  cache.BlobDescriptorCacheProvider
+	metadataCacheProvider        cache.MetadataCacheProvider
 	deleteEnabled                bool
 	resumableDigestEnabled       bool
 	schema1SigningKey            libtrust.PrivateKey
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	manifestURLs                 manifestURLs
+	routes                       []route
+	router                       *routedRegistry   // nil unless routes are configured
+	references                   *referenceCounter // nil unless reference counting is enabled
+	trashRetention               time.Duration     // zero unless the trash is enabled
 }
 
 // manifestURLs holds regular expressions for controlling manifest URL whitelisting
@@ -48,6 +55,37 @@ func EnableDelete(registry *registry) error {
 	return nil
 }
 
+// EnableReferenceCounting is a functional option for NewRegistry. It records
+// the manifest revisions referencing each blob as manifests are put and
+// deleted, so that SweepBlobs can delete the blobs no longer referenced.
+func EnableReferenceCounting(registry *registry) error {
+	registry.references = &referenceCounter{driver: registry.blobStore.driver, candidates: true}
+	return nil
+}
+
+// EnableLinkTracking is a functional option for NewRegistry. It records the
+// repositories linking each blob, for LinkingRepositories, without making
+// blobs candidates for SweepBlobs unless reference counting is enabled too.
+func EnableLinkTracking(registry *registry) error {
+	if registry.references == nil {
+		registry.references = &referenceCounter{driver: registry.blobStore.driver}
+	}
+	return nil
+}
+
+// EnableTrash returns a functional option for NewRegistry. Deleted manifests
+// and tags are moved to the trash, from which they can be restored with
+// RestoreTrash until retention has elapsed.
+func EnableTrash(retention time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if retention <= 0 {
+			return fmt.Errorf("invalid trash retention: %v", retention)
+		}
+		registry.trashRetention = retention
+		return nil
+	}
+}
+
 // DisableDigestResumption is a functional option for NewRegistry. It should be
 // used if the registry is acting as a caching proxy.
 func DisableDigestResumption(registry *registry) error {
@@ -100,6 +138,8 @@ func BlobDescriptorCacheProvider(blobDescriptorCacheProvider cache.BlobDescripto
 	// blobDescriptorCacheProvider.
 	return func(registry *registry) error {
 		if blobDescriptorCacheProvider != nil {
+			// the metrics are counted by the repository statters, whose
+			// misses fall through to this statter
 			statter := cache.NewCachedBlobStatter(blobDescriptorCacheProvider, registry.statter)
 			registry.blobStore.statter = statter
 			registry.blobServer.statter = statter
@@ -109,11 +149,34 @@ func BlobDescriptorCacheProvider(blobDescriptorCacheProvider cache.BlobDescripto
 	}
 }
 
+// MetadataCacheProvider returns a functional option for NewRegistry. It
+// caches tag resolutions and small manifests of local repositories.
+func MetadataCacheProvider(metadataCacheProvider cache.MetadataCacheProvider) RegistryOption {
+	return func(registry *registry) error {
+		registry.metadataCacheProvider = metadataCacheProvider
+		return nil
+	}
+}
+
 // NewRegistry creates a new registry instance from the provided driver. The
 // resulting registry may be shared by multiple goroutines but is cheap to
 // allocate. If the Redirect option is specified, the backend blob server will
-// attempt to use (StorageDriver).URLFor to serve all blobs.
+// attempt to use (StorageDriver).URLFor to serve all blobs. If Route options
+// are specified, the repositories are placed on several backends.
 func NewRegistry(ctx context.Context, driver storagedriver.StorageDriver, options ...RegistryOption) (distribution.Namespace, error) {
+	registry, err := newRegistry(driver, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(registry.routes) > 0 {
+		return newRoutedRegistry(registry, options)
+	}
+	return registry, nil
+}
+
+// newRegistry creates a registry from driver, applying options.
+func newRegistry(driver storagedriver.StorageDriver, options []RegistryOption) (*registry, error) {
 	// create global statter
 	statter := &blobStatter{
 		driver: driver,
@@ -163,11 +226,21 @@ func (reg *registry) Repository(ctx context.Context, canonicalName reference.Nam
 		}
 	}
 
+	var metadataCache cache.MetadataCache
+	if reg.metadataCacheProvider != nil {
+		var err error
+		metadataCache, err = reg.metadataCacheProvider.RepositoryScoped(canonicalName.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &repository{
 		ctx:             ctx,
 		registry:        reg,
 		name:            canonicalName,
 		descriptorCache: descriptorCache,
+		metadataCache:   metadataCache,
 	}, nil
 }
 
@@ -185,6 +258,7 @@ type repository struct {
 	ctx             context.Context
 	name            reference.Named
 	descriptorCache distribution.BlobDescriptorService
+	metadataCache   cache.MetadataCache
 }
 
 // Name returns the name of the repository.
@@ -193,11 +267,18 @@ func (repo *repository) Named() reference.Named {
 }
 
 func (repo *repository) Tags(ctx context.Context) distribution.TagService {
-	tags := &tagStore{
+	var tags distribution.TagService = &tagStore{
 		repository: repo,
 		blobStore:  repo.registry.blobStore,
 	}
 
+	if repo.metadataCache != nil {
+		tags = &cachedTagService{
+			TagService: tags,
+			cache:      repo.metadataCache,
+		}
+	}
+
 	return tags
 }
 
@@ -268,6 +349,13 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 		}
 	}
 
+	if repo.metadataCache != nil {
+		return &cachedManifestService{
+			ManifestService: ms,
+			cache:           repo.metadataCache,
+		}, nil
+	}
+
 	return ms, nil
 }
 
@@ -282,7 +370,7 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 	}
 
 	if repo.descriptorCache != nil {
-		statter = cache.NewCachedBlobStatter(repo.descriptorCache, statter)
+		statter = cache.NewCachedBlobDescriptorServiceWithMetrics(repo.descriptorCache, statter, blobStatterCacheMetrics)
 	}
 
 	if repo.registry.blobDescriptorServiceFactory != nil {
@@ -300,7 +388,9 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		// TODO(stevvooe): linkPath limits this blob store to only layers.
 		// This instance cannot be used for manifest checks.
 		linkPathFns:            []linkPathFunc{blobLinkPath},
+		linkDirectoryPathSpec:  layersPathSpec{name: repo.name.Name()},
 		deleteEnabled:          repo.registry.deleteEnabled,
 		resumableDigestEnabled: repo.resumableDigestEnabled,
+		references:             repo.registry.references,
 	}
 }
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// route places the repositories under prefix on driver.
+type route struct {
+	prefix string
+	driver storagedriver.StorageDriver
+}
+
+// Route is a functional option for NewRegistry. It places the repositories
+// under prefix, whose name is prefix or starts with prefix followed by a
+// slash, on a separate backend using driver, with its own blob store,
+// configured with the same options as the registry. The longest matching
+// prefix wins; the other repositories are placed on the driver passed to
+// NewRegistry. The prefix must not end with a slash.
+func Route(prefix string, driver storagedriver.StorageDriver) RegistryOption {
+	return func(registry *registry) error {
+		if prefix == "" || strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("invalid route prefix %q", prefix)
+		}
+		registry.routes = append(registry.routes, route{prefix: prefix, driver: driver})
+		return nil
+	}
+}
+
+// routedRegistry is a namespace placing repositories on several backends,
+// each a registry with its own driver and blob store.
+type routedRegistry struct {
+	defaultBackend *registry
+	backends       []*routedBackend // by decreasing prefix length
+}
+
+type routedBackend struct {
+	prefix string
+	*registry
+}
+
+var _ distribution.Namespace = &routedRegistry{}
+var _ distribution.RepositoryEnumerator = &routedRegistry{}
+
+// newRoutedRegistry creates the backends of the routes of defaultBackend,
+// with the same options.
+func newRoutedRegistry(defaultBackend *registry, options []RegistryOption) (*routedRegistry, error) {
+	rr := &routedRegistry{defaultBackend: defaultBackend}
+	defaultBackend.router = rr
+
+	for _, r := range defaultBackend.routes {
+		backend, err := newRegistry(r.driver, options)
+		if err != nil {
+			return nil, err
+		}
+		backend.routes = nil
+		backend.router = rr
+		rr.backends = append(rr.backends, &routedBackend{prefix: r.prefix, registry: backend})
+	}
+
+	sort.SliceStable(rr.backends, func(i, j int) bool {
+		return len(rr.backends[i].prefix) > len(rr.backends[j].prefix)
+	})
+	return rr, nil
+}
+
+// backendFor returns the backend holding the named repository.
+func (rr *routedRegistry) backendFor(name string) *registry {
+	for _, backend := range rr.backends {
+		if name == backend.prefix || strings.HasPrefix(name, backend.prefix+"/") {
+			return backend.registry
+		}
+	}
+	return rr.defaultBackend
+}
+
+// all returns all backends, starting with the default one.
+func (rr *routedRegistry) all() []*registry {
+	backends := []*registry{rr.defaultBackend}
+	for _, backend := range rr.backends {
+		backends = append(backends, backend.registry)
+	}
+	return backends
+}
+
+// Scope returns the namespace scope for a registry.
+func (rr *routedRegistry) Scope() distribution.Scope {
+	return distribution.GlobalScope
+}
+
+// Repository returns the named repository from its backend.
+func (rr *routedRegistry) Repository(ctx context.Context, canonicalName reference.Named) (distribution.Repository, error) {
+	return rr.backendFor(canonicalName.Name()).Repository(ctx, canonicalName)
+}
+
+// Repositories fills repos with the repositories of all backends, in order.
+// Repositories found on a backend other than the one they are routed to, such
+// as the repositories stored before the routes were configured, are omitted.
+func (rr *routedRegistry) Repositories(ctx context.Context, repos []string, last string) (int, error) {
+	var found []string
+	exhausted := true
+	for _, backend := range rr.all() {
+		names, done, err := rr.repositories(ctx, backend, len(repos), last)
+		if err != nil {
+			return 0, err
+		}
+		found = append(found, names...)
+		exhausted = exhausted && done
+	}
+
+	sort.Slice(found, func(i, j int) bool { return lessPath(found[i], found[j]) })
+	n := copy(repos, found)
+	if len(found) < len(repos) || (len(found) == len(repos) && exhausted) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// repositories returns up to size repositories routed to backend after last,
+// and whether backend has no more of them.
+func (rr *routedRegistry) repositories(ctx context.Context, backend *registry, size int, last string) ([]string, bool, error) {
+	var names []string
+	buf := make([]string, size)
+	for len(names) < size {
+		n, err := backend.Repositories(ctx, buf, last)
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		for _, name := range buf[:n] {
+			if rr.backendFor(name) == backend {
+				names = append(names, name)
+			}
+			last = name
+		}
+		if err == io.EOF || n == 0 {
+			return names, true, nil
+		}
+	}
+	return names[:size], false, nil
+}
+
+// Enumerate applies ingester to the repositories of each backend in turn,
+// omitting those found on a backend other than the one they are routed to.
+func (rr *routedRegistry) Enumerate(ctx context.Context, ingester func(string) error) error {
+	for _, backend := range rr.all() {
+		err := backend.Enumerate(ctx, func(name string) error {
+			if rr.backendFor(name) != backend {
+				return nil
+			}
+			return ingester(name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Blobs returns an enumerator of the blobs of all backends. A blob stored on
+// several backends is enumerated once for each.
+func (rr *routedRegistry) Blobs() distribution.BlobEnumerator {
+	return routedBlobEnumerator(rr.all())
+}
+
+// BlobStatter returns a statter of the blobs of all backends.
+func (rr *routedRegistry) BlobStatter() distribution.BlobStatter {
+	return routedBlobStatter(rr.all())
+}
+
+type routedBlobEnumerator []*registry
+
+func (backends routedBlobEnumerator) Enumerate(ctx context.Context, ingester func(dgst digest.Digest) error) error {
+	for _, backend := range backends {
+		if err := backend.Blobs().Enumerate(ctx, ingester); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type routedBlobStatter []*registry
+
+func (backends routedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	for _, backend := range backends {
+		desc, err := backend.BlobStatter().Stat(ctx, dgst)
+		if err != distribution.ErrBlobUnknown {
+			return desc, err
+		}
+	}
+	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+}
+
+// storageBackends returns the backends of namespace, one per storage
+// driver.
+func storageBackends(namespace distribution.Namespace) ([]*registry, error) {
+	var backends []*registry
+	switch reg := namespace.(type) {
+	case *registry:
+		backends = []*registry{reg}
+	case *routedRegistry:
+		backends = reg.all()
+	default:
+		return nil, fmt.Errorf("unsupported namespace %T", namespace)
+	}
+
+	var distinct []*registry
+	seen := make(map[storagedriver.StorageDriver]bool)
+	for _, backend := range backends {
+		// backends sharing a driver share their storage
+		if !seen[backend.blobStore.driver] {
+			seen[backend.blobStore.driver] = true
+			distinct = append(distinct, backend)
+		}
+	}
+	return distinct, nil
+}
+
+// namespaceBackend returns the backend of namespace holding the named
+// repository.
+func namespaceBackend(namespace distribution.Namespace, name string) (*registry, error) {
+	switch ns := namespace.(type) {
+	case *registry:
+		return ns.backendFor(name), nil
+	case *routedRegistry:
+		return ns.backendFor(name), nil
+	default:
+		return nil, fmt.Errorf("unsupported namespace %T", namespace)
+	}
+}
+
+// backendFor returns the backend holding the named repository, which is reg
+// unless it is routed.
+func (reg *registry) backendFor(name string) *registry {
+	if reg.router == nil {
+		return reg
+	}
+	return reg.router.backendFor(name)
+}
+
+// copyBlob links the blob dgst of sourceRepo, a repository of another
+// backend, to the repository, copying its content to the blob store of the
+// repository unless it is there already.
+func (lbs *linkedBlobStore) copyBlob(ctx context.Context, source *registry, sourceRepo reference.Named, dgst digest.Digest) (distribution.Descriptor, error) {
+	repo, err := source.Repository(ctx, sourceRepo)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	blobs := repo.Blobs(ctx)
+
+	stat, err := blobs.Stat(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	desc := distribution.Descriptor{
+		Size:      stat.Size,
+		MediaType: "application/octet-stream",
+		Digest:    dgst,
+	}
+	if _, err := lbs.blobStore.statter.Stat(ctx, dgst); err == nil {
+		return desc, lbs.linkBlob(ctx, desc)
+	}
+
+	dcontext.GetLogger(ctx).Infof("copying blob %s from %s to %s across storage backends", dgst, sourceRepo.Name(), lbs.repository.Named().Name())
+
+	rc, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer rc.Close()
+
+	bw, err := lbs.Create(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if _, err := io.Copy(bw, rc); err != nil {
+		bw.Cancel(ctx)
+		return distribution.Descriptor{}, err
+	}
+	return bw.Commit(ctx, desc)
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func uploadRandomLayer(t *testing.T, repo distribution.Repository) digest.Digest {
+	layers, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random layer: %v", err)
+	}
+	if err := testutil.UploadBlobs(repo, layers); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	for dgst := range layers {
+		return dgst
+	}
+	return ""
+}
+
+func blobExists(t *testing.T, registry distribution.Namespace, dgst digest.Digest) bool {
+	_, ok := allBlobs(t, registry)[dgst]
+	return ok
+}
+
+func TestRoutedRepositories(t *testing.T) {
+	ctx := context.Background()
+	fastDriver, cheapDriver := inmemory.New(), inmemory.New()
+
+	// a repository stored before the routes were configured
+	legacy := createRegistry(t, fastDriver)
+	legacyLayer := uploadRandomLayer(t, makeRepository(t, legacy, "ml/legacy"))
+
+	registry := createRegistry(t, fastDriver, Route("ml", cheapDriver), Route("ml/fast", fastDriver))
+	fast := createRegistry(t, fastDriver)
+	cheap := createRegistry(t, cheapDriver)
+
+	appLayer := uploadRandomLayer(t, makeRepository(t, registry, "app/web"))
+	modelLayer := uploadRandomLayer(t, makeRepository(t, registry, "ml/model"))
+	fastModelLayer := uploadRandomLayer(t, makeRepository(t, registry, "ml/fast/model"))
+
+	for _, tc := range []struct {
+		dgst        digest.Digest
+		fast, cheap bool
+	}{
+		{appLayer, true, false},
+		{modelLayer, false, true},
+		{fastModelLayer, true, false},
+		{legacyLayer, true, false},
+	} {
+		if blobExists(t, fast, tc.dgst) != tc.fast || blobExists(t, cheap, tc.dgst) != tc.cheap {
+			t.Fatalf("blob %s stored on the wrong backend", tc.dgst)
+		}
+	}
+
+	expected := []string{"app/web", "ml/fast/model", "ml/model"}
+	repos := make([]string, 10)
+	n, err := registry.Repositories(ctx, repos, "")
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if !reflect.DeepEqual(repos[:n], expected) {
+		t.Fatalf("unexpected catalog: %v", repos[:n])
+	}
+
+	// paginated
+	repos = make([]string, 2)
+	n, err = registry.Repositories(ctx, repos, "")
+	if err != nil || !reflect.DeepEqual(repos[:n], expected[:2]) {
+		t.Fatalf("unexpected first page: %v, %v", repos[:n], err)
+	}
+	n, err = registry.Repositories(ctx, repos, repos[1])
+	if err != io.EOF || !reflect.DeepEqual(repos[:n], expected[2:]) {
+		t.Fatalf("unexpected last page: %v, %v", repos[:n], err)
+	}
+
+	var enumerated []string
+	err = registry.(distribution.RepositoryEnumerator).Enumerate(ctx, func(name string) error {
+		enumerated = append(enumerated, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enumerated) != len(expected) {
+		t.Fatalf("unexpected enumeration: %v", enumerated)
+	}
+
+	if _, err := registry.BlobStatter().Stat(ctx, modelLayer); err != nil {
+		t.Fatalf("expected blob of routed repository to be found: %v", err)
+	}
+}
+
+func TestRoutePrefixBoundaries(t *testing.T) {
+	fastDriver, cheapDriver := inmemory.New(), inmemory.New()
+	rr := createRegistry(t, fastDriver, Route("ml", cheapDriver)).(*routedRegistry)
+
+	for name, routed := range map[string]bool{
+		"ml":          true,
+		"ml/model":    true,
+		"ml/fast/mod": true,
+		"mlops/model": false,
+		"ml-model":    false,
+		"app/ml":      false,
+	} {
+		if backend := rr.backendFor(name); (backend != rr.defaultBackend) != routed {
+			t.Fatalf("unexpected backend of %s", name)
+		}
+	}
+
+	if _, err := NewRegistry(context.Background(), fastDriver, Route("ml/", cheapDriver)); err == nil {
+		t.Fatalf("expected prefix ending with a slash to be rejected")
+	}
+}
+
+func TestRoutedMountCopies(t *testing.T) {
+	ctx := context.Background()
+	fastDriver, cheapDriver := inmemory.New(), inmemory.New()
+	registry := createRegistry(t, fastDriver, Route("ml", cheapDriver))
+	cheap := createRegistry(t, cheapDriver)
+
+	source := makeRepository(t, registry, "app/web")
+	dgst := uploadRandomLayer(t, source)
+	canonical, _ := reference.WithDigest(source.Named(), dgst)
+
+	for _, name := range []string{"app/other", "ml/model"} {
+		repo := makeRepository(t, registry, name)
+		_, err := repo.Blobs(ctx).Create(ctx, WithMountFrom(canonical))
+		mounted, ok := err.(distribution.ErrBlobMounted)
+		if !ok {
+			t.Fatalf("expected blob to be mounted in %s, got %v", name, err)
+		}
+		if mounted.Descriptor.Digest != dgst {
+			t.Fatalf("unexpected mounted descriptor: %v", mounted.Descriptor)
+		}
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("expected mounted blob in %s: %v", name, err)
+		}
+	}
+
+	if !blobExists(t, cheap, dgst) {
+		t.Fatalf("expected blob to be copied to the backend of the target repository")
+	}
+}
+
+func TestRoutedGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	fastDriver, cheapDriver := inmemory.New(), inmemory.New()
+
+	legacy := createRegistry(t, fastDriver)
+	legacyImage := uploadRandomSchema2Image(t, makeRepository(t, legacy, "ml/legacy"))
+
+	registry := createRegistry(t, fastDriver, Route("ml", cheapDriver), Route("ml/fast", fastDriver))
+	appImage := uploadRandomSchema2Image(t, makeRepository(t, registry, "app/web"))
+	fastModelImage := uploadRandomSchema2Image(t, makeRepository(t, registry, "ml/fast/model"))
+	modelImage := uploadRandomSchema2Image(t, makeRepository(t, registry, "ml/model"))
+	orphan := uploadRandomLayer(t, makeRepository(t, registry, "ml/other"))
+
+	err := MarkAndSweep(ctx, fastDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	fast := createRegistry(t, fastDriver)
+	cheap := createRegistry(t, cheapDriver)
+	for _, im := range []struct {
+		image
+		registry distribution.Namespace
+	}{
+		{legacyImage, fast},
+		{appImage, fast},
+		{fastModelImage, fast},
+		{modelImage, cheap},
+	} {
+		for dgst := range im.layers {
+			if !blobExists(t, im.registry, dgst) {
+				t.Fatalf("referenced layer %s was deleted", dgst)
+			}
+		}
+	}
+	if blobExists(t, cheap, orphan) {
+		t.Fatalf("orphan layer %s was not deleted", orphan)
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// SweepBlobs deletes the blobs which became candidates before olderThan and
+// are no longer referenced by any manifest revision, along with their links.
+// It returns the digests of the blobs deleted, or which would be deleted if
+// dryRun is set.
+//
+// Reference counting must be enabled on the registry with
+// EnableReferenceCounting. The first sweep of a backend builds the references
+// of the manifests stored before; no blob is deleted until they are built.
+//
+// Like MarkAndSweep, SweepBlobs may delete a blob which a manifest pushed
+// concurrently starts referencing, if the blob has been a candidate for
+// longer than the grace period.
+func SweepBlobs(ctx context.Context, namespace distribution.Namespace, olderThan time.Time, dryRun bool) ([]digest.Digest, error) {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []digest.Digest
+	for _, backend := range backends {
+		if backend.references == nil {
+			return swept, fmt.Errorf("reference counting is not enabled")
+		}
+		dgsts, err := backend.sweepBlobs(ctx, olderThan, dryRun)
+		swept = append(swept, dgsts...)
+		if err != nil {
+			return swept, err
+		}
+	}
+	return swept, nil
+}
+
+// BuildReferences records the references of the manifests and the links of
+// the blobs stored before reference counting or link tracking was enabled,
+// unless done already, so that LinkingRepositories finds the older links.
+// SweepBlobs builds them too.
+func BuildReferences(ctx context.Context, namespace distribution.Namespace) error {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, backend := range backends {
+		if backend.references == nil {
+			return fmt.Errorf("reference counting is not enabled")
+		}
+		if err := backend.buildReferences(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (reg *registry) sweepBlobs(ctx context.Context, olderThan time.Time, dryRun bool) ([]digest.Digest, error) {
+	if err := reg.buildReferences(ctx); err != nil {
+		return nil, fmt.Errorf("failed to build references: %v", err)
+	}
+
+	candidatesPath, err := pathFor(sweepCandidatesPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	err = reg.blobStore.driver.Walk(ctx, candidatesPath, func(fileInfo driver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			candidates = append(candidates, fileInfo.Path())
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var swept []digest.Digest
+	for _, candidatePath := range candidates {
+		deleted, dgst, err := reg.sweepCandidate(ctx, candidatePath, olderThan, dryRun)
+		if err != nil {
+			return swept, err
+		}
+		if deleted {
+			swept = append(swept, dgst)
+		}
+	}
+
+	dcontext.GetLogger(ctx).Infof("swept %d of %d candidate blobs", len(swept), len(candidates))
+	return swept, nil
+}
+
+// sweepCandidate deletes the candidate blob at candidatePath if it became a
+// candidate before olderThan and is no longer referenced.
+func (reg *registry) sweepCandidate(ctx context.Context, candidatePath string, olderThan time.Time, dryRun bool) (bool, digest.Digest, error) {
+	dgst, err := digestFromPath(candidatePath)
+	if err != nil {
+		return false, "", err
+	}
+
+	content, err := reg.blobStore.driver.GetContent(ctx, candidatePath)
+	if err != nil {
+		return false, dgst, err
+	}
+	since, err := time.Parse(time.RFC3339, string(content))
+	if err != nil {
+		return false, dgst, fmt.Errorf("invalid sweep candidate %s: %v", candidatePath, err)
+	}
+	if !since.Before(olderThan) {
+		return false, dgst, nil
+	}
+
+	referenced, names, err := reg.references.referenced(ctx, dgst)
+	if err != nil {
+		return false, dgst, err
+	}
+	if dryRun {
+		return !referenced, dgst, nil
+	}
+
+	if !referenced {
+		if err := reg.removeBlob(ctx, dgst, names); err != nil {
+			return false, dgst, err
+		}
+	}
+	if err := reg.blobStore.driver.Delete(ctx, candidatePath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return false, dgst, err
+		}
+	}
+	return !referenced, dgst, nil
+}
+
+// removeBlob deletes a blob, its links in the named repositories and its
+// references, and clears it from the blob descriptor cache.
+func (reg *registry) removeBlob(ctx context.Context, dgst digest.Digest, names []string) error {
+	if err := NewVacuum(ctx, reg.blobStore.driver).RemoveBlob(string(dgst)); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		linkPath, err := blobLinkPath(name, dgst)
+		if err != nil {
+			return err
+		}
+		if err := reg.blobStore.driver.Delete(ctx, linkPath); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+
+		// the blob may be a manifest cached for the repository
+		reg.invalidateManifest(ctx, name, dgst)
+	}
+	if reg.blobDescriptorCacheProvider != nil {
+		reg.blobDescriptorCacheProvider.Clear(ctx, dgst)
+	}
+
+	referencesPath, err := pathFor(blobReferencesPathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	if err := reg.blobStore.driver.Delete(ctx, referencesPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildReferences records the references of the manifests and the links of
+// the blobs stored before reference counting was enabled, unless done
+// already. Building them again is harmless: recording a reference is
+// idempotent.
+func (reg *registry) buildReferences(ctx context.Context) error {
+	builtAtPath, err := pathFor(referencesBuiltAtPathSpec{})
+	if err != nil {
+		return err
+	}
+	if _, err := reg.blobStore.driver.Stat(ctx, builtAtPath); err == nil {
+		return nil
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("building the references of the blobs")
+	err = reg.Enumerate(ctx, func(name string) error {
+		named, err := reference.WithName(name)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", name, err)
+		}
+		repository, err := reg.Repository(ctx, named)
+		if err != nil {
+			return err
+		}
+
+		blobEnumerator, ok := repository.Blobs(ctx).(distribution.BlobEnumerator)
+		if !ok {
+			return fmt.Errorf("unable to convert BlobStore into BlobEnumerator")
+		}
+		err = blobEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			linkReferencePath, err := pathFor(blobLinkReferencePathSpec{digest: dgst, name: name})
+			if err != nil {
+				return err
+			}
+			return reg.blobStore.driver.PutContent(ctx, linkReferencePath, []byte(dgst))
+		})
+		if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+			return err
+		}
+
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return err
+		}
+		manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
+		if !ok {
+			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
+		}
+		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			manifest, err := manifestService.Get(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve manifest %s@%s: %v", name, dgst, err)
+			}
+			return reg.references.add(ctx, name, dgst, manifest)
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return reg.blobStore.driver.PutContent(ctx, builtAtPath, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// sweepAll sweeps all candidates, regardless of the grace period.
+func sweepAll(t *testing.T, registry distribution.Namespace) []digest.Digest {
+	swept, err := SweepBlobs(context.Background(), registry, time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Fatalf("Failed to sweep blobs: %v", err)
+	}
+	return swept
+}
+
+func linkExists(t *testing.T, d driver.StorageDriver, name string, dgst digest.Digest) bool {
+	linkPath, err := blobLinkPath(name, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Stat(context.Background(), linkPath)
+	return err == nil
+}
+
+func TestSweepBlobs(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, EnableReferenceCounting)
+
+	repo := makeRepository(t, registry, "komnenos/alexios")
+	im := uploadRandomSchema2Image(t, repo)
+	orphan := uploadRandomLayer(t, repo)
+
+	// the same image in another repository
+	other := makeRepository(t, registry, "komnenos/ioannes")
+	for dgst := range im.layers {
+		canonical, _ := reference.WithDigest(repo.Named(), dgst)
+		if _, err := other.Blobs(ctx).Create(ctx, WithMountFrom(canonical)); err == nil {
+			t.Fatalf("expected blob %s to be mounted", dgst)
+		}
+	}
+	otherManifests, err := other.Manifests(ctx, SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherManifests.Put(ctx, im.manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is swept during the grace period
+	swept, err := SweepBlobs(ctx, registry, time.Now().Add(-time.Hour), false)
+	if err != nil || len(swept) != 0 {
+		t.Fatalf("unexpected sweep during grace period: %v, %v", swept, err)
+	}
+
+	// a dry run deletes nothing
+	swept, err = SweepBlobs(ctx, registry, time.Now().Add(time.Hour), true)
+	if err != nil || len(swept) != 1 || swept[0] != orphan {
+		t.Fatalf("unexpected dry run: %v, %v", swept, err)
+	}
+	if !blobExists(t, registry, orphan) {
+		t.Fatalf("dry run deleted orphan layer")
+	}
+
+	swept = sweepAll(t, registry)
+	if len(swept) != 1 || swept[0] != orphan {
+		t.Fatalf("expected orphan layer to be swept, got %v", swept)
+	}
+	if blobExists(t, registry, orphan) || linkExists(t, d, "komnenos/alexios", orphan) {
+		t.Fatalf("orphan layer %s or its link was not deleted", orphan)
+	}
+
+	// a blob still referenced from another repository is kept
+	if err := makeManifestService(t, repo).Delete(ctx, im.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if swept := sweepAll(t, registry); len(swept) != 0 {
+		t.Fatalf("expected referenced blobs to be kept, swept %v", swept)
+	}
+
+	if err := otherManifests.Delete(ctx, im.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	swept = sweepAll(t, registry)
+	if len(swept) != len(im.manifest.References())+1 {
+		t.Fatalf("expected the blobs of the deleted image to be swept, got %v", swept)
+	}
+	for dgst := range im.layers {
+		if blobExists(t, registry, dgst) {
+			t.Fatalf("unreferenced layer %s was not deleted", dgst)
+		}
+		for _, name := range []string{"komnenos/alexios", "komnenos/ioannes"} {
+			if linkExists(t, d, name, dgst) {
+				t.Fatalf("link of deleted layer %s was not deleted from %s", dgst, name)
+			}
+		}
+	}
+
+	// candidates are only swept once
+	if swept := sweepAll(t, registry); len(swept) != 0 {
+		t.Fatalf("unexpected second sweep: %v", swept)
+	}
+}
+
+func TestSweepBlobsBuildsReferences(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	// content stored before reference counting was enabled
+	legacy := makeRepository(t, createRegistry(t, d), "komnenos/legacy")
+	im := uploadRandomSchema2Image(t, legacy)
+
+	registry := createRegistry(t, d, EnableReferenceCounting)
+	repo := makeRepository(t, registry, "komnenos/alexios")
+	for dgst := range im.layers {
+		canonical, _ := reference.WithDigest(legacy.Named(), dgst)
+		if _, err := repo.Blobs(ctx).Create(ctx, WithMountFrom(canonical)); err == nil {
+			t.Fatalf("expected blob %s to be mounted", dgst)
+		}
+	}
+
+	if swept := sweepAll(t, registry); len(swept) != 0 {
+		t.Fatalf("expected blobs referenced before reference counting to be kept, swept %v", swept)
+	}
+
+	if err := makeManifestService(t, makeRepository(t, registry, "komnenos/legacy")).Delete(ctx, im.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	sweepAll(t, registry)
+	for dgst := range im.layers {
+		if blobExists(t, registry, dgst) {
+			t.Fatalf("unreferenced layer %s was not deleted", dgst)
+		}
+		if linkExists(t, d, "komnenos/legacy", dgst) {
+			t.Fatalf("link of deleted layer %s was not deleted", dgst)
+		}
+	}
+
+	if _, err := SweepBlobs(ctx, createRegistry(t, d), time.Now(), false); err == nil {
+		t.Fatalf("expected sweep to require reference counting")
+	}
+}
+
+func TestLinkTrackingBuildsReferences(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	// content stored before link tracking was enabled
+	legacy := makeRepository(t, createRegistry(t, d), "komnenos/legacy")
+	im := uploadRandomSchema2Image(t, legacy)
+
+	registry := createRegistry(t, d, EnableLinkTracking)
+	repo := makeRepository(t, registry, "komnenos/alexios")
+	layer := uploadRandomLayer(t, repo)
+
+	if err := BuildReferences(ctx, registry); err != nil {
+		t.Fatalf("Failed to build references: %v", err)
+	}
+	for dgst := range im.layers {
+		names, err := LinkingRepositories(ctx, registry, dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != "komnenos/legacy" {
+			t.Fatalf("unexpected repositories linking %s: %v", dgst, names)
+		}
+	}
+	names, err := LinkingRepositories(ctx, registry, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "komnenos/alexios" {
+		t.Fatalf("unexpected repositories linking %s: %v", layer, names)
+	}
+
+	// blobs are not made candidates without a sweeper to remove them
+	candidatesPath, err := pathFor(sweepCandidatesPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, candidatesPath); err == nil {
+		t.Fatalf("unexpected sweep candidates with link tracking only")
+	}
+}
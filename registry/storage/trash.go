@@ -0,0 +1,648 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// The kinds of trashed items.
+const (
+	TrashKindManifest   = "manifest"
+	TrashKindTag        = "tag"
+	TrashKindRepository = "repository"
+)
+
+// TrashedItem describes a manifest, a tag or a repository moved to the trash
+// when deleted. It can be restored until it expires. Until then, the
+// manifests it references are kept by the garbage collectors.
+type TrashedItem struct {
+	ID         string        `json:"id"`
+	Kind       string        `json:"kind"`
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	Tags       []string      `json:"tags,omitempty"`
+	DeletedAt  time.Time     `json:"deletedAt"`
+	ExpiresAt  time.Time     `json:"expiresAt"`
+}
+
+// ErrTrashItemUnknown is returned when restoring an item which is not in the
+// trash, or has expired.
+type ErrTrashItemUnknown struct {
+	ID string
+}
+
+func (err ErrTrashItemUnknown) Error() string {
+	return fmt.Sprintf("unknown trash item: %s", err.ID)
+}
+
+// ErrTrashConflict is returned when restoring an item would overwrite a link
+// changed since the item was trashed, such as a tag pushed again.
+type ErrTrashConflict struct {
+	ID   string
+	Path string
+}
+
+func (err ErrTrashConflict) Error() string {
+	return fmt.Sprintf("trash item %s conflicts with %s", err.ID, err.Path)
+}
+
+// trashRecord is the content of the file of a trashed item.
+type trashRecord struct {
+	TrashedItem
+
+	// Links holds the content of the links removed from the repository, by
+	// path relative to the repository.
+	Links map[string]digest.Digest `json:"links"`
+}
+
+// manifests returns the manifests linked by the item, as revisions or tags.
+func (record *trashRecord) manifests() []digest.Digest {
+	return record.linked("_manifests/", "link")
+}
+
+// revisions returns the manifest revisions linked by the item.
+func (record *trashRecord) revisions() []digest.Digest {
+	return record.linked("_manifests/revisions/", "link")
+}
+
+// tagged returns the manifests the tags of the item point to.
+func (record *trashRecord) tagged() []digest.Digest {
+	return record.linked("_manifests/tags/", "current/link")
+}
+
+func (record *trashRecord) linked(prefix, suffix string) []digest.Digest {
+	seen := make(map[digest.Digest]bool)
+	var dgsts []digest.Digest
+	for rel, dgst := range record.Links {
+		if strings.HasPrefix(rel, prefix) && strings.HasSuffix(rel, "/"+suffix) && !seen[dgst] {
+			seen[dgst] = true
+			dgsts = append(dgsts, dgst)
+		}
+	}
+	sort.Slice(dgsts, func(i, j int) bool { return dgsts[i] < dgsts[j] })
+	return dgsts
+}
+
+// repositoryPath returns the directory of the named repository.
+func repositoryPath(name string) (string, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, name), nil
+}
+
+// readLinks returns the content of the links under dir, a directory of the
+// named repository, by path relative to the repository. Uploads are skipped.
+func (reg *registry) readLinks(ctx context.Context, name, dir string) (map[string]digest.Digest, error) {
+	repoPath, err := repositoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make(map[string]digest.Digest)
+	err = reg.blobStore.driver.Walk(ctx, dir, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			if path.Base(fileInfo.Path()) == "_uploads" {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		if path.Base(fileInfo.Path()) != "link" {
+			return nil
+		}
+
+		dgst, err := reg.blobStore.readlink(ctx, fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		links[strings.TrimPrefix(fileInfo.Path(), repoPath+"/")] = dgst
+		return nil
+	})
+	return links, err
+}
+
+// trash records item in the trash, with the links it removes from its
+// repository. The caller removes the links once it is recorded.
+func (reg *registry) trash(ctx context.Context, item TrashedItem, links map[string]digest.Digest) (TrashedItem, error) {
+	item.ID = uuid.Generate().String()
+	item.DeletedAt = time.Now().UTC()
+	item.ExpiresAt = item.DeletedAt.Add(reg.trashRetention)
+	record := &trashRecord{TrashedItem: item, Links: links}
+
+	// the revisions are recorded first, so that SweepBlobs keeps the blobs
+	// they reference
+	for _, revision := range record.revisions() {
+		entryPath, err := pathFor(trashRevisionEntryPathSpec{name: item.Repository, revision: revision, id: item.ID})
+		if err != nil {
+			return TrashedItem{}, err
+		}
+		if err := reg.blobStore.driver.PutContent(ctx, entryPath, []byte(item.ExpiresAt.Format(time.RFC3339Nano))); err != nil {
+			return TrashedItem{}, err
+		}
+	}
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+	itemPath, err := pathFor(trashItemPathSpec{id: item.ID})
+	if err != nil {
+		return TrashedItem{}, err
+	}
+	if err := reg.blobStore.driver.PutContent(ctx, itemPath, content); err != nil {
+		return TrashedItem{}, err
+	}
+
+	dcontext.GetLogger(ctx).Infof("trashed %s %s of %s as %s", item.Kind, item.Digest, item.Repository, item.ID)
+	return item, nil
+}
+
+// trash moves the revision of a manifest to the trash, along with the tags
+// pointing to it. The references of the revision are kept until the item
+// expires.
+func (ms *manifestStore) trash(ctx context.Context, dgst digest.Digest) error {
+	if !ms.blobStore.deleteEnabled {
+		return distribution.ErrUnsupported
+	}
+
+	repo := ms.repository
+	name := repo.Named().Name()
+	revisionLinkPath, err := pathFor(manifestRevisionLinkPathSpec{name: name, revision: dgst})
+	if err != nil {
+		return err
+	}
+	revision, err := repo.blobStore.readlink(ctx, revisionLinkPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return distribution.ErrBlobUnknown
+	} else if err != nil {
+		return err
+	}
+	repoPath, err := repositoryPath(name)
+	if err != nil {
+		return err
+	}
+	links := map[string]digest.Digest{strings.TrimPrefix(revisionLinkPath, repoPath+"/"): revision}
+
+	ts := &tagStore{repository: repo, blobStore: repo.blobStore}
+	tags, err := ts.Lookup(ctx, distribution.Descriptor{Digest: dgst})
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tagPath, err := pathFor(manifestTagPathSpec{name: name, tag: tag})
+		if err != nil {
+			return err
+		}
+		tagLinks, err := repo.readLinks(ctx, name, tagPath)
+		if err != nil {
+			return err
+		}
+		for rel, linked := range tagLinks {
+			links[rel] = linked
+		}
+	}
+
+	_, err = repo.trash(ctx, TrashedItem{
+		Kind:       TrashKindManifest,
+		Repository: name,
+		Digest:     dgst,
+		Tags:       tags,
+	}, links)
+	if err != nil {
+		return err
+	}
+
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := ts.delete(ctx, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trash moves a tag to the trash. Like Untag, it succeeds if the tag does
+// not exist.
+func (ts *tagStore) trash(ctx context.Context, tag string) error {
+	name := ts.repository.Named().Name()
+	tagPath, err := pathFor(manifestTagPathSpec{name: name, tag: tag})
+	if err != nil {
+		return err
+	}
+	links, err := ts.repository.readLinks(ctx, name, tagPath)
+	if _, ok := err.(driver.PathNotFoundError); ok || (err == nil && len(links) == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{name: name, tag: tag})
+	if err != nil {
+		return err
+	}
+	repoPath, err := repositoryPath(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = ts.repository.trash(ctx, TrashedItem{
+		Kind:       TrashKindTag,
+		Repository: name,
+		Digest:     links[strings.TrimPrefix(currentPath, repoPath+"/")],
+		Tags:       []string{tag},
+	}, links)
+	if err != nil {
+		return err
+	}
+	return ts.delete(ctx, tag)
+}
+
+// delete removes the directory of a tag, and the tag from the metadata
+// cache.
+func (ts *tagStore) delete(ctx context.Context, tag string) error {
+	tagPath, err := pathFor(manifestTagPathSpec{name: ts.repository.Named().Name(), tag: tag})
+	if err != nil {
+		return err
+	}
+	if err := ts.blobStore.driver.Delete(ctx, tagPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	if ts.repository.metadataCache != nil {
+		if err := ts.repository.metadataCache.InvalidateTag(ctx, tag); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error invalidating tag %s in cache: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+// TrashRepository moves the named repository to the trash, except for its
+// uploads in progress which are deleted. Repositories may only be deleted
+// when deletes are enabled and go to the trash.
+func TrashRepository(ctx context.Context, namespace distribution.Namespace, name string) (TrashedItem, error) {
+	var reg *registry
+	switch ns := namespace.(type) {
+	case *registry:
+		reg = ns
+	case *routedRegistry:
+		reg = ns.backendFor(name)
+	default:
+		return TrashedItem{}, fmt.Errorf("unable to trash repositories of %T", namespace)
+	}
+	if !reg.deleteEnabled || reg.trashRetention <= 0 {
+		return TrashedItem{}, distribution.ErrUnsupported
+	}
+
+	repoPath, err := repositoryPath(name)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+	links, err := reg.readLinks(ctx, name, repoPath)
+	if _, ok := err.(driver.PathNotFoundError); ok || (err == nil && len(links) == 0) {
+		return TrashedItem{}, distribution.ErrRepositoryUnknown{Name: name}
+	} else if err != nil {
+		return TrashedItem{}, err
+	}
+
+	item := TrashedItem{Kind: TrashKindRepository, Repository: name}
+	for rel := range links {
+		if strings.HasPrefix(rel, "_manifests/tags/") && strings.HasSuffix(rel, "/current/link") {
+			item.Tags = append(item.Tags, strings.TrimSuffix(strings.TrimPrefix(rel, "_manifests/tags/"), "/current/link"))
+		}
+	}
+	sort.Strings(item.Tags)
+	item, err = reg.trash(ctx, item, links)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+
+	if err := NewVacuum(ctx, reg.blobStore.driver).RemoveRepository(name); err != nil {
+		return TrashedItem{}, err
+	}
+	reg.invalidate(ctx, name, links)
+	return item, nil
+}
+
+// invalidateManifest removes the manifest dgst of the named repository from
+// the caches.
+func (reg *registry) invalidateManifest(ctx context.Context, name string, dgst digest.Digest) {
+	reg.invalidate(ctx, name, map[string]digest.Digest{
+		path.Join("_manifests/revisions", dgst.Algorithm().String(), dgst.Hex(), "link"): dgst,
+	})
+}
+
+// invalidate removes the tags and manifests linked by links, the links of
+// the named repository, from the caches.
+func (reg *registry) invalidate(ctx context.Context, name string, links map[string]digest.Digest) {
+	if reg.metadataCacheProvider != nil {
+		if metadataCache, err := reg.metadataCacheProvider.RepositoryScoped(name); err == nil {
+			for rel, dgst := range links {
+				switch {
+				case strings.HasPrefix(rel, "_manifests/tags/") && strings.HasSuffix(rel, "/current/link"):
+					tag := strings.TrimSuffix(strings.TrimPrefix(rel, "_manifests/tags/"), "/current/link")
+					if err := metadataCache.InvalidateTag(ctx, tag); err != nil {
+						dcontext.GetLogger(ctx).Errorf("error invalidating tag %s in cache: %v", tag, err)
+					}
+				case strings.HasPrefix(rel, "_manifests/revisions/"):
+					if err := metadataCache.InvalidateManifest(ctx, dgst); err != nil {
+						dcontext.GetLogger(ctx).Errorf("error invalidating manifest %s in cache: %v", dgst, err)
+					}
+				}
+			}
+		}
+	}
+
+	if reg.blobDescriptorCacheProvider != nil {
+		if descriptorCache, err := reg.blobDescriptorCacheProvider.RepositoryScoped(name); err == nil {
+			for rel, dgst := range links {
+				if strings.HasPrefix(rel, "_layers/") || strings.HasPrefix(rel, "_manifests/revisions/") {
+					descriptorCache.Clear(ctx, dgst)
+				}
+			}
+		}
+	}
+}
+
+// readTrash returns the items in the trash of the backend, including the
+// expired ones, by deletion time.
+func (reg *registry) readTrash(ctx context.Context) ([]*trashRecord, error) {
+	itemsPath, err := pathFor(trashItemsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	itemPaths, err := reg.blobStore.driver.List(ctx, itemsPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []*trashRecord
+	for _, itemPath := range itemPaths {
+		record, err := reg.readTrashItem(ctx, path.Base(itemPath))
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// restored or purged concurrently
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeletedAt.Before(records[j].DeletedAt)
+	})
+	return records, nil
+}
+
+func (reg *registry) readTrashItem(ctx context.Context, id string) (*trashRecord, error) {
+	itemPath, err := pathFor(trashItemPathSpec{id: id})
+	if err != nil {
+		return nil, err
+	}
+	content, err := reg.blobStore.driver.GetContent(ctx, itemPath)
+	if err != nil {
+		return nil, err
+	}
+	var record trashRecord
+	if err := json.Unmarshal(content, &record); err != nil {
+		return nil, fmt.Errorf("invalid trash item %s: %v", itemPath, err)
+	}
+	return &record, nil
+}
+
+// ListTrash returns the items in the trash which have not expired, by
+// deletion time.
+func ListTrash(ctx context.Context, namespace distribution.Namespace) ([]TrashedItem, error) {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var items []TrashedItem
+	for _, backend := range backends {
+		records, err := backend.readTrash(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.ExpiresAt.After(now) {
+				items = append(items, record.TrashedItem)
+			}
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt.Before(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// RestoreTrash restores the links removed by a trashed item which has not
+// expired. It fails with ErrTrashConflict, restoring nothing, if a link has
+// changed since.
+func RestoreTrash(ctx context.Context, namespace distribution.Namespace, id string) (TrashedItem, error) {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return TrashedItem{}, err
+	}
+	if id == "" || strings.Contains(id, "/") {
+		return TrashedItem{}, ErrTrashItemUnknown{ID: id}
+	}
+
+	for _, backend := range backends {
+		record, err := backend.readTrashItem(ctx, id)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return TrashedItem{}, err
+		}
+		if !record.ExpiresAt.After(time.Now()) {
+			break
+		}
+		return record.TrashedItem, backend.restore(ctx, record)
+	}
+	return TrashedItem{}, ErrTrashItemUnknown{ID: id}
+}
+
+func (reg *registry) restore(ctx context.Context, record *trashRecord) error {
+	repoPath, err := repositoryPath(record.Repository)
+	if err != nil {
+		return err
+	}
+
+	for rel, dgst := range record.Links {
+		current, err := reg.blobStore.readlink(ctx, path.Join(repoPath, rel))
+		switch err.(type) {
+		case nil:
+			if current != dgst {
+				return ErrTrashConflict{ID: record.ID, Path: rel}
+			}
+		case driver.PathNotFoundError:
+		default:
+			return err
+		}
+	}
+
+	for rel, dgst := range record.Links {
+		if err := reg.blobStore.link(ctx, path.Join(repoPath, rel), dgst); err != nil {
+			return err
+		}
+	}
+	reg.invalidate(ctx, record.Repository, record.Links)
+
+	dcontext.GetLogger(ctx).Infof("restored %s %s of %s from %s", record.Kind, record.Digest, record.Repository, record.ID)
+	return reg.removeTrashItem(ctx, record)
+}
+
+// removeTrashItem removes an item from the trash, once restored or expired.
+func (reg *registry) removeTrashItem(ctx context.Context, record *trashRecord) error {
+	for _, revision := range record.revisions() {
+		entryPath, err := pathFor(trashRevisionEntryPathSpec{name: record.Repository, revision: revision, id: record.ID})
+		if err != nil {
+			return err
+		}
+		if err := reg.blobStore.driver.Delete(ctx, entryPath); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+
+	itemPath, err := pathFor(trashItemPathSpec{id: record.ID})
+	if err != nil {
+		return err
+	}
+	if err := reg.blobStore.driver.Delete(ctx, itemPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeTrash deletes the items of the trash which expired before now. The
+// blobs referenced by their manifests are then deleted by the next garbage
+// collection, or by SweepBlobs if reference counting is enabled.
+func PurgeTrash(ctx context.Context, namespace distribution.Namespace, now time.Time) ([]TrashedItem, error) {
+	backends, err := storageBackends(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []TrashedItem
+	for _, backend := range backends {
+		records, err := backend.readTrash(ctx)
+		if err != nil {
+			return purged, err
+		}
+		for _, record := range records {
+			if record.ExpiresAt.After(now) {
+				continue
+			}
+			if err := backend.purge(ctx, record); err != nil {
+				return purged, err
+			}
+			purged = append(purged, record.TrashedItem)
+		}
+	}
+	return purged, nil
+}
+
+// liveTrash returns the items of the trash of the backend which have not
+// expired by now. The expired items are purged, unless dryRun is set.
+func (reg *registry) liveTrash(ctx context.Context, now time.Time, dryRun bool) ([]*trashRecord, error) {
+	records, err := reg.readTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var live []*trashRecord
+	for _, record := range records {
+		if record.ExpiresAt.After(now) {
+			live = append(live, record)
+			continue
+		}
+		if !dryRun {
+			if err := reg.purge(ctx, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return live, nil
+}
+
+// purge removes an expired item from the trash, and the references of the
+// revisions it held unless they were restored or are held by another item.
+func (reg *registry) purge(ctx context.Context, record *trashRecord) error {
+	if err := reg.removeTrashItem(ctx, record); err != nil {
+		return err
+	}
+
+	if reg.references != nil {
+		for _, revision := range record.revisions() {
+			if err := reg.removeReferences(ctx, record.Repository, revision); err != nil {
+				return err
+			}
+		}
+	}
+
+	dcontext.GetLogger(ctx).Infof("purged %s %s of %s from %s", record.Kind, record.Digest, record.Repository, record.ID)
+	return nil
+}
+
+// removeReferences removes the references of a manifest revision purged
+// from the trash, unless it is live or still trashed.
+func (reg *registry) removeReferences(ctx context.Context, name string, revision digest.Digest) error {
+	revisionLinkPath, err := pathFor(manifestRevisionLinkPathSpec{name: name, revision: revision})
+	if err != nil {
+		return err
+	}
+	if _, err := reg.blobStore.driver.Stat(ctx, revisionLinkPath); err == nil {
+		return nil
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return err
+	}
+	if trashed, err := reg.references.trashed(ctx, name, revision); err != nil || trashed {
+		return err
+	}
+
+	manifest, err := reg.trashedManifest(ctx, revision)
+	if err == distribution.ErrBlobUnknown {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return reg.references.remove(ctx, name, revision, manifest)
+}
+
+// trashedManifest reads a manifest from the blob store, without going
+// through the links of a repository.
+func (reg *registry) trashedManifest(ctx context.Context, dgst digest.Digest) (distribution.Manifest, error) {
+	content, err := reg.blobStore.Get(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	var versioned manifest.Versioned
+	if err := json.Unmarshal(content, &versioned); err != nil {
+		return nil, err
+	}
+	m, _, err := distribution.UnmarshalManifest(versioned.MediaType, content)
+	return m, err
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func listTrash(t *testing.T, registry distribution.Namespace) []TrashedItem {
+	items, err := ListTrash(context.Background(), registry)
+	if err != nil {
+		t.Fatalf("Failed to list the trash: %v", err)
+	}
+	return items
+}
+
+func TestTrashManifest(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, EnableTrash(time.Hour))
+	repo := makeRepository(t, registry, "palaiologos/michael")
+	manifests := makeManifestService(t, repo)
+
+	im := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manifests.Delete(ctx, im.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := manifests.Exists(ctx, im.manifestDigest); err != nil || exists {
+		t.Fatalf("expected manifest to be deleted: %v", err)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); err == nil {
+		t.Fatalf("expected the tag of the manifest to be deleted")
+	}
+	if err := manifests.Delete(ctx, im.manifestDigest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected deleted manifest to be unknown, got %v", err)
+	}
+
+	items := listTrash(t, registry)
+	if len(items) != 1 || items[0].Kind != TrashKindManifest || items[0].Digest != im.manifestDigest ||
+		len(items[0].Tags) != 1 || items[0].Tags[0] != "latest" {
+		t.Fatalf("unexpected trash %v", items)
+	}
+
+	// the trashed manifest is kept by the garbage collector
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RemoveUntagged: true}); err != nil {
+		t.Fatal(err)
+	}
+	for dgst := range im.layers {
+		if !blobExists(t, registry, dgst) {
+			t.Fatalf("trashed layer %s was deleted", dgst)
+		}
+	}
+
+	restored, err := RestoreTrash(ctx, registry, items[0].ID)
+	if err != nil || restored.ID != items[0].ID {
+		t.Fatalf("failed to restore %v: %v", restored, err)
+	}
+	if _, err := manifests.Get(ctx, im.manifestDigest); err != nil {
+		t.Fatalf("expected manifest to be restored: %v", err)
+	}
+	if desc, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil || desc.Digest != im.manifestDigest {
+		t.Fatalf("expected tag to be restored: %v", err)
+	}
+	if items := listTrash(t, registry); len(items) != 0 {
+		t.Fatalf("expected restored item to leave the trash, got %v", items)
+	}
+	if _, err := RestoreTrash(ctx, registry, restored.ID); err != (ErrTrashItemUnknown{ID: restored.ID}) {
+		t.Fatalf("expected restored item to be unknown, got %v", err)
+	}
+}
+
+func TestTrashExpiry(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, EnableTrash(time.Hour), EnableReferenceCounting)
+	repo := makeRepository(t, registry, "palaiologos/andronikos")
+
+	im := uploadRandomSchema2Image(t, repo)
+	if err := makeManifestService(t, repo).Delete(ctx, im.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trashed manifest references its blobs until it expires
+	if swept := sweepAll(t, registry); len(swept) != 0 {
+		t.Fatalf("expected trashed blobs to be kept, swept %v", swept)
+	}
+
+	if purged, err := PurgeTrash(ctx, registry, time.Now()); err != nil || len(purged) != 0 {
+		t.Fatalf("unexpected purge before expiry: %v, %v", purged, err)
+	}
+	purged, err := PurgeTrash(ctx, registry, time.Now().Add(2*time.Hour))
+	if err != nil || len(purged) != 1 || purged[0].Digest != im.manifestDigest {
+		t.Fatalf("expected the trashed manifest to be purged, got %v: %v", purged, err)
+	}
+	if _, err := RestoreTrash(ctx, registry, purged[0].ID); err == nil {
+		t.Fatalf("expected purged item not to be restored")
+	}
+
+	if swept := sweepAll(t, registry); len(swept) != len(im.manifest.References())+1 {
+		t.Fatalf("expected the blobs of the purged manifest to be swept, got %v", swept)
+	}
+	for dgst := range im.layers {
+		if blobExists(t, registry, dgst) {
+			t.Fatalf("purged layer %s was not deleted", dgst)
+		}
+	}
+}
+
+func TestTrashTagConflict(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, EnableTrash(time.Hour))
+	repo := makeRepository(t, registry, "palaiologos/ioannes")
+	tags := repo.Tags(ctx)
+
+	first := uploadRandomSchema2Image(t, repo)
+	if err := tags.Tag(ctx, "stable", distribution.Descriptor{Digest: first.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tags.Untag(ctx, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tags.Untag(ctx, "stable"); err != nil {
+		t.Fatalf("expected untag to be idempotent: %v", err)
+	}
+	items := listTrash(t, registry)
+	if len(items) != 1 || items[0].Kind != TrashKindTag || items[0].Digest != first.manifestDigest {
+		t.Fatalf("unexpected trash %v", items)
+	}
+
+	// the manifest of a trashed tag is not untagged
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RemoveUntagged: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := allManifests(t, makeManifestService(t, repo))[first.manifestDigest]; !ok {
+		t.Fatalf("manifest of the trashed tag was deleted")
+	}
+
+	second := uploadRandomSchema2Image(t, repo)
+	if err := tags.Tag(ctx, "stable", distribution.Descriptor{Digest: second.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreTrash(ctx, registry, items[0].ID); err == nil {
+		t.Fatalf("expected restoring over a newer tag to conflict")
+	} else if _, ok := err.(ErrTrashConflict); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if desc, err := tags.Get(ctx, "stable"); err != nil || desc.Digest != second.manifestDigest {
+		t.Fatalf("expected the newer tag to be kept: %v", err)
+	}
+}
+
+func TestTrashRepository(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, EnableTrash(time.Hour))
+	repo := makeRepository(t, registry, "palaiologos/constantine")
+
+	im := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := TrashRepository(ctx, registry, "palaiologos/constantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Kind != TrashKindRepository || len(item.Tags) != 1 || item.Tags[0] != "latest" {
+		t.Fatalf("unexpected item %v", item)
+	}
+	if _, err := TrashRepository(ctx, registry, "palaiologos/constantine"); err == nil {
+		t.Fatalf("expected trashed repository to be unknown")
+	}
+
+	repos := make([]string, 10)
+	if n, _ := registry.Repositories(ctx, repos, ""); n != 0 {
+		t.Fatalf("expected trashed repository not to be listed, got %v", repos[:n])
+	}
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	for dgst := range im.layers {
+		if !blobExists(t, registry, dgst) {
+			t.Fatalf("layer %s of the trashed repository was deleted", dgst)
+		}
+	}
+
+	if _, err := RestoreTrash(ctx, registry, item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if desc, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil || desc.Digest != im.manifestDigest {
+		t.Fatalf("expected tag to be restored: %v", err)
+	}
+	for dgst := range im.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("expected layer %s to be linked again: %v", dgst, err)
+		}
+	}
+
+	if _, err := TrashRepository(ctx, createRegistry(t, d), "palaiologos/constantine"); err != distribution.ErrUnsupported {
+		t.Fatalf("expected repository deletion to require the trash, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	prometheus "github.com/docker/distribution/metrics"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/uuid"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// uploadsInProgress, uploadBytesInProgress and oldestUploadAge describe
+	// the upload sessions found by the last listing of all repositories.
+	uploadsInProgress     = prometheus.StorageNamespace.NewGauge("uploads_in_progress", "The number of blob uploads in progress", metrics.Unit(""))
+	uploadBytesInProgress = prometheus.StorageNamespace.NewGauge("uploads_in_progress", "The number of bytes received by blob uploads in progress", metrics.Bytes)
+	oldestUploadAge       = prometheus.StorageNamespace.NewGauge("oldest_upload_age", "The age of the oldest blob upload in progress", metrics.Seconds)
+)
+
+// UploadSession describes a blob upload in progress.
+type UploadSession struct {
+	Repository string    `json:"repository"`
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"startedAt"`
+	// Size is the number of bytes received, including chunks received out
+	// of order.
+	Size int64 `json:"size"`
+}
+
+// ListUploads returns the upload sessions of the named repository, or of all
+// repositories if name is empty, by repository and start time. Listing all
+// repositories updates the upload metrics.
+func ListUploads(ctx context.Context, namespace distribution.Namespace, name string) ([]UploadSession, error) {
+	var backends []*registry
+	if name == "" {
+		var err error
+		backends, err = storageBackends(namespace)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		reg, err := uploadBackend(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		backends = []*registry{reg}
+	}
+
+	var sessions []UploadSession
+	for _, backend := range backends {
+		found, err := backend.listUploads(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, found...)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if sessions[i].Repository != sessions[j].Repository {
+			return sessions[i].Repository < sessions[j].Repository
+		}
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+
+	if name == "" {
+		recordUploadMetrics(sessions)
+	}
+	return sessions, nil
+}
+
+// CancelUpload removes the upload session id of the named repository. It
+// returns distribution.ErrBlobUploadUnknown if there is no such session.
+func CancelUpload(ctx context.Context, namespace distribution.Namespace, name, id string) error {
+	reg, err := uploadBackend(namespace, name)
+	if err != nil {
+		return err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return distribution.ErrBlobUploadUnknown
+	}
+
+	startedAtPath, err := pathFor(uploadStartedAtPathSpec{name: name, id: id})
+	if err != nil {
+		return err
+	}
+	d := reg.blobStore.driver
+	if _, err := d.Stat(ctx, startedAtPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return distribution.ErrBlobUploadUnknown
+		}
+		return err
+	}
+	return d.Delete(ctx, path.Dir(startedAtPath))
+}
+
+// PurgeUploadSessions removes the upload sessions of the named repository,
+// or of all repositories if name is empty, which started before olderThan.
+// It returns the sessions removed, or which would be removed if dryRun is
+// set.
+func PurgeUploadSessions(ctx context.Context, namespace distribution.Namespace, name string, olderThan time.Time, dryRun bool) ([]UploadSession, error) {
+	sessions, err := ListUploads(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []UploadSession
+	for _, session := range sessions {
+		if !session.StartedAt.Before(olderThan) {
+			continue
+		}
+		if !dryRun {
+			err := CancelUpload(ctx, namespace, session.Repository, session.ID)
+			if err == distribution.ErrBlobUploadUnknown {
+				// Completed or cancelled since listed.
+				continue
+			} else if err != nil {
+				return purged, err
+			}
+		}
+		purged = append(purged, session)
+	}
+	return purged, nil
+}
+
+// uploadBackend returns the backend storing the uploads of the named
+// repository.
+func uploadBackend(namespace distribution.Namespace, name string) (*registry, error) {
+	if _, err := reference.WithName(name); err != nil {
+		return nil, distribution.ErrRepositoryNameInvalid{Name: name, Reason: err}
+	}
+	return namespaceBackend(namespace, name)
+}
+
+// listUploads walks the upload directories of the named repository, or of
+// all repositories if name is empty. Sessions without a start time, such as
+// those being created or removed, are skipped.
+func (reg *registry) listUploads(ctx context.Context, name string) ([]UploadSession, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	walkRoot := root
+	if name != "" {
+		walkRoot = path.Join(root, name, "_uploads")
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*UploadSession)
+	session := func(repo, id string) *UploadSession {
+		key := repo + "/" + id
+		s, ok := sessions[key]
+		if !ok {
+			s = &UploadSession{Repository: repo, ID: id}
+			sessions[key] = s
+		}
+		return s
+	}
+
+	d := reg.blobStore.driver
+	err = driver.WalkParallel(ctx, d, walkRoot, walkConcurrency, func(fileInfo driver.FileInfo) error {
+		filePath := fileInfo.Path()
+		if fileInfo.IsDir() {
+			switch path.Base(filePath) {
+			case "_manifests", "_layers", "hashstates":
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+
+		rel := strings.TrimPrefix(filePath, root+"/")
+		i := strings.LastIndex(rel, "/_uploads/")
+		if i < 0 {
+			return nil
+		}
+		repo := rel[:i]
+		components := strings.Split(rel[i+len("/_uploads/"):], "/")
+		if len(components) < 2 {
+			return nil
+		}
+		id := components[0]
+
+		switch {
+		case len(components) == 2 && components[1] == "startedat":
+			startedAt, err := readStartedAtFile(d, filePath)
+			if err != nil {
+				return nil
+			}
+			mu.Lock()
+			session(repo, id).StartedAt = startedAt
+			mu.Unlock()
+		case len(components) == 2 && components[1] == "data",
+			len(components) == 3 && components[1] == "chunks":
+			mu.Lock()
+			session(repo, id).Size += fileInfo.Size()
+			mu.Unlock()
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var found []UploadSession
+	for _, s := range sessions {
+		if !s.StartedAt.IsZero() {
+			found = append(found, *s)
+		}
+	}
+	return found, nil
+}
+
+// recordUploadMetrics sets the upload metrics from the sessions of all
+// repositories.
+func recordUploadMetrics(sessions []UploadSession) {
+	var size int64
+	var oldest time.Time
+	for _, s := range sessions {
+		size += s.Size
+		if oldest.IsZero() || s.StartedAt.Before(oldest) {
+			oldest = s.StartedAt
+		}
+	}
+
+	uploadsInProgress.Set(float64(len(sessions)))
+	uploadBytesInProgress.Set(float64(size))
+	if oldest.IsZero() {
+		oldestUploadAge.Set(0)
+	} else {
+		oldestUploadAge.Set(time.Since(oldest).Seconds())
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/uuid"
+)
+
+func TestUploadSessions(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	old, recent, other := uuid.Generate().String(), uuid.Generate().String(), uuid.Generate().String()
+	addUploads(ctx, t, d, old, "foo/bar", now.Add(-48*time.Hour))
+	addUploads(ctx, t, d, recent, "foo/bar", now)
+	addUploads(ctx, t, d, other, "baz", now.Add(-24*time.Hour))
+
+	dataPath, err := pathFor(uploadDataPathSpec{name: "foo/bar", id: recent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, dataPath, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	chunkPath, err := pathFor(uploadChunkPathSpec{name: "foo/bar", id: recent, offset: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, chunkPath, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ListUploads(ctx, reg, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 upload sessions, got %v", sessions)
+	}
+	expected := []UploadSession{
+		{Repository: "baz", ID: other, StartedAt: now.Add(-24 * time.Hour)},
+		{Repository: "foo/bar", ID: old, StartedAt: now.Add(-48 * time.Hour)},
+		{Repository: "foo/bar", ID: recent, StartedAt: now, Size: 15},
+	}
+	for i, session := range sessions {
+		if session.Repository != expected[i].Repository || session.ID != expected[i].ID ||
+			!session.StartedAt.Equal(expected[i].StartedAt) || session.Size != expected[i].Size {
+			t.Errorf("unexpected upload session %d: %+v != %+v", i, session, expected[i])
+		}
+	}
+
+	sessions, err = ListUploads(ctx, reg, "foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 upload sessions of foo/bar, got %v", sessions)
+	}
+	sessions, err = ListUploads(ctx, reg, "unknown")
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("expected no upload sessions of an unknown repository, got %v, %v", sessions, err)
+	}
+
+	purged, err := PurgeUploadSessions(ctx, reg, "", now.Add(-time.Hour), true)
+	if err != nil {
+		t.Fatalf("unexpected error purging uploads: %v", err)
+	}
+	if len(purged) != 2 {
+		t.Fatalf("expected 2 upload sessions to purge, got %v", purged)
+	}
+	purged, err = PurgeUploadSessions(ctx, reg, "foo/bar", now.Add(-time.Hour), false)
+	if err != nil {
+		t.Fatalf("unexpected error purging uploads: %v", err)
+	}
+	if len(purged) != 1 || purged[0].ID != old {
+		t.Fatalf("expected upload session %s to be purged, got %v", old, purged)
+	}
+
+	if err := CancelUpload(ctx, reg, "foo/bar", recent); err != nil {
+		t.Fatalf("unexpected error cancelling upload: %v", err)
+	}
+	if err := CancelUpload(ctx, reg, "foo/bar", recent); err != distribution.ErrBlobUploadUnknown {
+		t.Fatalf("expected ErrBlobUploadUnknown cancelling a cancelled upload, got %v", err)
+	}
+	if err := CancelUpload(ctx, reg, "foo/bar", "../../baz/_uploads/"+other); err != distribution.ErrBlobUploadUnknown {
+		t.Fatalf("expected ErrBlobUploadUnknown cancelling an invalid upload, got %v", err)
+	}
+
+	sessions, err = ListUploads(ctx, reg, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != other {
+		t.Fatalf("expected only upload session %s to remain, got %v", other, sessions)
+	}
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(TrashCmd)
+	TrashCmd.AddCommand(TrashListCmd)
+	TrashCmd.AddCommand(TrashRestoreCmd)
+}
+
+// TrashCmd is the cobra command that corresponds to the trash subcommand
+var TrashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "`trash` lists and restores deleted manifests, tags and repositories",
+	Long:  "`trash` lists and restores deleted manifests, tags and repositories",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// TrashListCmd is the cobra command that corresponds to the trash list
+// subcommand
+var TrashListCmd = &cobra.Command{
+	Use:   "list <config>",
+	Short: "`list` lists the items of the trash which have not expired",
+	Long:  "`list` lists the items of the trash which have not expired",
+	Run: func(cmd *cobra.Command, args []string) {
+		withStorageRegistry(cmd, args, func(ctx context.Context, registry distribution.Namespace) error {
+			items, err := storage.ListTrash(ctx, registry)
+			if err != nil {
+				return fmt.Errorf("failed to list the trash: %v", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tKIND\tREPOSITORY\tDIGEST\tTAGS\tEXPIRES")
+			for _, item := range items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", item.ID, item.Kind, item.Repository, item.Digest,
+					strings.Join(item.Tags, ","), item.ExpiresAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// TrashRestoreCmd is the cobra command that corresponds to the trash restore
+// subcommand
+var TrashRestoreCmd = &cobra.Command{
+	Use:   "restore <config> <id>",
+	Short: "`restore` restores an item of the trash",
+	Long:  "`restore` restores an item of the trash, unless a tag it holds was pushed again since",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		withStorageRegistry(cmd, args[:1], func(ctx context.Context, registry distribution.Namespace) error {
+			item, err := storage.RestoreTrash(ctx, registry, args[1])
+			if err != nil {
+				return fmt.Errorf("failed to restore %s: %v", args[1], err)
+			}
+			fmt.Printf("restored %s %s\n", item.Kind, item.Repository)
+			return nil
+		})
+	},
+}
+
+// withStorageRegistry calls f with the registry configured by args, exiting
+// on failure.
+func withStorageRegistry(cmd *cobra.Command, args []string, f func(context.Context, distribution.Namespace) error) {
+	config, err := resolveConfiguration(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	ctx := dcontext.Background()
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+		os.Exit(1)
+	}
+
+	_, registry, closeRegistry, err := newStorageRegistry(ctx, config)
+	if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = f(ctx, registry)
+	closeRegistry()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
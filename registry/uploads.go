@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/spf13/cobra"
+)
+
+var uploadsRepository string
+
+func init() {
+	RootCmd.AddCommand(UploadsCmd)
+	UploadsCmd.AddCommand(UploadsListCmd)
+	UploadsCmd.AddCommand(UploadsCancelCmd)
+	UploadsListCmd.Flags().StringVarP(&uploadsRepository, "repository", "r", "", "only list the uploads of this repository")
+}
+
+// UploadsCmd is the cobra command that corresponds to the uploads subcommand
+var UploadsCmd = &cobra.Command{
+	Use:   "uploads",
+	Short: "`uploads` lists and cancels blob uploads in progress",
+	Long:  "`uploads` lists and cancels blob uploads in progress",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// UploadsListCmd is the cobra command that corresponds to the uploads list
+// subcommand
+var UploadsListCmd = &cobra.Command{
+	Use:   "list <config>",
+	Short: "`list` lists the blob uploads in progress",
+	Long:  "`list` lists the blob uploads in progress, with the number of bytes received and their age",
+	Run: func(cmd *cobra.Command, args []string) {
+		withStorageRegistry(cmd, args, func(ctx context.Context, registry distribution.Namespace) error {
+			sessions, err := storage.ListUploads(ctx, registry, uploadsRepository)
+			if err != nil {
+				return fmt.Errorf("failed to list uploads: %v", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tID\tSIZE\tAGE\tSTARTED")
+			for _, session := range sessions {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", session.Repository, session.ID, session.Size,
+					time.Since(session.StartedAt).Round(time.Second), session.StartedAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// UploadsCancelCmd is the cobra command that corresponds to the uploads
+// cancel subcommand
+var UploadsCancelCmd = &cobra.Command{
+	Use:   "cancel <config> <repository> <id>",
+	Short: "`cancel` cancels a blob upload in progress",
+	Long:  "`cancel` cancels a blob upload in progress, removing the data received",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		withStorageRegistry(cmd, args[:1], func(ctx context.Context, registry distribution.Namespace) error {
+			if err := storage.CancelUpload(ctx, registry, args[1], args[2]); err != nil {
+				return fmt.Errorf("failed to cancel upload %s of %s: %v", args[2], args[1], err)
+			}
+			fmt.Printf("cancelled upload %s of %s\n", args[2], args[1])
+			return nil
+		})
+	},
+}